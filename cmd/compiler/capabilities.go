@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+	"github.com/spf13/pflag"
+)
+
+// capabilitiesVersion is the version of the capabilities manifest, which is increased whenever its fields change
+// meaning. New fields can be added without increasing it.
+const capabilitiesVersion = 1
+
+// What this build of the compiler supports, written by --capabilities-json and served on /capabilities, so tools can
+// adapt to whichever version is installed instead of guessing from its version number.
+type capabilities struct {
+	Version         int                      `json:"version"`
+	Compiler        string                   `json:"compiler"`        // The version of the compiler.
+	FurnaceVersions []furnace.VersionSupport `json:"furnaceVersions"` // The Furnace versions whose text exports are read.
+	Effects         []furnace.EffectInfo     `json:"effects"`
+	Formats         map[string]int           `json:"formats"` // The version of each versioned block and file written.
+	Targets         []string                 `json:"targets"` // The built-in targets.
+	ChipVariants    []string                 `json:"chipVariants"`
+	Subcommands     []string                 `json:"subcommands"`
+	Defaults        map[string]string        `json:"defaults"` // The default value of every option, by its name.
+}
+
+// subcommands are the names of the subcommands, in the order main checks for them.
+var subcommands = []string{"verify", "disassemble", "format", "tempo-plan", "upload", "compare", "diff",
+	"verify-signature", "lint", "selftest", "serve", "check-timing", "sweep"}
+
+// newCapabilities returns the capabilities of this build, with the given defaults for its options.
+func newCapabilities(defaults map[string]string) capabilities {
+	c := capabilities{
+		Version:         capabilitiesVersion,
+		Compiler:        version,
+		FurnaceVersions: furnace.SupportedVersions(),
+		Effects:         furnace.Effects(),
+		Formats:         nmos.FormatVersions,
+		Subcommands:     subcommands,
+		Defaults:        defaults,
+	}
+	for name := range nmos.BuiltinTargets {
+		c.Targets = append(c.Targets, name)
+	}
+	slices.Sort(c.Targets)
+	for name := range nmos.ChipVariants {
+		c.ChipVariants = append(c.ChipVariants, name)
+	}
+	slices.Sort(c.ChipVariants)
+	return c
+}
+
+// flagDefaults returns the default value of every flag, by its name, as it would be written on the command line.
+func flagDefaults(flags *pflag.FlagSet) map[string]string {
+	defaults := make(map[string]string)
+	flags.VisitAll(func(f *pflag.Flag) {
+		defaults[f.Name] = f.DefValue
+	})
+	return defaults
+}
+
+// writeCapabilities writes the capabilities as indented JSON.
+func writeCapabilities(w io.Writer, c capabilities) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/nmosconv"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+	"github.com/spf13/pflag"
+)
+
+// The conversion options a song is compiled with by the compare subcommand.
+type compareOptions struct {
+	subsong          int
+	target           string
+	optimize         string
+	slideMode        string
+	ch3Latch         string
+	noteRange        string
+	noisePreset      string
+	noiseTuning      string
+	rateTolerance    float64
+	fixedPoint       bool
+	restoreLoopTempo bool
+	noTrim           bool
+	transpose        []int
+	detune           []int
+	macroTicks       int
+}
+
+// addCompareFlags adds the conversion options to a flag set, with the values in defaults as their defaults.
+func addCompareFlags(flags *pflag.FlagSet, o *compareOptions, defaults compareOptions) {
+	flags.IntVarP(&o.subsong, "subsong", "s", defaults.subsong, "The subsong index to compile.")
+	flags.StringVar(&o.target, "target", defaults.target, "Built-in target name or path to a JSON target description.")
+	flags.StringVarP(&o.optimize, "optimize", "O", defaults.optimize, "Optimization level: \"size\", \"speed\" or \"off\".")
+	flags.StringVar(&o.slideMode, "slide-mode", defaults.slideMode, "How note slides are played: \"ticks\" or \"snap\".")
+	flags.StringVar(&o.ch3Latch, "ch3-latch", defaults.ch3Latch, "Which note is kept when square channel 3 and the noise channel both play on the same row: \"noise\" or \"square\".")
+	flags.StringVar(&o.noteRange, "note-range", defaults.noteRange, "What happens to notes too low or too high for the chip's periods: \"fail\", \"octave\" or \"drop\".")
+	flags.StringVar(&o.noisePreset, "noise-preset", defaults.noisePreset, "What happens to noise notes other than C, C# or D while the noise channel uses the preset rates: \"fail\", \"snap\" or \"track\".")
+	flags.StringVar(&o.noiseTuning, "noise-tuning", defaults.noiseTuning, "How noise pitches are calculated: \"exact\" or \"legacy\".")
+	flags.Float64Var(&o.rateTolerance, "rate-tolerance", defaults.rateTolerance, "The largest error allowed between the song's tick rate and the rate actually played, in percent.")
+	flags.BoolVar(&o.fixedPoint, "fixed-point", defaults.fixedPoint, "Calculate note periods using integer-only arithmetic.")
+	flags.BoolVar(&o.restoreLoopTempo, "restore-loop-tempo", defaults.restoreLoopTempo, "Make the loop target re-set its tempo.")
+	flags.BoolVar(&o.noTrim, "no-trim", defaults.noTrim, "Keep the silent frames at the end of songs which halt.")
+	flags.IntSliceVar(&o.transpose, "transpose", defaults.transpose, "Semitones to transpose each channel by, or a single value for every channel.")
+	flags.IntSliceVar(&o.detune, "detune", defaults.detune, "Cents to detune each channel by, or a single value for every channel.")
+	flags.IntVar(&o.macroTicks, "macro-ticks", defaults.macroTicks, "The most ticks after the start of a note that instrument macros are played for. 0 plays macros for as long as notes last.")
+}
+
+// runCompare implements the compare subcommand, which compiles two songs, or the same song with different options,
+// simulates them both, and lists every point where the chip's registers differ between them. It exits with
+// status 1 if they differ, like diff, so it can check whether an option change actually altered the sound.
+func runCompare(args []string) {
+	flags := pflag.NewFlagSet("compare", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s compare [flags] a.txt [b.txt]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var shared compareOptions
+	addCompareFlags(flags, &shared, compareOptions{
+		target:        "nmoscillator",
+		optimize:      "off",
+		slideMode:     "ticks",
+		ch3Latch:      "noise",
+		noteRange:     "fail",
+		noisePreset:   "fail",
+		noiseTuning:   "exact",
+		rateTolerance: nmos.DefaultRateTolerance * 100,
+	})
+	flags.Lookup("optimize").NoOptDefVal = "size"
+
+	var argsA, argsB string
+	flags.StringVar(&argsA, "a", "", "Extra options used only when compiling the first song, such as --a \"--optimize=size\".")
+	flags.StringVar(&argsB, "b", "", "Extra options used only when compiling the second song. If only one song is given, it's compared against itself with these options.")
+
+	var maxDiffs int
+	flags.IntVarP(&maxDiffs, "max", "n", 0, "The largest number of differences to list. 0 lists every difference.")
+
+	parseFlags(flags, args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		usageError(flags)
+	}
+	if maxDiffs < 0 {
+		logger.Fatalf("invalid --max: must not be negative, got %d", maxDiffs)
+	}
+	pathA, pathB := flags.Arg(0), flags.Arg(0)
+	if flags.NArg() == 2 {
+		pathB = flags.Arg(1)
+	}
+
+	// Keep the log out of the way of the differences.
+	logger.SetOutput(os.Stderr)
+
+	songA := compileForCompare("a", pathA, shared, argsA)
+	songB := compileForCompare("b", pathB, shared, argsB)
+
+	eventsA, err := songA.Simulate()
+	if err != nil {
+		logger.Fatalf("error simulating %s: %v", describeSide(pathA, argsA), err)
+	}
+	eventsB, err := songB.Simulate()
+	if err != nil {
+		logger.Fatalf("error simulating %s: %v", describeSide(pathB, argsB), err)
+	}
+	diffs := nmos.DiffPlayback(eventsA, eventsB)
+	if len(diffs) == 0 {
+		logger.Printf("%s and %s play the same way", describeSide(pathA, argsA), describeSide(pathB, argsB))
+		return
+	}
+
+	fmt.Printf("A: %s\nB: %s\n\n", describeSide(pathA, argsA), describeSide(pathB, argsB))
+	fmt.Printf("%8s  %-22s  %6s  %6s\n", "Cycle", "Register", "A", "B")
+	for i, d := range diffs {
+		if maxDiffs > 0 && i == maxDiffs {
+			fmt.Printf("... and %d more\n", len(diffs)-maxDiffs)
+			break
+		}
+		fmt.Printf("%8d  %-22s  %6s  %6s\n", d.Cycle, d.Register, registerValue(d.A), registerValue(d.B))
+	}
+	fmt.Printf("\n%d differences, the first on Frame Clock cycle %d\n", len(diffs), diffs[0].Cycle)
+	os.Exit(1)
+}
+
+// compileForCompare compiles a single subsong with the shared options, overridden by the options in extraArgs.
+func compileForCompare(name, path string, shared compareOptions, extraArgs string) *nmos.NmosSong {
+	flags := pflag.NewFlagSet("compare --"+name, pflag.ContinueOnError)
+	var o compareOptions
+	addCompareFlags(flags, &o, shared)
+	if err := flags.Parse(strings.Fields(extraArgs)); err != nil {
+		logger.Fatalf("invalid --%s: %v", name, err)
+	}
+	if flags.NArg() != 0 {
+		logger.Fatalf("invalid --%s: unexpected argument %q", name, flags.Arg(0))
+	}
+
+	var opts nmosconv.Options
+	var err error
+	opts.Subsong = o.subsong
+	opts.FixedPointPeriods = o.fixedPoint
+	if o.rateTolerance <= 0 {
+		logger.Fatalf("invalid --rate-tolerance: must be more than 0, got %g", o.rateTolerance)
+	}
+	opts.RateTolerance = o.rateTolerance / 100
+	if o.macroTicks < 0 {
+		logger.Fatalf("invalid --macro-ticks: must not be negative, got %d", o.macroTicks)
+	}
+	opts.MacroTicks = o.macroTicks
+	if opts.SlideMode, err = nmosconv.ParseSlideMode(o.slideMode); err != nil {
+		logger.Fatalf("invalid --slide-mode: %v", err)
+	}
+	if opts.Ch3Latch, err = nmosconv.ParseCh3Latch(o.ch3Latch); err != nil {
+		logger.Fatalf("invalid --ch3-latch: %v", err)
+	}
+	if opts.NoteRange, err = nmosconv.ParseNoteRange(o.noteRange); err != nil {
+		logger.Fatalf("invalid --note-range: %v", err)
+	}
+	if opts.NoisePreset, err = nmosconv.ParseNoisePreset(o.noisePreset); err != nil {
+		logger.Fatalf("invalid --noise-preset: %v", err)
+	}
+	if opts.NoiseTuning, err = nmos.ParseNoiseTuning(o.noiseTuning); err != nil {
+		logger.Fatalf("invalid --noise-tuning: %v", err)
+	}
+	if opts.Transpose, err = perChannel(o.transpose); err != nil {
+		logger.Fatalf("invalid --transpose: %v", err)
+	}
+	if opts.Detune, err = perChannel(o.detune); err != nil {
+		logger.Fatalf("invalid --detune: %v", err)
+	}
+	optimize, err := nmos.ParseOptimizeLevel(o.optimize)
+	if err != nil {
+		logger.Fatalf("invalid --optimize: %v", err)
+	}
+	target, err := loadTarget(o.target)
+	if err != nil {
+		logger.Fatalf("error loading target %q: %v", o.target, err)
+	}
+	opts.Chip = target.Chip
+	opts.Stereo = target.Stereo
+
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Fatalf("error opening file: %v", err)
+	}
+	defer file.Close()
+	internalSong, err := parseInput(path, file, nil, furnace.ParseOptions{Subsongs: []int{opts.Subsong}})
+	if err != nil {
+		fatalDiagnostic("parse error", err)
+	}
+	if opts.Subsong < 0 || opts.Subsong >= len(internalSong.Subsongs) {
+		logger.Fatalf("%s has no subsong %d", path, opts.Subsong)
+	}
+
+	result := convertSubsong(internalSong, opts, postProcess{restoreLoopTempo: o.restoreLoopTempo, trim: !o.noTrim, optimize: optimize})
+	reportWarnings("", result.warnings)
+	for _, line := range result.log {
+		logAt(line.level, "%s", line.text)
+	}
+	if result.err != nil {
+		fatalDiagnostic(fmt.Sprintf("error parsing subsong %d", opts.Subsong), result.err)
+	}
+	return result.song
+}
+
+// describeSide describes a song being compared, along with its extra options.
+func describeSide(path, extraArgs string) string {
+	if extraArgs == "" {
+		return path
+	}
+	return fmt.Sprintf("%s (%s)", path, extraArgs)
+}
+
+// registerValue formats a register's value for the compare table, where -1 means it hasn't been written yet.
+func registerValue(v int) string {
+	if v < 0 {
+		return "-"
+	}
+	return fmt.Sprint(v)
+}
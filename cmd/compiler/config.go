@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// configFileName is the name of the per-project config file, which is looked for in the working directory and
+// every directory above it.
+const configFileName = "nmoscc.toml"
+
+// configPathOptions are the options which hold paths. Relative paths in a config file are relative to the directory
+// the config file is in, so the config works from anywhere in the project.
+var configPathOptions = map[string]bool{
+	"output":      true,
+	"dump-json":   true,
+	"dump-frames": true,
+	"render":      true,
+	"save-state":  true,
+	"tags":        true,
+	"expect":      true,
+	"sign":        true,
+	"target":      true,
+}
+
+// A single option set in a config file.
+type configOption struct {
+	value string // The value, in the form the option's flag takes on the command line.
+	line  int
+}
+
+// A config file, with the options for each subcommand. Options for compiling are in the "" section.
+type config struct {
+	path     string
+	sections map[string]map[string]configOption
+}
+
+// findConfig returns the path of the nearest config file in the working directory or the directories above it,
+// or "" if there isn't one.
+func findConfig() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadConfig reads the config file at path.
+func loadConfig(path string) (config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return config{}, err
+	}
+	defer file.Close()
+	return parseConfig(path, file)
+}
+
+// parseConfig reads a config file, written in a subset of TOML: options are set with "name = value" lines, using
+// the long names of their flags, and "[subcommand]" tables hold the options of subcommands. Values are strings,
+// numbers, booleans, or arrays of them for flags which take a list. Comments start with '#'.
+func parseConfig(path string, r io.Reader) (config, error) {
+	c := config{path: path, sections: map[string]map[string]configOption{"": {}}}
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+		fail := func(format string, args ...any) (config, error) {
+			return config{}, fmt.Errorf("%s:%d: %s", path, line, fmt.Sprintf(format, args...))
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") || strings.HasPrefix(text, "[[") {
+				return fail("invalid table header %q", text)
+			}
+			section = strings.Trim(strings.TrimSpace(text[1:len(text)-1]), `"`)
+			if c.sections[section] == nil {
+				c.sections[section] = make(map[string]configOption)
+			}
+			continue
+		}
+
+		name, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return fail("expected name = value, got %q", text)
+		}
+		name = strings.Trim(strings.TrimSpace(name), `"`)
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return fail("%s: %v", name, err)
+		}
+		if _, ok := c.sections[section][name]; ok {
+			return fail("%s is set more than once", name)
+		}
+		c.sections[section][name] = configOption{value: value, line: line}
+	}
+	if err := scanner.Err(); err != nil {
+		return config{}, err
+	}
+	return c, nil
+}
+
+// stripConfigComment removes a comment from the end of a line of a config file, leaving '#'s in strings alone.
+func stripConfigComment(line string) string {
+	if i := indexOutsideStrings(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// indexOutsideStrings returns the index of the first c in s which isn't in a quoted string, or -1 if there isn't one.
+func indexOutsideStrings(s string, c rune) int {
+	var quote rune
+	escaped := false
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == c:
+			return i
+		}
+	}
+	return -1
+}
+
+// parseConfigValue converts a TOML value into the form its flag takes on the command line. Arrays are joined
+// with commas, like list flags such as --subsong 0,1,2.
+func parseConfigValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, "[") {
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("arrays must be on a single line")
+		}
+		var values []string
+		for _, item := range splitConfigArray(raw[1 : len(raw)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			value, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	}
+	switch {
+	case raw == "":
+		return "", errors.New("missing value")
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	number := strings.ReplaceAll(raw, "_", "")
+	if _, err := strconv.ParseFloat(number, 64); err != nil {
+		if _, err := strconv.ParseInt(number, 0, 64); err != nil {
+			return "", fmt.Errorf("invalid value %s, strings must be quoted", raw)
+		}
+	}
+	return number, nil
+}
+
+// splitConfigArray splits the items of a TOML array at the commas which aren't in strings.
+func splitConfigArray(s string) []string {
+	var items []string
+	for {
+		i := indexOutsideStrings(s, ',')
+		if i < 0 {
+			return append(items, s)
+		}
+		items = append(items, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// applyConfig sets every flag which wasn't given on the command line or in the environment from the config file,
+// using the section named after the subcommand, or the top level for compiling. The config file is the one given by
+// --config (or NMOSC_CONFIG for subcommands), or else the nearest nmoscc.toml. Options in the section which aren't
+// flags of the subcommand are an error, so typos don't go unnoticed.
+func applyConfig(flags *pflag.FlagSet, section string) {
+	path := os.Getenv(envName("config"))
+	if f := flags.Lookup("config"); f != nil {
+		path = f.Value.String()
+	}
+	switch path {
+	case "none":
+		return
+	case "":
+		if path = findConfig(); path == "" {
+			return
+		}
+	}
+
+	c, err := loadConfig(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Fatalf("config file %s doesn't exist", path)
+	}
+	if err != nil {
+		logger.Fatalf("error reading config file: %v", err)
+	}
+	for name, option := range c.sections[section] {
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			logger.Fatalf("%s:%d: unknown option %q", c.path, option.line, name)
+		}
+		if f.Changed {
+			continue
+		}
+		value := option.value
+		if configPathOptions[name] {
+			value = resolveConfigPaths(filepath.Dir(c.path), value)
+		}
+		if err := flags.Set(name, value); err != nil {
+			logger.Fatalf("%s:%d: invalid %s: %v", c.path, option.line, name, err)
+		}
+	}
+}
+
+// resolveConfigPaths makes the relative paths in an option from a config file relative to the config file's directory
+// instead. Lists of paths are separated by commas, and "-" (stdout) and the names of built-in targets are kept.
+func resolveConfigPaths(dir, value string) string {
+	paths := strings.Split(value, ",")
+	for i, path := range paths {
+		_, builtin := nmos.BuiltinTargets[strings.ToLower(path)]
+		if path == "" || path == "-" || builtin || filepath.IsAbs(path) {
+			continue
+		}
+		paths[i] = filepath.Join(dir, path)
+	}
+	return strings.Join(paths, ",")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/spf13/pflag"
+)
+
+// Whether diagnostics are written to stdout as JSON, one object per line, instead of being logged.
+var jsonDiagnostics bool
+
+// Exit statuses of the compiler, so build systems can tell clean compiles from those with warnings.
+const (
+	exitSuccess  = 0 // The ROM was built without any warnings.
+	exitError    = 1 // The ROM couldn't be built, or --warnings-as-errors was given and there were warnings.
+	exitWarnings = 2 // The ROM was built, but there were warnings.
+	exitUsage    = 3 // The command line couldn't be understood, such as an unknown flag or a missing input file.
+)
+
+// parseFlags parses the arguments of a flag set made with pflag.ContinueOnError. If they can't be parsed, it prints
+// the error and usage and exits with exitUsage. pflag prints the usage itself for --help, which exits with exitSuccess.
+func parseFlags(flags *pflag.FlagSet, args []string) {
+	err := flags.Parse(args)
+	switch {
+	case errors.Is(err, pflag.ErrHelp):
+		os.Exit(exitSuccess)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		usageError(flags)
+	}
+}
+
+// usageError prints the usage of a flag set and exits with exitUsage, for arguments which parse but don't make sense.
+func usageError(flags *pflag.FlagSet) {
+	flags.Usage()
+	os.Exit(exitUsage)
+}
+
+// The number of warnings reported so far.
+var warningCount int
+
+// parseDiagnosticsFormat sets how diagnostics are reported from the value of --diagnostics.
+func parseDiagnosticsFormat(name string) error {
+	switch name {
+	case "text":
+		jsonDiagnostics = false
+	case "json":
+		jsonDiagnostics = true
+	default:
+		return fmt.Errorf("unknown diagnostics format %q, expected text or json", name)
+	}
+	return nil
+}
+
+// reportWarnings reports a group of warnings. When logging them, they're listed under the heading.
+func reportWarnings(heading string, warnings []diag.Diagnostic) {
+	if len(warnings) == 0 {
+		return
+	}
+	warningCount += len(warnings)
+	if eventStream {
+		for _, w := range warnings {
+			emitEvent(event{Event: "warning", Diagnostic: &w})
+		}
+		return
+	}
+	if jsonDiagnostics {
+		for _, w := range warnings {
+			writeDiagnostic(w)
+		}
+		return
+	}
+	if heading != "" {
+		logger.Println(heading)
+	}
+	for _, w := range warnings {
+		logger.Println(w)
+	}
+}
+
+// logWarningf logs a warning which isn't a diagnostic, such as a frame which takes too long to play on a target.
+func logWarningf(format string, args ...any) {
+	warningCount++
+	logger.Printf(format, args...)
+}
+
+// fatalDiagnostic reports an error which stops the song from being compiled, and exits.
+// Errors which aren't diagnostics are reported as diagnostics with the code "error".
+func fatalDiagnostic(context string, err error) {
+	if !jsonDiagnostics && !eventStream {
+		logger.Fatalf("%s: %v", context, err)
+	}
+
+	var d diag.Diagnostic
+	if !errors.As(err, &d) {
+		d = diag.Errorf("error", "%v", err)
+	}
+	d.Message = context + ": " + d.Message
+	if eventStream {
+		emitEvent(event{Event: "error", Diagnostic: &d})
+	} else {
+		writeDiagnostic(d)
+	}
+	os.Exit(1)
+}
+
+// writeDiagnostic writes a diagnostic to stdout as a line of JSON.
+func writeDiagnostic(d diag.Diagnostic) {
+	if err := json.NewEncoder(os.Stdout).Encode(d); err != nil {
+		logger.Fatalf("error writing diagnostic: %v", err)
+	}
+}
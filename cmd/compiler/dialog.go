@@ -0,0 +1,22 @@
+//go:build !nodialog
+
+package main
+
+import "github.com/sqweek/dialog"
+
+// dialogAvailable reports whether this build of the compiler can open a file dialog.
+const dialogAvailable = true
+
+// errDialogCancelled is returned when the user closes the file dialog without choosing a file.
+var errDialogCancelled = dialog.ErrCancelled
+
+// openFileDialog asks the user to choose a Furnace text export or MML file, starting in the given directory.
+func openFileDialog(cwd string) (string, error) {
+	return dialog.
+		File().
+		Title("Open Furnace text export").
+		Filter("Furnace text exports (*.txt)", "txt").
+		Filter("MML files (*.mml)", "mml").
+		SetStartDir(cwd).
+		Load()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runDisassemble implements the disassemble subcommand, which prints the frames stored in a ROM image.
+func runDisassemble(args []string) {
+	flags := pflag.NewFlagSet("disassemble", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s disassemble [flags] song.bin\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var hexdump bool
+	flags.BoolVar(&hexdump, "hexdump", false, "Show the bytes each command and frame was read from.")
+
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		usageError(flags)
+	}
+
+	rom, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		logger.Fatalf("error reading ROM file: %v", err)
+	}
+
+	songs, err := nmos.Disassemble(rom)
+	if err != nil {
+		logger.Fatalf("error disassembling ROM: %v", err)
+	}
+
+	for i, song := range songs {
+		if len(songs) > 1 {
+			fmt.Printf("=== Song %d ===\n", i)
+		}
+		fmt.Println(song.Listing(hexdump))
+	}
+}
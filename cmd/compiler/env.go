@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// envPrefix starts the names of the environment variables which set options, such as NMOSC_TARGET for --target.
+const envPrefix = "NMOSC_"
+
+// envName returns the name of the environment variable for a flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// applyEnvironment sets every flag which wasn't given on the command line from its environment variable, if that's
+// set, so flags take precedence over the environment. Boolean flags are set with values like "true" or "1".
+// Flags which are still unset are then set from the config file (see applyConfig), which the environment overrides.
+func applyEnvironment(flags *pflag.FlagSet) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			logger.Fatalf("invalid %s: %v", envName(f.Name), err)
+		}
+	})
+
+	section := flags.Name() // The options of subcommands are in the table named after them.
+	if flags == pflag.CommandLine {
+		section = ""
+	}
+	applyConfig(flags, section)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+)
+
+// Whether --events was given, so what the compiler does is written to stdout as a stream of JSON events.
+var eventStream bool
+
+// An event written by --events, as a single line of JSON. Only the fields which apply to the kind of event are set.
+type event struct {
+	// What happened: "parse-started", "warning", "error", "subsong-compiled", "log" or "done".
+	Event string `json:"event"`
+
+	File       string           `json:"file,omitempty"`       // parse-started: the song being parsed.
+	Diagnostic *diag.Diagnostic `json:"diagnostic,omitempty"` // warning and error: the problem found.
+
+	// subsong-compiled: the subsong, the target it was built for, and the size of the converted song.
+	Subsong *int   `json:"subsong,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Frames  int    `json:"frames,omitempty"`
+	Bytes   int    `json:"bytes,omitempty"`
+
+	Message string `json:"message,omitempty"` // log: a line which would otherwise have been logged.
+
+	// done: whether the compile succeeded, and the exit status of the compiler.
+	OK         *bool `json:"ok,omitempty"`
+	ExitStatus *int  `json:"exitStatus,omitempty"`
+}
+
+// emitEvent writes an event to stdout.
+func emitEvent(e event) {
+	// Events are written in one call, so they can't be interleaved with events from another process.
+	line, err := json.Marshal(e)
+	if err != nil {
+		panic(err) // Events only contain types which can always be marshalled.
+	}
+	os.Stdout.Write(append(line, '\n'))
+}
+
+// emitDone writes the done event which ends every compile, given the compiler's exit status.
+func emitDone(exitStatus int) {
+	ok := exitStatus == exitSuccess || exitStatus == exitWarnings
+	emitEvent(event{Event: "done", OK: &ok, ExitStatus: &exitStatus})
+}
+
+// eventLogWriter turns the lines written by the logger into log events, for use with --events.
+type eventLogWriter struct{}
+
+func (eventLogWriter) Write(p []byte) (int, error) {
+	emitEvent(event{Event: "log", Message: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
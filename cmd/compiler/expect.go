@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+)
+
+// checkExpected implements --expect, comparing a ROM which has just been built against a known-good ROM at path.
+// If they differ, every field of the songs and frames which differs is logged, and it returns false.
+func checkExpected(path string, rom []byte) bool {
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		logger.Fatalf("error reading --expect ROM: %v", err)
+	}
+	if bytes.Equal(rom, expected) {
+		logAt(levelInfo, "ROM matches %s", path)
+		return true
+	}
+
+	diffs, err := nmos.DiffRoms(expected, rom)
+	if err != nil {
+		logger.Printf("ROM doesn't match %s, and the ROMs can't be compared frame by frame: %v", path, err)
+		return false
+	}
+	logger.Printf("ROM doesn't match %s (%d bytes expected, %d bytes built), %d differences:", path, len(expected), len(rom), len(diffs))
+	for _, d := range diffs {
+		logger.Printf("  %s: %s is %s, expected %s", d.Where(), d.Field, nmos.DescribeRomField(d.B), nmos.DescribeRomField(d.A))
+	}
+	if len(diffs) == 0 {
+		// The frames are all the same, so the bytes differ in a way the disassembly hides, such as the padding.
+		logger.Printf("  the ROMs decode to the same songs, so they differ only in their encoding")
+	}
+	return false
+}
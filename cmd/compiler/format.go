@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runFormat implements the format subcommand. Currently its only subcommand is doc, which writes a specification
+// of the ROM format generated from the compiler's own tables.
+func runFormat(args []string) {
+	if len(args) == 0 || args[0] != "doc" {
+		fmt.Fprintf(os.Stderr, "Usage: %s format doc [flags]\n", os.Args[0])
+		os.Exit(exitUsage)
+	}
+
+	flags := pflag.NewFlagSet("format doc", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s format doc [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var formatName string
+	flags.StringVar(&formatName, "format", "markdown", "Markup language of the specification: \"markdown\" or \"html\".")
+
+	var outPath string
+	flags.StringVarP(&outPath, "output", "o", "-", "Output path for the specification. Use \"-\" to write it to stdout.")
+
+	parseFlags(flags, args[1:])
+
+	if flags.NArg() != 0 {
+		usageError(flags)
+	}
+
+	format, err := nmos.ParseDocFormat(formatName)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if outPath != "-" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			logger.Fatalf("error creating output file: %v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := nmos.WriteFormatDoc(out, format); err != nil {
+		logger.Fatalf("error writing specification: %v", err)
+	}
+}
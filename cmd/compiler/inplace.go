@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+)
+
+// writeRomInPlace writes a binary ROM for --low-memory. Its file, or the file of each bank if bankSize isn't 0,
+// is created at its full size first, and then each song is compiled and written straight to its place in it, so
+// only a single song is ever held in memory.
+func writeRomInPlace(path string, songs []*nmos.NmosSong, layout nmos.RomLayout, romSize int, labels []string, bankSize int) {
+	banks := []nmos.Bank{{Start: 0, End: romSize}}
+	paths := []string{path}
+	if bankSize > 0 {
+		offsets, _, err := nmos.PlanRom(songs, layout)
+		if err != nil {
+			logger.Fatalf("error building rom: %v", err)
+		}
+		if banks, err = nmos.SplitBanks(romSize, songs, offsets, bankSize); err != nil {
+			logger.Fatalf("error splitting rom into banks: %v", err)
+		}
+		paths = paths[:0]
+		for i, bank := range banks {
+			logBank(i, bank, labels)
+			paths = append(paths, addFileNameSuffix(path, fmt.Sprint(i)))
+		}
+	}
+
+	w := bankWriter{banks: banks, files: make([]*os.File, len(banks))}
+	for i, bank := range banks {
+		file, err := os.OpenFile(paths[i], os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			logger.Fatalf("error writing output file: %v", err)
+		}
+		if err := file.Truncate(int64(bank.Size())); err != nil {
+			logger.Fatalf("error writing output file: %v", err)
+		}
+		w.files[i] = file
+	}
+
+	if _, err := nmos.WriteRomAt(w, songs, layout); err != nil {
+		logger.Fatalf("error writing output file: %v", err)
+	}
+	for _, file := range w.files {
+		if err := file.Close(); err != nil {
+			logger.Fatalf("error writing output file: %v", err)
+		}
+	}
+}
+
+// bankWriter writes parts of a ROM to the files of the banks they fall in, at their address relative to the
+// start of each bank. Writes which cross the end of a bank are split between the banks.
+type bankWriter struct {
+	banks []nmos.Bank
+	files []*os.File
+}
+
+func (w bankWriter) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	for i, bank := range w.banks {
+		start, end := max(int(off), bank.Start), min(int(off)+len(p), bank.End)
+		if start >= end {
+			continue
+		}
+		n, err := w.files[i].WriteAt(p[start-int(off):end-int(off)], int64(start-bank.Start))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	if written < len(p) {
+		return written, fmt.Errorf("%d bytes at address %d are outside the ROM", len(p)-written, off)
+	}
+	return written, nil
+}
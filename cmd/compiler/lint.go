@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/nmosconv"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+	"github.com/spf13/pflag"
+)
+
+// runLint implements the lint subcommand, which checks a song for things the NMOScillator can't play without
+// compiling it, and lists every problem found along with how it could be fixed. It exits with status 1 if it
+// finds any errors, or with --strict, any warnings.
+func runLint(args []string) {
+	flags := pflag.NewFlagSet("lint", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lint [flags] song.txt\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var targetSpec string
+	flags.StringVar(&targetSpec, "target", "nmoscillator", "Built-in target name or path to a JSON target description, which sets the chip and stereo support checked for.")
+	var rateTolerance float64
+	flags.Float64Var(&rateTolerance, "rate-tolerance", nmos.DefaultRateTolerance*100, "The largest error allowed between the song's tick rate and the rate actually played, in percent.")
+	var transpose, detune []int
+	flags.IntSliceVar(&transpose, "transpose", nil, "Semitones to transpose each channel by, or a single value for every channel.")
+	flags.IntSliceVar(&detune, "detune", nil, "Cents to detune each channel by, or a single value for every channel.")
+	var noteRangeName string
+	flags.StringVar(&noteRangeName, "note-range", "fail", "What happens to notes too low or too high for the chip's periods: \"fail\", \"octave\" or \"drop\". Out of range notes are only errors with \"fail\".")
+	var noisePresetName string
+	flags.StringVar(&noisePresetName, "noise-preset", "fail", "What happens to noise notes other than C, C# or D while the noise channel uses the preset rates: \"fail\", \"snap\" or \"track\". They're only errors with \"fail\".")
+	var diagnosticsFormat string
+	flags.StringVar(&diagnosticsFormat, "diagnostics", "text", "How problems are reported: \"text\", or \"json\" to write one JSON object per line to stdout.")
+	var maxLineLength int
+	flags.IntVar(&maxLineLength, "max-line-length", furnace.DefaultMaxLineLength, "The longest line allowed in a Furnace text export, in bytes.")
+	var strict bool
+	flags.BoolVar(&strict, "strict", false, "Exit with status 1 if there are any warnings, not just errors.")
+
+	parseFlags(flags, args)
+	applyEnvironment(flags)
+
+	if flags.NArg() != 1 {
+		usageError(flags)
+	}
+
+	var opts nmosconv.Options
+	var err error
+	if err := parseDiagnosticsFormat(diagnosticsFormat); err != nil {
+		logger.Fatalf("invalid --diagnostics: %v", err)
+	}
+	if maxLineLength < 1 {
+		logger.Fatalf("invalid --max-line-length: must be at least 1, got %d", maxLineLength)
+	}
+	if rateTolerance <= 0 {
+		logger.Fatalf("invalid --rate-tolerance: must be more than 0, got %g", rateTolerance)
+	}
+	opts.RateTolerance = rateTolerance / 100
+	if opts.NoteRange, err = nmosconv.ParseNoteRange(noteRangeName); err != nil {
+		logger.Fatalf("invalid --note-range: %v", err)
+	}
+	if opts.NoisePreset, err = nmosconv.ParseNoisePreset(noisePresetName); err != nil {
+		logger.Fatalf("invalid --noise-preset: %v", err)
+	}
+	if opts.Transpose, err = perChannel(transpose); err != nil {
+		logger.Fatalf("invalid --transpose: %v", err)
+	}
+	if opts.Detune, err = perChannel(detune); err != nil {
+		logger.Fatalf("invalid --detune: %v", err)
+	}
+	target, err := loadTarget(targetSpec)
+	if err != nil {
+		logger.Fatalf("error loading target %q: %v", targetSpec, err)
+	}
+	opts.Chip = target.Chip
+	opts.Stereo = target.Stereo
+
+	path := flags.Arg(0)
+	file, err := openInput(path)
+	if err != nil {
+		logger.Fatalf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	song, diagnostics, err := parseSong(path, file, nil, furnace.ParseOptions{MaxLineLength: maxLineLength})
+	if err != nil {
+		var d diag.Diagnostic
+		if !errors.As(err, &d) {
+			d = diag.Errorf("error", "%v", err)
+		}
+		d.Message = "parse error: " + d.Message
+		diagnostics = append(diagnostics, d)
+	} else {
+		diagnostics = append(diagnostics, nmosconv.Lint(song, opts)...)
+	}
+
+	errorCount, warningCount := 0, 0
+	for _, d := range diagnostics {
+		if d.Severity == diag.SeverityError {
+			errorCount++
+		} else {
+			warningCount++
+		}
+		if jsonDiagnostics {
+			writeDiagnostic(d)
+		} else {
+			fmt.Printf("%s: %v\n", d.Severity, d)
+		}
+	}
+
+	if !jsonDiagnostics {
+		if len(diagnostics) == 0 {
+			fmt.Printf("%s: no problems found\n", path)
+		} else {
+			fmt.Printf("%s: %d errors, %d warnings\n", path, errorCount, warningCount)
+		}
+	}
+	if errorCount > 0 || strict && warningCount > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// A position given to --locate: either a ROM address, or a frame of every song in the ROM.
+type locateSpec struct {
+	text    string
+	address int
+	frame   int
+	isFrame bool
+}
+
+// parseLocateSpec parses a value of --locate, which is an address in decimal or hex (such as 0x1a2),
+// or a frame number after a "#".
+func parseLocateSpec(s string) (locateSpec, error) {
+	spec := locateSpec{text: s}
+	if frame, ok := strings.CutPrefix(s, "#"); ok {
+		n, err := strconv.Atoi(frame)
+		if err != nil || n < 0 {
+			return spec, fmt.Errorf("invalid frame number %q", frame)
+		}
+		spec.frame, spec.isFrame = n, true
+		return spec, nil
+	}
+	address, err := strconv.ParseInt(s, 0, 64)
+	if err != nil || address < 0 {
+		return spec, fmt.Errorf("invalid address %q, expected a number such as 418 or 0x1a2, or a frame such as #12", s)
+	}
+	spec.address = int(address)
+	return spec, nil
+}
+
+// locateSources logs which frame, command and pattern cell produced each address or frame given to --locate.
+// subsongs holds the subsong each song was converted from, or nil for songs made from several subsongs, whose
+// rows can't be placed in a pattern.
+func locateSources(specs []locateSpec, songs []*nmos.NmosSong, labels []string, offsets []int, subsongs []*furnace.Subsong) {
+	for _, spec := range specs {
+		if spec.isFrame {
+			for i, song := range songs {
+				if spec.frame >= len(song.Frames) {
+					logger.Printf("%s: %s has no frame #%d", spec.text, labels[i], spec.frame)
+					continue
+				}
+				address := song.FrameAddresses(offsets[i])[spec.frame]
+				logger.Printf("%s: %s, frame #%d at address %d (0x%04x), %s", spec.text, labels[i], spec.frame, address, address,
+					describeRows(song.Frames[spec.frame].Rows, subsongs[i]))
+			}
+			continue
+		}
+
+		found := false
+		for i, song := range songs {
+			source, ok := song.SourceOf(offsets[i], spec.address)
+			if !ok {
+				continue
+			}
+			found = true
+			what := source.Part.String()
+			if source.Channel >= 0 {
+				what = fmt.Sprintf("%s %q on %s", what, source.Command, locateChannelName(source.Channel))
+			}
+			logger.Printf("%s: %s, frame #%d, %s, %s", spec.text, labels[i], source.Frame, what, describeRows(source.Rows, subsongs[i]))
+		}
+		if !found {
+			logger.Printf("%s: address %d (0x%04x) isn't part of a song, it's in the ROM's directory, metadata or checksum, or past its end",
+				spec.text, spec.address, spec.address)
+		}
+	}
+}
+
+// describeRows describes where the rows played by a frame are in the song's patterns. The frame's commands
+// all come from its first row, as any rows after it are empty.
+func describeRows(rows []int, subsong *furnace.Subsong) string {
+	if len(rows) == 0 {
+		return "added by the compiler rather than played from a row"
+	}
+	position := func(row int) string {
+		if subsong == nil {
+			return fmt.Sprintf("row %d", row)
+		}
+		order, patternRow := subsong.PatternPosition(row)
+		return fmt.Sprintf("order %d row %d (row %d)", order, patternRow, row)
+	}
+	description := "from " + position(rows[0])
+	switch {
+	case len(rows) == 2:
+		description += ", followed by an empty row at " + position(rows[1])
+	case len(rows) > 2:
+		description += fmt.Sprintf(", followed by %d empty rows up to %s", len(rows)-1, position(rows[len(rows)-1]))
+	}
+	return description
+}
+
+// locateChannelName names a channel the way Furnace shows the SN76489's channels.
+func locateChannelName(channel int) string {
+	if channel == nmos.NoiseChannel {
+		return "the noise channel"
+	}
+	return fmt.Sprintf("square channel %d", channel+1)
+}
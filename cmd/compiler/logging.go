@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+// How much the compiler logs, set with -q and -v.
+type logLevel int
+
+const (
+	levelQuiet logLevel = iota - 1 // Only warnings and errors, set with -q.
+	levelInfo                      // What was built and where it went, the default.
+	levelDebug                     // Also the details of each step of the conversion, set with -v.
+	levelTrace                     // Also every row which changes the course of the conversion, set with -vv.
+)
+
+// verbosity is the most detailed level which is logged.
+var verbosity = levelInfo
+
+// logAt logs a line if verbosity is at least level. Warnings and errors are always logged, so they go straight to
+// logger instead.
+func logAt(level logLevel, format string, args ...any) {
+	if level <= verbosity {
+		logger.Print(fmt.Sprintf(format, args...))
+	}
+}
+
+// A line to log once every earlier subsong has been logged, and the level to log it at.
+type logLine struct {
+	level logLevel
+	text  string
+}
+
+// parseVerbosity returns the level set by the -q and -v flags, where verbose is the number of times -v was given.
+func parseVerbosity(quiet bool, verbose int) (logLevel, error) {
+	switch {
+	case quiet && verbose > 0:
+		return 0, fmt.Errorf("-q and -v can't be used together")
+	case quiet:
+		return levelQuiet, nil
+	}
+	return min(levelInfo+logLevel(verbose), levelTrace), nil
+}
@@ -1,80 +1,553 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/nmosconv"
 	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/mml"
 	"github.com/spf13/pflag"
-	"github.com/sqweek/dialog"
 )
 
 var version = "undefined"
 
 var logger *log.Logger
 
+// The shortest run of frames worth reporting as a repeat.
+const minRepeatLength = 4
+
 func main() {
 	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
-	logger.Printf("NMOScillator Compiler version %s\n", version)
-
-	// Get the current working directory.
-	cwd, err := os.Getwd()
-	if err != nil {
-		logger.Fatalf("failed to get current working directory: %v", err)
+	// Subcommands have their own flags, so check for them before parsing anything else.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "disassemble":
+			runDisassemble(os.Args[2:])
+			return
+		case "format":
+			runFormat(os.Args[2:])
+			return
+		case "tempo-plan":
+			runTempoPlan(os.Args[2:])
+			return
+		case "upload":
+			runUpload(os.Args[2:])
+			return
+		case "compare":
+			runCompare(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "verify-signature":
+			runVerifySignature(os.Args[2:])
+			return
+		case "lint":
+			runLint(os.Args[2:])
+			return
+		case "selftest":
+			runSelfTest(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "check-timing":
+			runCheckTiming(os.Args[2:])
+			return
+		case "sweep":
+			runSweep(os.Args[2:])
+			return
+		}
 	}
 
 	var subsongIndices []int
 	pflag.IntSliceVarP(&subsongIndices, "subsong", "s", make([]int, 0), "Subsong index(es) (0-127). Pack multiple subsongs with syntax like 0,1,3,4.")
 
 	var binPath string
-	pflag.StringVarP(&binPath, "output", "o", "", "Output path for .bin file.")
+	pflag.StringVarP(&binPath, "output", "o", "", "Output path for .bin file. Use \"-\" to write the ROM to stdout.")
+
+	var outputFormatName string
+	pflag.StringVar(&outputFormatName, "format", "bin", "Output file format: \"bin\" for a raw ROM image, \"c\" for a C header with a const uint8_t array, or \"asm\" for .byte directives. C and assembly output label each subsong.")
+
+	var convertOpts nmosconv.Options
+	pflag.BoolVar(&convertOpts.FixedPointPeriods, "fixed-point", false, "Calculate note periods using integer-only arithmetic, so the output is identical on every platform.")
+
+	var slideModeName string
+	pflag.StringVar(&slideModeName, "slide-mode", "ticks", "How note slides (E1xy and E2xy) are played: \"ticks\" changes the pitch on every tick, \"snap\" jumps to the target note when the slide would reach it.")
+
+	var noteRangeName string
+	pflag.StringVar(&noteRangeName, "note-range", "fail", "What happens to notes too low or too high for the chip's periods: \"fail\" stops with an error, \"octave\" moves them by octaves until they fit, and \"drop\" leaves them out. \"octave\" and \"drop\" warn about the first such note on each channel.")
+
+	var maxNoteChanges int
+	pflag.IntVar(&maxNoteChanges, "max-note-changes", -1, "Stop with an error if --note-range and --noise-preset move or leave out more than this many notes across every subsong, so a mistake such as a channel in the wrong octave can't slip into a ROM unnoticed. -1 allows any number. Each note is listed with -v.")
+
+	var noisePresetName string
+	pflag.StringVar(&noisePresetName, "noise-preset", "fail", "What happens to notes other than C, C# or D on the noise channel while it uses the preset rates: \"fail\" stops with an error, \"snap\" plays the preset of the nearest of C, C# and D with a warning, and \"track\" makes the noise channel track square channel 3 for the note, taking over its period.")
+
+	pflag.Uint8Var(&convertOpts.ReleaseAttenuation, "release-attenuation", 15, "How many steps (1-15) a note release (===) lowers a channel's volume by. 15 silences the channel like a note off.")
+	pflag.IntVar(&convertOpts.MacroTicks, "macro-ticks", 0, "The most ticks after the start of a note that instrument macros are played for, after which they hold their value. Limits how many frames looping macros add to the ROM. 0 plays macros for as long as notes last.")
+
+	var ch3LatchName string
+	pflag.StringVar(&ch3LatchName, "ch3-latch", "noise", "Which note is kept when square channel 3 and the noise channel following it both play on the same row: \"noise\" (like Furnace) or \"square\".")
+
+	var rateTolerance float64
+	pflag.Float64Var(&rateTolerance, "rate-tolerance", nmos.DefaultRateTolerance*100, "The largest error allowed between the song's tick rate and the rate actually played, in percent.")
+
+	var transpose, detune []int
+	pflag.IntSliceVar(&transpose, "transpose", nil, "Semitones to transpose each channel by (square 1, square 2, square 3, noise), or a single value for every channel.")
+	pflag.IntSliceVar(&detune, "detune", nil, "Cents to detune each channel by (square 1, square 2, square 3, noise), or a single value for every channel.")
+
+	var noiseTuningName string
+	pflag.StringVar(&noiseTuningName, "noise-tuning", "exact", "How noise pitches are calculated when the noise channel follows square channel 3: \"exact\" corrects for the chip variant's noise shift register, \"legacy\" always assumes the SN76489's.")
+
+	var restoreLoopTempo bool
+	pflag.BoolVar(&restoreLoopTempo, "restore-loop-tempo", false, "Make the loop target re-set its tempo in songs which would otherwise play their looped part at a different tempo after looping.")
+
+	var optimizeName string
+	pflag.StringVarP(&optimizeName, "optimize", "O", "off", "Optimization level: \"size\" runs every pass which shrinks the ROM, \"speed\" only the passes which cut the frames and chip writes played each tick, and \"off\" none. -O alone is the same as --optimize size.")
+	pflag.Lookup("optimize").NoOptDefVal = "size"
+
+	var noTrim bool
+	pflag.BoolVar(&noTrim, "no-trim", false, "Keep the silent frames at the end of songs which halt, instead of trimming them.")
+
+	var reportRepeats bool
+	pflag.BoolVar(&reportRepeats, "report-repeats", false, "Report runs of frames which repeat earlier runs, and how much ROM space they take up.")
+
+	var reportDelays bool
+	pflag.BoolVar(&reportDelays, "report-delays", false, "Report how much of the ROM is taken up by frame delays and padding, and suggest a cheaper base frame delay if there is one.")
+
+	var stats bool
+	pflag.BoolVar(&stats, "stats", false, "Print statistics about each subsong, such as its size, tick rate error, and channel utilization.")
+
+	var jsonPath string
+	pflag.StringVar(&jsonPath, "dump-json", "", "Write the parsed Furnace song and the converted NMOScillator songs to a JSON file at this path.")
+
+	var framesPath string
+	pflag.StringVar(&framesPath, "dump-frames", "", "Write a readable table of every frame in each converted song to a text file at this path, or to stdout if it's \"-\". When there are several songs, each is written to its own file named after its subsong.")
+
+	var locateValues []string
+	pflag.StringSliceVar(&locateValues, "locate", nil, "ROM addresses (such as 418 or 0x1a2) or frames (such as #12) to trace back to the frame, chip command and pattern row which produced them, such as an address reported by the NMOScillator when it faults.")
+
+	var hexdump bool
+	pflag.BoolVar(&hexdump, "hexdump", false, "Show the bytes each command and frame compiles to in the tables written by --dump-frames.")
+
+	var renderPath string
+	pflag.StringVar(&renderPath, "render", "", "Write a preview of each converted song to a WAV file at this path, played through a simple model of the SN76489, with loop markers matching the ROM's loop target. When there are several songs, each is written to its own file named after its subsong.")
+
+	var renderLoops int
+	pflag.IntVar(&renderLoops, "render-loops", 0, "How many extra times --render plays the looped part of each song after its end.")
+
+	var sampleRate int
+	pflag.IntVar(&sampleRate, "sample-rate", 44100, "The sample rate of the files written by --render, in Hz.")
+
+	var tui bool
+	pflag.BoolVar(&tui, "tui", false, "Open an interactive, scrollable view of every frame in the ROM once it's built, with search and the address of each frame.")
+
+	var saveStatePath string
+	pflag.StringVar(&saveStatePath, "save-state", "", "Write the state of the NMOScillator before every frame of the ROM to a JSON file at this path, so an emulator can start playback partway through a song.")
+
+	var tagsPath string
+	pflag.StringVar(&tagsPath, "tags", "", "Write the title, author, album, Furnace version and the address, size and loop target of every song to a file at this path, so other tools can catalogue the ROM without parsing the song. Paths ending in .gd3 get a GD3 tag like those in VGM files, and any other path gets JSON.")
+
+	var maxSize int
+	pflag.IntVar(&maxSize, "max-size", 0, "Fail if the ROM is larger than this many bytes. 0 means no limit.")
+
+	var expectPath string
+	pflag.StringVar(&expectPath, "expect", "", "Path to a known-good ROM to compare the ROM against once it's built. If they differ, every frame which changed is listed and the compiler exits with status 1, so upgrades of the compiler can be checked against ROMs which are known to play correctly.")
+
+	var bankSize int
+	pflag.IntVar(&bankSize, "bank-size", 0, "Split the ROM at frame boundaries into numbered files of at most this many bytes each. 0 writes a single file.")
+
+	var lowMemory bool
+	pflag.BoolVar(&lowMemory, "low-memory", false, "Compile one song at a time straight into its place in the output file, or its bank's file, instead of building the whole ROM in memory first. Only works with binary output, and not with flags which need the whole ROM, such as --checksum or --expect.")
+
+	var layoutName string
+	pflag.StringVar(&layoutName, "layout", "flat", "ROM layout when packing subsongs: \"flat\" concatenates them, \"indexed\" also adds a directory of song addresses at the start of the ROM.")
+
+	var embedMetadata bool
+	pflag.BoolVar(&embedMetadata, "embed-metadata", false, "Add a metadata block to the end of the ROM with the title, author and loop target address of each song, and a checksum of the ROM.")
+
+	var metadataVersion int
+	pflag.IntVar(&metadataVersion, "metadata-version", 1, "The version of the metadata block added by --embed-metadata. Version 2 also has a cue table for each song, with the address and tempo of the frame every --cue-patterns patterns start in, so firmware can skip through songs.")
+
+	var cuePatterns int
+	pflag.IntVar(&cuePatterns, "cue-patterns", 1, "How many patterns apart the cues of a version 2 metadata block are.")
+
+	var checksumName string
+	pflag.StringVar(&checksumName, "checksum", "", "Add a footer to the end of the ROM with a checksum of the whole ROM, so corrupted copies can be found with the verify subcommand: \"crc32\" or \"sum\" (the sum of every byte, which is cheaper to check on the NMOScillator).")
+
+	var signKeyPath string
+	pflag.StringVar(&signKeyPath, "sign", "", "Path to a PEM file with an Ed25519 private key to sign the ROM with, adding a footer to the very end of the ROM so the verify-signature subcommand can check who signed it and that it hasn't been changed since.")
+
+	var targetSpecs []string
+	pflag.StringSliceVar(&targetSpecs, "target", []string{"nmoscillator"}, "Built-in target name(s) or path(s) to JSON target descriptions, used to check that every frame can be played in time. A ROM is built for each target.")
+
+	var jukeboxLoops []int
+	pflag.IntSliceVar(&jukeboxLoops, "jukebox", nil, "Chain the subsongs into one continuous song, playing each song's loop this many times before moving on to the next. Give one count for every song, or a single count for all of them.")
+
+	var albumGap, leadIn float64
+	pflag.Float64Var(&albumGap, "album-gap", 0, "Seconds of silence to insert before every subsong after the first, like the gaps between tracks on an album.")
+	pflag.Float64Var(&leadIn, "lead-in", 0, "Seconds over which every subsong fades in from silence.")
 
-	pflag.Parse()
+	var splitNoise bool
+	pflag.BoolVar(&splitNoise, "split-noise", false, "Write the noise channel to a separate .noise.bin ROM, which stays in sync with the main ROM, for hardware with a dedicated percussion path.")
+
+	var maxLineLength int
+	pflag.IntVar(&maxLineLength, "max-line-length", furnace.DefaultMaxLineLength, "The longest line allowed in a Furnace text export, in bytes. Longer lines stop the compiler with an error instead of being parsed in part, so raise this for songs with very many effect columns.")
+	var stream bool
+	pflag.BoolVar(&stream, "stream", false, "Convert each subsong's rows as they're parsed instead of keeping every row until the whole file is parsed, so huge songs don't need to fit in memory. Only works with a single target and Furnace text exports, and rows are left out of --dump-json.")
+	var jobs int
+	pflag.IntVarP(&jobs, "jobs", "j", runtime.NumCPU(), "The number of subsongs to convert at the same time.")
+
+	var diagnosticsName string
+	pflag.StringVar(&diagnosticsName, "diagnostics", "text", "How warnings and errors about the song are reported: \"text\" logs them, \"json\" writes them to stdout as one JSON object per line (and moves the log to stderr).")
+
+	var showProgress bool
+	pflag.BoolVar(&showProgress, "progress", false, "Show progress bars on stderr while parsing and converting, which helps with large songs.")
+
+	var watch bool
+	pflag.BoolVar(&watch, "watch", false, "Compile again whenever the input file or a target description file changes. Target descriptions are reloaded for every compile.")
+
+	var watchInterval time.Duration
+	pflag.DurationVar(&watchInterval, "watch-interval", 500*time.Millisecond, "How often --watch checks for changes.")
+
+	pflag.BoolVar(&eventStream, "events", false, "Write what the compiler does to stdout as newline-delimited JSON events (parse-started, warning, error, subsong-compiled, log and done), for editor plugins and other tools.")
+
+	pflag.String("config", "", "Path to a config file with defaults for any of these options. Defaults to the nearest "+configFileName+" in the working directory or the directories above it. \"none\" ignores config files.")
+
+	var quiet bool
+	pflag.BoolVarP(&quiet, "quiet", "q", false, "Only log warnings and errors.")
+
+	var verbose int
+	pflag.CountVarP(&verbose, "verbose", "v", "Log the details of each step of the conversion, such as every optimization pass. Give it twice (-vv) to also log every row which changes the speed or tick rate, jumps, halts or sets the loop target.")
+
+	var warningsAsErrors bool
+	pflag.BoolVar(&warningsAsErrors, "warnings-as-errors", false, "Treat warnings as errors, stopping with exit status 1 instead of writing the ROM if there are any. Otherwise the compiler exits with status 2 when it builds the ROM with warnings, and 0 when there are none.")
+
+	var capabilitiesJSON bool
+	pflag.BoolVar(&capabilitiesJSON, "capabilities-json", false, "Write what this build of the compiler supports to stdout as JSON and exit: the Furnace versions and effects it reads, the versions of the formats it writes, its built-in targets and chip variants, its subcommands, and the default of every option.")
+
+	var noDialog bool
+	pflag.BoolVar(&noDialog, "no-dialog", false, "Never open a file dialog. Exits with an error if no input file is given.")
+
+	pflag.CommandLine.Init(os.Args[0], pflag.ContinueOnError)
+	pflag.CommandLine.Usage = pflag.Usage
+	parseFlags(pflag.CommandLine, os.Args[1:])
+	applyEnvironment(pflag.CommandLine)
+
+	if capabilitiesJSON {
+		if err := writeCapabilities(os.Stdout, newCapabilities(flagDefaults(pflag.CommandLine))); err != nil {
+			logger.Fatalf("error writing capabilities: %v", err)
+		}
+		return
+	}
+
+	level, err := parseVerbosity(quiet, verbose)
+	if err != nil {
+		logger.Fatalf("invalid --verbose: %v", err)
+	}
+	verbosity = level
+	if err := parseDiagnosticsFormat(diagnosticsName); err != nil {
+		logger.Fatalf("invalid --diagnostics: %v", err)
+	}
+	if binPath == "-" && jsonDiagnostics {
+		logger.Fatalf("cannot write both the ROM and JSON diagnostics to stdout, choose an output file")
+	}
+
+	var locateSpecs []locateSpec
+	for _, value := range locateValues {
+		spec, err := parseLocateSpec(value)
+		if err != nil {
+			logger.Fatalf("invalid --locate: %v", err)
+		}
+		locateSpecs = append(locateSpecs, spec)
+	}
+
+	if binPath == "-" && eventStream {
+		logger.Fatalf("cannot write both the ROM and events to stdout, choose an output file")
+	}
+	if framesPath == "-" && (binPath == "-" || jsonDiagnostics || eventStream) {
+		logger.Fatalf("cannot write the frame dump to stdout along with the ROM, JSON diagnostics or events, choose an output file")
+	}
+
+	if eventStream {
+		// Log lines are sent as events too, so tools only have one stream to read.
+		logger = log.New(eventLogWriter{}, "", 0)
+	} else if binPath == "-" || framesPath == "-" || jsonDiagnostics {
+		// The ROM, the frame dump or the diagnostics are being written to stdout, so keep the log output out of the way.
+		logger.SetOutput(os.Stderr)
+	}
+
+	if os.Getenv(compileChildEnv) == "" {
+		// Compiles started by --watch and --events don't repeat the version.
+		logAt(levelInfo, "NMOScillator Compiler version %s", version)
+	}
+
+	var bar *progressBar // Left nil without --progress, which turns its methods into no-ops.
+	if showProgress {
+		bar = &progressBar{}
+	}
+
+	if albumGap < 0 || leadIn < 0 {
+		logger.Fatalf("--album-gap and --lead-in can't be negative")
+	}
+	if jobs < 1 {
+		logger.Fatalf("invalid --jobs: must be at least 1, got %d", jobs)
+	}
+	if maxSize < 0 || bankSize < 0 {
+		logger.Fatalf("--max-size and --bank-size can't be negative")
+	}
+	if renderLoops < 0 {
+		logger.Fatalf("invalid --render-loops: must not be negative, got %d", renderLoops)
+	}
+	if sampleRate < 8000 || sampleRate > 192000 {
+		logger.Fatalf("invalid --sample-rate: must be between 8000 and 192000 Hz, got %d", sampleRate)
+	}
+
+	outputFormat, err := nmos.ParseOutputFormat(outputFormatName)
+	if err != nil {
+		logger.Fatalf("invalid --format: %v", err)
+	}
+
+	optimize, err := nmos.ParseOptimizeLevel(optimizeName)
+	if err != nil {
+		logger.Fatalf("invalid --optimize: %v", err)
+	}
+
+	var checksum nmos.ChecksumType
+	if checksumName != "" {
+		if checksum, err = nmos.ParseChecksumType(checksumName); err != nil {
+			logger.Fatalf("invalid --checksum: %v", err)
+		}
+	}
+
+	var signKey ed25519.PrivateKey
+	if signKeyPath != "" {
+		if signKey, err = loadPrivateKey(signKeyPath); err != nil {
+			logger.Fatalf("invalid --sign: error loading %s: %v", signKeyPath, err)
+		}
+	}
+
+	layout, err := nmos.ParseRomLayout(layoutName)
+	if err != nil {
+		logger.Fatalf("invalid --layout: %v", err)
+	}
+	if metadataVersion != 1 && metadataVersion != 2 {
+		logger.Fatalf("invalid --metadata-version: must be 1 or 2, got %d", metadataVersion)
+	}
+	if cuePatterns < 1 {
+		logger.Fatalf("invalid --cue-patterns: must be at least 1, got %d", cuePatterns)
+	}
+
+	if convertOpts.SlideMode, err = nmosconv.ParseSlideMode(slideModeName); err != nil {
+		logger.Fatalf("invalid --slide-mode: %v", err)
+	}
+
+	if convertOpts.Ch3Latch, err = nmosconv.ParseCh3Latch(ch3LatchName); err != nil {
+		logger.Fatalf("invalid --ch3-latch: %v", err)
+	}
+	if convertOpts.ReleaseAttenuation < 1 || convertOpts.ReleaseAttenuation > 15 {
+		logger.Fatalf("invalid --release-attenuation: must be 1-15, got %d", convertOpts.ReleaseAttenuation)
+	}
+	if convertOpts.MacroTicks < 0 {
+		logger.Fatalf("invalid --macro-ticks: must not be negative, got %d", convertOpts.MacroTicks)
+	}
+	if convertOpts.NoteRange, err = nmosconv.ParseNoteRange(noteRangeName); err != nil {
+		logger.Fatalf("invalid --note-range: %v", err)
+	}
+	if convertOpts.NoisePreset, err = nmosconv.ParseNoisePreset(noisePresetName); err != nil {
+		logger.Fatalf("invalid --noise-preset: %v", err)
+	}
+
+	if maxLineLength < 1 {
+		logger.Fatalf("invalid --max-line-length: must be at least 1, got %d", maxLineLength)
+	}
+	if maxNoteChanges < -1 {
+		logger.Fatalf("invalid --max-note-changes: must be -1 or more, got %d", maxNoteChanges)
+	}
+
+	if rateTolerance <= 0 {
+		logger.Fatalf("invalid --rate-tolerance: must be more than 0, got %g", rateTolerance)
+	}
+	convertOpts.RateTolerance = rateTolerance / 100
+
+	if convertOpts.NoiseTuning, err = nmos.ParseNoiseTuning(noiseTuningName); err != nil {
+		logger.Fatalf("invalid --noise-tuning: %v", err)
+	}
+	if convertOpts.Transpose, err = perChannel(transpose); err != nil {
+		logger.Fatalf("invalid --transpose: %v", err)
+	}
+	if convertOpts.Detune, err = perChannel(detune); err != nil {
+		logger.Fatalf("invalid --detune: %v", err)
+	}
+
+	targets := make([]nmos.Target, 0, len(targetSpecs))
+	for _, spec := range targetSpecs {
+		target, err := loadTarget(spec)
+		if err != nil {
+			logger.Fatalf("error loading target %q: %v", spec, err)
+		}
+		targets = append(targets, target)
+	}
+	if binPath == "-" && len(targets) > 1 {
+		logger.Fatalf("cannot write ROMs for %d targets to stdout, choose a single target or an output file", len(targets))
+	}
+	if binPath == "-" && splitNoise {
+		logger.Fatalf("cannot write both the main and noise ROMs to stdout, choose an output file")
+	}
+	if binPath == "-" && bankSize > 0 {
+		logger.Fatalf("cannot write several banks to stdout, choose an output file")
+	}
+	if lowMemory {
+		switch {
+		case outputFormat != nmos.OutputBinary:
+			logger.Fatalf("cannot use --low-memory with --format %s, only binary ROMs can be written in place", outputFormatName)
+		case binPath == "-":
+			logger.Fatalf("cannot use --low-memory while writing the ROM to stdout, choose an output file")
+		case embedMetadata || checksumName != "" || signKey != nil:
+			logger.Fatalf("cannot use --low-memory with --embed-metadata, --checksum or --sign, which need the whole ROM")
+		case expectPath != "":
+			logger.Fatalf("cannot use --low-memory with --expect, which needs the whole ROM")
+		case splitNoise:
+			logger.Fatalf("cannot use --low-memory with --split-noise")
+		}
+	}
+	if stream && len(targets) > 1 {
+		logger.Fatalf("cannot use --stream with %d targets, as rows are converted for a single target while they're parsed", len(targets))
+	}
+	if tui && (binPath == "-" || jsonDiagnostics || eventStream) {
+		logger.Fatalf("cannot open --tui while writing to stdout")
+	}
+	if embedMetadata && metadataVersion == 2 && len(jukeboxLoops) > 0 {
+		logger.Fatalf("cannot use --metadata-version 2 with --jukebox, as a chained song has no patterns of its own to cue")
+	}
+	compileChild := os.Getenv(compileChildEnv) != ""
+	if compileChild {
+		// This is one of the compiles started by --watch or --events.
+		watch = false
+	}
+	if watch && tui {
+		logger.Fatalf("cannot use --watch with --tui")
+	}
+	if watchInterval <= 0 {
+		logger.Fatalf("invalid --watch-interval: must be more than 0, got %v", watchInterval)
+	}
+
+	// Get the current working directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		logger.Fatalf("failed to get current working directory: %v", err)
+	}
+
+	if len(pflag.Args()) == 0 && (noDialog || !dialogAvailable) {
+		// There's no way to ask for an input file, so fail straight away instead of waiting on a dialog.
+		fmt.Fprintln(os.Stderr, "no input file given")
+		usageError(pflag.CommandLine)
+	}
 
 	// Get the path of the Furnace text export file.
 	path, err := choosePath(cwd, pflag.Args())
 	if err != nil {
-		if errors.Is(err, dialog.ErrCancelled) {
+		if errors.Is(err, errDialogCancelled) {
 			logger.Printf("User cancelled the file dialog")
 			os.Exit(1)
 		}
 		logger.Fatalf("failed to determine file path: %v", err)
 	}
 
-	file, err := os.Open(path)
+	if path == stdinPath && binPath == "" {
+		logger.Fatalf("reading the song from stdin needs an output path, pass -o or --output")
+	}
+	if watch {
+		if len(pflag.Args()) == 0 {
+			logger.Fatalf("--watch needs the input file to be given as an argument")
+		}
+		if path == stdinPath {
+			logger.Fatalf("cannot use --watch while reading the song from stdin")
+		}
+		runWatch(path, targetSpecs, watchInterval)
+	}
+	if eventStream && !compileChild {
+		// Compile in a new process, so there's always a done event, however the compile ends.
+		if len(pflag.Args()) == 0 {
+			logger.Fatalf("--events needs the input file to be given as an argument")
+		}
+		exitStatus := runCompileChild()
+		emitDone(exitStatus)
+		os.Exit(exitStatus)
+	}
+
+	file, err := openInput(path)
 	if err != nil {
 		logger.Fatalf("error opening file: %v", err)
 	}
 	defer file.Close()
 
-	var rom []byte
-
 	// parse whole file into internal Furnace format.
-	p := furnace.NewParser(file, logger)
-	internalSong, err := p.ParseInternal()
+	if eventStream {
+		emitEvent(event{Event: "parse-started", File: path})
+	}
+	// Only the selected subsongs are parsed, so the others don't take up memory or produce warnings.
+	parseOpts := furnace.ParseOptions{MaxLineLength: maxLineLength}
+	if len(subsongIndices) > 0 {
+		parseOpts.Subsongs = subsongIndices
+	}
+	var finishStream func() map[int]*streamedSubsong
+	if stream {
+		if strings.EqualFold(filepath.Ext(path), ".mml") {
+			logger.Fatalf("cannot use --stream with MML files, only with Furnace text exports")
+		}
+		opts := convertOpts
+		opts.Chip = targets[0].Chip
+		opts.Stereo = targets[0].Stereo
+		parseOpts.Rows, finishStream = streamSubsongs(opts)
+	}
+	internalSong, err := parseInput(path, file, bar, parseOpts)
+	var streamed map[int]*streamedSubsong
+	if finishStream != nil {
+		// Wait for the subsongs being converted, even if parsing failed, so they don't outlive it.
+		streamed = finishStream()
+		logAt(levelDebug, "Converted %d subsongs while parsing", len(streamed))
+	}
 	if err != nil {
-		logger.Fatalf("parse error: %v", err)
+		fatalDiagnostic("parse error", err)
 	}
-	if len(internalSong.Warnings) > 0 {
-		logger.Println("Warnings produced while parsing file:")
-		for _, warning := range internalSong.Warnings {
-			logger.Printf("line %d: %v\n", warning.Line, warning.Message)
+	skipped := 0
+	for _, subsong := range internalSong.Subsongs {
+		if subsong.Skipped {
+			skipped++
 		}
 	}
+	if skipped > 0 {
+		logAt(levelDebug, "Skipped the rows of %d subsongs which weren't selected", skipped)
+	}
 
 	if len(subsongIndices) == 0 {
 		// If no subsongs are specified, parse all subsongs into a single rom.
 
-		n := len(internalSong.Song.Subsongs)
+		n := len(internalSong.Subsongs)
 
 		if n > 1 {
-			logger.Printf("Concatenating %d subsongs", n)
+			logAt(levelInfo, "Concatenating %d subsongs", n)
 		}
 
 		subsongIndices = make([]int, n) // Allocate space for the indices.
@@ -84,44 +557,640 @@ func main() {
 		}
 	}
 
-	// Iterate over every subsong index provided and parse/compile them, then combine them into a single rom.
-	for _, subsongIndex := range subsongIndices {
-		if subsongIndex > 255 {
-			logger.Fatalf("subsong index %d out of range", subsongIndex)
+	// convertSubsongs converts every subsong index provided for the given target.
+	// Subsongs are converted concurrently, but the songs and log output are always in the order of subsongIndices.
+	convertSubsongs := func(target nmos.Target) []*nmos.NmosSong {
+		results := make([]conversionResult, len(subsongIndices))
+		rows := make([]int, len(subsongIndices))
+		for i, subsongIndex := range subsongIndices {
+			if subsongIndex >= 0 && subsongIndex < len(internalSong.Subsongs) {
+				rows[i] = len(internalSong.Subsongs[subsongIndex].Rows)
+			}
+		}
+		progress := newConversionProgress(bar, rows)
+		indices := make(chan int)
+		var wg sync.WaitGroup
+		for range min(jobs, len(subsongIndices)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indices {
+					opts := convertOpts
+					opts.Subsong = subsongIndices[i]
+					opts.Chip = target.Chip
+					opts.Stereo = target.Stereo
+					opts.Progress = progress.callback(i)
+					post := postProcess{restoreLoopTempo, !noTrim, optimize, reportRepeats, reportDelays, stats}
+					if s := streamed[opts.Subsong]; s != nil {
+						results[i] = postProcessStreamed(internalSong, s, opts, post)
+					} else {
+						results[i] = convertSubsong(internalSong, opts, post)
+					}
+				}
+			}()
+		}
+		for i := range subsongIndices {
+			indices <- i
 		}
+		close(indices)
+		wg.Wait()
+		bar.clear()
 
-		song, err := p.ParseNmos(internalSong, uint8(subsongIndex))
-		if err != nil {
-			logger.Fatalf("error parsing subsong %d: %v", subsongIndex, err)
+		songs := make([]*nmos.NmosSong, 0, len(subsongIndices))
+		noteChanges := 0
+		for i, result := range results {
+			noteChanges += result.noteChanges
+			reportWarnings("", result.warnings)
+			for _, line := range result.log {
+				logAt(line.level, "%s", line.text)
+			}
+			if result.err != nil {
+				fatalDiagnostic(fmt.Sprintf("error parsing subsong %d", subsongIndices[i]), result.err)
+			}
+			if eventStream {
+				emitEvent(event{Event: "subsong-compiled", Subsong: &subsongIndices[i], Target: target.Name,
+					Frames: len(result.song.Frames), Bytes: result.song.CalculateSize()})
+			}
+			songs = append(songs, result.song)
+		}
+		if noteChanges > 0 {
+			logAt(levelInfo, "%d notes were moved or left out to fit the chip", noteChanges)
+		}
+		if maxNoteChanges >= 0 && noteChanges > maxNoteChanges {
+			logger.Fatalf("stopping because %d notes were moved or left out, more than the %d allowed by --max-note-changes", noteChanges, maxNoteChanges)
+		}
+		return songs
+	}
+
+	// Write to a .bin file in the same directory as the source file.
+	if binPath == "" { // No output path provided
+		ext := filepath.Ext(path)
+		binPath = strings.TrimSuffix(path, ext) + outputFormat.Extension()
+	}
+
+	// The converted songs for every target, to be written to the JSON dump.
+	var dumpedSongs []jsonDumpSong
+
+	// The songs shown by --tui, which are those built for the first target.
+	var previewSongs []previewSong
+
+	// Whether a ROM didn't match its --expect ROM, which makes the compiler exit with status 1 once it's done.
+	unexpected := false
+
+	// Build a ROM for every target.
+	for _, target := range targets {
+		if len(targets) > 1 {
+			logAt(levelInfo, "Building for target %s", target.Name)
+		}
+
+		songs := convertSubsongs(target)
+
+		for i, song := range songs {
+			patternLength := int(internalSong.Subsongs[subsongIndices[i]].PatternLength)
+			dumpedSongs = append(dumpedSongs, jsonDumpSong{Target: target.Name, Subsong: subsongIndices[i], Song: song,
+				Rows: song.RowFrames(patternLength)})
+		}
+
+		// Names of each song in the ROM, used when logging.
+		labels := make([]string, len(songs))
+		for i, subsongIndex := range subsongIndices {
+			labels[i] = fmt.Sprintf("subsong %d", subsongIndex)
+		}
+
+		for i, song := range songs {
+			if leadIn > 0 && song.AddLeadIn(leadIn) {
+				logWarningf("%s: lead-in was cut short at the loop target", labels[i])
+			}
+			if i > 0 {
+				song.AddGap(albumGap)
+			}
+		}
+
+		if len(jukeboxLoops) > 0 {
+			jukebox, err := nmos.Jukebox(songs, jukeboxLoops)
+			if err != nil {
+				logger.Fatalf("error building jukebox: %v", err)
+			}
+			songs = []*nmos.NmosSong{jukebox}
+			labels = []string{"jukebox"}
+		}
+
+		if target.MaxChipWrites > 0 {
+			for i, song := range songs {
+				added, warnings := song.ThrottleWrites(target.MaxChipWrites)
+				if added > 0 {
+					logAt(levelInfo, "%s: split %d frames to write at most %d bytes per tick to the SN76489", labels[i], added, target.MaxChipWrites)
+				}
+				for _, warning := range warnings {
+					logWarningf("%s: %v on target %s", labels[i], warning, target.Name)
+				}
+			}
 		}
 
-		// fmt.Println(song)
+		for i, song := range songs {
+			for _, warning := range song.CheckBudget(target) {
+				logWarningf("%s: %v on target %s", labels[i], warning, target.Name)
+			}
+		}
+		if warningsAsErrors && warningCount > 0 {
+			logger.Fatalf("stopping because of %d warnings, which are errors with --warnings-as-errors", warningCount)
+		}
+
+		if framesPath != "" {
+			path := framesPath
+			if len(targets) > 1 && path != "-" {
+				path = addFileNameSuffix(path, fileNameSafe(target.Name))
+			}
+			writeFrameDumps(path, songs, labels, hexdump)
+		}
+
+		if renderPath != "" {
+			path := renderPath
+			if len(targets) > 1 {
+				path = addFileNameSuffix(path, fileNameSafe(target.Name))
+			}
+			chip, err := nmos.LookupChipVariant(target.Chip)
+			if err != nil {
+				logger.Fatalf("error rendering for target %s: %v", target.Name, err)
+			}
+			writeRenders(path, songs, labels, nmos.RenderOptions{SampleRate: sampleRate, Loops: renderLoops, Chip: chip})
+		}
 
-		subsongBin, err := song.Compile()
+		var noiseSongs []*nmos.NmosSong
+		if splitNoise {
+			for i, song := range songs {
+				songs[i], song = song.SplitNoise()
+				noiseSongs = append(noiseSongs, song)
+			}
+		}
+
+		// With --low-memory, the ROM is only planned here, and it's compiled once it's written.
+		var rom []byte
+		var offsets []int
+		var romSize int
+		if lowMemory {
+			offsets, romSize, err = nmos.PlanRom(songs, layout)
+		} else {
+			rom, offsets, err = nmos.BuildRom(songs, layout)
+			romSize = len(rom)
+		}
 		if err != nil {
-			logger.Fatalf("error compiling subsong %d: %v", subsongIndex, err)
+			logger.Fatalf("error building rom: %v", err)
+		}
+
+		symbols := make([]nmos.RomSymbol, len(labels))
+		symbolCounts := make(map[string]int) // Used to keep symbols unique when a subsong is packed more than once.
+		for i, label := range labels {
+			end := romSize
+			if i+1 < len(offsets) {
+				end = offsets[i+1]
+			}
+			logAt(levelInfo, "%s:\taddress: %d,\tsize: %d bytes", strings.ToUpper(label[:1])+label[1:], offsets[i], end-offsets[i])
+			name := identifier(label)
+			if n := symbolCounts[name]; n > 0 {
+				name = fmt.Sprintf("%s_%d", name, n)
+			}
+			symbolCounts[identifier(label)]++
+			symbols[i] = nmos.RomSymbol{Name: name, Offset: offsets[i]}
+		}
+
+		if len(locateSpecs) > 0 {
+			subsongs := make([]*furnace.Subsong, len(songs))
+			if len(jukeboxLoops) == 0 {
+				for i, subsongIndex := range subsongIndices {
+					subsongs[i] = internalSong.Subsongs[subsongIndex]
+				}
+			}
+			locateSources(locateSpecs, songs, labels, offsets, subsongs)
+		}
+
+		// The pattern length of each song's subsong, which its cues are placed by.
+		patternLengths := make([]int, len(subsongIndices))
+		for i, subsongIndex := range subsongIndices {
+			patternLengths[i] = int(internalSong.Subsongs[subsongIndex].PatternLength)
+		}
+
+		if embedMetadata {
+			if rom, err = appendMetadata(rom, songs, offsets, metadataVersion, patternLengths, cuePatterns); err != nil {
+				logger.Fatalf("error adding metadata: %v", err)
+			}
+		}
+		if checksumName != "" {
+			if rom, err = nmos.AppendChecksum(rom, checksum); err != nil {
+				logger.Fatalf("error adding checksum: %v", err)
+			}
+		}
+		if signKey != nil {
+			rom = nmos.AppendSignature(rom, signKey)
+		}
+		if !lowMemory {
+			romSize = len(rom)
+		}
+
+		if tui && previewSongs == nil {
+			for i, song := range songs {
+				previewSongs = append(previewSongs, previewSong{label: labels[i], song: song, address: offsets[i]})
+			}
 		}
 
-		logger.Printf("Subsong %d:\taddress: %d,\tsize: %d bytes", subsongIndex, len(rom), len(subsongBin))
+		logAt(levelInfo, "Total rom size: %d bytes", romSize)
+		if maxSize > 0 && romSize > maxSize {
+			logger.Fatalf("rom is %d bytes, which is %d bytes over the maximum size of %d bytes", romSize, romSize-maxSize, maxSize)
+		}
 
-		rom = slices.Concat(rom, subsongBin)
+		if expectPath != "" {
+			path := expectPath
+			if len(targets) > 1 {
+				path = addFileNameSuffix(path, fileNameSafe(target.Name))
+			}
+			if !checkExpected(path, rom) {
+				unexpected = true
+			}
+		}
+
+		if tagsPath != "" {
+			tags := nmos.RomTags{
+				Title:          internalSong.Name,
+				Author:         internalSong.Author,
+				Album:          internalSong.Album,
+				FurnaceVersion: internalSong.Version,
+				Compiler:       "NMOScillator Compiler " + version,
+				Target:         target.Name,
+				Size:           romSize,
+			}
+			for i, song := range songs {
+				tags.Songs = append(tags.Songs, song.Tags(labels[i], offsets[i]))
+			}
+			path := tagsPath
+			if len(targets) > 1 {
+				path = addFileNameSuffix(path, fileNameSafe(target.Name))
+			}
+			if err := writeTags(path, tags); err != nil {
+				logger.Fatalf("error writing tags: %v", err)
+			}
+		}
+
+		if saveStatePath != "" {
+			states := nmos.SaveStates{Version: nmos.SaveStateVersion}
+			for i, song := range songs {
+				states.Songs = append(states.Songs, song.SaveStates(labels[i], offsets[i]))
+			}
+			path := saveStatePath
+			if len(targets) > 1 {
+				path = addFileNameSuffix(path, fileNameSafe(target.Name))
+			}
+			if err := writeJSONFile(path, states); err != nil {
+				logger.Fatalf("error writing save states: %v", err)
+			}
+		}
+
+		if binPath == "-" {
+			if err := nmos.WriteRom(os.Stdout, outputFormat, "song_rom", rom, symbols); err != nil {
+				logger.Fatalf("error writing output to stdout: %v", err)
+			}
+			continue
+		}
+
+		outPath := binPath
+		if len(targets) > 1 {
+			// Keep each target's ROM separate by adding the target name to the file name.
+			outPath = addFileNameSuffix(outPath, fileNameSafe(target.Name))
+		}
+		if lowMemory {
+			writeRomInPlace(outPath, songs, layout, romSize, labels, bankSize)
+			continue
+		}
+		writeBanks(outPath, outputFormat, rom, symbols, songs, offsets, labels, bankSize)
+
+		if splitNoise {
+			noiseRom, noiseOffsets, err := nmos.BuildRom(noiseSongs, layout)
+			if err != nil {
+				logger.Fatalf("error building noise rom: %v", err)
+			}
+			if embedMetadata {
+				if noiseRom, err = appendMetadata(noiseRom, noiseSongs, noiseOffsets, metadataVersion, patternLengths, cuePatterns); err != nil {
+					logger.Fatalf("error adding metadata to noise rom: %v", err)
+				}
+			}
+			if checksumName != "" {
+				if noiseRom, err = nmos.AppendChecksum(noiseRom, checksum); err != nil {
+					logger.Fatalf("error adding checksum to noise rom: %v", err)
+				}
+			}
+			if signKey != nil {
+				noiseRom = nmos.AppendSignature(noiseRom, signKey)
+			}
+			logAt(levelInfo, "Noise rom size: %d bytes", len(noiseRom))
+			if maxSize > 0 && len(noiseRom) > maxSize {
+				logger.Fatalf("noise rom is %d bytes, which is %d bytes over the maximum size of %d bytes", len(noiseRom), len(noiseRom)-maxSize, maxSize)
+			}
+			for i := range symbols {
+				symbols[i].Offset = noiseOffsets[i]
+			}
+			writeBanks(addFileNameSuffix(outPath, "noise"), outputFormat, noiseRom, symbols, noiseSongs, noiseOffsets, labels, bankSize)
+		}
 	}
 
-	logger.Printf("Total rom size: %d bytes", len(rom))
+	if jsonPath != "" {
+		err := writeJSONFile(jsonPath, jsonDump{Furnace: internalSong, Nmos: dumpedSongs})
+		if err != nil {
+			logger.Fatalf("error writing JSON dump: %v", err)
+		}
+	}
 
-	// Write to a .bin file in the same directory as the source file.
-	if binPath == "" { // No output path provided
-		ext := filepath.Ext(path)
-		binPath = strings.TrimSuffix(path, ext) + ".bin"
+	if tui {
+		if err := runFrameViewer(previewSongs); err != nil {
+			logger.Fatalf("error opening --tui: %v", err)
+		}
 	}
-	binPath, err = filepath.Abs(binPath)
+
+	if unexpected {
+		os.Exit(exitError)
+	}
+	if warningCount > 0 {
+		os.Exit(exitWarnings)
+	}
+}
+
+// The outcome of converting a single subsong.
+type conversionResult struct {
+	song     *nmos.NmosSong
+	warnings []nmosconv.Warning // Warnings to report once every earlier subsong has been logged.
+	log      []logLine          // Lines to log once every earlier subsong has been logged.
+	err      error
+
+	noteChanges int // The number of notes which were moved or left out (see nmosconv.Options.NoteChanged).
+}
+
+// Steps to run on every subsong after converting it.
+type postProcess struct {
+	restoreLoopTempo bool
+	trim             bool
+	optimize         nmos.OptimizeLevel
+	reportRepeats    bool
+	reportDelays     bool
+	stats            bool
+}
+
+// convertSubsong converts and post-processes a single subsong. It doesn't log anything itself,
+// so it's safe to call for several subsongs at once.
+func convertSubsong(internalSong *furnace.Song, opts nmosconv.Options, post postProcess) conversionResult {
+	var traced []logLine
+	var noteChanges int
+	opts.Trace = traceTo(&traced, opts.Subsong)
+	opts.NoteChanged = countNoteChanges(&traced, &noteChanges, opts.Subsong)
+
+	song, warnings, err := nmosconv.Convert(internalSong, opts)
 	if err != nil {
-		logger.Fatalf("error parsing output path: %v", err)
+		return conversionResult{warnings: warnings, log: traced, err: err, noteChanges: noteChanges}
+	}
+	result := postProcessSubsong(internalSong, song, opts, post)
+	result.warnings = warnings
+	result.log = append(traced, result.log...)
+	result.noteChanges = noteChanges
+	return result
+}
+
+// traceTo returns a function to pass to nmosconv.Options.Trace which adds the rows traced while converting a subsong
+// to lines, or nil if they wouldn't be logged.
+func traceTo(lines *[]logLine, subsong int) func(row int, message string) {
+	if verbosity < levelTrace {
+		return nil
+	}
+	return func(row int, message string) {
+		*lines = append(*lines, logLine{levelTrace, fmt.Sprintf("Subsong %d, row %d: %s", subsong, row, message)})
+	}
+}
+
+// countNoteChanges returns a function to pass to nmosconv.Options.NoteChanged which counts the notes moved or left
+// out while converting a subsong, and adds each of them to lines.
+func countNoteChanges(lines *[]logLine, count *int, subsong int) func(row int, message string) {
+	return func(row int, message string) {
+		*count++
+		*lines = append(*lines, logLine{levelDebug, fmt.Sprintf("Subsong %d, row %d: %s", subsong, row, message)})
+	}
+}
+
+// A subsong which was converted while it was parsed, with --stream.
+type streamedSubsong struct {
+	song        *nmos.NmosSong
+	warnings    []nmosconv.Warning
+	traced      []logLine
+	noteChanges int
+	err         error
+}
+
+// streamSubsongs returns a function to pass to furnace.ParseOptions.Rows which converts the rows of each subsong with
+// opts as they're parsed, and a function to call once parsing is done, which waits for the last subsong to be
+// converted and returns every converted subsong by its index.
+func streamSubsongs(opts nmosconv.Options) (func(*furnace.Song, *furnace.Subsong, furnace.Row) error, func() map[int]*streamedSubsong) {
+	streamed := make(map[int]*streamedSubsong)
+	var current *streamedSubsong
+	var converter *nmosconv.StreamConverter
+	finish := func() {
+		if converter != nil {
+			current.song, current.warnings, current.err = converter.Finish()
+			converter = nil
+		}
+	}
+	rows := func(song *furnace.Song, subsong *furnace.Subsong, row furnace.Row) error {
+		if streamed[subsong.Index] == nil {
+			// Rows are passed on in order, so the first row of a subsong means the one before it is complete.
+			finish()
+			current = &streamedSubsong{}
+			streamed[subsong.Index] = current
+			opts := opts
+			opts.Subsong = subsong.Index
+			opts.Trace = traceTo(&current.traced, subsong.Index)
+			opts.NoteChanged = countNoteChanges(&current.traced, &current.noteChanges, subsong.Index)
+			converter = nmosconv.NewStreamConverter(song, subsong, opts)
+		}
+		converter.Add(row)
+		return nil
+	}
+	return rows, func() map[int]*streamedSubsong {
+		finish()
+		return streamed
+	}
+}
+
+// postProcessStreamed post-processes a subsong converted with --stream, like convertSubsong. The streamed song is
+// left as it is, in case the subsong is in the ROM more than once.
+func postProcessStreamed(internalSong *furnace.Song, s *streamedSubsong, opts nmosconv.Options, post postProcess) conversionResult {
+	if s.err != nil {
+		return conversionResult{warnings: s.warnings, log: s.traced, err: s.err, noteChanges: s.noteChanges}
+	}
+	result := postProcessSubsong(internalSong, s.song.Clone(), opts, post)
+	result.warnings = s.warnings
+	result.log = append(slices.Clone(s.traced), result.log...)
+	result.noteChanges = s.noteChanges
+	return result
+}
+
+// postProcessSubsong runs the steps in post on a subsong which has already been converted with opts, changing the
+// song in place. Like convertSubsong, it doesn't log anything itself.
+func postProcessSubsong(internalSong *furnace.Song, song *nmos.NmosSong, opts nmosconv.Options, post postProcess) conversionResult {
+	var result conversionResult
+	logf := func(level logLevel, format string, args ...any) {
+		result.log = append(result.log, logLine{level, fmt.Sprintf(format, args...)})
+	}
+
+	if mismatch, ok := song.CheckLoopTempo(); ok {
+		if post.restoreLoopTempo {
+			song.RestoreTempoAtLoopTarget()
+			logf(levelInfo, "Subsong %d: %v, so the loop target now restores tempo %d", opts.Subsong, mismatch, mismatch.FirstTempo)
+		} else {
+			logf(levelInfo, "Subsong %d: %v (use --restore-loop-tempo to fix this)", opts.Subsong, mismatch)
+		}
+	}
+
+	if post.trim {
+		if trimmed := song.TrimTrailingSilence(); trimmed > 0 {
+			logf(levelInfo, "Subsong %d: trimmed %d silent frames from the end of the song", opts.Subsong, trimmed)
+		}
 	}
 
-	err = os.WriteFile(binPath, rom, 0o644)
+	if post.optimize != nmos.OptimizeOff {
+		// Simulate the song before and after optimizing it, so an optimization which changes the sound is never shipped.
+		before, err := song.Simulate()
+		if err != nil {
+			result.err = fmt.Errorf("error simulating the song: %w", err)
+			return result
+		}
+		optimized := song.Clone()
+		passes := optimized.Optimize(post.optimize)
+		after, err := optimized.Simulate()
+		if err == nil {
+			err = nmos.ComparePlayback(before, after)
+		}
+		if err != nil {
+			result.err = fmt.Errorf("optimization changed the way the song plays, which is a bug in the compiler (compile without --optimize to work around it): %w", err)
+			return result
+		}
+		song = optimized
+
+		total := 0
+		for _, pass := range passes {
+			logf(levelDebug, "Subsong %d: %v", opts.Subsong, pass)
+			total += pass.Saved
+		}
+		logf(levelInfo, "Subsong %d: optimization for %v saved %d bytes, and plays the same as before", opts.Subsong, post.optimize, total)
+	}
+
+	if post.reportRepeats {
+		repeats := song.FindRepeats(minRepeatLength)
+		total := 0
+		for _, repeat := range repeats {
+			logf(levelInfo, "subsong %d: %v", opts.Subsong, repeat)
+			total += repeat.Size
+		}
+		logf(levelInfo, "Subsong %d: %d bytes are taken up by repeated frame runs", opts.Subsong, total)
+	}
+
+	if post.reportDelays {
+		logf(levelInfo, "Subsong %d: %v", opts.Subsong, song.AnalyzeDelays())
+	}
+
+	if post.stats {
+		st := song.Stats()
+		logf(levelInfo, "Subsong %d: %v", opts.Subsong, st)
+		target := nmosconv.RowRate(internalSong.Subsongs[opts.Subsong])
+		logf(levelInfo, "Subsong %d: plays %.3f rows per second, %+.3f%% off the target of %.3f", opts.Subsong, st.RowRate, (st.RowRate-target)/target*100, target)
+	}
+
+	result.song = song
+	return result
+}
+
+// The contents of the file written by --dump-json.
+type jsonDump struct {
+	Furnace *furnace.Song  `json:"furnace"`
+	Nmos    []jsonDumpSong `json:"nmos"`
+}
+
+// A single converted song in the JSON dump.
+type jsonDumpSong struct {
+	Target  string         `json:"target"`
+	Subsong int            `json:"subsong"`
+	Song    *nmos.NmosSong `json:"song"`
+	// Where each source row starts playing, so tools can follow along with the patterns.
+	Rows []nmos.RowFrame `json:"rows"`
+}
+
+// appendMetadata adds a metadata block of the given version to the end of a ROM. Version 2 blocks have a cue every
+// cuePatterns patterns, where patternLengths holds the pattern length of each song's subsong.
+func appendMetadata(rom []byte, songs []*nmos.NmosSong, offsets []int, version int, patternLengths []int, cuePatterns int) ([]byte, error) {
+	if version == 1 {
+		return nmos.AppendMetadata(rom, songs, offsets)
+	}
+	cues := make([][]nmos.Cue, len(songs))
+	for i, song := range songs {
+		cues[i] = song.Cues(song.RowFrames(patternLengths[i]), cuePatterns)
+	}
+	return nmos.AppendMetadataWithCues(rom, songs, offsets, cues)
+}
+
+// writeJSONFile writes a value to a file as indented JSON.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		logger.Fatalf("error writing output file: %v", err)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// writeTags writes the tags of a ROM to a file, as a GD3 tag if the path ends in .gd3, and as JSON otherwise.
+func writeTags(path string, tags nmos.RomTags) error {
+	if !strings.EqualFold(filepath.Ext(path), ".gd3") {
+		return writeJSONFile(path, tags)
+	}
+	var buf bytes.Buffer
+	if err := tags.WriteGD3(&buf); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// writeFrameDumps writes the frame table of each song to a text file, or one after another to stdout if path is "-".
+// If there's more than one song, each song's file is named after its label. If hexdump is true, the bytes of each
+// command and frame are included.
+func writeFrameDumps(path string, songs []*nmos.NmosSong, labels []string, hexdump bool) {
+	for i, song := range songs {
+		if path == "-" {
+			if _, err := io.WriteString(os.Stdout, song.Listing(hexdump)); err != nil {
+				logger.Fatalf("error writing frame dump to stdout: %v", err)
+			}
+			continue
+		}
+		songPath := path
+		if len(songs) > 1 {
+			songPath = addFileNameSuffix(path, fileNameSafe(labels[i]))
+		}
+		if err := os.WriteFile(songPath, []byte(song.Listing(hexdump)), 0o644); err != nil {
+			logger.Fatalf("error writing frame dump: %v", err)
+		}
+	}
+}
+
+// writeRenders writes a WAV preview of each song, with markers at its loop. If there's more than one song,
+// each song's file is named after its label.
+func writeRenders(path string, songs []*nmos.NmosSong, labels []string, opts nmos.RenderOptions) {
+	for i, song := range songs {
+		songPath := path
+		if len(songs) > 1 {
+			songPath = addFileNameSuffix(path, fileNameSafe(labels[i]))
+		}
+		samples, loop := song.Render(opts)
+		var wav bytes.Buffer
+		if err := nmos.WriteWAV(&wav, samples, opts.SampleRate, loop); err != nil {
+			logger.Fatalf("error rendering %s: %v", labels[i], err)
+		}
+		if err := os.WriteFile(songPath, wav.Bytes(), 0o644); err != nil {
+			logger.Fatalf("error writing render: %v", err)
+		}
+		start, end := loop.Seconds(opts.SampleRate)
+		logAt(levelInfo, "%s: rendered %.2f seconds to %s, looping from %.3f to %.3f seconds (samples %d to %d)",
+			labels[i], float64(len(samples))/float64(opts.SampleRate), songPath, start, end, loop.Start, loop.End)
 	}
 }
 
@@ -131,6 +1200,9 @@ func choosePath(cwd string, args []string) (string, error) {
 	// If an argument was passed to the program, use it.
 	if len(args) > 0 {
 		path := args[0]
+		if path == stdinPath {
+			return path, nil
+		}
 		absPath, err := filepath.Abs(path)
 		if err != nil {
 			return "", fmt.Errorf("cannot get absolute path: %w", err)
@@ -142,14 +1214,9 @@ func choosePath(cwd string, args []string) (string, error) {
 	}
 
 	// Otherwise open the file dialog.
-	path, err := dialog.
-		File().
-		Title("Open Furnace text export").
-		Filter("Furnace text exports (*.txt)", "txt").
-		SetStartDir(cwd).
-		Load()
-	if err != nil {
-		// Propagate the error. Caller will check for dialog.ErrCancelled.
+	path, err := openFileDialog(cwd)
+	if err != nil {
+		// Propagate the error. Caller will check for errDialogCancelled.
 		return "", err
 	}
 
@@ -160,7 +1227,7 @@ func choosePath(cwd string, args []string) (string, error) {
 
 	// Check for empty path just in case.
 	if absPath == "" {
-		return "", dialog.ErrCancelled
+		return "", errDialogCancelled
 	}
 	if err := validatePath(absPath); err != nil {
 		return "", fmt.Errorf("dialog selection invalid: %w", err)
@@ -168,10 +1235,175 @@ func choosePath(cwd string, args []string) (string, error) {
 	return absPath, nil
 }
 
+// stdinPath is the input path which reads the song from stdin, as a Furnace text export.
+const stdinPath = "-"
+
+// openInput opens the input file, or stdin if the path is stdinPath.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == stdinPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// parseInput parses the input file into the internal Furnace format, logging any warnings.
+// Files with the .mml extension are parsed as MML, and anything else as a Furnace text export.
+// If bar isn't nil, it shows how much of a Furnace text export has been parsed.
+func parseInput(path string, r io.Reader, bar *progressBar, opts furnace.ParseOptions) (*furnace.Song, error) {
+	song, warnings, err := parseSong(path, r, bar, opts)
+	reportWarnings("Warnings produced while parsing file:", warnings)
+	if err != nil {
+		return nil, err
+	}
+	if song.Version != 0 {
+		logAt(levelInfo, "Furnace version %d detected", song.Version)
+	}
+	if !song.Ignored.IsZero() {
+		logAt(levelDebug, "Ignored by the compiler: %v", song.Ignored)
+	}
+	return song, nil
+}
+
+// parseSong parses a Furnace text export with opts, or an MML file if the path ends in .mml, returning the warnings
+// produced while parsing it instead of reporting them. opts.Progress is set from bar.
+func parseSong(path string, r io.Reader, bar *progressBar, opts furnace.ParseOptions) (*furnace.Song, []diag.Diagnostic, error) {
+	if strings.EqualFold(filepath.Ext(path), ".mml") {
+		return mml.Parse(r)
+	}
+	if bar != nil {
+		opts.Progress = func(line, lines int) {
+			if lines == 0 { // Streamed files aren't read ahead to count their lines.
+				bar.update("Parsing", line, -1, fmt.Sprintf("%d lines", line))
+				return
+			}
+			bar.update("Parsing", line, lines, fmt.Sprintf("%d/%d lines", line, lines))
+		}
+	}
+	song, warnings, err := furnace.ParseWithOptions(r, opts)
+	bar.clear()
+	return song, warnings, err
+}
+
+// loadTarget returns the built-in target with the given name,
+// or otherwise reads a target description from the JSON file at that path.
+func loadTarget(spec string) (nmos.Target, error) {
+	if target, ok := nmos.BuiltinTargets[strings.ToLower(spec)]; ok {
+		return target, nil
+	}
+
+	file, err := os.Open(spec)
+	if err != nil {
+		return nmos.Target{}, err
+	}
+	defer file.Close()
+	return nmos.ParseTarget(file)
+}
+
+// perChannel expands a list of per-channel values given on the command line into a value for each of the 4 channels.
+// A single value applies to every channel, and an empty list leaves every channel at 0.
+func perChannel(values []int) ([4]int, error) {
+	var out [4]int
+	switch len(values) {
+	case 0:
+	case 1:
+		out = [4]int{values[0], values[0], values[0], values[0]}
+	case 4:
+		copy(out[:], values)
+	default:
+		return out, fmt.Errorf("expected 1 or 4 values, got %d", len(values))
+	}
+	return out, nil
+}
+
+// addFileNameSuffix adds a suffix to the name of the file at path, before its extension.
+func addFileNameSuffix(path string, suffix string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + suffix + ext
+}
+
+// writeBanks writes the ROM to a file like writeRom. If bankSize isn't 0, the ROM is split into banks of at most
+// bankSize bytes instead, which are written to files numbered from 0, and the songs in each bank are logged.
+func writeBanks(path string, format nmos.OutputFormat, rom []byte, symbols []nmos.RomSymbol, songs []*nmos.NmosSong, offsets []int, labels []string, bankSize int) {
+	if bankSize == 0 {
+		writeRom(path, format, rom, symbols)
+		return
+	}
+
+	banks, err := nmos.SplitBanks(len(rom), songs, offsets, bankSize)
+	if err != nil {
+		logger.Fatalf("error splitting rom into banks: %v", err)
+	}
+	for i, bank := range banks {
+		logBank(i, bank, labels)
+
+		// Symbols are kept in the bank they point into, relative to the start of the bank.
+		var bankSymbols []nmos.RomSymbol
+		for _, symbol := range symbols {
+			if symbol.Offset >= bank.Start && symbol.Offset < bank.End {
+				bankSymbols = append(bankSymbols, nmos.RomSymbol{Name: symbol.Name, Offset: symbol.Offset - bank.Start})
+			}
+		}
+		writeRom(addFileNameSuffix(path, fmt.Sprint(i)), format, rom[bank.Start:bank.End], bankSymbols)
+	}
+}
+
+// logBank logs the address and size of a bank, and the labels of the songs in it.
+func logBank(index int, bank nmos.Bank, labels []string) {
+	var names []string
+	for _, song := range bank.Songs {
+		names = append(names, labels[song])
+	}
+	logAt(levelInfo, "Bank %d:	address: %d,	size: %d bytes,	songs: %s", index, bank.Start, bank.Size(), strings.Join(names, ", "))
+}
+
+// writeRom writes a ROM image to the given path in the given format.
+// In C and assembly output, the ROM is named after the file.
+func writeRom(path string, format nmos.OutputFormat, rom []byte, symbols []nmos.RomSymbol) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		logger.Fatalf("error parsing output path: %v", err)
+	}
+
+	var b bytes.Buffer
+	name := identifier(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	if err := nmos.WriteRom(&b, format, name, rom, symbols); err != nil {
+		logger.Fatalf("error writing output file: %v", err)
+	}
+
+	err = os.WriteFile(path, b.Bytes(), 0o644)
+	if err != nil {
+		logger.Fatalf("error writing output file: %v", err)
+	}
+}
+
+// identifier turns s into a valid C and assembly identifier.
+func identifier(s string) string {
+	s = strings.ToLower(strings.Map(func(r rune) rune {
+		if r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, s))
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	return s
+}
+
+// fileNameSafe replaces any characters in s which might not be allowed in a file name.
+func fileNameSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
 // validatePath performs simple checks to verify if a file exists or not.
 func validatePath(p string) error {
-	if strings.ToLower(filepath.Ext(p)) != ".txt" {
-		return fmt.Errorf("file must have .txt extension")
+	if ext := strings.ToLower(filepath.Ext(p)); ext != ".txt" && ext != ".mml" {
+		return fmt.Errorf("file must have .txt or .mml extension")
 	}
 	if _, err := os.Stat(p); err != nil {
 		return fmt.Errorf("cannot stat file: %w", err)
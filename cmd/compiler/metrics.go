@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The upper bounds of the buckets of each histogram exported by the serve subcommand.
+var (
+	compileDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	romSizeBuckets         = []float64{256, 1024, 4096, 8192, 16384, 32768, 65536, 131072}
+)
+
+// A histogram of observed values, counted into buckets by their upper bounds like a Prometheus histogram.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // The number of values in each bucket, not including those in earlier buckets.
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// observe adds a value to the histogram.
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+	if i, _ := slices.BinarySearch(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+// write writes the histogram in the Prometheus text format, with cumulative buckets.
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// Statistics about the compiles run by the serve subcommand, exported on its /metrics endpoint.
+type compileMetrics struct {
+	mu       sync.Mutex
+	compiles uint64
+	failures map[string]uint64 // The number of failed compiles, by the class of error which stopped them.
+	duration histogram         // How long each compile took, in seconds.
+	romSize  histogram         // The size of each ROM which was compiled, in bytes.
+}
+
+func newCompileMetrics() *compileMetrics {
+	return &compileMetrics{
+		failures: make(map[string]uint64),
+		duration: newHistogram(compileDurationBuckets),
+		romSize:  newHistogram(romSizeBuckets),
+	}
+}
+
+// record adds a compile which took the given time. If failure isn't "", the compile failed with that class of
+// error, and otherwise it built a ROM of the given size.
+func (m *compileMetrics) record(duration time.Duration, romSize int, failure string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compiles++
+	m.duration.observe(duration.Seconds())
+	if failure != "" {
+		m.failures[failure]++
+		return
+	}
+	m.romSize.observe(float64(romSize))
+}
+
+// write writes every metric in the Prometheus text format.
+func (m *compileMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP nmosc_compiles_total The number of compiles requested, including those which failed.\n")
+	fmt.Fprintf(w, "# TYPE nmosc_compiles_total counter\n")
+	fmt.Fprintf(w, "nmosc_compiles_total %d\n", m.compiles)
+
+	fmt.Fprintf(w, "# HELP nmosc_compile_failures_total The number of compiles which failed, by the class of error which stopped them.\n")
+	fmt.Fprintf(w, "# TYPE nmosc_compile_failures_total counter\n")
+	classes := make([]string, 0, len(m.failures))
+	for class := range m.failures {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "nmosc_compile_failures_total{class=%q} %d\n", class, m.failures[class])
+	}
+
+	m.duration.write(w, "nmosc_compile_duration_seconds", "How long each compile took, in seconds.")
+	m.romSize.write(w, "nmosc_rom_size_bytes", "The size of each ROM compiled, in bytes.")
+}
@@ -0,0 +1,17 @@
+//go:build nodialog
+
+package main
+
+import "errors"
+
+// dialogAvailable reports whether this build of the compiler can open a file dialog.
+// Builds using the nodialog tag don't depend on a GUI toolkit, which is useful for CI and scripting.
+const dialogAvailable = false
+
+// errDialogCancelled is returned when the user closes the file dialog without choosing a file.
+var errDialogCancelled = errors.New("cancelled")
+
+// openFileDialog always fails, as this build of the compiler has no file dialog support.
+func openFileDialog(cwd string) (string, error) {
+	return "", errors.New("this build of the compiler doesn't support file dialogs, pass the input file as an argument instead")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the progress bar is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+const progressBarWidth = 30
+
+// progressBar draws a progress bar on a single line of stderr, for --progress.
+// Its methods are safe to call from several goroutines at once, and do nothing if it's nil.
+type progressBar struct {
+	mu       sync.Mutex
+	lastDraw time.Time
+	drawn    bool // Whether the bar is currently on screen.
+}
+
+// update redraws the bar, showing done out of total and a description of the progress. If total is negative, it isn't
+// known, so only the description is shown.
+// Updates which come sooner than progressInterval after the last redraw are skipped, unless the task is finished.
+func (p *progressBar) update(label string, done, total int, detail string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastDraw) < progressInterval && (total < 0 || done < total) {
+		return
+	}
+	p.lastDraw = time.Now()
+	p.drawn = true
+	if total < 0 {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s %s", label, detail)
+		return
+	}
+
+	fraction := 1.0
+	if total > 0 {
+		fraction = min(float64(done)/float64(total), 1)
+	}
+	filled := int(fraction * progressBarWidth)
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%s [%s%s] %3.0f%% %s",
+		label, strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), fraction*100, detail)
+}
+
+// clear removes the bar from the screen, so the log can be written over it.
+func (p *progressBar) clear() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.drawn {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		p.drawn = false
+	}
+	p.lastDraw = time.Time{}
+}
+
+// conversionProgress adds up the progress of subsongs being converted at the same time.
+type conversionProgress struct {
+	bar    *progressBar
+	mu     sync.Mutex
+	rows   []int // The furthest row reached in each subsong.
+	totals []int // The number of rows in each subsong.
+	frames []int // The number of frames made for each subsong.
+}
+
+// newConversionProgress returns a conversionProgress for subsongs with the given numbers of rows.
+func newConversionProgress(bar *progressBar, rows []int) *conversionProgress {
+	return &conversionProgress{bar: bar, rows: make([]int, len(rows)), totals: rows, frames: make([]int, len(rows))}
+}
+
+// callback returns a function to pass to nmosconv.Options.Progress for the i-th subsong being converted.
+func (c *conversionProgress) callback(i int) func(row, rows, frames int) {
+	if c.bar == nil {
+		return nil
+	}
+	return func(row, rows, frames int) {
+		c.mu.Lock()
+		c.rows[i] = max(c.rows[i], row) // Jumps can move backwards, but the bar shouldn't.
+		c.frames[i] = frames
+		done, total, allFrames := 0, 0, 0
+		for j := range c.rows {
+			done += c.rows[j]
+			total += c.totals[j]
+			allFrames += c.frames[j]
+		}
+		c.mu.Unlock()
+		c.bar.update("Converting", done, total, fmt.Sprintf("%d/%d rows, %d frames", done, total, allFrames))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runDiff implements the diff subcommand, which decodes two ROMs into frames and lists the songs, frames and
+// commands which differ between them. It exits with status 1 if they differ, like diff.
+func runDiff(args []string) {
+	flags := pflag.NewFlagSet("diff", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [flags] a.bin b.bin\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var maxDiffs int
+	flags.IntVarP(&maxDiffs, "max", "n", 0, "The largest number of differences to list. 0 lists every difference.")
+	var asJSON bool
+	flags.BoolVar(&asJSON, "json", false, "Write the differences to stdout as a JSON array, for other tools to read.")
+
+	parseFlags(flags, args)
+
+	if flags.NArg() != 2 {
+		usageError(flags)
+	}
+	if maxDiffs < 0 {
+		logger.Fatalf("invalid --max: must not be negative, got %d", maxDiffs)
+	}
+	pathA, pathB := flags.Arg(0), flags.Arg(1)
+
+	romA, err := os.ReadFile(pathA)
+	if err != nil {
+		logger.Fatalf("error reading ROM file: %v", err)
+	}
+	romB, err := os.ReadFile(pathB)
+	if err != nil {
+		logger.Fatalf("error reading ROM file: %v", err)
+	}
+
+	diffs, err := nmos.DiffRoms(romA, romB)
+	if err != nil {
+		logger.Fatalf("error decoding ROMs: %v", err)
+	}
+	if maxDiffs > 0 && len(diffs) > maxDiffs && asJSON {
+		diffs = diffs[:maxDiffs]
+	}
+
+	if asJSON {
+		if diffs == nil {
+			diffs = []nmos.RomDifference{}
+		}
+		out, err := json.MarshalIndent(diffs, "", "  ")
+		if err != nil {
+			logger.Fatalf("error encoding differences: %v", err)
+		}
+		fmt.Println(string(out))
+	} else if len(diffs) > 0 {
+		fmt.Printf("A: %s (%d bytes)\nB: %s (%d bytes)\n", pathA, len(romA), pathB, len(romB))
+		// Differences are grouped under the song or frame they're in.
+		where := ""
+		for i, d := range diffs {
+			if maxDiffs > 0 && i == maxDiffs {
+				fmt.Printf("... and %d more\n", len(diffs)-maxDiffs)
+				break
+			}
+			if d.Where() != where {
+				where = d.Where()
+				fmt.Printf("\n%s:\n", where)
+			}
+			fmt.Printf("  %-14s A: %s\n  %-14s B: %s\n", d.Field, nmos.DescribeRomField(d.A), "", nmos.DescribeRomField(d.B))
+		}
+		fmt.Printf("\n%d differences\n", len(diffs))
+	}
+
+	switch {
+	case len(diffs) > 0:
+		os.Exit(1)
+	case !bytes.Equal(romA, romB):
+		logger.Printf("%s and %s decode to the same songs, but are encoded differently", pathA, pathB)
+		os.Exit(1)
+	case !asJSON:
+		logger.Printf("%s and %s are the same", pathA, pathB)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/nmosconv"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+	"github.com/spf13/pflag"
+)
+
+// The songs run by the selftest subcommand.
+//
+//go:embed selftest/*.txt
+var selfTestFiles embed.FS
+
+// A song run through the whole pipeline by the selftest subcommand, with the ROM it's known to compile to.
+type selfTestVector struct {
+	file      string // The name of the song in the selftest directory.
+	optimize  nmos.OptimizeLevel
+	romSHA256 string // The SHA-256 of the flat ROM, compiled with fixed-point periods so it's the same on every platform.
+	stereo    bool   // Whether the song is converted for a target with a stereo control register.
+	fails     string // If not empty, converting the song must fail with a warning or error containing this text.
+}
+
+var selfTestVectors = []selfTestVector{
+	{file: "basic.txt", optimize: nmos.OptimizeOff, romSHA256: "34875a7ae7859e3816fe8ddfe6f363a7098de131307236a9ccbddac6791a51bb"},
+	{file: "basic.txt", optimize: nmos.OptimizeSize, romSHA256: "99a60fbf53abaa67d26de36ca3043089ce48165e4dbbdcf978164adc4999f0b9"},
+	// basic.txt with its empty cells left blank instead of filled with dots, which must compile to the same ROM.
+	{file: "blank.txt", optimize: nmos.OptimizeOff, romSHA256: "34875a7ae7859e3816fe8ddfe6f363a7098de131307236a9ccbddac6791a51bb"},
+	// Rows with several effect columns, which change the speed and tick rate together and combine 0Bxx with 0Dxx.
+	{file: "effects.txt", optimize: nmos.OptimizeOff, romSHA256: "a2b3dcf8b843d6ee0093fb51f6ae931e6ddb1d16e2e5eec2c8d584bdeabb9a1b"},
+	// effects.txt with the effects on every row in the opposite order, which must compile to the same ROM.
+	{file: "effects-swapped.txt", optimize: nmos.OptimizeOff, romSHA256: "a2b3dcf8b843d6ee0093fb51f6ae931e6ddb1d16e2e5eec2c8d584bdeabb9a1b"},
+	// 0Bxx with 0Dxx skipping forward within a pattern and looping back to a blank row partway through one, and 0Dxx
+	// landing partway through the next pattern.
+	{file: "jumps.txt", optimize: nmos.OptimizeOff, romSHA256: "dc17903aeec23e84cf53accbc9fce1bbb29b4ac3e15eafccb56b5022b88544da"},
+	// A loop which re-sets the initial tempo before changing it, so the re-set must be kept when optimizing, as the
+	// song loops back with the other tempo.
+	{file: "loop-tempo.txt", optimize: nmos.OptimizeSize, romSHA256: "c708487878be71ba22eabe9aec273923bac9a1815d3806ad74a8cdf7bbe894fd"},
+	// 0B00 looping back to the first row of the song, which must target the frame after the reset frame.
+	{file: "loop-start.txt", optimize: nmos.OptimizeOff, romSHA256: "80ac860bd6ccf93c053e3d9d8c3c01c168a9dd3cd22781ea8eea8f4f883e670e"},
+	// 0Bxx jumping to a pattern past the end of the song, which plays as a loop back to the start, like in Furnace,
+	// but must be warned about.
+	{file: "loop-missing.txt", optimize: nmos.OptimizeOff, fails: "only has 2 patterns"},
+	// Panning in a loop which is played at another tempo after looping, so the frames which write to the stereo
+	// control register, and re-set the tempo with it, must be repeated before the song loops.
+	{file: "stereo.txt", optimize: nmos.OptimizeOff, romSHA256: "78be1f80e6015b21988f9463ecff8717e6a6059c559f52041456fe5567e6f2ea", stereo: true},
+	{file: "stereo.txt", optimize: nmos.OptimizeSize, romSHA256: "4573edd57143428bc50618d5b8488b9b9f7cfabe3a01094b54a4780e99df773f", stereo: true},
+}
+
+// runSelfTest implements the selftest subcommand, which runs songs built into the compiler through every stage
+// of compiling (parsing, converting, compiling, disassembling and simulating) and checks the results against those
+// known to be correct. If it passes, the compiler works on this platform, and any problem lies with the song or
+// the hardware instead.
+func runSelfTest(args []string) {
+	flags := pflag.NewFlagSet("selftest", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s selftest [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var verbose bool
+	flags.BoolVarP(&verbose, "verbose", "v", false, "List every stage checked, not just the result of each song.")
+	parseFlags(flags, args)
+	if flags.NArg() != 0 {
+		usageError(flags)
+	}
+
+	failed := 0
+	for _, v := range selfTestVectors {
+		name := fmt.Sprintf("%s (optimize %v)", v.file, v.optimize)
+		stages, err := v.run()
+		if verbose {
+			for _, stage := range stages {
+				fmt.Printf("  %s: %s passed\n", name, stage)
+			}
+		}
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("PASS %s\n", name)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d self-tests failed\n", failed, len(selfTestVectors))
+		os.Exit(1)
+	}
+	fmt.Printf("All %d self-tests passed\n", len(selfTestVectors))
+}
+
+// run runs the vector through every stage, and returns the stages which passed, and an error from the first
+// stage which failed.
+func (v selfTestVector) run() ([]string, error) {
+	var passed []string
+	stage := func(name string, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		passed = append(passed, name)
+		return nil
+	}
+
+	input, err := selfTestFiles.ReadFile(path.Join("selftest", v.file))
+	if err != nil {
+		return passed, stage("read", err)
+	}
+	song, warnings, err := furnace.Parse(bytes.NewReader(input))
+	if err == nil && len(warnings) > 0 {
+		err = fmt.Errorf("unexpected warning: %v", warnings[0])
+	}
+	if err := stage("parse", err); err != nil {
+		return passed, err
+	}
+
+	opts := nmosconv.Options{FixedPointPeriods: true, Stereo: v.stereo}
+	// Optimizing checks itself that the optimized song plays the same as before.
+	result := convertSubsong(song, opts, postProcess{trim: true, optimize: v.optimize})
+	if result.err == nil && len(result.warnings) > 0 {
+		result.err = fmt.Errorf("unexpected warning: %v", result.warnings[0])
+	}
+	if v.fails != "" {
+		switch {
+		case result.err == nil:
+			result.err = fmt.Errorf("converted without the expected failure %q", v.fails)
+		case !strings.Contains(result.err.Error(), v.fails):
+			result.err = fmt.Errorf("expected a failure containing %q, got: %w", v.fails, result.err)
+		default:
+			result.err = nil
+		}
+		return passed, stage("convert", result.err)
+	}
+	if err := stage("convert", result.err); err != nil {
+		return passed, err
+	}
+	converted := result.song
+
+	rom, _, err := nmos.BuildRom([]*nmos.NmosSong{converted}, nmos.LayoutFlat)
+	if err == nil && fmt.Sprintf("%x", sha256.Sum256(rom)) != v.romSHA256 {
+		err = fmt.Errorf("ROM has SHA-256 %x, expected %s", sha256.Sum256(rom), v.romSHA256)
+	}
+	if err := stage("compile", err); err != nil {
+		return passed, err
+	}
+
+	songs, err := nmos.Disassemble(rom)
+	if err == nil && len(songs) != 1 {
+		err = fmt.Errorf("found %d songs, expected 1", len(songs))
+	}
+	if err == nil {
+		var again []byte
+		again, err = songs[0].Compile()
+		if err == nil && !bytes.Equal(again, rom) {
+			err = errors.New("compiling the disassembled song doesn't give the same ROM")
+		}
+	}
+	if err := stage("disassemble", err); err != nil {
+		return passed, err
+	}
+
+	// Simulating a song also checks that its compiled ROM plays the way its frames ask for.
+	want, err := converted.Simulate()
+	if err == nil {
+		var got []nmos.PlaybackEvent
+		got, err = songs[0].Simulate()
+		if err == nil {
+			err = nmos.ComparePlayback(want, got)
+		}
+	}
+	if err := stage("simulate", err); err != nil {
+		return passed, err
+	}
+	return passed, nil
+}
@@ -0,0 +1,73 @@
+//go:build linux && (386 || amd64 || arm || arm64 || riscv64)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Baud rate codes for the termios c_cflag field, which aren't defined by the syscall package on every architecture.
+var baudRates = map[int]uint32{
+	9600:   0xd,
+	19200:  0xe,
+	38400:  0xf,
+	57600:  0x1001,
+	115200: 0x1002,
+	230400: 0x1003,
+}
+
+const termiosBaudMask = 0x100f // CBAUD
+
+// openSerialPort opens a serial port and sets it up for raw 8N1 communication at the given baud rate.
+func openSerialPort(path string, baud int) (*os.File, error) {
+	speed, ok := baudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+
+	port, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var t syscall.Termios
+	if err := ioctl(port, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		port.Close()
+		return nil, fmt.Errorf("%s isn't a serial port: %w", path, err)
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | termiosBaudMask
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+	t.Ispeed, t.Ospeed = speed, speed
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctl(port, syscall.TCSETS, unsafe.Pointer(&t)); err != nil {
+		port.Close()
+		return nil, fmt.Errorf("error configuring %s: %w", path, err)
+	}
+	return port, nil
+}
+
+// ioctl calls the ioctl system call on a file, such as to get or set the termios settings of a terminal.
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !(linux && (386 || amd64 || arm || arm64 || riscv64))
+
+package main
+
+import "os"
+
+// openSerialPort opens a serial port. The compiler can only set up serial ports on Linux, so elsewhere
+// the port's baud rate and raw mode must already be set up, such as with stty or mode.
+func openSerialPort(path string, baud int) (*os.File, error) {
+	logger.Printf("can't configure serial ports on this platform, make sure %s is already set to %d baud, 8N1, raw mode", path, baud)
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/nmosconv"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+	"github.com/spf13/pflag"
+)
+
+// runServe implements the serve subcommand, which runs the compiler as an HTTP service. Songs POSTed to /compile
+// are compiled into ROMs, statistics about the compiles are exported on /metrics for Prometheus to scrape, and what
+// the service supports is described on /capabilities.
+func runServe(args []string) {
+	flags := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var listen string
+	flags.StringVarP(&listen, "listen", "l", "localhost:8080", "The address to listen for HTTP requests on.")
+	var maxBody int64
+	flags.Int64Var(&maxBody, "max-body", 4<<20, "The largest song accepted by /compile, in bytes.")
+	parseFlags(flags, args)
+	applyEnvironment(flags)
+	if flags.NArg() != 0 {
+		usageError(flags)
+	}
+	if maxBody <= 0 {
+		logger.Fatalf("invalid --max-body: must be more than 0, got %d", maxBody)
+	}
+
+	metrics := newCompileMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /compile", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rom, status, class, err := compileRequest(r, maxBody)
+		metrics.record(time.Since(start), len(rom), class)
+		if err != nil {
+			logger.Printf("%s %s: %v", r.Method, r.URL, err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		logger.Printf("%s %s: compiled %d bytes in %v", r.Method, r.URL, len(rom), time.Since(start).Round(time.Millisecond))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(rom)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+
+	mux.HandleFunc("GET /capabilities", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeCapabilities(w, newCapabilities(compileRequestDefaults))
+	})
+
+	logger.Printf("Listening on %s", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		logger.Fatalf("error serving: %v", err)
+	}
+}
+
+// compileRequestDefaults are the values of the query parameters of /compile which aren't given.
+var compileRequestDefaults = map[string]string{
+	"subsong":     "0",
+	"optimize":    "off",
+	"target":      "nmoscillator",
+	"fixed-point": "false",
+	"format":      "text",
+}
+
+// compileRequest compiles the song in the body of a /compile request into a flat ROM. The query can set the
+// subsong ("subsong"), "optimize" level, built-in "target", and "fixed-point" periods, and "format=mml" reads
+// the song as MML. If it fails, it returns the HTTP status and the class of error, which is the code of the
+// diagnostic which stopped the compile, or the stage it failed at.
+func compileRequest(r *http.Request, maxBody int64) ([]byte, int, string, error) {
+	query := r.URL.Query()
+	badRequest := func(format string, args ...any) ([]byte, int, string, error) {
+		return nil, http.StatusBadRequest, "request", fmt.Errorf(format, args...)
+	}
+
+	var opts nmosconv.Options
+	var err error
+	if s := query.Get("subsong"); s != "" {
+		if opts.Subsong, err = strconv.Atoi(s); err != nil {
+			return badRequest("invalid subsong: %v", err)
+		}
+	}
+	optimize := nmos.OptimizeOff
+	if s := query.Get("optimize"); s != "" {
+		if optimize, err = nmos.ParseOptimizeLevel(s); err != nil {
+			return badRequest("invalid optimize: %v", err)
+		}
+	}
+	if s := query.Get("fixed-point"); s != "" {
+		if opts.FixedPointPeriods, err = strconv.ParseBool(s); err != nil {
+			return badRequest("invalid fixed-point: %v", err)
+		}
+	}
+	// Only built-in targets can be used, so requests can't read files on the server.
+	targetName := query.Get("target")
+	if targetName == "" {
+		targetName = "nmoscillator"
+	}
+	target, ok := nmos.BuiltinTargets[strings.ToLower(targetName)]
+	if !ok {
+		return badRequest("unknown target %q", targetName)
+	}
+	opts.Chip = target.Chip
+	opts.Stereo = target.Stereo
+
+	// parseSong picks the parser by the file extension.
+	name := "song.txt"
+	if strings.EqualFold(query.Get("format"), "mml") {
+		name = "song.mml"
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBody))
+	if err != nil {
+		return nil, http.StatusRequestEntityTooLarge, "request", fmt.Errorf("error reading song: %w", err)
+	}
+
+	song, _, err := parseSong(name, bytes.NewReader(body), nil, furnace.ParseOptions{Subsongs: []int{opts.Subsong}})
+	if err != nil {
+		return nil, http.StatusUnprocessableEntity, errorClass(err, "parse"), err
+	}
+	if opts.Subsong < 0 || opts.Subsong >= len(song.Subsongs) {
+		return badRequest("the song has no subsong %d", opts.Subsong)
+	}
+	result := convertSubsong(song, opts, postProcess{trim: true, optimize: optimize})
+	if result.err != nil {
+		return nil, http.StatusUnprocessableEntity, errorClass(result.err, "convert"), result.err
+	}
+	rom, _, err := nmos.BuildRom([]*nmos.NmosSong{result.song}, nmos.LayoutFlat)
+	if err != nil {
+		return nil, http.StatusUnprocessableEntity, errorClass(err, "build"), err
+	}
+	return rom, http.StatusOK, "", nil
+}
+
+// errorClass returns the class of an error for the failure metrics: the code of the diagnostic, if it is one,
+// and otherwise the stage of compiling it happened in.
+func errorClass(err error, stage string) string {
+	var d diag.Diagnostic
+	if errors.As(err, &d) && d.Code != "" {
+		return d.Code
+	}
+	return stage
+}
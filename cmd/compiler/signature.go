@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runVerifySignature implements the verify-signature subcommand, which checks that a ROM was signed with --sign
+// by the holder of a key, and hasn't been changed since.
+func runVerifySignature(args []string) {
+	flags := pflag.NewFlagSet("verify-signature", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify-signature --key public.pem song.bin\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var keyPath string
+	flags.StringVarP(&keyPath, "key", "k", "", "Path to the PEM file with the Ed25519 public key the ROM should be signed with, as published by whoever signed it. A private key file works too.")
+
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 || keyPath == "" {
+		usageError(flags)
+	}
+
+	trusted, err := loadPublicKey(keyPath)
+	if err != nil {
+		logger.Fatalf("error loading key: %v", err)
+	}
+	rom, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		logger.Fatalf("error reading ROM file: %v", err)
+	}
+
+	_, key, ok, err := nmos.VerifySignature(rom)
+	if !ok {
+		logger.Fatalf("ROM isn't signed, compile it with --sign to add a signature")
+	}
+	if err != nil {
+		logger.Fatalf("signature doesn't match: %v", err)
+	}
+	if !key.Equal(trusted) {
+		logger.Fatalf("ROM was signed with key %x, not the key in %s", []byte(key), keyPath)
+	}
+	logger.Printf("signature matches, the ROM was signed with the key in %s and hasn't been changed since", keyPath)
+}
+
+// readPEMBlock reads the only PEM block in a file.
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, errors.New("expected a single PEM block")
+	}
+	return block, nil
+}
+
+// loadPrivateKey loads an Ed25519 private key from a PKCS #8 PEM file, as written by
+// "openssl genpkey -algorithm ed25519".
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("expected a PRIVATE KEY PEM block, got %s", block.Type)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, got %T", parsed)
+	}
+	return key, nil
+}
+
+// loadPublicKey loads an Ed25519 public key from a PKIX PEM file, as written by "openssl pkey -pubout",
+// or takes it from a private key file.
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := loadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public().(ed25519.PublicKey), nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("expected an Ed25519 key, got %T", parsed)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("expected a PUBLIC KEY or PRIVATE KEY PEM block, got %s", block.Type)
+	}
+}
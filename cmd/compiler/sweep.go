@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/nmosconv"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+	"github.com/spf13/pflag"
+)
+
+// The options which change how a subsong is converted in a sweep. Combinations of options which only differ in how
+// the converted song is post-processed, such as the optimization level, share a single conversion.
+type sweepKey struct {
+	rateTolerance float64 // In percent.
+	slideMode     string
+	macroTicks    int
+}
+
+// A conversion made for a sweep, kept for every combination of options with the same sweepKey.
+type sweepConversion struct {
+	song     *nmos.NmosSong
+	warnings int
+	err      error
+}
+
+// runSweep implements the sweep subcommand, which compiles a subsong with every combination of the given rate
+// tolerances, slide modes, macro tick limits and optimization levels, and lists the size and timing of each,
+// so the best settings for a song can be picked without compiling it over and over by hand.
+func runSweep(args []string) {
+	flags := pflag.NewFlagSet("sweep", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s sweep [flags] song.txt\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var subsong int
+	flags.IntVarP(&subsong, "subsong", "s", 0, "The subsong index to compile.")
+	var targetSpec string
+	flags.StringVar(&targetSpec, "target", "nmoscillator", "Built-in target name or path to a JSON target description, which frames are checked against.")
+	var rateTolerances []float64
+	flags.Float64SliceVar(&rateTolerances, "rate-tolerance", []float64{0.25, nmos.DefaultRateTolerance * 100, 4}, "The rate tolerances to try, in percent.")
+	var slideModes []string
+	flags.StringSliceVar(&slideModes, "slide-mode", []string{"ticks", "snap"}, "The slide modes to try.")
+	var macroTicks []int
+	flags.IntSliceVar(&macroTicks, "macro-ticks", []int{0}, "The limits on instrument macros to try, in ticks. 0 plays macros for as long as notes last.")
+	var optimizeNames []string
+	flags.StringSliceVarP(&optimizeNames, "optimize", "O", []string{"off", "size", "speed"}, "The optimization levels to try.")
+	parseFlags(flags, args)
+	applyEnvironment(flags)
+
+	if flags.NArg() != 1 {
+		usageError(flags)
+	}
+	for _, tolerance := range rateTolerances {
+		if tolerance <= 0 {
+			logger.Fatalf("invalid --rate-tolerance: must be more than 0, got %g", tolerance)
+		}
+	}
+	for _, name := range slideModes {
+		if _, err := nmosconv.ParseSlideMode(name); err != nil {
+			logger.Fatalf("invalid --slide-mode: %v", err)
+		}
+	}
+	for _, ticks := range macroTicks {
+		if ticks < 0 {
+			logger.Fatalf("invalid --macro-ticks: must not be negative, got %d", ticks)
+		}
+	}
+	levels := make([]nmos.OptimizeLevel, len(optimizeNames))
+	for i, name := range optimizeNames {
+		var err error
+		if levels[i], err = nmos.ParseOptimizeLevel(name); err != nil {
+			logger.Fatalf("invalid --optimize: %v", err)
+		}
+	}
+	target, err := loadTarget(targetSpec)
+	if err != nil {
+		logger.Fatalf("error loading target %q: %v", targetSpec, err)
+	}
+
+	path := flags.Arg(0)
+	file, err := openInput(path)
+	if err != nil {
+		logger.Fatalf("error opening file: %v", err)
+	}
+	defer file.Close()
+	internalSong, err := parseInput(path, file, nil, furnace.ParseOptions{Subsongs: []int{subsong}})
+	if err != nil {
+		fatalDiagnostic("parse error", err)
+	}
+	if subsong < 0 || subsong >= len(internalSong.Subsongs) {
+		logger.Fatalf("%s has no subsong %d", path, subsong)
+	}
+	targetRate := nmosconv.RowRate(internalSong.Subsongs[subsong])
+
+	conversions := make(map[sweepKey]sweepConversion)
+	convert := func(key sweepKey) (nmosconv.Options, sweepConversion) {
+		opts := nmosconv.Options{
+			Subsong:       subsong,
+			Chip:          target.Chip,
+			Stereo:        target.Stereo,
+			RateTolerance: key.rateTolerance / 100,
+			MacroTicks:    key.macroTicks,
+		}
+		opts.SlideMode, _ = nmosconv.ParseSlideMode(key.slideMode)
+		if c, ok := conversions[key]; ok {
+			return opts, c
+		}
+		song, warnings, err := nmosconv.Convert(internalSong, opts)
+		c := sweepConversion{song: song, warnings: len(warnings), err: err}
+		conversions[key] = c
+		return opts, c
+	}
+
+	fmt.Printf("%9s  %6s  %5s  %8s  %7s  %6s  %10s  %11s  %8s\n",
+		"Tolerance", "Slides", "Macro", "Optimize", "Size", "Frames", "Rate error", "Late frames", "Warnings")
+	// The best options make the smallest ROM which plays every frame in time, and then the most accurate one.
+	var best string
+	bestSize, bestError := -1, 0.0
+	for _, tolerance := range rateTolerances {
+		for _, slideMode := range slideModes {
+			for _, ticks := range macroTicks {
+				for i, level := range levels {
+					key := sweepKey{rateTolerance: tolerance, slideMode: slideMode, macroTicks: ticks}
+					opts, c := convert(key)
+					options := fmt.Sprintf("%8g%%  %6s  %5s  %8s", tolerance, slideMode, describeMacroTicks(ticks), optimizeNames[i])
+					if c.err != nil {
+						fmt.Printf("%s  %s\n", options, firstLine(c.err.Error()))
+						continue
+					}
+					result := postProcessSubsong(internalSong, c.song.Clone(), opts, postProcess{trim: true, optimize: level})
+					if result.err != nil {
+						fmt.Printf("%s  %s\n", options, firstLine(result.err.Error()))
+						continue
+					}
+					st := result.song.Stats()
+					late := len(result.song.CheckBudget(target))
+					rateError := (st.RowRate - targetRate) / targetRate * 100
+					fmt.Printf("%s  %7d  %6d  %+9.3f%%  %11d  %8d\n", options, st.Size, st.Frames, rateError, late, c.warnings)
+					if late == 0 && (bestSize < 0 || st.Size < bestSize || st.Size == bestSize && math.Abs(rateError) < bestError) {
+						best = fmt.Sprintf("--rate-tolerance %g --slide-mode %s --macro-ticks %d --optimize %s", tolerance, slideMode, ticks, optimizeNames[i])
+						bestSize, bestError = st.Size, math.Abs(rateError)
+					}
+				}
+			}
+		}
+	}
+
+	fmt.Println()
+	if bestSize < 0 {
+		fmt.Printf("None of the options play every frame in time on target %s\n", target.Name)
+		return
+	}
+	fmt.Printf("The smallest ROM which plays every frame in time is %d bytes, with %s\n", bestSize, best)
+}
+
+// describeMacroTicks describes a limit on instrument macros for the table of the sweep subcommand.
+func describeMacroTicks(ticks int) string {
+	if ticks == 0 {
+		return "all"
+	}
+	return fmt.Sprint(ticks)
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
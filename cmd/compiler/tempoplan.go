@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runTempoPlan implements the tempo-plan subcommand, which shows how a tick rate would be played
+// without compiling a song, so composers can pick tick rates the NMOScillator can play exactly.
+func runTempoPlan(args []string) {
+	flags := pflag.NewFlagSet("tempo-plan", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s tempo-plan --rate <Hz> [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var rate float64
+	flags.Float64Var(&rate, "rate", 0, "The tick rate to plan for, in Hz.")
+
+	var rateTolerance float64
+	flags.Float64Var(&rateTolerance, "rate-tolerance", nmos.DefaultRateTolerance*100, "The largest error allowed between the tick rate and the rate actually played, in percent.")
+
+	var count int
+	flags.IntVarP(&count, "count", "n", 10, "The number of alternatives to list.")
+
+	parseFlags(flags, args)
+
+	if flags.NArg() != 0 || rate <= 0 {
+		usageError(flags)
+	}
+	if rateTolerance <= 0 {
+		logger.Fatalf("invalid --rate-tolerance: must be more than 0, got %g", rateTolerance)
+	}
+	if count < 0 {
+		logger.Fatalf("invalid --count: must not be negative, got %d", count)
+	}
+
+	best, alternatives, ok := nmos.PlanTempo(rate, rateTolerance/100, count)
+	if ok {
+		fmt.Printf("%.3f Hz is played with %v\n", rate, best)
+	} else {
+		fmt.Printf("%.3f Hz can't be played within %g%%. The closest is %v\n", rate, rateTolerance, best)
+	}
+
+	if len(alternatives) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("%5s  %11s  %12s  %8s\n", "Tempo", "Frame delay", "Tick rate", "Error")
+	for _, o := range alternatives {
+		fmt.Printf("%5d  %11d  %8.3f Hz  %7.3f%%\n", o.Tempo, o.FrameDelay, o.Achieved, o.RelErr*100)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux && (386 || amd64 || arm || arm64 || riscv64)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// makeRaw puts a terminal into raw mode, so keys are read as they're pressed without being echoed,
+// and returns a function which restores its previous settings.
+func makeRaw(f *os.File) (func(), error) {
+	var old syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, fmt.Errorf("not a terminal: %w", err)
+	}
+	t := old
+	t.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+	t.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctl(f, syscall.TCSETS, unsafe.Pointer(&t)); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(f, syscall.TCSETS, unsafe.Pointer(&old)) }, nil
+}
+
+// terminalSize returns the number of columns and rows of a terminal.
+func terminalSize(f *os.File) (int, int, error) {
+	var size struct{ rows, cols, xPixels, yPixels uint16 }
+	if err := ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(&size)); err != nil {
+		return 0, 0, err
+	}
+	return int(size.cols), int(size.rows), nil
+}
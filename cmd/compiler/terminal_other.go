@@ -0,0 +1,18 @@
+//go:build !(linux && (386 || amd64 || arm || arm64 || riscv64))
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// makeRaw always fails, as the compiler can only set up terminals on Linux.
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("interactive terminals are only supported on Linux")
+}
+
+// terminalSize always fails, as the compiler can only query terminals on Linux.
+func terminalSize(f *os.File) (int, int, error) {
+	return 0, 0, errors.New("interactive terminals are only supported on Linux")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runCheckTiming implements the check-timing subcommand, which compares a logic-analyzer capture of the NMOScillator
+// playing a ROM against the writes the simulator predicts for it, byte by byte and in time. A reference ROM and its
+// capture act as a golden test of the tempo model and the frame encoder against the real hardware: it exits with
+// status 1 if any write differs.
+func runCheckTiming(args []string) {
+	flags := pflag.NewFlagSet("check-timing", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check-timing [flags] song.bin capture.csv\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var songIndex int
+	flags.IntVarP(&songIndex, "song", "s", 0, "The index of the song in the ROM which was captured.")
+	var targetSpec string
+	flags.StringVar(&targetSpec, "target", "nmoscillator", "Built-in target name or path to a JSON target description of the hardware which was captured.")
+	var clockRate float64
+	flags.Float64Var(&clockRate, "clock", 4e6, "The base clock frequency of the hardware, in Hz.")
+	var tolerance float64
+	flags.Float64Var(&tolerance, "tolerance", 64, "The largest difference allowed between when a write was captured and when it's predicted, in microseconds.")
+	var columns nmos.CaptureColumns
+	flags.StringVar(&columns.Time, "time-column", "", "The name of the capture's column with the time of each write in seconds. Defaults to the first column.")
+	flags.StringVar(&columns.Data, "data-column", "", "The name of the capture's column with the byte written. Defaults to the last column.")
+	var maxDiffs int
+	flags.IntVarP(&maxDiffs, "max", "n", 20, "The largest number of differences to list. 0 lists every difference.")
+	parseFlags(flags, args)
+	applyEnvironment(flags)
+
+	if flags.NArg() != 2 {
+		usageError(flags)
+	}
+	if clockRate <= 0 {
+		logger.Fatalf("invalid --clock: must be more than 0, got %g", clockRate)
+	}
+	if tolerance < 0 {
+		logger.Fatalf("invalid --tolerance: must not be negative, got %g", tolerance)
+	}
+	if maxDiffs < 0 {
+		logger.Fatalf("invalid --max: must not be negative, got %d", maxDiffs)
+	}
+	target, err := loadTarget(targetSpec)
+	if err != nil {
+		logger.Fatalf("error loading target %q: %v", targetSpec, err)
+	}
+
+	rom, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		logger.Fatalf("error reading ROM file: %v", err)
+	}
+	songs, err := nmos.Disassemble(rom)
+	if err != nil {
+		logger.Fatalf("error disassembling ROM: %v", err)
+	}
+	if songIndex < 0 || songIndex >= len(songs) {
+		logger.Fatalf("%s has no song %d, it has %d songs", flags.Arg(0), songIndex, len(songs))
+	}
+	predicted, err := songs[songIndex].PredictWrites(target, clockRate)
+	if err != nil {
+		logger.Fatalf("error simulating song %d: %v", songIndex, err)
+	}
+
+	file, err := os.Open(flags.Arg(1))
+	if err != nil {
+		logger.Fatalf("error opening capture: %v", err)
+	}
+	defer file.Close()
+	captured, err := nmos.ReadCapture(file, columns)
+	if err != nil {
+		logger.Fatalf("error reading capture: %v", err)
+	}
+
+	compared := min(len(predicted), len(captured))
+	logger.Printf("Captured %d writes, the simulator predicts %d, comparing the first %d", len(captured), len(predicted), compared)
+	diffs, maxError := nmos.CompareCapture(predicted, captured, tolerance/1e6)
+	logger.Printf("Largest timing error: %.1fµs", maxError*1e6)
+	if len(diffs) == 0 {
+		logger.Printf("Every write matches the simulator")
+		return
+	}
+	for i, d := range diffs {
+		if maxDiffs > 0 && i == maxDiffs {
+			fmt.Printf("... and %d more\n", len(diffs)-maxDiffs)
+			break
+		}
+		fmt.Println(d)
+	}
+	fmt.Printf("%d of %d writes differ\n", len(diffs), compared)
+	os.Exit(1)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+)
+
+// A song shown in the frame viewer.
+type previewSong struct {
+	label   string
+	song    *nmos.NmosSong
+	address int // The address of the song's first frame in the ROM.
+}
+
+// frameViewer is the interactive, scrollable view of a ROM's frames opened by --tui.
+type frameViewer struct {
+	songs   []previewSong
+	current int // Index into songs of the song being shown.
+	hexdump bool
+
+	lines       []string // The listing of the current song, one line per entry.
+	frameStarts []int    // The index into lines of each frame's first line.
+	addresses   []int    // The ROM address of each frame.
+
+	top     int    // The first line shown.
+	search  string // The last text searched for.
+	message string // Shown in the status bar until the next key is pressed.
+
+	out           *bufio.Writer
+	width, height int
+}
+
+const frameViewerHelp = "q quit  j/k scroll  space/b page  [/] frame  L loop target  : frame  @ address  / search  n/N match  x bytes  tab song"
+
+// runFrameViewer shows the songs in an interactive frame viewer until the user quits.
+// It fails if stdin isn't a terminal.
+func runFrameViewer(songs []previewSong) error {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	v := &frameViewer{songs: songs, out: bufio.NewWriter(os.Stdout), message: frameViewerHelp}
+	// Use the terminal's alternate screen, so the log is still there afterwards.
+	v.out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		v.out.WriteString("\x1b[?25h\x1b[?1049l")
+		v.out.Flush()
+	}()
+
+	v.load()
+	keys := bufio.NewReader(os.Stdin)
+	for {
+		v.render()
+		key, err := readKey(keys)
+		if err != nil {
+			return err
+		}
+		v.message = ""
+		if !v.handleKey(key, keys) {
+			return nil
+		}
+	}
+}
+
+// load builds the listing of the current song, keeping the view on the same frame if there is one.
+func (v *frameViewer) load() {
+	frame := 0
+	if len(v.frameStarts) > 0 {
+		frame = v.frameAt(v.top)
+	}
+
+	s := v.songs[v.current]
+	v.addresses = s.song.FrameAddresses(s.address)
+	v.lines = []string{
+		fmt.Sprintf("%s: %q by %q", s.label, s.song.Name, s.song.Author),
+		fmt.Sprintf("Initial tempo %d, %d frames, %d bytes at address %d, loop target frame #%d",
+			s.song.InitialTempo, len(s.song.Frames), s.song.CalculateSize(), s.address, s.song.LoopTarget),
+	}
+	v.frameStarts = make([]int, len(s.song.Frames))
+	for i, listing := range s.song.FrameListings(v.hexdump) {
+		v.lines = append(v.lines, "")
+		v.frameStarts[i] = len(v.lines)
+		lines := strings.Split(strings.TrimSuffix(listing, "\n"), "\n")
+		lines[0] += fmt.Sprintf("  @ %d (0x%04x)", v.addresses[i], v.addresses[i])
+		v.lines = append(v.lines, lines...)
+	}
+
+	v.top = 0
+	if frame < len(v.frameStarts) && frame > 0 {
+		v.top = v.frameStarts[frame]
+	}
+}
+
+// frameAt returns the index of the frame shown on the given line.
+func (v *frameViewer) frameAt(line int) int {
+	return max(sort.SearchInts(v.frameStarts, line+1)-1, 0)
+}
+
+// pageSize returns the number of listing lines which fit on the screen above the status bar.
+func (v *frameViewer) pageSize() int {
+	return max(v.height-1, 1)
+}
+
+// scrollTo moves the view so it starts on the given line, keeping it within the listing.
+func (v *frameViewer) scrollTo(line int) {
+	v.top = max(min(line, len(v.lines)-1), 0)
+}
+
+// render draws the visible part of the listing and the status bar.
+func (v *frameViewer) render() {
+	v.width, v.height = 80, 24
+	if width, height, err := terminalSize(os.Stdout); err == nil && width > 0 && height > 0 {
+		v.width, v.height = width, height
+	}
+
+	v.out.WriteString("\x1b[H\x1b[2J")
+	for i := v.top; i < v.top+v.pageSize() && i < len(v.lines); i++ {
+		line := truncate(v.lines[i], v.width)
+		if v.search != "" && strings.Contains(strings.ToLower(v.lines[i]), strings.ToLower(v.search)) {
+			line = "\x1b[1m" + line + "\x1b[0m"
+		}
+		v.out.WriteString(line + "\r\n")
+	}
+
+	status := v.message
+	if status == "" && len(v.frameStarts) == 0 {
+		status = v.songs[v.current].label + " has no frames"
+	} else if status == "" {
+		s := v.songs[v.current]
+		frame := v.frameAt(v.top)
+		status = fmt.Sprintf("%s | frame #%d of %d | address %d (0x%04x) | line %d of %d | ? for help",
+			s.label, frame, len(v.frameStarts), v.addresses[frame], v.addresses[frame], v.top+1, len(v.lines))
+	}
+	v.drawStatus(status)
+}
+
+// drawStatus draws the status bar on the bottom line of the screen.
+func (v *frameViewer) drawStatus(status string) {
+	fmt.Fprintf(v.out, "\x1b[%d;1H\x1b[7m%-*s\x1b[0m", v.height, v.width, truncate(status, v.width))
+	v.out.Flush()
+}
+
+// handleKey acts on a key press, and returns false if the viewer should close.
+func (v *frameViewer) handleKey(key string, keys *bufio.Reader) bool {
+	frame := v.frameAt(v.top)
+	switch key {
+	case "q", "\x03", "\x1b":
+		return false
+	case "j", "\x1b[B", "\r":
+		v.scrollTo(v.top + 1)
+	case "k", "\x1b[A":
+		v.scrollTo(v.top - 1)
+	case " ", "f", "\x06", "\x1b[6~":
+		v.scrollTo(v.top + v.pageSize())
+	case "b", "\x02", "\x1b[5~":
+		v.scrollTo(v.top - v.pageSize())
+	case "g", "\x1b[H", "\x1b[1~":
+		v.scrollTo(0)
+	case "G", "\x1b[F", "\x1b[4~":
+		v.scrollTo(len(v.lines) - v.pageSize())
+	case "]":
+		if frame+1 < len(v.frameStarts) {
+			v.scrollTo(v.frameStarts[frame+1])
+		}
+	case "[":
+		if len(v.frameStarts) == 0 {
+			break
+		}
+		if v.top > v.frameStarts[frame] || frame == 0 {
+			v.scrollTo(v.frameStarts[frame])
+		} else {
+			v.scrollTo(v.frameStarts[frame-1])
+		}
+	case "L":
+		if target := v.songs[v.current].song.LoopTarget; target >= 0 && target < len(v.frameStarts) {
+			v.scrollTo(v.frameStarts[target])
+		}
+	case ":":
+		input, ok := v.prompt("Go to frame: ", keys)
+		if n, err := strconv.Atoi(input); ok && err == nil && n >= 0 && n < len(v.frameStarts) {
+			v.scrollTo(v.frameStarts[n])
+		} else if ok {
+			v.message = fmt.Sprintf("No frame %q", input)
+		}
+	case "@":
+		input, ok := v.prompt("Go to address: ", keys)
+		address, err := strconv.ParseInt(input, 0, 64)
+		if !ok {
+			break
+		}
+		if err != nil || len(v.addresses) == 0 || int(address) < v.addresses[0] {
+			v.message = fmt.Sprintf("Address %q isn't in %s", input, v.songs[v.current].label)
+			break
+		}
+		v.scrollTo(v.frameStarts[max(sort.SearchInts(v.addresses, int(address)+1)-1, 0)])
+	case "/":
+		if input, ok := v.prompt("Search: ", keys); ok && input != "" {
+			v.search = input
+			v.findMatch(1)
+		}
+	case "n":
+		v.findMatch(1)
+	case "N":
+		v.findMatch(-1)
+	case "x":
+		v.hexdump = !v.hexdump
+		v.load()
+	case "\t", "s":
+		v.current = (v.current + 1) % len(v.songs)
+		v.frameStarts = nil
+		v.load()
+	case "S", "\x1b[Z":
+		v.current = (v.current + len(v.songs) - 1) % len(v.songs)
+		v.frameStarts = nil
+		v.load()
+	case "?", "h":
+		v.message = frameViewerHelp
+	}
+	return true
+}
+
+// findMatch scrolls to the next line after (or before, if direction is -1) the top line which contains the
+// search text, ignoring case.
+func (v *frameViewer) findMatch(direction int) {
+	if v.search == "" {
+		v.message = "Nothing to search for, press / to search"
+		return
+	}
+	search := strings.ToLower(v.search)
+	for i := v.top + direction; i >= 0 && i < len(v.lines); i += direction {
+		if strings.Contains(strings.ToLower(v.lines[i]), search) {
+			v.top = i
+			return
+		}
+	}
+	v.message = fmt.Sprintf("No more matches for %q", v.search)
+}
+
+// prompt reads a line of text typed into the status bar. It returns false if the prompt was cancelled with escape.
+func (v *frameViewer) prompt(label string, keys *bufio.Reader) (string, bool) {
+	var input []rune
+	for {
+		v.drawStatus(label + string(input))
+		key, err := readKey(keys)
+		if err != nil {
+			return "", false
+		}
+		switch {
+		case key == "\r" || key == "\n":
+			return strings.TrimSpace(string(input)), true
+		case key == "\x1b" || key == "\x03":
+			return "", false
+		case key == "\x7f" || key == "\b":
+			if len(input) > 0 {
+				input = input[:len(input)-1]
+			}
+		case !strings.HasPrefix(key, "\x1b") && key >= " ":
+			input = append(input, []rune(key)...)
+		}
+	}
+}
+
+// readKey reads a single key press from a terminal in raw mode, including the whole of escape sequences
+// such as those sent by the arrow keys.
+func readKey(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if b != 0x1b || r.Buffered() == 0 {
+		if b < 0x80 {
+			return string(b), nil
+		}
+		// The start of a multi-byte UTF-8 character.
+		r.UnreadByte()
+		c, _, err := r.ReadRune()
+		return string(c), err
+	}
+
+	// Escape sequences arrive all at once, so anything already buffered belongs to this key.
+	seq := []byte{b}
+	for r.Buffered() > 0 {
+		c, _ := r.ReadByte()
+		seq = append(seq, c)
+		if len(seq) > 2 && (c >= 'A' && c <= 'Z' || c == '~') {
+			break
+		}
+	}
+	return string(seq), nil
+}
+
+// truncate shortens a line to fit in the given number of columns.
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width])
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runUpload implements the upload subcommand, which sends a compiled ROM to the NMOScillator over a serial port,
+// so it can be written to the EEPROM without taking it out and using an EEPROM programmer.
+func runUpload(args []string) {
+	flags := pflag.NewFlagSet("upload", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s upload --port /dev/ttyUSB0 [flags] song.bin\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var portPath string
+	flags.StringVarP(&portPath, "port", "p", "", "The serial port the NMOScillator is connected to.")
+
+	var baud int
+	flags.IntVarP(&baud, "baud", "b", 115200, "The baud rate of the serial port.")
+
+	var timeout time.Duration
+	flags.DurationVar(&timeout, "timeout", time.Second, "How long to wait for the NMOScillator to acknowledge each packet.")
+
+	var retries int
+	flags.IntVar(&retries, "retries", 3, "How many times to resend a packet which isn't acknowledged.")
+
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 || portPath == "" {
+		usageError(flags)
+	}
+	if timeout <= 0 {
+		logger.Fatalf("invalid --timeout: must be more than 0, got %v", timeout)
+	}
+	if retries < 0 {
+		logger.Fatalf("invalid --retries: must not be negative, got %d", retries)
+	}
+
+	rom, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		logger.Fatalf("error reading ROM file: %v", err)
+	}
+	body, _, _, err := nmos.VerifySignature(rom)
+	if err != nil {
+		logger.Fatalf("refusing to upload a changed ROM: %v", err)
+	}
+	if _, _, _, err := nmos.VerifyChecksum(body); err != nil {
+		logger.Fatalf("refusing to upload a corrupted ROM: %v", err)
+	}
+
+	port, err := openSerialPort(portPath, baud)
+	if err != nil {
+		logger.Fatalf("error opening serial port: %v", err)
+	}
+	defer port.Close()
+
+	logger.Printf("uploading %d bytes to %s", len(rom), portPath)
+	start := time.Now()
+	lastPercent := -1
+	err = nmos.Upload(port, rom, nmos.UploadOptions{
+		Timeout: timeout,
+		Retries: retries,
+		Progress: func(sent, total int) {
+			// Only log every 10%, as large ROMs are sent in thousands of packets.
+			if percent := sent * 100 / total; percent/10 != lastPercent/10 {
+				lastPercent = percent
+				logger.Printf("sent %d/%d bytes (%d%%)", sent, total, percent)
+			}
+		},
+	})
+	if err != nil {
+		logger.Fatalf("upload failed: %v", err)
+	}
+	logger.Printf("upload finished in %v", time.Since(start).Round(time.Millisecond))
+}
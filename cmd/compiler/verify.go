@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/spf13/pflag"
+)
+
+// runVerify implements the verify subcommand, which checks that the contents of a device's EEPROM match a ROM file.
+// The EEPROM can be read back through the NMOScillator over the serial upload protocol, or dumped to a file using an
+// EEPROM programmer. Without either, it checks the ROM's own checksums instead.
+func runVerify(args []string) {
+	flags := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [--readback dump.bin | --port /dev/ttyUSB0] song.bin\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var readbackPath string
+	flags.StringVarP(&readbackPath, "readback", "r", "", "Path to a dump of the EEPROM contents, read back using an EEPROM programmer. If neither this nor --port is given, the checksums stored in the ROM are checked instead.")
+
+	var portPath string
+	flags.StringVarP(&portPath, "port", "p", "", "The serial port the NMOScillator is connected to, to read the EEPROM contents back through it.")
+
+	var baud int
+	flags.IntVarP(&baud, "baud", "b", 115200, "The baud rate of the serial port.")
+
+	var timeout time.Duration
+	flags.DurationVar(&timeout, "timeout", time.Second, "How long to wait for the NMOScillator to answer each read packet.")
+
+	var retries int
+	flags.IntVar(&retries, "retries", 3, "How many times to resend a read packet which isn't answered correctly.")
+
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		usageError(flags)
+	}
+	if readbackPath != "" && portPath != "" {
+		logger.Fatalf("cannot use --readback with --port")
+	}
+	if timeout <= 0 {
+		logger.Fatalf("invalid --timeout: must be more than 0, got %v", timeout)
+	}
+	if retries < 0 {
+		logger.Fatalf("invalid --retries: must not be negative, got %d", retries)
+	}
+
+	rom, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		logger.Fatalf("error reading ROM file: %v", err)
+	}
+
+	var readback []byte
+	switch {
+	case portPath != "":
+		readback = readBackRom(portPath, baud, len(rom), nmos.UploadOptions{Timeout: timeout, Retries: retries})
+	case readbackPath != "":
+		readback, err = os.ReadFile(readbackPath)
+		if err != nil {
+			logger.Fatalf("error reading EEPROM dump: %v", err)
+		}
+	default:
+		verifyChecksums(rom)
+		return
+	}
+
+	if len(readback) < len(rom) {
+		logger.Fatalf("EEPROM dump is %d bytes, but the ROM is %d bytes long", len(readback), len(rom))
+	}
+	if len(readback) > len(rom) {
+		// EEPROMs are usually larger than the ROMs written to them, so only compare the part which was written.
+		logger.Printf("EEPROM dump is %d bytes, only comparing the first %d bytes", len(readback), len(rom))
+		readback = readback[:len(rom)]
+	}
+
+	romHash := sha256.Sum256(rom)
+	readbackHash := sha256.Sum256(readback)
+	logger.Printf("ROM SHA-256:    %x", romHash)
+	logger.Printf("EEPROM SHA-256: %x", readbackHash)
+
+	if romHash != readbackHash {
+		mismatches := 0
+		for i := range rom {
+			if rom[i] != readback[i] {
+				if mismatches == 0 {
+					logger.Printf("first mismatch at address %d: expected 0x%02x, got 0x%02x", i, rom[i], readback[i])
+				}
+				mismatches++
+			}
+		}
+		logger.Printf("%d bytes differ", mismatches)
+		os.Exit(1)
+	}
+	logger.Printf("EEPROM contents match the ROM")
+}
+
+// readBackRom reads the first length bytes of the EEPROM back through the NMOScillator connected to the serial port.
+func readBackRom(portPath string, baud int, length int, opts nmos.UploadOptions) []byte {
+	port, err := openSerialPort(portPath, baud)
+	if err != nil {
+		logger.Fatalf("error opening serial port: %v", err)
+	}
+	defer port.Close()
+
+	logger.Printf("reading %d bytes back from %s", length, portPath)
+	lastPercent := -1
+	opts.Progress = func(read, total int) {
+		// Only log every 10%, like upload.
+		if percent := read * 100 / total; percent/10 != lastPercent/10 {
+			lastPercent = percent
+			logger.Printf("read %d/%d bytes (%d%%)", read, total, percent)
+		}
+	}
+	readback, err := nmos.ReadBack(port, length, opts)
+	if err != nil {
+		logger.Fatalf("reading the EEPROM back failed: %v", err)
+	}
+	return readback
+}
+
+// verifyChecksums checks the signature footer, checksum footer and metadata block checksum of a ROM, and exits
+// with status 1 if any don't match. It fails if the ROM has none of them.
+func verifyChecksums(rom []byte) {
+	rom, key, hasSignature, err := nmos.VerifySignature(rom)
+	if err != nil {
+		logger.Printf("signature footer doesn't match: %v", err)
+		os.Exit(1)
+	}
+	if hasSignature {
+		logger.Printf("signature footer matches, signed with key %x (use verify-signature to check who signed it)", []byte(key))
+	}
+
+	body, checksumType, hasChecksum, err := nmos.VerifyChecksum(rom)
+	if err != nil {
+		logger.Printf("checksum footer doesn't match: %v", err)
+		os.Exit(1)
+	}
+	if hasChecksum {
+		logger.Printf("%v checksum footer matches", checksumType)
+	}
+
+	_, _, hasMetadata, err := nmos.ReadMetadata(body)
+	if err != nil {
+		logger.Printf("metadata block doesn't match: %v", err)
+		os.Exit(1)
+	}
+	if hasMetadata {
+		logger.Printf("metadata block checksum matches")
+	}
+
+	if !hasSignature && !hasChecksum && !hasMetadata {
+		logger.Fatalf("ROM has no checksum to verify, compile it with --checksum or --embed-metadata, or pass --readback to compare it with an EEPROM dump")
+	}
+}
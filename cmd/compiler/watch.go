@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+)
+
+// compileChildEnv is set in the environment of the compiles started by --watch and --events,
+// so they compile once and exit.
+const compileChildEnv = "NMOSCC_COMPILE_CHILD"
+
+// A file watched by --watch, and what it looked like when it was last checked.
+type watchedFile struct {
+	path    string
+	kind    string // What the file is used for, such as "input" or "target".
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+// check updates the file's state, and reports whether it changed since it was last checked.
+func (f *watchedFile) check() bool {
+	info, err := os.Stat(f.path)
+	exists := err == nil
+	var modTime time.Time
+	var size int64
+	if exists {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	changed := exists != f.exists || !modTime.Equal(f.modTime) || size != f.size
+	f.modTime, f.size, f.exists = modTime, size, exists
+	return changed
+}
+
+// runWatch compiles the song with the same arguments every time the input file or a target description changes,
+// and never returns. Each compile runs in a new process, so target descriptions are read again every time,
+// and a failed compile doesn't stop the watcher.
+func runWatch(inputPath string, targetSpecs []string, interval time.Duration) {
+	files := []*watchedFile{{path: inputPath, kind: "input"}}
+	for _, spec := range targetSpecs {
+		if _, ok := nmos.BuiltinTargets[strings.ToLower(spec)]; !ok {
+			files = append(files, &watchedFile{path: spec, kind: "target"})
+		}
+	}
+	for _, f := range files {
+		f.check()
+	}
+
+	for {
+		logger.Printf("Compiling %s", inputPath)
+		exitStatus := runCompileChild()
+		switch exitStatus {
+		case exitSuccess:
+			logger.Printf("Compiled successfully, watching for changes")
+		case exitWarnings:
+			logger.Printf("Compiled with warnings, watching for changes")
+		default:
+			logger.Printf("Compile failed with exit status %d, watching for changes", exitStatus)
+		}
+		if eventStream {
+			emitDone(exitStatus)
+		}
+
+		for changed := false; !changed; {
+			time.Sleep(interval)
+			for _, f := range files {
+				if !f.check() {
+					continue
+				}
+				changed = true
+				switch {
+				case !f.exists:
+					logger.Printf("%s file %s was removed", f.kind, f.path)
+				case f.kind == "target":
+					logger.Printf("Target file %s changed, it will be reloaded", f.path)
+				default:
+					logger.Printf("%s changed", f.path)
+				}
+			}
+		}
+	}
+}
+
+// runCompileChild compiles the song in a new process with the same arguments, and returns its exit status.
+func runCompileChild() int {
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Fatalf("error finding the compiler to run: %v", err)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), compileChildEnv+"=1")
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		logger.Fatalf("error running the compiler: %v", err)
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+// Package diag describes problems found while parsing and converting songs, in a form which can be
+// shown to people or read by editors and CI tools.
+package diag
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is how serious a diagnostic is.
+type Severity string
+
+const (
+	// The problem stopped the song from being compiled.
+	SeverityError Severity = "error"
+	// The song was compiled, but may not sound the way it was written.
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a single problem found in a song.
+type Diagnostic struct {
+	Code     string   `json:"code"` // A short, stable name for the kind of problem, such as "unsupported-effect".
+	Severity Severity `json:"severity"`
+
+	// The position of the problem in the input file, counting from 1. Zero if it isn't known.
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+
+	// The subsong and row of the problem, for problems found after parsing. Nil if they don't apply.
+	Subsong *int `json:"subsong,omitempty"`
+	Row     *int `json:"row,omitempty"`
+
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"` // How the problem could be fixed, if there's an obvious way.
+}
+
+// Warningf returns a warning with the given code and message.
+func Warningf(code string, format string, args ...any) Diagnostic {
+	return Diagnostic{Code: code, Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)}
+}
+
+// Errorf returns an error with the given code and message.
+func Errorf(code string, format string, args ...any) Diagnostic {
+	return Diagnostic{Code: code, Severity: SeverityError, Message: fmt.Sprintf(format, args...)}
+}
+
+// Suggest returns the diagnostic with a suggestion for fixing it.
+func (d Diagnostic) Suggest(suggestion string) Diagnostic {
+	d.Suggestion = suggestion
+	return d
+}
+
+// AtRow returns the diagnostic placed at a row of a subsong. A negative row leaves the row unset.
+func (d Diagnostic) AtRow(subsong int, row int) Diagnostic {
+	d.Subsong = &subsong
+	if row >= 0 {
+		d.Row = &row
+	}
+	return d
+}
+
+// String formats the diagnostic for people, starting with its position.
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	switch {
+	case d.Line > 0 && d.Column > 0:
+		fmt.Fprintf(&b, "line %d, column %d: ", d.Line, d.Column)
+	case d.Line > 0:
+		fmt.Fprintf(&b, "line %d: ", d.Line)
+	}
+	if d.Subsong != nil {
+		fmt.Fprintf(&b, "subsong %d: ", *d.Subsong)
+	}
+	if d.Row != nil {
+		fmt.Fprintf(&b, "row %d: ", *d.Row)
+	}
+	b.WriteString(d.Message)
+	if d.Suggestion != "" {
+		fmt.Fprintf(&b, " (%s)", d.Suggestion)
+	}
+	return b.String()
+}
+
+// Error lets diagnostics be returned as errors, so callers can recover their position with errors.As.
+func (d Diagnostic) Error() string {
+	return d.String()
+}
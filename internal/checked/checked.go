@@ -0,0 +1,52 @@
+// Package checked converts between numeric types without silently truncating values which don't fit.
+package checked
+
+import (
+	"fmt"
+	"math"
+)
+
+// Integer is any integer type.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// Unsigned is any unsigned integer type.
+type Unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// RangeError is returned when a value doesn't fit in the type it's being converted to.
+type RangeError struct {
+	Value any    // The value which was being converted.
+	Type  string // The name of the type it was being converted to.
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%v doesn't fit in a %s", e.Value, e.Type)
+}
+
+// Narrow converts v to the integer type T, returning a *RangeError if the value would change.
+func Narrow[T Integer, V Integer](v V) (T, error) {
+	t := T(v)
+	if V(t) != v || (t < 0) != (v < 0) {
+		return t, &RangeError{Value: v, Type: fmt.Sprintf("%T", t)}
+	}
+	return t, nil
+}
+
+// Saturate converts f to the unsigned integer type T, truncating its fractional part.
+// Values outside T's range become the closest value which fits, and NaN becomes 0.
+// ok reports whether f was in range.
+func Saturate[T Unsigned](f float64) (t T, ok bool) {
+	maximum := ^T(0)
+	switch {
+	case math.IsNaN(f) || f < 0:
+		return 0, false
+	case f >= float64(maximum):
+		// Conversions of the maximum to float64 may round up, so the maximum itself is handled here too.
+		return maximum, f < float64(maximum)+1
+	default:
+		return T(f), true
+	}
+}
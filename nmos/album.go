@@ -0,0 +1,95 @@
+package nmos
+
+import "math"
+
+// The largest number of Frame Clock cycles a single frame can last for.
+const maxFrameCycles = 256
+
+// frameClockRate returns the number of Frame Clock cycles per second at the given tempo.
+func frameClockRate(tempo uint8) float64 {
+	return effectiveTickRate(tempo, 0)
+}
+
+// AddGap inserts silent frames lasting about the given number of seconds at the start of the song,
+// so there's a pause before the song starts when it follows another song in an album.
+// The gap is timed using the song's initial tempo.
+func (s *NmosSong) AddGap(seconds float64) {
+	cycles := int(math.Round(seconds * frameClockRate(s.InitialTempo)))
+	if cycles <= 0 {
+		return
+	}
+
+	var gap []Frame
+	for cycles > 0 {
+		n := min(cycles, maxFrameCycles)
+		gap = append(gap, Frame{FrameDelay: uint8(n - 1)})
+		cycles -= n
+	}
+	// The previous song may have left channels playing.
+	for c := range uint8(4) {
+		gap[0].SetAttenuation(c, maxAttenuation)
+	}
+
+	s.Frames = append(gap, s.Frames...)
+	s.LoopTarget += len(gap)
+}
+
+// AddLeadIn fades the song in over the given number of seconds, like the lead-in of a track on a record.
+//
+// Every channel starts fully attenuated, and the extra attenuation is reduced in even steps until the song
+// plays at its normal volume. The steps happen at frame boundaries, so frames with long delays make the
+// fade coarser. The looped part of the song has to sound the same every time it's played, so the fade
+// is cut short at the loop target; AddLeadIn reports whether that happened.
+func (s *NmosSong) AddLeadIn(seconds float64) (cutShort bool) {
+	if seconds <= 0 {
+		return false
+	}
+
+	// The attenuation of each channel in the original song, and the attenuation actually written to the chip.
+	var actual, written [4]uint8
+	for c := range actual {
+		actual[c], written[c] = maxAttenuation, maxAttenuation
+	}
+
+	tempo := s.InitialTempo
+	elapsed := 0.0
+	for i := range s.Frames {
+		frame := &s.Frames[i]
+		if frame.LoopToTarget {
+			break
+		}
+		if frame.hasTempoChange {
+			tempo = frame.tempo
+		}
+
+		offset := uint8(0)
+		if elapsed < seconds {
+			offset = uint8(math.Ceil(maxAttenuation * (1 - elapsed/seconds)))
+		}
+		if i == s.LoopTarget && offset > 0 {
+			// Restore the normal volume here, so the looped part isn't faded.
+			offset = 0
+			cutShort = true
+		}
+
+		for _, c := range frame.commands {
+			if c.commandType == SetAttenuationCommand {
+				actual[c.channel] = c.attenuation
+			}
+		}
+		for c := range uint8(4) {
+			attenuation := min(maxAttenuation, actual[c]+offset)
+			if attenuation != written[c] || frame.commandAlreadyExists(SetAttenuationCommand, c) {
+				frame.ReplaceAttenuation(c, attenuation)
+				written[c] = attenuation
+			}
+		}
+
+		if offset == 0 {
+			break
+		}
+		elapsed += float64(int(frame.FrameDelay)+1) / frameClockRate(tempo)
+	}
+
+	return cutShort
+}
@@ -0,0 +1,69 @@
+package nmos
+
+import "fmt"
+
+// A part of a ROM which is stored in its own bank.
+type Bank struct {
+	Start int   // Address of the bank's first byte in the ROM.
+	End   int   // Address after the bank's last byte in the ROM.
+	Songs []int // Indices of the songs with at least one frame in the bank.
+}
+
+func (b Bank) Size() int {
+	return b.End - b.Start
+}
+
+// SplitBanks splits a ROM built by BuildRom into banks of at most bankSize bytes. Banks are only split
+// at frame boundaries, and the directory of an indexed ROM is kept in a single bank.
+// offsets are the addresses of each song in the ROM, as returned by BuildRom.
+func SplitBanks(romSize int, songs []*NmosSong, offsets []int, bankSize int) ([]Bank, error) {
+	if bankSize <= 0 {
+		return nil, fmt.Errorf("bank size must be more than 0, got %d", bankSize)
+	}
+	if len(songs) != len(offsets) {
+		return nil, fmt.Errorf("got %d offsets for %d songs", len(offsets), len(songs))
+	}
+
+	// Addresses which a bank can end at.
+	var boundaries []int
+	for i, song := range songs {
+		address := offsets[i]
+		for _, size := range song.frameSizes() {
+			boundaries = append(boundaries, address)
+			address += size
+		}
+	}
+	boundaries = append(boundaries, romSize)
+
+	var banks []Bank
+	start, last := 0, 0 // The start of the current bank, and the last boundary which fits in it.
+	for _, boundary := range boundaries {
+		if boundary-start > bankSize {
+			if last <= start {
+				return nil, fmt.Errorf("%d bytes at address %d can't be split to fit in a bank of %d bytes", boundary-start, start, bankSize)
+			}
+			banks = append(banks, Bank{Start: start, End: last})
+			start = last
+			if boundary-start > bankSize {
+				return nil, fmt.Errorf("%d bytes at address %d can't be split to fit in a bank of %d bytes", boundary-start, start, bankSize)
+			}
+		}
+		last = boundary
+	}
+	if romSize > start {
+		banks = append(banks, Bank{Start: start, End: romSize})
+	}
+
+	for b := range banks {
+		for i := range songs {
+			end := romSize
+			if i+1 < len(offsets) {
+				end = offsets[i+1]
+			}
+			if offsets[i] < banks[b].End && end > banks[b].Start {
+				banks[b].Songs = append(banks[b].Songs, i)
+			}
+		}
+	}
+	return banks, nil
+}
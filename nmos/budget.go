@@ -0,0 +1,45 @@
+package nmos
+
+import "fmt"
+
+// A frame which is estimated to take longer than a single tick to process on the target hardware.
+// Frames like this make the song stutter, as the next tick arrives before the frame is finished.
+type BudgetWarning struct {
+	Frame  int // Index of the frame.
+	Cycles int // Estimated number of cycles needed to process the frame.
+	Budget int // Number of cycles available in a single tick.
+}
+
+func (w BudgetWarning) String() string {
+	return fmt.Sprintf("frame %d needs about %d cycles to process, but only %d are available in one tick", w.Frame, w.Cycles, w.Budget)
+}
+
+// Cost estimates the number of cycles needed to process the frame on the given target.
+func (f *Frame) Cost(t Target) int {
+	return f.CalculateSize()*t.CyclesPerByte + f.chipWrites()*t.CyclesPerChipWrite
+}
+
+// CheckBudget returns a warning for every frame in the song which is too dense to be processed
+// within a single tick on the given target.
+func (s *NmosSong) CheckBudget(t Target) []BudgetWarning {
+	var warnings []BudgetWarning
+
+	tempo := s.InitialTempo
+	for i, frame := range s.Frames {
+		if i == 0 {
+			// The initial tempo is written to the first frame when compiling, so account for it here too.
+			frame.SetNewTempo(s.InitialTempo)
+		}
+		if frame.hasTempoChange {
+			tempo = frame.tempo
+		}
+
+		cost := frame.Cost(t)
+		budget := t.tickCycles(tempo)
+		if cost > budget {
+			warnings = append(warnings, BudgetWarning{Frame: i, Cycles: cost, Budget: budget})
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,112 @@
+package nmos
+
+import "fmt"
+
+// A single SN76489 command in a frame. Only the fields used by its Type are set.
+type Command struct {
+	Type        CommandType
+	Channel     uint8     // For SetSquarePeriodCommand and SetAttenuationCommand.
+	Period      uint16    // For SetSquarePeriodCommand.
+	Attenuation uint8     // For SetAttenuationCommand.
+	NoiseMode   NoiseMode // For SetNoiseControlCommand.
+	NoiseRate   NoiseRate // For SetNoiseControlCommand.
+}
+
+// NewFrame returns a frame with no commands, which lasts the given number of Frame Clock cycles after the first.
+// Commands are added with its Set methods, which check each value and stop a register being set twice.
+func NewFrame(frameDelay uint8) Frame {
+	return Frame{FrameDelay: frameDelay}
+}
+
+// Commands returns a copy of the frame's SN76489 commands, in the order they're written to the chip.
+func (f *Frame) Commands() []Command {
+	commands := make([]Command, len(f.commands))
+	for i, c := range f.commands {
+		commands[i] = Command{Type: c.commandType, Channel: c.channel}
+		switch c.commandType {
+		case SetSquarePeriodCommand:
+			commands[i].Period = c.period
+		case SetAttenuationCommand:
+			commands[i].Attenuation = c.attenuation
+		case SetNoiseControlCommand:
+			commands[i].NoiseMode = c.noiseMode
+			commands[i].NoiseRate = c.noiseRate
+		}
+	}
+	return commands
+}
+
+// Tempo returns the tempo the frame changes to, and false if it doesn't change the tempo.
+func (f *Frame) Tempo() (uint8, bool) {
+	return f.tempo, f.hasTempoChange
+}
+
+// Stereo returns the value the frame writes to the stereo control register, and false if it doesn't write to it.
+func (f *Frame) Stereo() (uint8, bool) {
+	return f.stereo, f.hasStereo
+}
+
+// NewSong returns an empty song which starts at the given tempo, for building songs frame by frame
+// without a source file. Frames are added with AppendFrame, and the song is finished with Loop or Halt.
+func NewSong(name string, author string, initialTempo uint8) (*NmosSong, error) {
+	if initialTempo > maxTempo {
+		return nil, fmt.Errorf("tempo must be 0-%d, got %d", maxTempo, initialTempo)
+	}
+	return &NmosSong{Name: name, Author: author, InitialTempo: initialTempo}, nil
+}
+
+// ended reports whether the song's last frame loops back to the loop target, so nothing can be played after it.
+func (s *NmosSong) ended() bool {
+	return len(s.Frames) > 0 && s.Frames[len(s.Frames)-1].LoopToTarget
+}
+
+// AppendFrame adds a frame to the end of the song, and returns its index.
+// Frames can't be added once the song has been finished, and frames which loop are added by Loop and Halt instead.
+func (s *NmosSong) AppendFrame(frame Frame) (int, error) {
+	if s.ended() {
+		return 0, fmt.Errorf("song has already been finished")
+	}
+	if frame.LoopToTarget {
+		return 0, fmt.Errorf("frames which loop to the loop target are added by Loop or Halt")
+	}
+	s.Frames = append(s.Frames, frame.Clone())
+	return len(s.Frames) - 1, nil
+}
+
+// MarkLoopTarget makes the next frame added to the song its loop target.
+func (s *NmosSong) MarkLoopTarget() error {
+	if s.ended() {
+		return fmt.Errorf("song has already been finished")
+	}
+	s.LoopTarget = len(s.Frames)
+	return nil
+}
+
+// Loop finishes the song by looping back to its loop target, which is the first frame unless
+// MarkLoopTarget was called.
+func (s *NmosSong) Loop() error {
+	if s.ended() {
+		return fmt.Errorf("song has already been finished")
+	}
+	s.Frames = append(s.Frames, Frame{LoopToTarget: true})
+	if err := s.ValidateLoopTarget(); err != nil {
+		s.Frames = s.Frames[:len(s.Frames)-1]
+		return fmt.Errorf("invalid loop target: %w", err)
+	}
+	return nil
+}
+
+// Halt finishes the song by silencing every channel forever, as the NMOScillator has no way to stop playing.
+// This replaces any loop target set by MarkLoopTarget.
+func (s *NmosSong) Halt() error {
+	if s.ended() {
+		return fmt.Errorf("song has already been finished")
+	}
+	silence := Frame{}
+	for c := range uint8(4) {
+		silence.SetAttenuation(c, maxAttenuation)
+	}
+	s.LoopTarget = len(s.Frames)
+	s.Frames = append(s.Frames, silence, Frame{LoopToTarget: true})
+	return nil
+}
@@ -0,0 +1,194 @@
+package nmos
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A byte written to the SN76489, as predicted by PredictWrites or captured from the hardware by ReadCapture.
+type ChipWrite struct {
+	Time  float64 // Seconds since the first write.
+	Value byte
+	Frame int // Index of the frame the byte belongs to, or -1 for captured writes.
+}
+
+// PredictWrites returns every byte the NMOScillator writes to the SN76489 while playing the song through to the end
+// and then through its loop once more, like Simulate, along with when each is written. Frames are compiled like
+// Compile does, so the dummy commands which pad frames out to a tempo change are included, as the hardware writes
+// them too. clockRate is the base clock frequency in Hz (usually 4 MHz).
+//
+// The timing follows the model in ROM_FORMAT.md: each frame starts on a cycle of the Frame Clock, its bytes are read
+// one every target.CyclesPerByte cycles of the base clock after its header, and the next frame starts
+// FrameDelay + 1 Frame Clock cycles later, at the tempo the frame sets. Times are counted from the first write.
+func (s *NmosSong) PredictWrites(target Target, clockRate float64) ([]ChipWrite, error) {
+	if err := s.ValidateLoopTarget(); err != nil {
+		return nil, fmt.Errorf("invalid loop target: %w", err)
+	}
+	rom, err := s.Compile()
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]int, len(s.Frames))
+	address := 0
+	for i, size := range s.frameSizes() {
+		addresses[i] = address
+		address += size
+	}
+
+	var writes []ChipWrite
+	tempo := s.InitialTempo
+	cycle := 0 // Base clock cycles since the start of the song.
+	play := func(from int) {
+		for i := from; i < len(s.Frames); i++ {
+			frame := s.Frames[i]
+			if frame.LoopToTarget {
+				return
+			}
+			commandCount := int(rom[addresses[i]] & 0x0f)
+			for b := range commandCount {
+				index := commandCount - b
+				if index < firstChipCommandIndex || index > lastChipCommandIndex {
+					continue
+				}
+				writes = append(writes, ChipWrite{
+					Time:  float64(cycle+(b+1)*target.CyclesPerByte) / clockRate,
+					Value: rom[addresses[i]+1+b],
+					Frame: i,
+				})
+			}
+			if frame.hasTempoChange {
+				tempo = frame.tempo
+			}
+			cycle += (int(frame.FrameDelay) + 1) * 128 * (int(tempo) + 129)
+		}
+	}
+	play(0)
+	play(s.LoopTarget)
+
+	if len(writes) > 0 {
+		start := writes[0].Time
+		for i := range writes {
+			writes[i].Time -= start
+		}
+	}
+	return writes, nil
+}
+
+// The columns of a logic-analyzer capture read by ReadCapture.
+type CaptureColumns struct {
+	Time string // Name of the column with the time of each write in seconds. If "", the first column is used.
+	Data string // Name of the column with the byte written. If "", the last column is used.
+}
+
+// ReadCapture reads the writes to the SN76489 recorded by a logic analyzer, exported as CSV with a header row.
+// Each row is a single write, with its time in seconds and the byte on the data bus as a decimal number or as hex
+// starting with "0x". Rows without data are skipped, so captures can include other events. Times are counted from
+// the first write.
+func ReadCapture(r io.Reader, columns CaptureColumns) ([]ChipWrite, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("capture is empty")
+		}
+		return nil, err
+	}
+
+	findColumn := func(name string, fallback int) (int, error) {
+		if name == "" {
+			return fallback, nil
+		}
+		for i, column := range header {
+			if strings.EqualFold(strings.TrimSpace(column), name) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("capture has no column %q, its columns are %s", name, strings.Join(header, ", "))
+	}
+	timeColumn, err := findColumn(columns.Time, 0)
+	if err != nil {
+		return nil, err
+	}
+	dataColumn, err := findColumn(columns.Data, len(header)-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var writes []ChipWrite
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if dataColumn >= len(record) || strings.TrimSpace(record[dataColumn]) == "" {
+			continue
+		}
+		if timeColumn >= len(record) {
+			return nil, fmt.Errorf("line %d: missing time", line)
+		}
+		t, err := strconv.ParseFloat(strings.TrimSpace(record[timeColumn]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid time: %w", line, err)
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(record[dataColumn]), 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid data: %w", line, err)
+		}
+		writes = append(writes, ChipWrite{Time: t, Value: byte(value), Frame: -1})
+	}
+	if len(writes) == 0 {
+		return nil, fmt.Errorf("capture has no writes")
+	}
+
+	start := writes[0].Time
+	for i := range writes {
+		writes[i].Time -= start
+	}
+	return writes, nil
+}
+
+// A write in a capture which doesn't match the simulator's prediction, found by CompareCapture.
+type CaptureDifference struct {
+	Index     int // Index of the write, counted from the first write of the song.
+	Predicted ChipWrite
+	Captured  ChipWrite
+	Reason    string // Describes how the writes differ.
+}
+
+func (d CaptureDifference) String() string {
+	return fmt.Sprintf("write %d: %s", d.Index, d.Reason)
+}
+
+// CompareCapture compares the writes captured from the hardware against those predicted by PredictWrites, in order.
+// A write differs if its byte differs, or if it happens more than tolerance seconds away from when it's predicted.
+// Writes are only compared up to the end of the shorter list, so a capture can stop partway through the song, or
+// run on past the end of the prediction. It also returns the largest timing error of any write compared, in seconds.
+func CompareCapture(predicted, captured []ChipWrite, tolerance float64) ([]CaptureDifference, float64) {
+	var diffs []CaptureDifference
+	maxError := 0.0
+	for i := range min(len(predicted), len(captured)) {
+		p, c := predicted[i], captured[i]
+		timingError := c.Time - p.Time
+		maxError = max(maxError, math.Abs(timingError))
+		switch {
+		case p.Value != c.Value:
+			diffs = append(diffs, CaptureDifference{Index: i, Predicted: p, Captured: c,
+				Reason: fmt.Sprintf("wrote 0x%02x at %.6fs, expected 0x%02x (frame #%d)", c.Value, c.Time, p.Value, p.Frame)})
+		case math.Abs(timingError) > tolerance:
+			diffs = append(diffs, CaptureDifference{Index: i, Predicted: p, Captured: c,
+				Reason: fmt.Sprintf("wrote 0x%02x at %.6fs, expected at %.6fs (frame #%d), %+.1fµs off", c.Value, c.Time, p.Time, p.Frame, timingError*1e6)})
+		}
+	}
+	return diffs, maxError
+}
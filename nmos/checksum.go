@@ -0,0 +1,92 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// ChecksumType selects how the checksum in a ROM's checksum footer is calculated.
+type ChecksumType byte
+
+const (
+	ChecksumCRC32 ChecksumType = 1 // CRC-32 (IEEE), as used by zip and PNG.
+	ChecksumSum   ChecksumType = 2 // The sum of every byte, which is cheap to check on the NMOScillator itself.
+)
+
+func (t ChecksumType) String() string {
+	switch t {
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumSum:
+		return "sum"
+	default:
+		return fmt.Sprintf("ChecksumType(%d)", int(t))
+	}
+}
+
+// ParseChecksumType returns the ChecksumType with the given name.
+func ParseChecksumType(name string) (ChecksumType, error) {
+	switch name {
+	case "crc32":
+		return ChecksumCRC32, nil
+	case "sum":
+		return ChecksumSum, nil
+	default:
+		return 0, fmt.Errorf("unknown checksum %q, expected crc32 or sum", name)
+	}
+}
+
+const (
+	checksumFooter     = "NMCK"                      // Magic bytes at the very end of the ROM.
+	checksumFooterSize = 4 + 1 + len(checksumFooter) // Checksum, type and magic bytes.
+)
+
+// checksum calculates a checksum of data.
+func (t ChecksumType) checksum(data []byte) (uint32, error) {
+	switch t {
+	case ChecksumCRC32:
+		return crc32.ChecksumIEEE(data), nil
+	case ChecksumSum:
+		var sum uint32
+		for _, b := range data {
+			sum += uint32(b)
+		}
+		return sum, nil
+	default:
+		return 0, fmt.Errorf("unknown checksum type %d", byte(t))
+	}
+}
+
+// AppendChecksum adds a footer to the end of a ROM with a checksum of every byte before it, so corrupted copies
+// of the ROM can be found. It should be added after anything else, such as the metadata block (see AppendMetadata).
+func AppendChecksum(rom []byte, t ChecksumType) ([]byte, error) {
+	sum, err := t.checksum(rom)
+	if err != nil {
+		return nil, err
+	}
+	out := binary.LittleEndian.AppendUint32(bytes.Clone(rom), sum)
+	out = append(out, byte(t))
+	return append(out, checksumFooter...), nil
+}
+
+// VerifyChecksum checks the checksum footer at the end of a ROM, and returns the ROM without it and the type
+// of checksum used. If the ROM has no checksum footer, it returns the whole ROM and false.
+func VerifyChecksum(rom []byte) ([]byte, ChecksumType, bool, error) {
+	if len(rom) < checksumFooterSize || !bytes.HasSuffix(rom, []byte(checksumFooter)) {
+		return rom, 0, false, nil
+	}
+	body := rom[:len(rom)-checksumFooterSize]
+	footer := rom[len(body):]
+	t := ChecksumType(footer[4])
+
+	sum, err := t.checksum(body)
+	if err != nil {
+		return nil, t, true, err
+	}
+	if expected := binary.LittleEndian.Uint32(footer[0:4]); sum != expected {
+		return nil, t, true, fmt.Errorf("ROM %v checksum is 0x%08x, but the footer expects 0x%08x", t, sum, expected)
+	}
+	return body, t, true, nil
+}
@@ -0,0 +1,153 @@
+package nmos
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/internal/checked"
+)
+
+// ChipVariant describes the differences between revisions of the SN76489 family of sound chips
+// which affect how periods should be calculated.
+type ChipVariant struct {
+	Name string
+
+	// The internal divider applied to the input clock. Most variants divide the clock by 8,
+	// but some (like the SN76494 and SN94624) have no divider and expect a slower clock instead.
+	Prescaler int
+	// The length of the noise shift register, which determines the pitch of periodic noise.
+	NoiseLFSRBits int
+	// If true, a period of 0 behaves like a period of 1024 (the lowest note) instead of 1 (the highest note).
+	ZeroPeriodIsLowest bool
+}
+
+// ChipVariants contains every supported SN76489 variant, keyed by name.
+var ChipVariants = map[string]ChipVariant{
+	"sn76489":  {Name: "sn76489", Prescaler: 8, NoiseLFSRBits: 15, ZeroPeriodIsLowest: true},
+	"sn76489a": {Name: "sn76489a", Prescaler: 8, NoiseLFSRBits: 17, ZeroPeriodIsLowest: true},
+	"sn76494":  {Name: "sn76494", Prescaler: 1, NoiseLFSRBits: 17, ZeroPeriodIsLowest: true},
+	"sn76496":  {Name: "sn76496", Prescaler: 8, NoiseLFSRBits: 17, ZeroPeriodIsLowest: true},
+	"sn94624":  {Name: "sn94624", Prescaler: 1, NoiseLFSRBits: 15, ZeroPeriodIsLowest: true},
+	"ncr8496":  {Name: "ncr8496", Prescaler: 8, NoiseLFSRBits: 16, ZeroPeriodIsLowest: true},
+	"segapsg":  {Name: "segapsg", Prescaler: 8, NoiseLFSRBits: 16, ZeroPeriodIsLowest: false},
+}
+
+// DefaultChipVariant is the variant assumed when none is given.
+var DefaultChipVariant = ChipVariants["sn76489"]
+
+// LookupChipVariant returns the chip variant with the given name (case insensitive).
+// An empty name returns DefaultChipVariant.
+func LookupChipVariant(name string) (ChipVariant, error) {
+	if name == "" {
+		return DefaultChipVariant, nil
+	}
+	variant, ok := ChipVariants[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(ChipVariants))
+		for n := range ChipVariants {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return ChipVariant{}, fmt.Errorf("unknown chip variant %q, expected one of: %s", name, strings.Join(names, ", "))
+	}
+	return variant, nil
+}
+
+// squareDivider returns the number that the clock rate is divided by (along with the period)
+// to get the frequency of a square channel.
+func (v ChipVariant) squareDivider() (num, den uint64) {
+	return 4 * uint64(v.Prescaler), 1
+}
+
+// noiseDivider returns the number that the clock rate is divided by (along with the period)
+// to get the frequency of the noise channel, when it tracks the period of square channel 3.
+func (v ChipVariant) noiseDivider() (num, den uint64) {
+	// Noise pitches are relative to a 16 bit shift register.
+	num, den = uint64(v.Prescaler)*uint64(v.NoiseLFSRBits), 4
+	// Reduce the fraction, so the default variant gives exactly the same results as CalculateNoisePeriod.
+	d := gcd(num, den)
+	return num / d, den / d
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// clampPeriod avoids a period of 0 on variants where it would play the lowest note instead of the highest.
+func (v ChipVariant) clampPeriod(period uint16) uint16 {
+	if period == 0 && v.ZeroPeriodIsLowest {
+		return 1
+	}
+	return period
+}
+
+// SquarePeriod computes the (rounded) period of a square channel from a given frequency and clock rate.
+// The result saturates at the maximum value of a uint16.
+func (v ChipVariant) SquarePeriod(freq float64, clockRate float64) uint16 {
+	num, den := v.squareDivider()
+	period, _ := checked.Saturate[uint16](math.RoundToEven(clockRate * float64(den) / (float64(num) * freq)))
+	return v.clampPeriod(period)
+}
+
+// NoisePeriod computes the (rounded) period of the noise channel from a given frequency and clock rate.
+// The result saturates at the maximum value of a uint16.
+func (v ChipVariant) NoisePeriod(freq float64, clockRate float64) uint16 {
+	num, den := v.noiseDivider()
+	period, _ := checked.Saturate[uint16](math.RoundToEven(clockRate * float64(den) / (float64(num) * freq)))
+	return v.clampPeriod(period)
+}
+
+// SquarePeriodFixed is the integer-only equivalent of SquarePeriod. The clock rate is given in hertz.
+func (v ChipVariant) SquarePeriodFixed(freq FixedFreq, clockRate uint64) uint16 {
+	num, den := v.squareDivider()
+	return v.clampPeriod(fixedPeriod(freq, clockRate*den, num))
+}
+
+// NoisePeriodFixed is the integer-only equivalent of NoisePeriod. The clock rate is given in hertz.
+func (v ChipVariant) NoisePeriodFixed(freq FixedFreq, clockRate uint64) uint16 {
+	num, den := v.noiseDivider()
+	return v.clampPeriod(fixedPeriod(freq, clockRate*den, num))
+}
+
+// NoiseTuning selects how the period of square channel 3 is calculated for noise notes,
+// when the noise channel tracks the period of that channel.
+type NoiseTuning int
+
+const (
+	// Corrects for the length of the chip variant's noise shift register, and its prescaler.
+	NoiseTuningExact NoiseTuning = iota
+	// Always uses the SN76489's 15 bit shift register and divide-by-8 prescaler, like earlier versions of the compiler.
+	NoiseTuningLegacy
+)
+
+// ParseNoiseTuning returns the NoiseTuning with the given name.
+func ParseNoiseTuning(name string) (NoiseTuning, error) {
+	switch name {
+	case "exact":
+		return NoiseTuningExact, nil
+	case "legacy":
+		return NoiseTuningLegacy, nil
+	default:
+		return 0, fmt.Errorf("unknown noise tuning %q, expected exact or legacy", name)
+	}
+}
+
+// LegacyNoiseCorrection is the correction factor used by NoiseTuningLegacy, for a 15 bit shift register.
+const LegacyNoiseCorrection = 15.0 / 16
+
+// CalculateNoisePeriodFromCh3 computes the (rounded) period of square channel 3 which makes the noise channel
+// play at the given frequency, for a chip with a divide-by-8 prescaler.
+//
+// Note pitches of periodic noise assume that the noise repeats every 16 periods of channel 3, so the period
+// is the same as a square channel's. The correction factor is the actual length of the shift register divided
+// by 16 (for example 15/16 on the SN76489, as its noise repeats every 15 periods).
+func CalculateNoisePeriodFromCh3(freq float64, clockRate float64, correction float64) uint16 {
+	period, _ := checked.Saturate[uint16](math.RoundToEven(clockRate / (32 * correction * freq)))
+	return period
+}
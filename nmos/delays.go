@@ -0,0 +1,159 @@
+package nmos
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DelayAnalysis breaks down how much of a song's ROM space is spent on chip commands,
+// and how much is spent on frame delays and padding.
+type DelayAnalysis struct {
+	Size          int // Total size of the song in bytes.
+	CommandBytes  int // SN76489 command bytes.
+	ControlBytes  int // Tempo and stereo control bytes.
+	OverheadBytes int // Headers and frame delay bytes of frames which contain commands or control bytes.
+	FillerBytes   int // Dummy commands which pad frames out to the tempo or stereo control byte.
+	RestFrames    int // Frames which only wait, usually because a rest was too long for a single frame delay.
+	RestBytes     int // Size of the frames in RestFrames.
+
+	// The frame delay of a single row, or -1 if it changes during the song.
+	BaseFrameDelay int
+	// The base frame delay which would make the song smallest while keeping its speed,
+	// and the size of the song with it. Only set if BaseFrameDelay is known.
+	BestBaseFrameDelay int
+	BestSize           int
+}
+
+func (a DelayAnalysis) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d bytes: %d in SN76489 commands, %d in tempo and stereo changes, %d in frame headers and delays, %d in dummy commands, and %d in %d frames which only wait",
+		a.Size, a.CommandBytes, a.ControlBytes, a.OverheadBytes, a.FillerBytes, a.RestBytes, a.RestFrames)
+
+	switch {
+	case a.BaseFrameDelay < 0:
+		b.WriteString(". The base frame delay changes during the song, so no better one can be suggested")
+	case a.BestSize < a.Size:
+		fmt.Fprintf(&b, ". A base frame delay of %d instead of %d would play at the same speed and save %d bytes",
+			a.BestBaseFrameDelay, a.BaseFrameDelay, a.Size-a.BestSize)
+	default:
+		fmt.Fprintf(&b, ". The base frame delay of %d is already the cheapest for this speed (rests of up to %d rows fit in one frame)",
+			a.BaseFrameDelay, 256/(a.BaseFrameDelay+1))
+	}
+	return b.String()
+}
+
+// isRest reports whether the frame at index i only waits, which usually means that the rest
+// before it was too long to fit in the previous frame's delay.
+func (s *NmosSong) isRest(i int) bool {
+	f := &s.Frames[i]
+	return i != 0 && i != s.LoopTarget && !f.LoopToTarget && len(f.Rows) > 0 &&
+		len(f.commands) == 0 && !f.hasTempoChange && !f.hasStereo
+}
+
+// AnalyzeDelays breaks down the size of the song, and works out which base frame delay (the number of
+// Frame Clock cycles each row takes, minus one) would make the song smallest at the same speed.
+//
+// The longest rest a single frame can hold shrinks as the base frame delay grows, and longer rests need
+// extra frames which only wait. The row rate only depends on the base frame delay and the tempo, so the
+// same speed can sometimes be played with a smaller base frame delay and a slower tempo.
+func (s *NmosSong) AnalyzeDelays() DelayAnalysis {
+	a := DelayAnalysis{BaseFrameDelay: -1}
+
+	baseFrameDelay := -1
+	constantRate := true
+	var runs []int // The number of rows each frame and the rest frames after it last for.
+	for i, frame := range s.Frames {
+		if i == 0 {
+			// The initial tempo is written to the first frame when compiling.
+			frame.SetNewTempo(s.InitialTempo)
+		} else if frame.hasTempoChange {
+			constantRate = false
+		}
+
+		size := frame.CalculateSize()
+		a.Size += size
+
+		if rows := len(frame.Rows); rows > 0 {
+			delay := (int(frame.FrameDelay) + 1) / rows
+			if (int(frame.FrameDelay)+1)%rows != 0 || (baseFrameDelay >= 0 && delay-1 != baseFrameDelay) {
+				constantRate = false
+			}
+			baseFrameDelay = delay - 1
+
+			if s.isRest(i) && len(runs) > 0 {
+				runs[len(runs)-1] += rows
+			} else {
+				runs = append(runs, rows)
+			}
+		}
+
+		if s.isRest(i) {
+			a.RestFrames++
+			a.RestBytes += size
+			continue
+		}
+
+		commandBytes := 0
+		for _, c := range frame.commands {
+			commandBytes += len(c.toBytes())
+		}
+		overhead := min(size, 2) // Header and frame delay.
+		control := controlBytes(&frame)
+		a.CommandBytes += commandBytes
+		a.ControlBytes += control
+		a.OverheadBytes += overhead
+		a.FillerBytes += size - overhead - commandBytes - control
+	}
+
+	if !constantRate || baseFrameDelay < 0 {
+		return a
+	}
+
+	a.BaseFrameDelay = baseFrameDelay
+	a.BestBaseFrameDelay, a.BestSize = baseFrameDelay, a.Size
+	rowRate := effectiveTickRate(s.InitialTempo, uint8(baseFrameDelay))
+	for delay := range 256 {
+		if _, _, relErr := bestTempoForDelay(rowRate, uint8(delay)); relErr > DefaultRateTolerance {
+			continue
+		}
+		// Only rest frames needed because of the frame delay limit change with the base frame delay.
+		size := a.Size
+		for _, rows := range runs {
+			size += restSize(rows, delay) - restSize(rows, baseFrameDelay)
+		}
+		if size < a.BestSize {
+			a.BestBaseFrameDelay, a.BestSize = delay, size
+		}
+	}
+
+	return a
+}
+
+// controlBytes returns the number of tempo and stereo control bytes in the frame.
+func controlBytes(f *Frame) int {
+	switch {
+	case f.hasStereo:
+		return 2
+	case f.hasTempoChange:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// restSize returns the size of the rest frames needed after a frame which lasts for the given number of rows,
+// if every row takes delay+1 Frame Clock cycles.
+func restSize(rows int, delay int) int {
+	// A frame delay can't be more than 255, which limits how many rows a single frame can last for.
+	maxRows := 256 / (delay + 1)
+
+	size := 0
+	for rows -= maxRows; rows > 0; rows -= maxRows {
+		if min(rows, maxRows)*(delay+1)-1 > 0 {
+			size += 2 // Header and frame delay.
+		} else {
+			size++ // Header only.
+		}
+	}
+	return size
+}
@@ -0,0 +1,215 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Disassemble parses a ROM image back into songs.
+//
+// Any signature footer (see AppendSignature) and checksum footer (see AppendChecksum) are checked and removed first.
+// If the ROM ends with a metadata block (see AppendMetadata), each song listed in it is parsed, along with its
+// title and author. Otherwise, if the ROM starts with a directory (see LayoutIndexed), each song listed in it is parsed.
+// Otherwise the songs are assumed to be concatenated, and a new song is started after every loop frame.
+// Information which isn't stored in the ROM (such as the source rows of each frame) is left empty.
+func Disassemble(rom []byte) ([]*NmosSong, error) {
+	rom, _, _, err := VerifySignature(rom)
+	if err != nil {
+		return nil, err
+	}
+	rom, _, _, err = VerifyChecksum(rom)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, rom, ok, err := ReadMetadata(rom)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return disassembleWithMetadata(rom, metadata)
+	}
+
+	if bytes.HasPrefix(rom, []byte(directoryHeader)) {
+		return disassembleIndexed(rom)
+	}
+
+	var songs []*NmosSong
+	for address := 0; address < len(rom); {
+		song, size, err := disassembleSong(rom, address)
+		if err != nil {
+			return nil, err
+		}
+		songs = append(songs, song)
+		address += size
+	}
+	return songs, nil
+}
+
+// disassembleWithMetadata parses every song listed in a ROM's metadata block.
+func disassembleWithMetadata(rom []byte, metadata []SongMetadata) ([]*NmosSong, error) {
+	songs := make([]*NmosSong, 0, len(metadata))
+	for i, m := range metadata {
+		song, _, err := disassembleSong(rom, m.Address)
+		if err != nil {
+			return nil, fmt.Errorf("song %d: %w", i, err)
+		}
+		song.Name = m.Title
+		song.Author = m.Author
+		songs = append(songs, song)
+	}
+	return songs, nil
+}
+
+// disassembleIndexed parses every song listed in the directory at the start of an indexed ROM.
+func disassembleIndexed(rom []byte) ([]*NmosSong, error) {
+	if len(rom) < directoryFixedSize {
+		return nil, fmt.Errorf("ROM directory is truncated")
+	}
+	if version := rom[len(directoryHeader)]; version != directoryVersion {
+		return nil, fmt.Errorf("unsupported ROM directory version %d", version)
+	}
+
+	count := int(rom[len(directoryHeader)+1])
+	if len(rom) < directoryFixedSize+count*directoryEntrySize {
+		return nil, fmt.Errorf("ROM directory is truncated")
+	}
+
+	songs := make([]*NmosSong, 0, count)
+	for i := range count {
+		entry := rom[directoryFixedSize+i*directoryEntrySize:][:directoryEntrySize]
+		address := int(binary.LittleEndian.Uint32(entry[0:4]))
+
+		song, _, err := disassembleSong(rom, address)
+		if err != nil {
+			return nil, fmt.Errorf("song %d: %w", i, err)
+		}
+		song.Name = string(bytes.TrimRight(entry[5:], "\x00"))
+		songs = append(songs, song)
+	}
+	return songs, nil
+}
+
+// disassembleSong parses a single song starting at the given address, up to and including its loop frame.
+// It returns the song and its size in bytes.
+func disassembleSong(rom []byte, start int) (*NmosSong, int, error) {
+	song := &NmosSong{}
+	address := start
+	for {
+		if address >= len(rom) {
+			return nil, 0, fmt.Errorf("song at address %d has no loop frame", start)
+		}
+
+		frame, size, isLoopTarget, err := disassembleFrame(rom[address:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("frame at address %d: %w", address, err)
+		}
+		if isLoopTarget {
+			song.LoopTarget = len(song.Frames)
+		}
+		song.Frames = append(song.Frames, frame)
+		address += size
+
+		if frame.LoopToTarget {
+			break
+		}
+	}
+
+	// The initial tempo is always written to the first frame.
+	first := &song.Frames[0]
+	if first.hasTempoChange {
+		song.InitialTempo = first.tempo
+		first.hasTempoChange = false
+		first.tempo = 0
+	}
+
+	return song, address - start, nil
+}
+
+// disassembleFrame parses the frame at the start of data, and returns the frame, its size in bytes,
+// and whether it's marked as the loop target.
+func disassembleFrame(data []byte) (Frame, int, bool, error) {
+	var frame Frame
+
+	header := DecodeFrameHeader(data[0])
+	isLoopTarget := header.LoopTarget
+	frame.LoopToTarget = header.LoopToTarget
+	numCommands := header.CommandCount
+
+	if len(data) < numCommands+1 {
+		return Frame{}, 0, false, fmt.Errorf("frame is truncated, expected %d command bytes", numCommands)
+	}
+
+	var chipBytes []byte
+	for i, b := range data[1 : numCommands+1] {
+		switch index := numCommands - i; {
+		case index == stereoCommandIndex:
+			frame.stereo = b
+			frame.hasStereo = true
+		case index == tempoCommandIndex:
+			frame.tempo = b & maxTempo
+			frame.hasTempoChange = true
+		case index == frameDelayCommandIndex:
+			frame.FrameDelay = b
+		default:
+			chipBytes = append(chipBytes, b)
+		}
+	}
+
+	if err := frame.decodeChipBytes(chipBytes); err != nil {
+		return Frame{}, 0, false, err
+	}
+
+	return frame, numCommands + 1, isLoopTarget, nil
+}
+
+// decodeChipBytes converts a sequence of SN76489 command bytes back into commands, adding them to the frame.
+// Dummy commands (which repeat the previous byte) are skipped.
+func (f *Frame) decodeChipBytes(chipBytes []byte) error {
+	var last command
+	hasLast := false
+	for i := 0; i < len(chipBytes); i++ {
+		b := chipBytes[i]
+		if b&0b10000000 == 0 {
+			// A data byte without a preceding period latch byte is a repeated data byte,
+			// which is how dummy commands look after a period command.
+			continue
+		}
+
+		channel := (b >> 5) & 0b11
+		isAttenuation := b&0b00010000 != 0
+
+		var c command
+		switch {
+		case isAttenuation:
+			c = command{commandType: SetAttenuationCommand, channel: channel, attenuation: b & 0x0f}
+		case channel == 3:
+			c = command{commandType: SetNoiseControlCommand, channel: 3}
+			if b&0b100 != 0 {
+				c.noiseMode = WhiteNoise
+			} else {
+				c.noiseMode = PeriodicNoise
+			}
+			c.noiseRate = [4]NoiseRate{HighNoise, MediumNoise, LowNoise, Channel3Noise}[b&0b11]
+		default:
+			if i+1 >= len(chipBytes) || chipBytes[i+1]&0b10000000 != 0 {
+				return fmt.Errorf("period command for channel %d is missing its data byte", channel)
+			}
+			i++
+			period := uint16(b&0x0f) | uint16(chipBytes[i]&0b00111111)<<4
+			c = command{commandType: SetSquarePeriodCommand, channel: channel, period: period}
+		}
+
+		if hasLast && c == last {
+			// Dummy command.
+			continue
+		}
+		if f.commandAlreadyExists(c.commandType, c.channel) {
+			return fmt.Errorf("frame sets the same register more than once: %s", c.String())
+		}
+		f.commands = append(f.commands, c)
+		last, hasLast = c, true
+	}
+	return nil
+}
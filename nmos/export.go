@@ -0,0 +1,118 @@
+package nmos
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// OutputFormat is a file format which a ROM image can be written in.
+type OutputFormat int
+
+const (
+	OutputBinary OutputFormat = iota // The raw ROM image.
+	OutputC                          // A C header containing the ROM as a const uint8_t array.
+	OutputAsm                        // An assembly include file containing the ROM as .byte directives.
+)
+
+// ParseOutputFormat returns the OutputFormat with the given name.
+func ParseOutputFormat(name string) (OutputFormat, error) {
+	switch name {
+	case "bin", "binary":
+		return OutputBinary, nil
+	case "c":
+		return OutputC, nil
+	case "asm":
+		return OutputAsm, nil
+	default:
+		return 0, fmt.Errorf("unknown output format %q, expected bin, c or asm", name)
+	}
+}
+
+// Extension returns the usual file extension of the format, including the dot.
+func (f OutputFormat) Extension() string {
+	switch f {
+	case OutputC:
+		return ".h"
+	case OutputAsm:
+		return ".s"
+	default:
+		return ".bin"
+	}
+}
+
+// A named address in a ROM image, such as the start of a song.
+type RomSymbol struct {
+	Name   string
+	Offset int
+}
+
+// The number of bytes written on each line of C and assembly output.
+const bytesPerLine = 16
+
+// WriteRom writes a ROM image in the given format. name is the name of the array or label holding the whole ROM,
+// and every symbol is written as a label (or an offset macro in C) named after it, prefixed with name.
+// Names must be valid identifiers.
+func WriteRom(w io.Writer, format OutputFormat, name string, rom []byte, symbols []RomSymbol) error {
+	var b strings.Builder
+	switch format {
+	case OutputBinary:
+		b.Write(rom)
+
+	case OutputC:
+		guard := strings.ToUpper(name) + "_H"
+		fmt.Fprintf(&b, "/* Generated by the NMOScillator compiler. Do not edit it by hand. */\n")
+		fmt.Fprintf(&b, "#ifndef %s\n#define %s\n\n#include <stdint.h>\n\n", guard, guard)
+		fmt.Fprintf(&b, "#define %s_SIZE %d\n", strings.ToUpper(name), len(rom))
+		for _, symbol := range symbols {
+			fmt.Fprintf(&b, "#define %s_%s_OFFSET %d\n", strings.ToUpper(name), strings.ToUpper(symbol.Name), symbol.Offset)
+		}
+		fmt.Fprintf(&b, "\nstatic const uint8_t %s[%d] = {\n", name, len(rom))
+		for i := 0; i < len(rom); i += bytesPerLine {
+			b.WriteString("\t")
+			for j, v := range rom[i:min(i+bytesPerLine, len(rom))] {
+				if j > 0 {
+					b.WriteString(" ")
+				}
+				fmt.Fprintf(&b, "0x%02x,", v)
+			}
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "};\n\n#endif /* %s */\n", guard)
+
+	case OutputAsm:
+		fmt.Fprintf(&b, "; Generated by the NMOScillator compiler. Do not edit it by hand.\n\n%s:\n", name)
+		next := 0 // Index of the next symbol to write.
+		for i := 0; i < len(rom); {
+			// Lines are split at symbols, so every label points at the right byte.
+			end := min(i+bytesPerLine, len(rom))
+			for next < len(symbols) && symbols[next].Offset <= i {
+				fmt.Fprintf(&b, "%s_%s:\n", name, symbols[next].Name)
+				next++
+			}
+			if next < len(symbols) && symbols[next].Offset < end {
+				end = symbols[next].Offset
+			}
+
+			b.WriteString("\t.byte ")
+			for j, v := range rom[i:end] {
+				if j > 0 {
+					b.WriteString(", ")
+				}
+				fmt.Fprintf(&b, "0x%02x", v)
+			}
+			b.WriteString("\n")
+			i = end
+		}
+		for ; next < len(symbols); next++ {
+			fmt.Fprintf(&b, "%s_%s:\n", name, symbols[next].Name)
+		}
+		fmt.Fprintf(&b, "%s_end:\n", name)
+
+	default:
+		return fmt.Errorf("unknown output format %d", format)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,130 @@
+package nmos
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Fixed-point period calculations.
+//
+// The float64 period helpers in song.go are accurate enough for normal use, but the result of a floating point
+// expression is allowed to vary slightly between architectures and compiler versions (e.g. fused multiply-adds).
+// The functions in this file only use integer arithmetic, so the periods they produce are bit-identical everywhere.
+// This is useful for golden ROMs which are checked in and compared byte-for-byte.
+
+// fixedFreqShift is the number of fractional bits used by FixedFreq.
+const fixedFreqShift = 30
+
+// FixedFreq is a frequency in millihertz, scaled by 2^fixedFreqShift.
+type FixedFreq uint64
+
+// semitoneRatios contains 2^(n/12) for n = 0..11, scaled by 2^fixedFreqShift.
+var semitoneRatios = [12]uint64{
+	1073741824,
+	1137589835,
+	1205234447,
+	1276901417,
+	1352829926,
+	1433273380,
+	1518500250,
+	1608794974,
+	1704458901,
+	1805811301,
+	1913190429,
+	2026954652,
+}
+
+// FixedFreqFromSemitones returns the frequency which is the given number of semitones above (or below, if negative)
+// a reference frequency given in millihertz, using 12-tone equal temperament.
+func FixedFreqFromSemitones(referenceMilliHz uint64, semitones int) FixedFreq {
+	// Split the semitone offset into whole octaves and the remaining semitones (always 0..11).
+	octave := semitones / 12
+	semitone := semitones % 12
+	if semitone < 0 {
+		semitone += 12
+		octave--
+	}
+
+	hi, freq := bits.Mul64(referenceMilliHz, semitoneRatios[semitone])
+	if hi != 0 {
+		return FixedFreq(math.MaxUint64)
+	}
+
+	if octave >= 0 {
+		if octave >= bits.LeadingZeros64(freq) {
+			// Shifting would overflow, saturate instead.
+			return FixedFreq(math.MaxUint64)
+		}
+		return FixedFreq(freq << octave)
+	}
+	if -octave >= 64 {
+		return 0
+	}
+	return FixedFreq(freq >> -octave)
+}
+
+// centRatio is 2^(1/1200), the frequency ratio of one cent, scaled by 2^fixedFreqShift.
+const centRatio = 1074362221
+
+// FixedFreqFromCents returns the frequency which is the given number of cents above (or below, if negative)
+// a reference frequency given in millihertz, using 12-tone equal temperament.
+func FixedFreqFromCents(referenceMilliHz uint64, cents int) FixedFreq {
+	// Split the offset into whole semitones and the remaining cents (always 0..99).
+	semitones := cents / 100
+	rest := cents % 100
+	if rest < 0 {
+		rest += 100
+		semitones--
+	}
+
+	freq := FixedFreqFromSemitones(referenceMilliHz, semitones)
+	for range rest {
+		hi, lo := bits.Mul64(uint64(freq), centRatio)
+		if hi>>fixedFreqShift != 0 {
+			return FixedFreq(math.MaxUint64)
+		}
+		freq = FixedFreq(hi<<(64-fixedFreqShift) | lo>>fixedFreqShift)
+	}
+	return freq
+}
+
+// fixedPeriod computes round(clockRate / (divider * freq)) using only integer arithmetic.
+// The result saturates at the maximum value of a uint16.
+func fixedPeriod(freq FixedFreq, clockRate uint64, divider uint64) uint16 {
+	if freq == 0 {
+		return math.MaxUint16
+	}
+
+	denHi, den := bits.Mul64(divider, uint64(freq))
+	if denHi != 0 {
+		// Frequency is so high that the period rounds to 0.
+		return 0
+	}
+
+	// The frequency is in millihertz scaled by 2^fixedFreqShift, so the clock rate needs the same scaling.
+	hi, lo := bits.Mul64(clockRate*1000, 1<<fixedFreqShift)
+
+	// Add half of the denominator so the division rounds to the nearest integer.
+	var carry uint64
+	lo, carry = bits.Add64(lo, den/2, 0)
+	hi += carry
+
+	if hi >= den {
+		// Quotient doesn't fit in 64 bits.
+		return math.MaxUint16
+	}
+	period, _ := bits.Div64(hi, lo, den)
+	return uint16(min(period, math.MaxUint16))
+}
+
+// CalculateSquarePeriodFixed is the integer-only equivalent of CalculateSquarePeriod.
+// The clock rate is given in hertz.
+func CalculateSquarePeriodFixed(freq FixedFreq, clockRate uint64) uint16 {
+	return fixedPeriod(freq, clockRate, 32)
+}
+
+// CalculateNoisePeriodFixed is the integer-only equivalent of CalculateNoisePeriod.
+// The clock rate is given in hertz.
+func CalculateNoisePeriodFixed(freq FixedFreq, clockRate uint64) uint16 {
+	return fixedPeriod(freq, clockRate, 30)
+}
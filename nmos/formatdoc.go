@@ -0,0 +1,334 @@
+package nmos
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Command indices with special meanings. Indices between firstChipCommandIndex and lastChipCommandIndex
+// (inclusive) are streamed to the SN76489.
+const (
+	frameDelayCommandIndex = 1
+	firstChipCommandIndex  = 2
+	lastChipCommandIndex   = 13
+	tempoCommandIndex      = 14
+	stereoCommandIndex     = 15
+)
+
+// A field of the frame header byte.
+type headerField struct {
+	mask        byte
+	symbol      byte // The letter used for the field's bits in the header's bit pattern.
+	name        string
+	description string
+}
+
+// headerFields describes every bit of the frame header byte, from the most significant bit.
+var headerFields = []headerField{
+	{FlagLoopTarget, 'T', "Loop Target", "When set, this frame becomes the Loop Target."},
+	{FlagLoopToTarget, 'L', "Loop", "When set, playback jumps back to the Loop Target immediately. Nothing else in the frame is executed."},
+	{HeaderReservedMask, 'x', "Reserved", "Ignored by the NMOScillator. The compiler always writes zeroes."},
+	{CommandCountMask, 'N', "Command count", "The number of command bytes following the header (N)."},
+}
+
+// A range of command indices with the same meaning.
+type commandIndexRange struct {
+	first, last int
+	name        string
+	description string
+}
+
+// commandIndices describes the meaning of every command index, in the order the bytes appear in a frame.
+var commandIndices = []commandIndexRange{
+	{stereoCommandIndex, stereoCommandIndex, "Stereo Control",
+		"On targets with a stereo control register, the byte is written to that register. Bits 7-4 enable channels 3-0 on the left output, and bits 3-0 enable channels 3-0 on the right output. On other targets this byte is overwritten by the byte at the next index and does nothing."},
+	{tempoCommandIndex, tempoCommandIndex, "Tempo Change",
+		fmt.Sprintf("The lower 7 bits are copied into the Tempo Register (0-%d).", maxTempo)},
+	{firstChipCommandIndex, lastChipCommandIndex, "SN76489 Command",
+		"The byte is streamed directly to the SN76489. Unused indices are filled with dummy commands which repeat the previous byte, or in frames with no SN76489 commands, set a channel's attenuation to the value it already has."},
+	{frameDelayCommandIndex, frameDelayCommandIndex, "Frame Delay",
+		"The number of extra Frame Clock cycles the frame takes before the next frame is read (0-255)."},
+}
+
+// chipCommandFormats describes the bytes written for every SN76489 command type, along with an example command.
+var chipCommandFormats = []struct {
+	pattern string
+	example command
+}{
+	{"1cc0pppp 00pppppp", command{commandType: SetSquarePeriodCommand, channel: 1, period: 0x1ab}},
+	{"1cc1aaaa", command{commandType: SetAttenuationCommand, channel: 2, attenuation: 4}},
+	{"11100mrr", command{commandType: SetNoiseControlCommand, channel: 3, noiseMode: WhiteNoise, noiseRate: HighNoise}},
+}
+
+// DocFormat is a markup language which the ROM format specification can be written in.
+type DocFormat int
+
+const (
+	DocMarkdown DocFormat = iota
+	DocHTML
+)
+
+// ParseDocFormat returns the DocFormat with the given name.
+func ParseDocFormat(name string) (DocFormat, error) {
+	switch name {
+	case "markdown", "md":
+		return DocMarkdown, nil
+	case "html":
+		return DocHTML, nil
+	default:
+		return 0, fmt.Errorf("unknown documentation format %q, expected markdown or html", name)
+	}
+}
+
+// A section of generated documentation.
+type docSection struct {
+	title      string
+	paragraphs []string
+	header     []string   // Column names of the section's table, if it has one.
+	rows       [][]string // Rows of the section's table.
+}
+
+// WriteFormatDoc writes a specification of the ROM format in the given markup language.
+// The specification is generated from the same tables and constants used by the compiler,
+// so it always matches the ROMs the compiler produces.
+func WriteFormatDoc(w io.Writer, format DocFormat) error {
+	sections := formatDocSections()
+	switch format {
+	case DocMarkdown:
+		return writeMarkdownDoc(w, sections)
+	case DocHTML:
+		return writeHTMLDoc(w, sections)
+	default:
+		return fmt.Errorf("unknown documentation format %d", format)
+	}
+}
+
+// formatDocSections generates the content of the ROM format specification.
+func formatDocSections() []docSection {
+	var sections []docSection
+
+	// Frame header.
+	var pattern [8]byte
+	header := docSection{
+		title: "Frame Header",
+		paragraphs: []string{
+			"Every frame starts with a header byte, followed by N command bytes. Frames are played in order, starting at address 0.",
+		},
+		header: []string{"Bits", "Field", "Description"},
+	}
+	for _, field := range headerFields {
+		var bits [8]byte
+		for i := range 8 {
+			bits[i] = '-'
+			if field.mask&(0x80>>i) != 0 {
+				bits[i] = field.symbol
+				pattern[i] = field.symbol
+			}
+		}
+		header.rows = append(header.rows, []string{string(bits[:]), field.name, field.description})
+	}
+	header.paragraphs = append(header.paragraphs, fmt.Sprintf("The header has the format %s.", pattern[:]))
+	sections = append(sections, header)
+
+	// Command indices.
+	indices := docSection{
+		title: "Command Indices",
+		paragraphs: []string{
+			"The command index starts at N for the first command byte and counts down to 1. The meaning of each byte depends on its command index.",
+			fmt.Sprintf("A frame which changes the tempo is always %d bytes long, and a frame which writes to the stereo control register is always %d bytes long. "+
+				"A frame without any commands or frame delay is a single header byte (N = 0).", tempoCommandIndex+1, stereoCommandIndex+1),
+		},
+		header: []string{"Index", "Command", "Description"},
+	}
+	for _, r := range commandIndices {
+		index := fmt.Sprint(r.first)
+		if r.first != r.last {
+			index = fmt.Sprintf("%d-%d", r.last, r.first)
+		}
+		indices.rows = append(indices.rows, []string{index, r.name, r.description})
+	}
+	sections = append(sections, indices)
+
+	// SN76489 commands.
+	chipCommands := docSection{
+		title: "SN76489 Commands",
+		paragraphs: []string{
+			"c is the channel (0-2 for square channels, 3 for noise), p is the period, a is the attenuation, m is the noise mode (1 = white) and r is the noise rate (0 = high, 1 = medium, 2 = low, 3 = channel 3).",
+		},
+		header: []string{"Command", "Bytes", "Example", "Example bytes"},
+	}
+	for _, f := range chipCommandFormats {
+		name, _ := f.example.commandType.MarshalText()
+		var example []string
+		for _, b := range f.example.toBytes() {
+			example = append(example, fmt.Sprintf("%08b", b))
+		}
+		chipCommands.rows = append(chipCommands.rows, []string{string(name), f.pattern, f.example.String(), strings.Join(example, " ")})
+	}
+	sections = append(sections, chipCommands)
+
+	// Indexed ROM directory.
+	sections = append(sections, docSection{
+		title: "Indexed ROM Directory",
+		paragraphs: []string{
+			fmt.Sprintf("ROMs built with the indexed layout start with a directory, followed by the songs. It can list up to %d songs.", maxDirectorySongs),
+			"Each song entry contains the little-endian address of the song's first frame (4 bytes), its initial tempo (1 byte), " +
+				fmt.Sprintf("and its name in UTF-8, truncated or padded with zero bytes to %d bytes.", directoryNameSize),
+		},
+		header: []string{"Offset", "Size", "Description"},
+		rows: [][]string{
+			{"0", fmt.Sprint(len(directoryHeader)), fmt.Sprintf("The ASCII characters %s.", directoryHeader)},
+			{fmt.Sprint(len(directoryHeader)), "1", fmt.Sprintf("Directory format version (%d).", directoryVersion)},
+			{fmt.Sprint(len(directoryHeader) + 1), "1", "The number of songs (S)."},
+			{fmt.Sprint(directoryFixedSize), fmt.Sprintf("%d×S", directoryEntrySize), "One entry for each song."},
+		},
+	})
+
+	// Metadata block.
+	sections = append(sections, docSection{
+		title: "Metadata Block",
+		paragraphs: []string{
+			"ROMs built with metadata end with a block listing the title and author of each song. It comes after every song, so it's never played. " +
+				"Readers find it from the end of the ROM, using the size in its last 4 bytes.",
+			"Each song entry contains the little-endian addresses of the song's first frame and its loop target frame (4 bytes each), " +
+				fmt.Sprintf("followed by its title and then its author in UTF-8, each preceded by its length in bytes (1 byte, at most %d).", metadataMaxString),
+			fmt.Sprintf("In version %d blocks, each song entry ends with a cue table: the number of cues (2 bytes, little-endian), then %d bytes for each cue ", metadataCueVersion, metadataCueSize) +
+				"with the pattern it starts (2 bytes), the address of the frame the pattern starts in (4 bytes, both little-endian), and the tempo to set before playing from that frame (1 byte). " +
+				"Firmware can seek by setting the tempo and jumping to the frame. Channels keep playing whatever they were, so silence them first.",
+		},
+		header: []string{"Offset", "Size", "Description"},
+		rows: [][]string{
+			{"0", fmt.Sprint(len(metadataHeader)), fmt.Sprintf("The ASCII characters %s.", metadataHeader)},
+			{fmt.Sprint(len(metadataHeader)), "1", fmt.Sprintf("Metadata format version (%d, or %d with cue tables).", metadataVersion, metadataCueVersion)},
+			{fmt.Sprint(len(metadataHeader) + 1), "1", "The number of songs (S)."},
+			{fmt.Sprint(metadataFixedSize), "varies", "One entry for each song."},
+			{"B-8", "4", "Little-endian CRC-32 (IEEE) of every byte of the ROM before this field."},
+			{"B-4", "4", "The size of the block in bytes (B), including this field."},
+		},
+	})
+
+	// Checksum footer.
+	sections = append(sections, docSection{
+		title: "Checksum Footer",
+		paragraphs: []string{
+			"ROMs built with a checksum end with a footer, after the metadata block if there is one. The checksum covers every byte of the ROM before the footer.",
+		},
+		header: []string{"Offset", "Size", "Description"},
+		rows: [][]string{
+			{"0", "4", "The little-endian checksum."},
+			{"4", "1", fmt.Sprintf("The checksum type: %d for CRC-32 (IEEE), %d for the sum of every byte.", ChecksumCRC32, ChecksumSum)},
+			{"5", fmt.Sprint(len(checksumFooter)), fmt.Sprintf("The ASCII characters %s.", checksumFooter)},
+		},
+	})
+
+	// Signature footer.
+	sections = append(sections, docSection{
+		title: "Signature Footer",
+		paragraphs: []string{
+			"Signed ROMs end with a footer, after everything else including the checksum footer. The signature covers every byte of the ROM before the footer.",
+		},
+		header: []string{"Offset", "Size", "Description"},
+		rows: [][]string{
+			{"0", fmt.Sprint(ed25519.SignatureSize), "The Ed25519 signature."},
+			{fmt.Sprint(ed25519.SignatureSize), fmt.Sprint(ed25519.PublicKeySize), "The Ed25519 public key which checks the signature."},
+			{fmt.Sprint(ed25519.SignatureSize + ed25519.PublicKeySize), fmt.Sprint(len(signatureFooter)), fmt.Sprintf("The ASCII characters %s.", signatureFooter)},
+		},
+	})
+
+	// Targets.
+	targets := docSection{
+		title:      "Built-in Targets",
+		paragraphs: []string{"Timings are in cycles of the base clock. A tick budget of 0 means the budget is one Frame Clock cycle."},
+		header:     []string{"Name", "Chip", "Cycles per byte", "Cycles per chip write", "Tick budget", "Stereo"},
+	}
+	for _, name := range sortedKeys(BuiltinTargets) {
+		t := BuiltinTargets[name]
+		targets.rows = append(targets.rows, []string{name, t.Chip, fmt.Sprint(t.CyclesPerByte), fmt.Sprint(t.CyclesPerChipWrite), fmt.Sprint(t.TickCycles), fmt.Sprint(t.Stereo)})
+	}
+	sections = append(sections, targets)
+
+	// Chip variants.
+	variants := docSection{
+		title:  "Chip Variants",
+		header: []string{"Name", "Prescaler", "Noise LFSR bits", "Period 0 is lowest"},
+	}
+	for _, name := range sortedKeys(ChipVariants) {
+		v := ChipVariants[name]
+		variants.rows = append(variants.rows, []string{name, fmt.Sprint(v.Prescaler), fmt.Sprint(v.NoiseLFSRBits), fmt.Sprint(v.ZeroPeriodIsLowest)})
+	}
+	sections = append(sections, variants)
+
+	return sections
+}
+
+// sortedKeys returns the keys of a map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMarkdownDoc(w io.Writer, sections []docSection) error {
+	var b strings.Builder
+	b.WriteString("# NMOScillator ROM Format\n\n")
+	b.WriteString("This document is generated by the compiler. Do not edit it by hand.\n")
+	for _, section := range sections {
+		fmt.Fprintf(&b, "\n## %s\n\n", section.title)
+		for _, p := range section.paragraphs {
+			fmt.Fprintf(&b, "%s\n\n", p)
+		}
+		if len(section.header) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "| %s |\n", strings.Join(section.header, " | "))
+		b.WriteString("|" + strings.Repeat(" --- |", len(section.header)) + "\n")
+		for _, row := range section.rows {
+			cells := make([]string, len(row))
+			for i, cell := range row {
+				cells[i] = strings.ReplaceAll(cell, "|", "\\|")
+			}
+			fmt.Fprintf(&b, "| %s |\n", strings.Join(cells, " | "))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHTMLDoc(w io.Writer, sections []docSection) error {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>NMOScillator ROM Format</title>\n</head>\n<body>\n")
+	b.WriteString("<h1>NMOScillator ROM Format</h1>\n")
+	b.WriteString("<p>This document is generated by the compiler. Do not edit it by hand.</p>\n")
+	for _, section := range sections {
+		fmt.Fprintf(&b, "<h2>%s</h2>\n", html.EscapeString(section.title))
+		for _, p := range section.paragraphs {
+			fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(p))
+		}
+		if len(section.header) == 0 {
+			continue
+		}
+		b.WriteString("<table>\n<tr>")
+		for _, cell := range section.header {
+			fmt.Fprintf(&b, "<th>%s</th>", html.EscapeString(cell))
+		}
+		b.WriteString("</tr>\n")
+		for _, row := range section.rows {
+			b.WriteString("<tr>")
+			for _, cell := range row {
+				fmt.Fprintf(&b, "<td>%s</td>", html.EscapeString(cell))
+			}
+			b.WriteString("</tr>\n")
+		}
+		b.WriteString("</table>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
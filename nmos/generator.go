@@ -7,10 +7,13 @@ import (
 
 // CalculateSize returns the size in bytes of the frame.
 func (f *Frame) CalculateSize() int {
+	if f.hasStereo {
+		// The stereo control byte is at command index 15, which only exists in 16 byte frames.
+		return stereoCommandIndex + 1
+	}
 	if f.hasTempoChange {
 		// Tempo changes require the frame to be 15+ bytes long.
-		// This is the only way a 15+ byte frame can exist.
-		return 15
+		return tempoCommandIndex + 1
 	}
 
 	runningTotal := 1 // Frame header data takes 1 byte
@@ -38,20 +41,45 @@ func (f *Frame) CalculateSize() int {
 // CalculateSize returns the total size in bytes of the song.
 func (s *NmosSong) CalculateSize() int {
 	size := 0
+	for _, frameSize := range s.frameSizes() {
+		size += frameSize
+	}
+	return size
+}
+
+// LoopTargetAddress returns the ROM address of the song's loop target frame, if the song starts at the given address.
+func (s *NmosSong) LoopTargetAddress(address int) int {
+	for _, size := range s.frameSizes()[:s.LoopTarget] {
+		address += size
+	}
+	return address
+}
+
+// frameSizes returns the size in bytes of each frame in the song, once compiled.
+func (s *NmosSong) frameSizes() []int {
+	sizes := make([]int, len(s.Frames))
 	for i, frame := range s.Frames {
 		frameSize := frame.CalculateSize()
 		if i == 0 {
 			// Initial tempo is an extra byte in the first frame when compiling,
 			// but only if the first frame doesn't already have a tempo set.
-			if !frame.hasTempoChange {
-				// Frames with a tempo change are always 15 bytes long.
-				// Thus, the first frame in the song must be 15 bytes long.
-				frameSize = 15
-			}
+			// Frames with a tempo change are always at least 15 bytes long.
+			// Thus, the first frame in the song must be at least 15 bytes long.
+			frameSize = max(frameSize, 15)
 		}
-		size += frameSize
+		sizes[i] = frameSize
 	}
-	return size
+	return sizes
+}
+
+// FrameAddresses returns the ROM address of each frame in the song, when the song starts at the given address.
+func (s *NmosSong) FrameAddresses(start int) []int {
+	addresses := make([]int, len(s.Frames))
+	for i, size := range s.frameSizes() {
+		addresses[i] = start
+		start += size
+	}
+	return addresses
 }
 
 // toBytes converts the command into a slice of bytes which should be written to ROM in order to execute this command.
@@ -118,11 +146,146 @@ func (c *command) toBytes() []byte {
 	}
 }
 
+// Compile converts the frame into the bytes the NMOScillator reads from the ROM. currentTempo is the tempo in effect
+// when the frame is played, which frames that write to the stereo control register re-set if they don't change it.
+// dummy is the chip command written as the dummy commands of a frame which has no chip commands of its own to repeat,
+// and must leave the chip as it is (see NmosSong.dummyCommands). It's ignored by every other frame.
+// The initial tempo of a song is stored in its first frame, which Compile doesn't know about (see NmosSong.Compile).
+func (f *Frame) Compile(isLoopTarget bool, currentTempo uint8, dummy byte) ([]byte, error) {
+	frameSize := f.CalculateSize()
+	numCommands := frameSize - 1
+	buffer := bytes.NewBuffer(make([]byte, 0, frameSize))
+
+	// Calculate the number of command bytes we actually care about writing to the frame (so #commands - #dummy commands)
+	commandBytesToWrite := 0
+	for _, command := range f.commands {
+		if command.commandType == SetSquarePeriodCommand {
+			// Period commands on the square wave channel are 2 bytes long.
+			commandBytesToWrite += 2
+		} else {
+			// All other commands are 1 byte long.
+			commandBytesToWrite++
+		}
+	}
+	if commandBytesToWrite > 1 || f.FrameDelay > 0 {
+		commandBytesToWrite++
+	}
+
+	header, err := FrameHeader{
+		LoopTarget:   isLoopTarget,
+		LoopToTarget: f.LoopToTarget,
+		CommandCount: numCommands, // The size of the frame minus the header itself.
+	}.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	buffer.WriteByte(header)
+
+	// Store the last command written to the frame, to be used as a dummy command if needed.
+	// Frames without chip commands repeat the dummy command they're given instead.
+	lastCommand := dummy
+	if len(f.commands) == 0 && numCommands >= firstChipCommandIndex && dummy&0b10000000 == 0 {
+		// A data byte would be written to whichever register was latched last, changing its value.
+		return nil, fmt.Errorf("frame has no chip commands to repeat as dummy commands, and no dummy command was given")
+	}
+
+	// The reason we iterate over a range instead of f.commands is because
+	// the number of command bytes required may not be the number of actual commands we want to execute.
+	// This happens when the frame contains a tempo change, as tempo changes are always
+	// at command index 14, and so we need filler "dummy commands" to make the index go that high.
+	chipCommandIndex := 0
+	c := numCommands
+	for c > 0 {
+		// fmt.Println("")
+		if c == stereoCommandIndex {
+			// Stereo control command.
+			buffer.WriteByte(f.stereo)
+			c--
+			continue
+		}
+
+		if c == tempoCommandIndex {
+			// Tempo change command.
+			if f.hasTempoChange {
+				// Only write the first 7 bits, which is the highest the tempo should be anyway.
+				buffer.WriteByte(f.tempo & 0x7f)
+			} else {
+				// If the frame doesn't have a tempo value set (for some reason),
+				// make it re-set the tempo value to be the same as the current value (so it doesn't change the tempo).
+				buffer.WriteByte(currentTempo & 0x7f)
+			}
+			c--
+			continue
+		}
+
+		if c == frameDelayCommandIndex {
+			// Frame delay command.
+			buffer.WriteByte(f.FrameDelay)
+			c--
+			continue
+		}
+
+		// The formula here checks if we've already written every command we need to,
+		// and thus outputs true if we should write a dummy command to pad out the frame.
+		// fmt.Printf("Frame's command length: %d\n", numCommands)
+		// fmt.Printf("Number of actual commands: %d\n", commandBytesToWrite)
+		isChipCommand := (c >= firstChipCommandIndex && c <= lastChipCommandIndex)
+		// fmt.Printf("Command index: %d\n", c)
+		// fmt.Printf("Chip command index: %d\n", chipCommandIndex)
+		isDummyCommand := chipCommandIndex >= len(f.commands)
+		// fmt.Printf("Is dummy command: %t\n", isDummyCommand)
+		if isChipCommand && isDummyCommand {
+			// If the command index is higher than the number of commands we want to execute,
+			// and the command index specifies a sound chip command, fill the index with a dummy command.
+			// In this case, the dummy command is the last command repeated again,
+			// which hopefully shouldn't cause audible artifacts, but also changes nothing about
+			// the way the chip is running. Essentially performing no operation.
+			buffer.WriteByte(lastCommand)
+			c--
+			continue
+		}
+
+		// Write all other chip commands now.
+		if isChipCommand {
+			// fmt.Printf("Handling command '%s'\n", f.commands[chipCommandIndex].String())
+			commandBytes := f.commands[chipCommandIndex].toBytes()
+			if len(commandBytes) == 0 {
+				panic(fmt.Sprintf("command is 0 bytes long! Command trying to parse: '%s'", f.commands[chipCommandIndex].String()))
+			}
+			buffer.Write(commandBytes)
+			// fmt.Printf("Command byte length: %d\n", len(commandBytes))
+			lastCommand = commandBytes[len(commandBytes)-1]
+			c -= len(commandBytes)
+			chipCommandIndex++
+			continue
+		}
+
+		panic(fmt.Sprintf("encountered command index %d", c))
+	}
+
+	return buffer.Bytes(), nil
+}
+
 // Compile converts the song data into the ROM binary format that the NMOScillator can play.
 func (s *NmosSong) Compile() ([]byte, error) {
+	if err := s.ValidateLoopTarget(); err != nil {
+		return nil, fmt.Errorf("invalid loop target: %w", err)
+	}
+
 	totalSize := s.CalculateSize()
 	buffer := bytes.NewBuffer(make([]byte, 0, totalSize))
 
+	dummies, err := s.dummyCommands()
+	if err != nil {
+		return nil, err
+	}
+
+	// The tempo in effect when each frame is played, used to fill the tempo change index of frames which don't change it.
+	// Frames in the looped part are played again after looping, maybe at another tempo, so the converter repeats the
+	// ones which need padding there before the loop (see RepeatStereoBeforeLoopTempo).
+	currentTempo := s.InitialTempo
+
 	for i, frame := range s.Frames {
 
 		if i == 0 { // First frame logic.
@@ -131,123 +294,66 @@ func (s *NmosSong) Compile() ([]byte, error) {
 			frame.SetNewTempo(s.InitialTempo)
 			// HACK: We can ignore any errors (probably not the best idea though).
 		}
-
-		frameSize := frame.CalculateSize()
-		numCommands := frameSize&0x0f - 1
-
-		// Calculate the number of command bytes we actually care about writing to the frame (so #commands - #dummy commands)
-		commandBytesToWrite := 0
-		for _, command := range frame.commands {
-			if command.commandType == SetSquarePeriodCommand {
-				// Period commands on the square wave channel are 2 bytes long.
-				commandBytesToWrite += 2
-			} else {
-				// All other commands are 1 byte long.
-				commandBytesToWrite++
-			}
+		if frame.hasTempoChange && !frame.LoopToTarget {
+			currentTempo = frame.tempo
 		}
-		if commandBytesToWrite > 1 || frame.FrameDelay > 0 {
-			commandBytesToWrite++
+
+		frameBytes, err := frame.Compile(i == s.LoopTarget, currentTempo, dummies[i])
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
 		}
+		buffer.Write(frameBytes)
+	}
 
-		const (
-			flagLoopTarget   = 1 << 7 // 0b10000000
-			flagLoopToTarget = 1 << 6 // 0b01000000
-		)
+	// Sanity check to make sure the output binary is the expected size.
+	if buffer.Len() != totalSize {
+		return nil, fmt.Errorf("ROM image size mismatch: got %d bytes, expected %d", buffer.Len(), totalSize)
+	}
+	return buffer.Bytes(), nil
+}
 
-		var header byte
-		header = 0b00000000
+// dummyCommands returns the chip command which each frame without chip commands of its own pads its chip command
+// indexes with, or 0 for frames which don't need one. The command sets a channel's attenuation to the value it
+// already has every time the frame is played, so it changes nothing about the way the chip is running. The loop
+// target can be reached from the end of the song as well, so only attenuations which are the same either way are
+// used from there on (see loopTargetState). If a frame needs a dummy command but no channel's attenuation is known,
+// it returns an error, and 0 for that frame.
+func (s *NmosSong) dummyCommands() ([]byte, error) {
+	dummies := make([]byte, len(s.Frames))
+	sizes := s.frameSizes()
+	loopState := newChipState()
+	if s.LoopTarget > 0 && s.LoopTarget < len(s.Frames) {
+		loopState = s.loopTargetState()
+	}
 
+	var firstErr error
+	state := newChipState()
+	for i, frame := range s.Frames {
 		if i == s.LoopTarget {
-			// If this frame is the loop target, set the appropriate flag bit.
-			header |= flagLoopTarget
+			state = loopState
 		}
 		if frame.LoopToTarget {
-			// If this frame should cause a loop back to the target, set the appropriate flag bit.
-			header |= flagLoopToTarget
-		}
-
-		// Set the lowest 4 bits to the number of commands in the frame (-1 to account for the size of the header).
-		header |= byte(numCommands)
-
-		buffer.WriteByte(header)
-
-		// Store the last command written to the frame, to be used as a dummy command if needed.
-		var lastCommand byte
-
-		// The reason we iterate over a range instead of frame.commands is because
-		// the number of command bytes required may not be the number of actual commands we want to execute.
-		// This happens when the frame contains a tempo change, as tempo changes are always
-		// at command index 14, and so we need filler "dummy commands" to make the index go that high.
-		chipCommandIndex := 0
-		c := numCommands
-		for c > 0 {
-			// fmt.Println("")
-			if c == 14 {
-				// Tempo change command.
-				if frame.hasTempoChange {
-					// Only write the first 7 bits, which is the highest the tempo should be anyway.
-					buffer.WriteByte(frame.tempo & 0x7f)
-				} else {
-					// If the frame doesn't have a tempo value set (for some reason),
-					// make it re-set the tempo value to be the same as the current value (so it doesn't change the tempo).
-
-				}
-				c--
-				continue
-			}
-
-			if c == 1 {
-				// Frame delay command.
-				buffer.WriteByte(frame.FrameDelay)
-				c--
-				continue
-			}
-
-			// The formula here checks if we've already written every command we need to,
-			// and thus outputs true if we should write a dummy command to pad out the frame.
-			// fmt.Printf("Frame's command length: %d\n", numCommands)
-			// fmt.Printf("Number of actual commands: %d\n", commandBytesToWrite)
-			isChipCommand := (c > 1 && c < 14)
-			// fmt.Printf("Command index: %d\n", c)
-			// fmt.Printf("Chip command index: %d\n", chipCommandIndex)
-			isDummyCommand := chipCommandIndex >= len(frame.commands)
-			// fmt.Printf("Is dummy command: %t\n", isDummyCommand)
-			if isChipCommand && isDummyCommand {
-				// If the command index is higher than the number of commands we want to execute,
-				// and the command index specifies a sound chip command, fill the index with a dummy command.
-				// In this case, the dummy command is the last command repeated again,
-				// which hopefully shouldn't cause audible artifacts, but also changes nothing about
-				// the way the chip is running. Essentially performing no operation.
-				buffer.WriteByte(lastCommand)
-				c--
-				continue
-			}
+			continue
+		}
+		for _, c := range frame.commands {
+			state.apply(c)
+		}
+		if len(frame.commands) > 0 || sizes[i]-1 < firstChipCommandIndex {
+			continue
+		}
 
-			// Write all other chip commands now.
-			if isChipCommand {
-				// fmt.Printf("Handling command '%s'\n", frame.commands[chipCommandIndex].String())
-				commandBytes := frame.commands[chipCommandIndex].toBytes()
-				if len(commandBytes) == 0 {
-					panic(fmt.Sprintf("command is 0 bytes long! Command trying to parse: '%s'", frame.commands[chipCommandIndex].String()))
-				}
-				buffer.Write(commandBytes)
-				// fmt.Printf("Command byte length: %d\n", len(commandBytes))
-				lastCommand = commandBytes[len(commandBytes)-1]
-				c -= len(commandBytes)
-				chipCommandIndex++
-				continue
+		found := false
+		for channel, attenuation := range state.attenuations {
+			if attenuation >= 0 {
+				c := command{commandType: SetAttenuationCommand, channel: uint8(channel), attenuation: uint8(attenuation)}
+				dummies[i] = c.toBytes()[0]
+				found = true
+				break
 			}
-
-			panic(fmt.Sprintf("encountered command index %d", c))
 		}
-
-		// TODO: continue writing compile logic
-	}
-
-	// Sanity check to make sure the output binary is the expected size.
-	if buffer.Len() != totalSize {
-		return nil, fmt.Errorf("ROM image size mismatch: got %d bytes, expected %d", buffer.Len(), totalSize)
+		if !found && firstErr == nil {
+			firstErr = fmt.Errorf("frame %d has no chip commands, and no channel's attenuation is known every time it's played, so there's nothing to safely pad it out with", i)
+		}
 	}
-	return buffer.Bytes(), nil
+	return dummies, firstErr
 }
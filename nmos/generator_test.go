@@ -0,0 +1,138 @@
+package nmos
+
+import (
+	"bytes"
+	"testing"
+)
+
+// resetFrame returns a frame which silences every channel, like the first frame of a converted song.
+func resetFrame(t *testing.T) Frame {
+	t.Helper()
+	var f Frame
+	for channel := range uint8(4) {
+		if err := f.SetAttenuation(channel, 15); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+// compiledFrames compiles the song, and splits the ROM into the bytes of each frame.
+func compiledFrames(t *testing.T, s *NmosSong) [][]byte {
+	t.Helper()
+	rom, err := s.Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	var frames [][]byte
+	for _, size := range s.frameSizes() {
+		frames = append(frames, rom[:size])
+		rom = rom[size:]
+	}
+	return frames
+}
+
+// padded returns n copies of b.
+func padded(b byte, n int) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func TestCompilePadsFramesWithoutChipCommands(t *testing.T) {
+	var played Frame
+	if err := played.SetAttenuation(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := played.SetSquarePeriod(0, 300); err != nil {
+		t.Fatal(err)
+	}
+	played.FrameDelay = 2
+
+	var tempoOnly Frame
+	if err := tempoOnly.SetNewTempo(50); err != nil {
+		t.Fatal(err)
+	}
+	tempoOnly.FrameDelay = 3
+
+	var stereoOnly Frame
+	if err := stereoOnly.SetStereo(0xf0); err != nil {
+		t.Fatal(err)
+	}
+
+	song := &NmosSong{
+		InitialTempo: 100,
+		Frames:       []Frame{resetFrame(t), played, tempoOnly, stereoOnly, {LoopToTarget: true}},
+		LoopTarget:   1,
+	}
+	frames := compiledFrames(t, song)
+
+	// Square 1 is set to attenuation 0 every time frame 1 is played, so re-setting it is safe afterwards.
+	const dummy = 0b1_00_1_0000
+	tests := []struct {
+		name  string
+		frame int
+		want  []byte
+	}{
+		{"tempo only", 2, append(append([]byte{0x0e, 50}, padded(dummy, 12)...), 3)},
+		{"stereo only", 3, append(append([]byte{0x0f, 0xf0, 50}, padded(dummy, 12)...), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(frames[tt.frame], tt.want) {
+				t.Errorf("frame %d compiled to % x, want % x", tt.frame, frames[tt.frame], tt.want)
+			}
+		})
+	}
+}
+
+func TestCompilePadsLoopTargetWithStateKnownOnEveryPass(t *testing.T) {
+	var tempoOnly Frame
+	if err := tempoOnly.SetNewTempo(50); err != nil {
+		t.Fatal(err)
+	}
+
+	// Square 1 and 2 are louder at the end of the song than when the loop target is first played,
+	// so only square 3 and noise are known to be silent every time the loop target is played.
+	var louder Frame
+	if err := louder.SetAttenuation(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := louder.SetAttenuation(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	song := &NmosSong{
+		InitialTempo: 100,
+		Frames:       []Frame{resetFrame(t), tempoOnly, louder, {LoopToTarget: true}},
+		LoopTarget:   1,
+	}
+	frames := compiledFrames(t, song)
+
+	want := append(append([]byte{0x8e, 50}, padded(0b1_10_1_1111, 12)...), 0)
+	if !bytes.Equal(frames[1], want) {
+		t.Errorf("loop target compiled to % x, want % x", frames[1], want)
+	}
+}
+
+func TestCompileRejectsFramesWithNothingSafeToPadWith(t *testing.T) {
+	var tempoOnly Frame
+	if err := tempoOnly.SetNewTempo(50); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every channel is louder at the end of the song than when the loop target is first played.
+	var louder Frame
+	for channel := range uint8(4) {
+		if err := louder.SetAttenuation(channel, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	song := &NmosSong{
+		InitialTempo: 100,
+		Frames:       []Frame{resetFrame(t), tempoOnly, louder, {LoopToTarget: true}},
+		LoopTarget:   1,
+	}
+	if rom, err := song.Compile(); err == nil {
+		t.Errorf("Compile succeeded with % x, want an error", rom)
+	}
+}
@@ -0,0 +1,46 @@
+package nmos
+
+import "fmt"
+
+// Bits of the frame header byte, which starts every frame.
+const (
+	FlagLoopTarget     = 1 << 7     // 0b10000000: the frame is the Loop Target.
+	FlagLoopToTarget   = 1 << 6     // 0b01000000: playback jumps back to the Loop Target.
+	HeaderReservedMask = 0b00110000 // Ignored by the NMOScillator, and always written as zeroes.
+	CommandCountMask   = 0x0f       // The number of command bytes following the header.
+)
+
+// MaxCommandCount is the largest number of command bytes a frame can have.
+const MaxCommandCount = CommandCountMask
+
+// FrameHeader is the decoded contents of a frame header byte.
+type FrameHeader struct {
+	LoopTarget   bool
+	LoopToTarget bool
+	CommandCount int // The number of command bytes following the header, from 0 to MaxCommandCount.
+}
+
+// Encode returns the frame header byte. The reserved bits are always zero.
+func (h FrameHeader) Encode() (byte, error) {
+	if h.CommandCount < 0 || h.CommandCount > MaxCommandCount {
+		return 0, fmt.Errorf("a frame can't have %d command bytes, expected 0-%d", h.CommandCount, MaxCommandCount)
+	}
+
+	header := byte(h.CommandCount)
+	if h.LoopTarget {
+		header |= FlagLoopTarget
+	}
+	if h.LoopToTarget {
+		header |= FlagLoopToTarget
+	}
+	return header, nil
+}
+
+// DecodeFrameHeader decodes a frame header byte, ignoring the reserved bits.
+func DecodeFrameHeader(header byte) FrameHeader {
+	return FrameHeader{
+		LoopTarget:   header&FlagLoopTarget != 0,
+		LoopToTarget: header&FlagLoopToTarget != 0,
+		CommandCount: int(header & CommandCountMask),
+	}
+}
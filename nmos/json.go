@@ -0,0 +1,110 @@
+package nmos
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalText serialises the command type as a name.
+func (t CommandType) MarshalText() ([]byte, error) {
+	switch t {
+	case SetSquarePeriodCommand:
+		return []byte("setSquarePeriod"), nil
+	case SetAttenuationCommand:
+		return []byte("setAttenuation"), nil
+	case SetNoiseControlCommand:
+		return []byte("setNoiseControl"), nil
+	default:
+		return nil, fmt.Errorf("unknown command type %d", int(t))
+	}
+}
+
+// MarshalText serialises the noise mode as a name.
+func (m NoiseMode) MarshalText() ([]byte, error) {
+	switch m {
+	case PeriodicNoise:
+		return []byte("periodic"), nil
+	case WhiteNoise:
+		return []byte("white"), nil
+	default:
+		return nil, fmt.Errorf("unknown noise mode %d", int(m))
+	}
+}
+
+// MarshalText serialises the noise rate as a name.
+func (r NoiseRate) MarshalText() ([]byte, error) {
+	switch r {
+	case LowNoise:
+		return []byte("low"), nil
+	case MediumNoise:
+		return []byte("medium"), nil
+	case HighNoise:
+		return []byte("high"), nil
+	case Channel3Noise:
+		return []byte("channel3"), nil
+	default:
+		return nil, fmt.Errorf("unknown noise rate %d", int(r))
+	}
+}
+
+// MarshalJSON serialises the command, only including the fields which are used by its type.
+func (c command) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Type        CommandType `json:"type"`
+		Channel     uint8       `json:"channel"`
+		Period      *uint16     `json:"period,omitempty"`
+		Attenuation *uint8      `json:"attenuation,omitempty"`
+		NoiseMode   *NoiseMode  `json:"noiseMode,omitempty"`
+		NoiseRate   *NoiseRate  `json:"noiseRate,omitempty"`
+	}{
+		Type:    c.commandType,
+		Channel: c.channel,
+	}
+
+	switch c.commandType {
+	case SetSquarePeriodCommand:
+		out.Period = &c.period
+	case SetAttenuationCommand:
+		out.Attenuation = &c.attenuation
+	case SetNoiseControlCommand:
+		out.NoiseMode = &c.noiseMode
+		out.NoiseRate = &c.noiseRate
+	}
+
+	return json.Marshal(out)
+}
+
+// MarshalJSON serialises the frame, including its commands, tempo change and stereo control value.
+func (f Frame) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Commands     []command `json:"commands"`
+		FrameDelay   uint8     `json:"frameDelay"`
+		Tempo        *uint8    `json:"tempo,omitempty"`  // Only present if the frame changes the tempo.
+		Stereo       *uint8    `json:"stereo,omitempty"` // Only present if the frame writes to the stereo register.
+		LoopToTarget bool      `json:"loopToTarget"`
+		Rows         []int     `json:"rows"`
+		Comments     []string  `json:"comments,omitempty"`
+		Size         int       `json:"size"`
+	}{
+		Commands:     f.commands,
+		FrameDelay:   f.FrameDelay,
+		LoopToTarget: f.LoopToTarget,
+		Rows:         f.Rows,
+		Comments:     f.Comments,
+		Size:         f.CalculateSize(),
+	}
+	if out.Commands == nil {
+		out.Commands = []command{}
+	}
+	if out.Rows == nil {
+		out.Rows = []int{}
+	}
+	if f.hasTempoChange {
+		out.Tempo = &f.tempo
+	}
+	if f.hasStereo {
+		out.Stereo = &f.stereo
+	}
+
+	return json.Marshal(out)
+}
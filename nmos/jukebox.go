@@ -0,0 +1,84 @@
+package nmos
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Jukebox chains songs into a single song which plays each of them in turn, then loops back to the first.
+//
+// The NMOScillator can only loop back to a single loop target, so each song's loop is unrolled instead:
+// the looped part of song i is played loops[i] times in total before the next song starts.
+// If loops contains a single value, it's used for every song.
+func Jukebox(songs []*NmosSong, loops []int) (*NmosSong, error) {
+	if len(songs) == 0 {
+		return nil, fmt.Errorf("jukebox needs at least one song")
+	}
+	if len(loops) == 1 {
+		loops = slices.Repeat(loops, len(songs))
+	}
+	if len(loops) != len(songs) {
+		return nil, fmt.Errorf("got %d loop counts for %d songs", len(loops), len(songs))
+	}
+
+	jukebox := &NmosSong{
+		Author:       songs[0].Author,
+		InitialTempo: songs[0].InitialTempo,
+		ClockDiv:     songs[0].ClockDiv,
+		LoopTarget:   0,
+	}
+
+	var names []string
+	for i, song := range songs {
+		if loops[i] < 1 {
+			return nil, fmt.Errorf("song %d must loop at least once, got %d", i, loops[i])
+		}
+		if song.ClockDiv != jukebox.ClockDiv {
+			return nil, fmt.Errorf("song %d uses a different clock rate to the first song", i)
+		}
+		if err := song.ValidateLoopTarget(); err != nil {
+			return nil, fmt.Errorf("song %d: invalid loop target: %w", i, err)
+		}
+		if song.Name != "" {
+			names = append(names, song.Name)
+		}
+
+		// Frames up to the loop frame, which is left out so playback falls through to the looped part again.
+		end := len(song.Frames)
+		for j, frame := range song.Frames {
+			if frame.LoopToTarget {
+				end = j
+				break
+			}
+		}
+
+		if song.LoopTarget >= end {
+			return nil, fmt.Errorf("song %d has its loop target after its loop frame", i)
+		}
+
+		start := len(jukebox.Frames)
+		jukebox.appendFrames(song.Frames[:end])
+		for range loops[i] - 1 {
+			jukebox.appendFrames(song.Frames[song.LoopTarget:end])
+		}
+
+		if i > 0 {
+			// Only the first frame of the jukebox gets the initial tempo when compiling,
+			// so every other song has to set its own.
+			jukebox.Frames[start].SetNewTempo(song.InitialTempo)
+		}
+	}
+
+	jukebox.Name = strings.Join(names, " / ")
+	jukebox.Frames = append(jukebox.Frames, Frame{LoopToTarget: true})
+
+	return jukebox, nil
+}
+
+// appendFrames appends copies of the given frames to the song.
+func (s *NmosSong) appendFrames(frames []Frame) {
+	for _, frame := range frames {
+		s.Frames = append(s.Frames, frame.Clone())
+	}
+}
@@ -0,0 +1,66 @@
+package nmos
+
+import "fmt"
+
+// A song whose looped part is played at a different tempo after looping, because the tempo
+// was changed somewhere between the loop target and the end of the song.
+type LoopTempoMismatch struct {
+	Frame      int    // Index of the last frame which changes the tempo before the song loops.
+	FirstTempo uint8  // Tempo when the loop target is first played.
+	LoopTempo  uint8  // Tempo when the loop target is played again after looping.
+	Section    string // The section of the song Frame is in (see SectionAt), or "" if the song has no comments.
+}
+
+func (m LoopTempoMismatch) String() string {
+	frame := fmt.Sprintf("frame %d", m.Frame)
+	if m.Section != "" {
+		frame += fmt.Sprintf(" (%q)", m.Section)
+	}
+	return fmt.Sprintf("the loop target is first played at tempo %d, but the tempo change in %s makes it play at tempo %d after looping",
+		m.FirstTempo, frame, m.LoopTempo)
+}
+
+// CheckLoopTempo reports whether the tempo in effect at the end of the song differs from the tempo in effect
+// when the loop target is first played. Songs which don't loop, or whose loop target sets its own tempo, are fine.
+func (s *NmosSong) CheckLoopTempo() (LoopTempoMismatch, bool) {
+	if s.LoopTarget < 0 || s.LoopTarget >= len(s.Frames) {
+		return LoopTempoMismatch{}, false
+	}
+
+	loops := false
+	tempo := s.InitialTempo
+	var firstTempo uint8
+	lastChange := -1
+	for i, frame := range s.Frames {
+		if i == s.LoopTarget {
+			if frame.hasTempoChange {
+				// The tempo is set again every time the loop target is played.
+				return LoopTempoMismatch{}, false
+			}
+			firstTempo = tempo
+		}
+		if frame.LoopToTarget {
+			loops = i >= s.LoopTarget
+			break
+		}
+		if i > 0 && frame.hasTempoChange {
+			tempo = frame.tempo
+			lastChange = i
+		}
+	}
+
+	if !loops || tempo == firstTempo {
+		return LoopTempoMismatch{}, false
+	}
+	return LoopTempoMismatch{Frame: lastChange, FirstTempo: firstTempo, LoopTempo: tempo, Section: s.SectionAt(lastChange)}, true
+}
+
+// RestoreTempoAtLoopTarget makes the loop target set the tempo it's first played at, so the looped part of the song
+// always plays at the same tempo. It reports whether the song had to be changed.
+func (s *NmosSong) RestoreTempoAtLoopTarget() bool {
+	mismatch, ok := s.CheckLoopTempo()
+	if !ok {
+		return false
+	}
+	return s.Frames[s.LoopTarget].SetNewTempo(mismatch.FirstTempo) == nil
+}
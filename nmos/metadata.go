@@ -0,0 +1,198 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	metadataVersion     = 1
+	metadataCueVersion  = 2                           // The version of metadata blocks with a cue table for each song.
+	metadataHeader      = "NMOSMETA"                  // Magic bytes at the start of the metadata block.
+	metadataFixedSize   = len(metadataHeader) + 1 + 1 // Magic bytes, version and song count.
+	metadataFooterSize  = 4 + 4                       // Checksum and block size.
+	metadataMaxString   = 255                         // Titles and authors are truncated to this many bytes.
+	metadataAddressSize = 4 + 4                       // Song and loop target addresses at the start of each entry.
+	metadataCueSize     = 2 + 4 + 1                   // Pattern, frame address and tempo of each cue.
+	maxMetadataSongs    = 255
+	maxMetadataCues     = 1<<16 - 1
+)
+
+// The metadata of a single song, as stored in a ROM's metadata block.
+type SongMetadata struct {
+	Title      string
+	Author     string
+	Address    int   // Address of the song's first frame.
+	LoopTarget int   // Address of the song's loop target frame.
+	Cues       []Cue // The song's cue table, which only version 2 blocks have.
+}
+
+// A point partway through a song which it can be played from, so players can seek through it.
+type Cue struct {
+	Pattern int // The pattern (order) of the source song which starts at the cue.
+	Frame   int // The index of the frame the pattern starts in, or -1 if the cue was read from a ROM.
+	Address int // The ROM address of the frame, which is only known once the song is in a ROM.
+	Tempo   int // The tempo to set before playing from the frame, as the frames before it would have.
+}
+
+// Cues returns a cue at the start of every interval-th pattern of the song, given where each of its source rows
+// starts playing (see RowFrames). Patterns which are never played have no cue, and patterns which are jumped into
+// partway through have their cue at the first row played. interval must be at least 1.
+func (s *NmosSong) Cues(rowFrames []RowFrame, interval int) []Cue {
+	var cues []Cue
+	for _, rf := range rowFrames {
+		if rf.Pattern%interval != 0 || len(cues) > 0 && cues[len(cues)-1].Pattern == rf.Pattern {
+			continue
+		}
+		cues = append(cues, Cue{Pattern: rf.Pattern, Frame: rf.Frame, Tempo: int(s.tempoBefore(rf.Frame))})
+	}
+	return cues
+}
+
+// tempoBefore returns the tempo the song plays at when it reaches the frame at the given index, before any tempo
+// change in the frame itself.
+func (s *NmosSong) tempoBefore(frameIndex int) uint8 {
+	tempo := s.InitialTempo
+	for _, frame := range s.Frames[:frameIndex] {
+		if frame.hasTempoChange {
+			tempo = frame.tempo
+		}
+	}
+	return tempo
+}
+
+// AppendMetadata adds a metadata block to the end of a ROM built by BuildRom, listing the title, author
+// and addresses of every song. offsets are the addresses of each song in the ROM, as returned by BuildRom.
+//
+// The block comes after every song, so the NMOScillator never reaches it while playing. It ends with a CRC-32
+// of the whole ROM before the checksum, followed by the size of the block, so it can be found from the end of the ROM.
+func AppendMetadata(rom []byte, songs []*NmosSong, offsets []int) ([]byte, error) {
+	return appendMetadata(rom, songs, offsets, nil)
+}
+
+// AppendMetadataWithCues adds a version 2 metadata block to the end of a ROM, like AppendMetadata, which also has
+// the given cue table for each song (see Cues), so firmware can skip through songs. The address of each cue is
+// filled in from the address of its frame.
+func AppendMetadataWithCues(rom []byte, songs []*NmosSong, offsets []int, cues [][]Cue) ([]byte, error) {
+	if len(cues) != len(songs) {
+		return nil, fmt.Errorf("got %d cue tables for %d songs", len(cues), len(songs))
+	}
+	return appendMetadata(rom, songs, offsets, cues)
+}
+
+// appendMetadata adds a metadata block to the end of a ROM, with a cue table for each song if cues isn't nil.
+func appendMetadata(rom []byte, songs []*NmosSong, offsets []int, cues [][]Cue) ([]byte, error) {
+	if len(songs) != len(offsets) {
+		return nil, fmt.Errorf("got %d offsets for %d songs", len(offsets), len(songs))
+	}
+	if len(songs) > maxMetadataSongs {
+		return nil, fmt.Errorf("metadata blocks can list at most %d songs, got %d", maxMetadataSongs, len(songs))
+	}
+
+	var block bytes.Buffer
+	block.WriteString(metadataHeader)
+	if cues != nil {
+		block.WriteByte(metadataCueVersion)
+	} else {
+		block.WriteByte(metadataVersion)
+	}
+	block.WriteByte(byte(len(songs)))
+	for i, song := range songs {
+		block.Write(binary.LittleEndian.AppendUint32(nil, uint32(offsets[i])))
+		block.Write(binary.LittleEndian.AppendUint32(nil, uint32(song.LoopTargetAddress(offsets[i]))))
+		for _, s := range []string{song.Name, song.Author} {
+			s = s[:min(len(s), metadataMaxString)]
+			block.WriteByte(byte(len(s)))
+			block.WriteString(s)
+		}
+		if cues == nil {
+			continue
+		}
+		if len(cues[i]) > maxMetadataCues {
+			return nil, fmt.Errorf("song %d has %d cues, but metadata blocks can list at most %d for each song", i, len(cues[i]), maxMetadataCues)
+		}
+		addresses := song.FrameAddresses(offsets[i])
+		block.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(cues[i]))))
+		for _, cue := range cues[i] {
+			if cue.Frame < 0 || cue.Frame >= len(addresses) {
+				return nil, fmt.Errorf("song %d has a cue at frame %d, but only %d frames", i, cue.Frame, len(addresses))
+			}
+			if cue.Pattern < 0 || cue.Pattern > 0xffff {
+				return nil, fmt.Errorf("song %d has a cue at pattern %d, but cue tables only hold patterns 0 to %d", i, cue.Pattern, 0xffff)
+			}
+			block.Write(binary.LittleEndian.AppendUint16(nil, uint16(cue.Pattern)))
+			block.Write(binary.LittleEndian.AppendUint32(nil, uint32(addresses[cue.Frame])))
+			block.WriteByte(byte(cue.Tempo) & 0x7f)
+		}
+	}
+
+	out := append(bytes.Clone(rom), block.Bytes()...)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+	out = binary.LittleEndian.AppendUint32(out, uint32(block.Len()+metadataFooterSize))
+	return out, nil
+}
+
+// ReadMetadata finds the metadata block at the end of a ROM and checks its checksum. It returns the metadata of
+// every song, and the ROM without the block. If the ROM has no metadata block, it returns the whole ROM and false.
+func ReadMetadata(rom []byte) ([]SongMetadata, []byte, bool, error) {
+	if len(rom) < metadataFixedSize+metadataFooterSize {
+		return nil, rom, false, nil
+	}
+	size := int(binary.LittleEndian.Uint32(rom[len(rom)-4:]))
+	if size < metadataFixedSize+metadataFooterSize || size > len(rom) || !bytes.HasPrefix(rom[len(rom)-size:], []byte(metadataHeader)) {
+		return nil, rom, false, nil
+	}
+	start := len(rom) - size
+	block := rom[start : len(rom)-metadataFooterSize]
+
+	checksum := binary.LittleEndian.Uint32(rom[len(rom)-metadataFooterSize:])
+	if actual := crc32.ChecksumIEEE(rom[:len(rom)-metadataFooterSize]); actual != checksum {
+		return nil, nil, true, fmt.Errorf("ROM checksum is 0x%08x, but the metadata block expects 0x%08x", actual, checksum)
+	}
+	version := block[len(metadataHeader)]
+	if version != metadataVersion && version != metadataCueVersion {
+		return nil, nil, true, fmt.Errorf("unsupported metadata block version %d", version)
+	}
+
+	count := int(block[len(metadataHeader)+1])
+	songs := make([]SongMetadata, 0, count)
+	data := block[metadataFixedSize:]
+	for i := range count {
+		if len(data) < metadataAddressSize {
+			return nil, nil, true, fmt.Errorf("metadata of song %d is truncated", i)
+		}
+		song := SongMetadata{
+			Address:    int(binary.LittleEndian.Uint32(data[0:4])),
+			LoopTarget: int(binary.LittleEndian.Uint32(data[4:8])),
+		}
+		data = data[metadataAddressSize:]
+		for _, s := range []*string{&song.Title, &song.Author} {
+			if len(data) < 1 || len(data) < 1+int(data[0]) {
+				return nil, nil, true, fmt.Errorf("metadata of song %d is truncated", i)
+			}
+			*s = string(data[1 : 1+int(data[0])])
+			data = data[1+int(data[0]):]
+		}
+		if version == metadataCueVersion {
+			if len(data) < 2 || len(data) < 2+metadataCueSize*int(binary.LittleEndian.Uint16(data)) {
+				return nil, nil, true, fmt.Errorf("cue table of song %d is truncated", i)
+			}
+			numCues := int(binary.LittleEndian.Uint16(data))
+			data = data[2:]
+			song.Cues = make([]Cue, numCues)
+			for j := range song.Cues {
+				song.Cues[j] = Cue{
+					Pattern: int(binary.LittleEndian.Uint16(data[0:2])),
+					Frame:   -1,
+					Address: int(binary.LittleEndian.Uint32(data[2:6])),
+					Tempo:   int(data[6]),
+				}
+				data = data[metadataCueSize:]
+			}
+		}
+		songs = append(songs, song)
+	}
+	return songs, rom[:start], true, nil
+}
@@ -0,0 +1,330 @@
+package nmos
+
+import (
+	"fmt"
+	"slices"
+)
+
+// chipState tracks the last value written to each SN76489 register, so that redundant commands can be found.
+// A value of -1 means the register's value is unknown.
+type chipState struct {
+	periods      [3]int
+	attenuations [4]int
+	noiseControl int
+}
+
+// newChipState returns a chipState where every register's value is unknown.
+func newChipState() chipState {
+	return chipState{
+		periods:      [3]int{-1, -1, -1},
+		attenuations: [4]int{-1, -1, -1, -1},
+		noiseControl: -1,
+	}
+}
+
+// apply updates the state with the given command, and returns false if the command didn't change anything.
+func (cs *chipState) apply(c command) bool {
+	var register *int
+	var value int
+	switch c.commandType {
+	case SetSquarePeriodCommand:
+		register = &cs.periods[c.channel]
+		value = int(c.period)
+	case SetAttenuationCommand:
+		register = &cs.attenuations[c.channel]
+		value = int(c.attenuation)
+	case SetNoiseControlCommand:
+		register = &cs.noiseControl
+		value = int(c.noiseMode)<<2 | int(c.noiseRate)
+	default:
+		return true
+	}
+
+	if *register == value {
+		return false
+	}
+	*register = value
+	return true
+}
+
+// OptimizeLevel selects which optimization passes are run on a song.
+type OptimizeLevel int
+
+const (
+	OptimizeOff OptimizeLevel = iota
+	// Runs the passes which cut the number of frames and chip writes the player handles each tick,
+	// while keeping the loop target frame independent of the end of the song.
+	OptimizeSpeed
+	// Runs every pass which shrinks the ROM.
+	OptimizeSize
+)
+
+func (l OptimizeLevel) String() string {
+	switch l {
+	case OptimizeOff:
+		return "off"
+	case OptimizeSpeed:
+		return "speed"
+	case OptimizeSize:
+		return "size"
+	default:
+		return fmt.Sprintf("OptimizeLevel(%d)", int(l))
+	}
+}
+
+// ParseOptimizeLevel returns the OptimizeLevel with the given name.
+func ParseOptimizeLevel(name string) (OptimizeLevel, error) {
+	switch name {
+	case "off":
+		return OptimizeOff, nil
+	case "speed":
+		return OptimizeSpeed, nil
+	case "size":
+		return OptimizeSize, nil
+	default:
+		return 0, fmt.Errorf("unknown optimization level %q, expected size, speed or off", name)
+	}
+}
+
+// The outcome of a single optimization pass.
+type OptimizePass struct {
+	Name  string
+	Saved int // The number of bytes saved by the pass.
+}
+
+func (p OptimizePass) String() string {
+	return fmt.Sprintf("%s saved %d bytes", p.Name, p.Saved)
+}
+
+// Optimize shrinks the song without changing the way it sounds, and returns the passes which were run
+// along with the number of bytes each one saved.
+//
+// Commands which restate the chip's current state are removed, as are tempo changes which re-set the current tempo,
+// and frames which are left empty are merged into the previous frame by extending its frame delay.
+// At OptimizeSize, commands in the loop target frame are also removed if they restate the chip's state both when
+// the loop target is first played and when the song loops back to it.
+func (s *NmosSong) Optimize(level OptimizeLevel) []OptimizePass {
+	if level == OptimizeOff {
+		return nil
+	}
+
+	passes := []struct {
+		name string
+		run  func()
+	}{
+		{"redundant commands", func() { s.removeRedundantCommands(level == OptimizeSize) }},
+		{"redundant tempo changes", s.removeRedundantTempoChanges},
+		{"empty frame merging", s.mergeEmptyFrames},
+	}
+
+	var results []OptimizePass
+	for _, pass := range passes {
+		before := s.CalculateSize()
+		pass.run()
+		results = append(results, OptimizePass{Name: pass.name, Saved: before - s.CalculateSize()})
+	}
+	return results
+}
+
+// removeRedundantCommands removes any commands which set a register to the value it already has.
+// If loopAware is true, registers with the same value when the loop target is first played and when
+// the song loops back to it are treated as known at the loop target.
+func (s *NmosSong) removeRedundantCommands(loopAware bool) {
+	// The loop target can be reached from the end of the song as well as the previous frame,
+	// so only registers which have the same value either way are known there.
+	loopState := newChipState()
+	if loopAware {
+		loopState = s.loopTargetState()
+	}
+
+	state := newChipState()
+	for i := range s.Frames {
+		frame := &s.Frames[i]
+		if i == s.LoopTarget {
+			state = loopState
+		}
+		if frame.LoopToTarget {
+			// Nothing else in a loop frame gets executed.
+			continue
+		}
+
+		frame.commands = slices.DeleteFunc(frame.commands, func(c command) bool {
+			return !state.apply(c)
+		})
+	}
+}
+
+// loopTargetState returns the registers which have the same value when the loop target is first played
+// and every time the song loops back to it. Every other register is unknown.
+func (s *NmosSong) loopTargetState() chipState {
+	first := newChipState()
+	for _, frame := range s.Frames[:s.LoopTarget] {
+		for _, c := range frame.commands {
+			first.apply(c)
+		}
+	}
+
+	// Removing redundant commands never changes the state, so the state at the end of the song
+	// is the same before and after they're removed.
+	last := first
+	for _, frame := range s.Frames[s.LoopTarget:] {
+		if frame.LoopToTarget {
+			break
+		}
+		for _, c := range frame.commands {
+			last.apply(c)
+		}
+	}
+
+	known := newChipState()
+	for c := range known.periods {
+		if first.periods[c] == last.periods[c] {
+			known.periods[c] = first.periods[c]
+		}
+	}
+	for c := range known.attenuations {
+		if first.attenuations[c] == last.attenuations[c] {
+			known.attenuations[c] = first.attenuations[c]
+		}
+	}
+	if first.noiseControl == last.noiseControl {
+		known.noiseControl = first.noiseControl
+	}
+	return known
+}
+
+// removeRedundantTempoChanges removes tempo changes which set the tempo that's already in effect.
+// Frames which write to the stereo control register keep their tempo changes, as they re-set the tempo anyway.
+func (s *NmosSong) removeRedundantTempoChanges() {
+	if len(s.Frames) == 0 {
+		return
+	}
+
+	// The tempo when the song loops back to the loop target.
+	endTempo := s.InitialTempo
+	for _, frame := range s.Frames {
+		if frame.hasTempoChange && !frame.LoopToTarget {
+			endTempo = frame.tempo
+		}
+	}
+
+	tempo := s.InitialTempo
+	known := true // Whether tempo is the tempo in effect every time the frame is played.
+	for i := range s.Frames {
+		frame := &s.Frames[i]
+		if i == s.LoopTarget && tempo != endTempo {
+			// The loop target is reached with a different tempo the first time than when the song loops back to it.
+			known = false
+		}
+		if !frame.hasTempoChange || frame.LoopToTarget {
+			continue
+		}
+		if i == 0 {
+			// The first frame's tempo change replaces the initial tempo, so it's never redundant.
+			tempo = frame.tempo
+			continue
+		}
+		redundant := known && frame.tempo == tempo && !frame.hasStereo
+		tempo, known = frame.tempo, true
+		if redundant {
+			frame.hasTempoChange = false
+			frame.tempo = 0
+		}
+	}
+}
+
+// mergeEmptyFrames merges frames which contain nothing but a frame delay into the previous frame's delay.
+func (s *NmosSong) mergeEmptyFrames() {
+	if len(s.Frames) == 0 {
+		return
+	}
+
+	merged := []Frame{s.Frames[0]}
+	newLoopTarget := 0
+	for i, frame := range s.Frames[1:] {
+		i++ // Index into s.Frames, not s.Frames[1:].
+		prev := &merged[len(merged)-1]
+
+		canMerge := i != s.LoopTarget &&
+			len(frame.commands) == 0 &&
+			!frame.hasTempoChange &&
+			!frame.hasStereo &&
+			!frame.LoopToTarget &&
+			!prev.LoopToTarget &&
+			int(prev.FrameDelay)+int(frame.FrameDelay)+1 <= 255
+
+		if canMerge {
+			// Playing an empty frame takes one tick plus its frame delay.
+			prev.FrameDelay += frame.FrameDelay + 1
+			prev.Rows = append(prev.Rows, frame.Rows...)
+			prev.Comments = append(prev.Comments, frame.Comments...)
+			continue
+		}
+
+		if i == s.LoopTarget {
+			newLoopTarget = len(merged)
+		}
+		merged = append(merged, frame)
+	}
+
+	s.Frames = merged
+	s.LoopTarget = newLoopTarget
+}
+
+// isSilent reports whether every channel is known to be fully attenuated.
+func (cs *chipState) isSilent() bool {
+	for _, a := range cs.attenuations {
+		if a != maxAttenuation {
+			return false
+		}
+	}
+	return true
+}
+
+// TrimTrailingSilence removes the blank frames at the end of a song whose looped part is silent, such as a
+// song which halts, and returns the number of frames removed. Blank frames are frames which leave every channel
+// silent and don't change the tempo or stereo. Frames in the looped part are never removed, as they set how
+// long the loop lasts.
+func (s *NmosSong) TrimTrailingSilence() int {
+	if s.LoopTarget <= 1 || s.LoopTarget >= len(s.Frames) {
+		return 0
+	}
+
+	// The state of the chip before each frame up to the loop target, which is only ever played once.
+	state := newChipState()
+	silentBefore := make([]bool, s.LoopTarget+1)
+	for i, frame := range s.Frames[:s.LoopTarget] {
+		silentBefore[i] = state.isSilent()
+		for _, c := range frame.commands {
+			state.apply(c)
+		}
+	}
+	silentBefore[s.LoopTarget] = state.isSilent()
+
+	// Silence before the loop target is only trailing if the loop never makes a sound.
+	for _, frame := range s.Frames[s.LoopTarget:] {
+		if frame.LoopToTarget {
+			break
+		}
+		for _, c := range frame.commands {
+			state.apply(c)
+		}
+		if !state.isSilent() {
+			return 0
+		}
+	}
+
+	start := s.LoopTarget
+	for start > 1 {
+		frame := &s.Frames[start-1]
+		if !silentBefore[start-1] || !silentBefore[start] || frame.hasTempoChange || frame.hasStereo || frame.LoopToTarget {
+			break
+		}
+		start--
+	}
+
+	trimmed := s.LoopTarget - start
+	s.Frames = slices.Delete(s.Frames, start, s.LoopTarget)
+	s.LoopTarget = start
+	return trimmed
+}
@@ -0,0 +1,52 @@
+package nmos
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOptimizeTempoFrameWithOnlyRedundantCommands(t *testing.T) {
+	var played Frame
+	if err := played.SetAttenuation(0, 5); err != nil {
+		t.Fatal(err)
+	}
+	played.FrameDelay = 2
+
+	// Square 1 is already at attenuation 5, so the optimizer leaves this frame with just its tempo change.
+	var tempo Frame
+	if err := tempo.SetNewTempo(50); err != nil {
+		t.Fatal(err)
+	}
+	if err := tempo.SetAttenuation(0, 5); err != nil {
+		t.Fatal(err)
+	}
+	tempo.FrameDelay = 3
+
+	song := &NmosSong{
+		InitialTempo: 100,
+		Frames:       []Frame{resetFrame(t), played, tempo, {LoopToTarget: true}},
+		LoopTarget:   1,
+	}
+	before := song.Clone()
+	song.Optimize(OptimizeSize)
+
+	if n := len(song.Frames[2].commands); n != 0 {
+		t.Fatalf("optimized tempo frame has %d commands, want 0", n)
+	}
+	frames := compiledFrames(t, song)
+	want := append(append([]byte{0x0e, 50}, padded(0b1_00_1_0101, 12)...), 3)
+	if !bytes.Equal(frames[2], want) {
+		t.Errorf("optimized tempo frame compiled to % x, want % x", frames[2], want)
+	}
+	beforeEvents, err := before.Simulate()
+	if err != nil {
+		t.Fatalf("simulating the song: %v", err)
+	}
+	afterEvents, err := song.Simulate()
+	if err != nil {
+		t.Fatalf("simulating the optimized song: %v", err)
+	}
+	if err := ComparePlayback(beforeEvents, afterEvents); err != nil {
+		t.Errorf("optimized song plays differently: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Options for Render.
+type RenderOptions struct {
+	SampleRate int         // Samples per second.
+	Loops      int         // How many extra times the looped part is played after the song reaches its end.
+	Chip       ChipVariant // The chip the song is played on, which sets the noise channel's shift register.
+}
+
+// The loop of a rendered song, in samples from the start of the render. Playing the samples from Start up to
+// (but not including) End over and over sounds like the NMOScillator looping the song.
+type RenderLoop struct {
+	Start int
+	End   int
+}
+
+// Seconds returns the start and end of the loop in seconds.
+func (l RenderLoop) Seconds(sampleRate int) (start, end float64) {
+	return float64(l.Start) / float64(sampleRate), float64(l.End) / float64(sampleRate)
+}
+
+// synth is a simple model of the SN76489, good enough to preview a song.
+type synth struct {
+	chip       ChipVariant
+	clockRate  float64
+	sampleRate float64
+
+	registers chipState
+	phases    [3]float64 // Position within the current cycle of each square channel, from 0 to 1.
+	lfsr      uint32     // The noise shift register.
+	lfsrPhase float64    // Time until the next shift of the noise register, in shifts.
+}
+
+// newSynth returns a synth where every register's value is unknown, which plays as silence.
+func newSynth(chip ChipVariant, clockRate float64, sampleRate int) *synth {
+	return &synth{
+		chip:       chip,
+		clockRate:  clockRate,
+		sampleRate: float64(sampleRate),
+		registers:  newChipState(),
+		lfsr:       1 << (chip.NoiseLFSRBits - 1),
+	}
+}
+
+// write applies a command to the chip. Writing the noise control register resets the noise shift register.
+func (sy *synth) write(c command) {
+	sy.registers.apply(c)
+	if c.commandType == SetNoiseControlCommand {
+		sy.lfsr = 1 << (sy.chip.NoiseLFSRBits - 1)
+	}
+}
+
+// squareFrequency returns the frequency of a square channel's output, or 0 if it's too high to play back.
+func (sy *synth) squareFrequency(channel int) float64 {
+	period := sy.registers.periods[channel]
+	if period < 0 {
+		return 0
+	}
+	if period == 0 {
+		if !sy.chip.ZeroPeriodIsLowest {
+			return 0
+		}
+		period = 1024
+	}
+	num, den := sy.chip.squareDivider()
+	freq := sy.clockRate * float64(den) / (float64(num) * float64(period))
+	if freq >= sy.sampleRate/2 {
+		return 0
+	}
+	return freq
+}
+
+// shiftRate returns the number of times per second the noise shift register shifts.
+func (sy *synth) shiftRate() float64 {
+	if sy.registers.noiseControl < 0 {
+		return 0
+	}
+	switch NoiseRate(sy.registers.noiseControl & 0b11) {
+	case HighNoise:
+		return sy.clockRate / float64(sy.chip.Prescaler*64)
+	case MediumNoise:
+		return sy.clockRate / float64(sy.chip.Prescaler*128)
+	case LowNoise:
+		return sy.clockRate / float64(sy.chip.Prescaler*256)
+	default:
+		// The register shifts once for every cycle of square channel 3.
+		return sy.squareFrequency(TrackedChannel)
+	}
+}
+
+// volume returns the amplitude of a channel from 0 to 1. The SN76489 attenuates by 2 dB per step.
+func (sy *synth) volume(channel int) float64 {
+	attenuation := sy.registers.attenuations[channel]
+	if attenuation < 0 || attenuation >= maxAttenuation {
+		return 0
+	}
+	return math.Pow(10, -2*float64(attenuation)/20)
+}
+
+// sample returns the next sample, from -1 to 1.
+func (sy *synth) sample() float64 {
+	out := 0.0
+	for c := range sy.phases {
+		freq := sy.squareFrequency(c)
+		if freq == 0 {
+			continue
+		}
+		sy.phases[c] = math.Mod(sy.phases[c]+freq/sy.sampleRate, 1)
+		if sy.phases[c] < 0.5 {
+			out += sy.volume(c)
+		} else {
+			out -= sy.volume(c)
+		}
+	}
+
+	if rate := sy.shiftRate(); rate > 0 {
+		sy.lfsrPhase += rate / sy.sampleRate
+		for ; sy.lfsrPhase >= 1; sy.lfsrPhase-- {
+			sy.shift()
+		}
+	}
+	if sy.lfsr&1 != 0 {
+		out += sy.volume(NoiseChannel)
+	} else {
+		out -= sy.volume(NoiseChannel)
+	}
+	return out / 4
+}
+
+// shift shifts the noise register once, feeding back its lowest bit (periodic noise) or a mix of its bits (white noise).
+func (sy *synth) shift() {
+	feedback := sy.lfsr & 1
+	if NoiseMode(sy.registers.noiseControl>>2) == WhiteNoise {
+		tap := uint32(1)
+		if sy.chip.NoiseLFSRBits == 16 {
+			tap = 3 // The Sega PSG taps bits 0 and 3.
+		}
+		feedback ^= sy.lfsr >> tap & 1
+	}
+	sy.lfsr = sy.lfsr>>1 | feedback<<(sy.chip.NoiseLFSRBits-1)
+}
+
+// Render plays the song through a simple model of the SN76489 and returns the samples, along with the loop.
+// The song is played to its end, and then through its looped part opts.Loops more times. The stereo control
+// register isn't modelled, so the render is mono.
+func (s *NmosSong) Render(opts RenderOptions) ([]int16, RenderLoop) {
+	clockRate := 4e6
+	if s.ClockDiv {
+		clockRate = 2e6
+	}
+	sy := newSynth(opts.Chip, clockRate, opts.SampleRate)
+
+	var samples []int16
+	var loop RenderLoop
+	tempo := s.InitialTempo
+	elapsed := 0.0 // Seconds since the start of the song.
+
+	play := func(frames []Frame) {
+		for _, frame := range frames {
+			if frame.LoopToTarget {
+				return
+			}
+			for _, c := range frame.commands {
+				sy.write(c)
+			}
+			if frame.hasTempoChange {
+				tempo = frame.tempo
+			}
+			elapsed += float64(int(frame.FrameDelay)+1) / frameClockRate(tempo)
+			for end := int(math.Round(elapsed * float64(opts.SampleRate))); len(samples) < end; {
+				samples = append(samples, int16(sy.sample()*math.MaxInt16*0.9))
+			}
+		}
+	}
+
+	loopTarget := max(min(s.LoopTarget, len(s.Frames)), 0)
+	play(s.Frames[:loopTarget])
+	loop.Start = len(samples)
+	play(s.Frames[loopTarget:])
+	loop.End = len(samples)
+	for range opts.Loops {
+		play(s.Frames[loopTarget:])
+	}
+	return samples, loop
+}
+
+// WriteWAV writes samples rendered by Render to a mono, 16-bit WAV file. The loop is marked with both a smpl chunk,
+// which samplers and game engines use to loop the sound, and a pair of cue points, which audio editors show as markers.
+func WriteWAV(w io.Writer, samples []int16, sampleRate int, loop RenderLoop) error {
+	var body bytes.Buffer
+	le := binary.LittleEndian
+	chunk := func(id string, data []byte) {
+		body.WriteString(id)
+		binary.Write(&body, le, uint32(len(data)))
+		body.Write(data)
+		if len(data)%2 != 0 {
+			body.WriteByte(0) // Chunks are padded to an even length.
+		}
+	}
+
+	var fmtChunk bytes.Buffer
+	binary.Write(&fmtChunk, le, struct {
+		Format, Channels          uint16
+		SampleRate, ByteRate      uint32
+		BlockAlign, BitsPerSample uint16
+	}{1, 1, uint32(sampleRate), uint32(sampleRate * 2), 2, 16})
+	chunk("fmt ", fmtChunk.Bytes())
+
+	var data bytes.Buffer
+	binary.Write(&data, le, samples)
+	chunk("data", data.Bytes())
+
+	if loop.End > loop.Start {
+		var cue bytes.Buffer
+		binary.Write(&cue, le, uint32(2))
+		for i, position := range []int{loop.Start, loop.End} {
+			binary.Write(&cue, le, struct {
+				ID, Position           uint32
+				Chunk                  [4]byte
+				ChunkStart, BlockStart uint32
+				SampleOffset           uint32
+			}{uint32(i + 1), uint32(position), [4]byte{'d', 'a', 't', 'a'}, 0, 0, uint32(position)})
+		}
+		chunk("cue ", cue.Bytes())
+
+		var labels bytes.Buffer
+		labels.WriteString("adtl")
+		for i, label := range []string{"Loop start", "Loop end"} {
+			labels.WriteString("labl")
+			text := append([]byte(label), 0)
+			binary.Write(&labels, le, uint32(4+len(text)))
+			binary.Write(&labels, le, uint32(i+1))
+			labels.Write(text)
+			if len(text)%2 != 0 {
+				labels.WriteByte(0)
+			}
+		}
+		chunk("LIST", labels.Bytes())
+
+		var smpl bytes.Buffer
+		binary.Write(&smpl, le, struct {
+			Manufacturer, Product, SamplePeriod uint32
+			UnityNote, PitchFraction            uint32
+			SMPTEFormat, SMPTEOffset            uint32
+			Loops, SamplerData                  uint32
+			CueID, LoopType, LoopStart, LoopEnd uint32
+			LoopFraction, PlayCount             uint32
+		}{
+			SamplePeriod: uint32(1e9 / sampleRate), // In nanoseconds.
+			UnityNote:    60,
+			Loops:        1,
+			CueID:        1,
+			LoopStart:    uint32(loop.Start),
+			LoopEnd:      uint32(loop.End - 1), // The last sample played in the loop, not the one after it.
+			// A forward loop (type 0) with a play count of 0, which loops forever.
+		})
+		chunk("smpl", smpl.Bytes())
+	}
+
+	var header bytes.Buffer
+	header.WriteString("RIFF")
+	binary.Write(&header, le, uint32(4+body.Len()))
+	header.WriteString("WAVE")
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
@@ -0,0 +1,176 @@
+package nmos
+
+import (
+	"fmt"
+	"hash/maphash"
+	"slices"
+)
+
+// A run of frames which is identical to an earlier run of frames in the same song.
+//
+// The NMOScillator reads frames strictly in order with its address counter (apart from the single loop back to
+// the loop target), and has no stack to return from a call with, so the ROM format has no way to call or repeat
+// an earlier run of frames and repeated runs must be stored in full. Repeats are only reported so that the
+// potential savings of hardware which could play them can be measured.
+type Repeat struct {
+	Start  int // Index of the first frame in the repeated run.
+	Source int // Index of the first frame in the earlier run which it repeats.
+	Length int // Number of frames in the run.
+	Size   int // Size of the run in bytes.
+
+	// The sections of the song the runs start in (see SectionAt), or "" if the song has no comments.
+	StartSection, SourceSection string
+}
+
+func (r Repeat) String() string {
+	s := fmt.Sprintf("frames %d..%d repeat frames %d..%d (%d bytes)", r.Start, r.Start+r.Length-1, r.Source, r.Source+r.Length-1, r.Size)
+	if r.StartSection != "" || r.SourceSection != "" {
+		s += fmt.Sprintf(" [%q repeats %q]", r.StartSection, r.SourceSection)
+	}
+	return s
+}
+
+// equal reports whether two frames would compile to the same bytes.
+func (f *Frame) equal(other *Frame) bool {
+	return f.FrameDelay == other.FrameDelay &&
+		f.hasTempoChange == other.hasTempoChange &&
+		f.tempo == other.tempo &&
+		f.hasStereo == other.hasStereo &&
+		f.stereo == other.stereo &&
+		f.LoopToTarget == other.LoopToTarget &&
+		slices.Equal(f.commands, other.commands)
+}
+
+// FindRepeats finds runs of at least minLength frames which are identical to an earlier run in the song.
+// The runs don't overlap each other, and the longest earlier match is preferred.
+//
+// Only earlier runs whose first minLength frames match, found by a rolling hash of the frames, are compared in full,
+// so songs with many frames don't take quadratic time per frame.
+func (s *NmosSong) FindRepeats(minLength int) []Repeat {
+	minLength = max(minLength, 1)
+
+	ids := s.frameIDs()
+	hashes := windowHashes(ids, minLength)
+	// The earlier runs of minLength frames with each hash, which all end before the frame being matched.
+	sources := make(map[uint64][]int)
+	added := 0
+
+	var repeats []Repeat
+	for start := 1; start < len(s.Frames); {
+		// The earlier run must end before the repeated run starts.
+		for ; added+minLength <= start; added++ {
+			sources[hashes[added]] = append(sources[hashes[added]], added)
+		}
+
+		bestSource, bestLength := 0, 0
+		if start+minLength <= len(ids) {
+			for _, source := range sources[hashes[start]] {
+				length := 0
+				for source+length < start && start+length < len(ids) && ids[source+length] == ids[start+length] {
+					length++
+				}
+				if length > bestLength {
+					bestSource, bestLength = source, length
+				}
+			}
+		}
+
+		if bestLength < minLength {
+			start++
+			continue
+		}
+
+		size := 0
+		for i := start; i < start+bestLength; i++ {
+			size += s.Frames[i].CalculateSize()
+		}
+		repeats = append(repeats, Repeat{
+			Start:         start,
+			Source:        bestSource,
+			Length:        bestLength,
+			Size:          size,
+			StartSection:  s.SectionAt(start),
+			SourceSection: s.SectionAt(bestSource),
+		})
+		start += bestLength
+	}
+
+	return repeats
+}
+
+// frameIDs numbers the frames of the song, so that a frame has the same number as the frames it repeats
+// (see isRepeatable). The first frame and the loop target never repeat, so they have negative numbers of their own.
+func (s *NmosSong) frameIDs() []int {
+	seed := maphash.MakeSeed()
+	ids := make([]int, len(s.Frames))
+	var firsts []int                  // The first frame with each number.
+	buckets := make(map[uint64][]int) // The numbers of the frames with each hash.
+	for i := range s.Frames {
+		if i == 0 || i == s.LoopTarget {
+			ids[i] = -1 - i
+			continue
+		}
+		frame := &s.Frames[i]
+		h := frame.hash(seed)
+		ids[i] = -1
+		for _, id := range buckets[h] {
+			if s.Frames[firsts[id]].equal(frame) {
+				ids[i] = id
+				break
+			}
+		}
+		if ids[i] == -1 {
+			ids[i] = len(firsts)
+			firsts = append(firsts, i)
+			buckets[h] = append(buckets[h], ids[i])
+		}
+	}
+	return ids
+}
+
+// hash returns a hash of everything which equal compares.
+func (f *Frame) hash(seed maphash.Seed) uint64 {
+	var h maphash.Hash
+	h.SetSeed(seed)
+	maphash.WriteComparable(&h, struct {
+		frameDelay, tempo, stereo               uint8
+		hasTempoChange, hasStereo, loopToTarget bool
+	}{f.FrameDelay, f.tempo, f.stereo, f.hasTempoChange, f.hasStereo, f.LoopToTarget})
+	for _, c := range f.commands {
+		maphash.WriteComparable(&h, c)
+	}
+	return h.Sum64()
+}
+
+// windowHashes returns a rolling hash of every run of the given length in ids, indexed by the start of the run.
+func windowHashes(ids []int, length int) []uint64 {
+	if len(ids) < length {
+		return nil
+	}
+	const base = 1099511628211
+	// The factor of the first id in a run, which is taken back out as the run moves on.
+	var first uint64 = 1
+	for range length - 1 {
+		first *= base
+	}
+	hashes := make([]uint64, len(ids)-length+1)
+	var h uint64
+	for i, id := range ids {
+		if i >= length {
+			hashes[i-length] = h
+			h -= uint64(ids[i-length]) * first
+		}
+		h = h*base + uint64(id)
+	}
+	hashes[len(hashes)-1] = h
+	return hashes
+}
+
+// isRepeatable reports whether the frame at index b repeats the frame at index a.
+// The first frame and the loop target are never treated as repeats, as they have special meaning.
+func (s *NmosSong) isRepeatable(a, b int) bool {
+	if a == 0 || b == 0 || a == s.LoopTarget || b == s.LoopTarget {
+		return false
+	}
+	return s.Frames[a].equal(&s.Frames[b])
+}
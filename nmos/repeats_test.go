@@ -0,0 +1,61 @@
+package nmos
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// findRepeatsSlowly is FindRepeats comparing every earlier run with every frame in full.
+func (s *NmosSong) findRepeatsSlowly(minLength int) []Repeat {
+	minLength = max(minLength, 1)
+
+	var repeats []Repeat
+	for start := 1; start < len(s.Frames); {
+		bestSource, bestLength := 0, 0
+		for source := 0; source < start; source++ {
+			length := 0
+			for source+length < start && start+length < len(s.Frames) &&
+				s.isRepeatable(source+length, start+length) {
+				length++
+			}
+			if length > bestLength {
+				bestSource, bestLength = source, length
+			}
+		}
+		if bestLength < minLength {
+			start++
+			continue
+		}
+		size := 0
+		for i := start; i < start+bestLength; i++ {
+			size += s.Frames[i].CalculateSize()
+		}
+		repeats = append(repeats, Repeat{Start: start, Source: bestSource, Length: bestLength, Size: size})
+		start += bestLength
+	}
+	return repeats
+}
+
+func TestFindRepeats(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := range 200 {
+		// Few distinct frames, so runs repeat often and at many lengths.
+		song := &NmosSong{Frames: make([]Frame, 1+r.IntN(60))}
+		for j := range song.Frames {
+			song.Frames[j].FrameDelay = uint8(r.IntN(3))
+			if r.IntN(2) == 0 {
+				if err := song.Frames[j].SetAttenuation(0, uint8(r.IntN(2))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		song.LoopTarget = r.IntN(len(song.Frames))
+		for minLength := range 5 {
+			got, want := song.FindRepeats(minLength), song.findRepeatsSlowly(minLength)
+			if !slices.Equal(got, want) {
+				t.Fatalf("song %d with %d frames, minimum length %d: found %v, want %v", i, len(song.Frames), minLength, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// RomLayout determines how multiple songs are arranged in a single ROM image.
+type RomLayout int
+
+const (
+	LayoutFlat    RomLayout = iota // Songs are concatenated with nothing in between.
+	LayoutIndexed                  // Songs are preceded by a directory listing where each song starts.
+)
+
+func (l RomLayout) String() string {
+	switch l {
+	case LayoutFlat:
+		return "flat"
+	case LayoutIndexed:
+		return "indexed"
+	default:
+		return fmt.Sprintf("RomLayout(%d)", int(l))
+	}
+}
+
+// ParseRomLayout returns the RomLayout with the given name.
+func ParseRomLayout(name string) (RomLayout, error) {
+	switch name {
+	case "flat":
+		return LayoutFlat, nil
+	case "indexed":
+		return LayoutIndexed, nil
+	default:
+		return 0, fmt.Errorf("unknown ROM layout %q, expected flat or indexed", name)
+	}
+}
+
+const (
+	directoryVersion   = 1
+	directoryNameSize  = 32                           // Song names are truncated or padded with zeroes to this many bytes.
+	directoryEntrySize = 4 + 1 + directoryNameSize    // Offset, initial tempo and name.
+	directoryHeader    = "NMOS"                       // Magic bytes at the start of the directory.
+	directoryFixedSize = len(directoryHeader) + 1 + 1 // Magic bytes, version and song count.
+	maxDirectorySongs  = 255
+)
+
+// FormatVersions holds the version of each versioned block and file the compiler writes, by name: the song directory
+// of indexed ROMs, the metadata block, save states, and GD3 tags. Tools can check these before reading them.
+var FormatVersions = map[string]int{
+	"directory":  directoryVersion,
+	"metadata":   metadataCueVersion,
+	"save-state": SaveStateVersion,
+	"gd3":        gd3Version,
+}
+
+// BuildRom compiles every song and arranges them into a single ROM image using the given layout.
+// It also returns the address in the ROM at which each song starts.
+func BuildRom(songs []*NmosSong, layout RomLayout) ([]byte, []int, error) {
+	compiled, err := compileAll(songs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headerSize, err := directorySize(songs, layout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	offsets := make([]int, len(songs))
+	address := headerSize
+	for i, bin := range compiled {
+		offsets[i] = address
+		address += len(bin)
+	}
+
+	var buffer bytes.Buffer
+	buffer.Grow(address)
+
+	if layout == LayoutIndexed {
+		buffer.Write(appendDirectory(nil, songs, offsets))
+	}
+
+	for _, bin := range compiled {
+		buffer.Write(bin)
+	}
+
+	return buffer.Bytes(), offsets, nil
+}
+
+// PlanRom returns the address at which each song starts in the ROM BuildRom would build from the songs,
+// and the size of that ROM, without compiling them.
+func PlanRom(songs []*NmosSong, layout RomLayout) ([]int, int, error) {
+	headerSize, err := directorySize(songs, layout)
+	if err != nil {
+		return nil, 0, err
+	}
+	offsets := make([]int, len(songs))
+	address := headerSize
+	for i, song := range songs {
+		offsets[i] = address
+		address += song.CalculateSize()
+	}
+	return offsets, address, nil
+}
+
+// WriteRomAt builds the same ROM as BuildRom, but writes each part of it straight to its address in w,
+// compiling one song at a time so the whole ROM is never held in memory. w is usually a file which has been
+// truncated to the size of the ROM returned by PlanRom. It returns the address at which each song starts.
+func WriteRomAt(w io.WriterAt, songs []*NmosSong, layout RomLayout) ([]int, error) {
+	offsets, _, err := PlanRom(songs, layout)
+	if err != nil {
+		return nil, err
+	}
+	if layout == LayoutIndexed {
+		if _, err := w.WriteAt(appendDirectory(nil, songs, offsets), 0); err != nil {
+			return nil, fmt.Errorf("error writing directory: %w", err)
+		}
+	}
+	for i, song := range songs {
+		bin, err := song.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("error compiling song %d: %w", i, err)
+		}
+		if _, err := w.WriteAt(bin, int64(offsets[i])); err != nil {
+			return nil, fmt.Errorf("error writing song %d: %w", i, err)
+		}
+	}
+	return offsets, nil
+}
+
+// directorySize returns the size of the directory at the start of a ROM with the given layout.
+func directorySize(songs []*NmosSong, layout RomLayout) (int, error) {
+	switch layout {
+	case LayoutFlat:
+		return 0, nil // No header.
+	case LayoutIndexed:
+		if len(songs) > maxDirectorySongs {
+			return 0, fmt.Errorf("indexed ROMs can hold at most %d songs, got %d", maxDirectorySongs, len(songs))
+		}
+		return directoryFixedSize + directoryEntrySize*len(songs), nil
+	default:
+		return 0, fmt.Errorf("unknown ROM layout %v", layout)
+	}
+}
+
+// appendDirectory appends the directory of an indexed ROM to b, listing the songs which start at the given offsets.
+func appendDirectory(b []byte, songs []*NmosSong, offsets []int) []byte {
+	b = append(b, directoryHeader...)
+	b = append(b, directoryVersion, byte(len(songs)))
+	for i, song := range songs {
+		b = binary.LittleEndian.AppendUint32(b, uint32(offsets[i]))
+		b = append(b, song.InitialTempo&0x7f)
+
+		var name [directoryNameSize]byte
+		copy(name[:], song.Name)
+		b = append(b, name[:]...)
+	}
+	return b
+}
+
+// compileAll compiles every song concurrently, returning the ROMs in the same order as the songs.
+func compileAll(songs []*NmosSong) ([][]byte, error) {
+	compiled := make([][]byte, len(songs))
+	errs := make([]error, len(songs))
+
+	// Limit the number of songs being compiled at once to the number of CPUs.
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i, song := range songs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			compiled[i], errs[i] = song.Compile()
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error compiling song %d: %w", i, err)
+		}
+	}
+	return compiled, nil
+}
@@ -0,0 +1,158 @@
+package nmos
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// A part of two ROMs which differs, found by DiffRoms.
+type RomDifference struct {
+	Song  int    `json:"song"`  // The index of the song which differs, or -1 if the difference is in the ROM as a whole.
+	Frame int    `json:"frame"` // The index of the frame which differs, or -1 if the difference is in the song as a whole.
+	Field string `json:"field"` // What differs, such as "Square 2" (the channel's commands) or "Frame delay".
+	A     string `json:"a"`     // The field in the first ROM, or "" if it doesn't have it.
+	B     string `json:"b"`     // The field in the second ROM, or "" if it doesn't have it.
+}
+
+func (d RomDifference) String() string {
+	return fmt.Sprintf("%s: %s is %s, but %s", d.Where(), d.Field, DescribeRomField(d.A), DescribeRomField(d.B))
+}
+
+// Where returns the part of the ROM which differs, such as "song 0, frame #12".
+func (d RomDifference) Where() string {
+	switch {
+	case d.Song < 0:
+		return "ROM"
+	case d.Frame < 0:
+		return fmt.Sprintf("song %d", d.Song)
+	default:
+		return fmt.Sprintf("song %d, frame #%d", d.Song, d.Frame)
+	}
+}
+
+// DescribeRomField returns the value of a field of a RomDifference as it's shown to the user.
+func DescribeRomField(value string) string {
+	if value == "" {
+		return "missing"
+	}
+	return value
+}
+
+// A named part of a ROM, song or frame, and its value, used to compare ROMs field by field.
+type romField struct {
+	name  string
+	value string
+}
+
+// DiffRoms disassembles two ROMs (see Disassemble), and returns every field of the ROMs, their songs and their frames
+// which differs between them, in the order they appear in the ROMs. Frames are compared by their index in each song,
+// so a frame added or removed partway through a song makes every later frame differ.
+func DiffRoms(a, b []byte) ([]RomDifference, error) {
+	songsA, err := Disassemble(a)
+	if err != nil {
+		return nil, fmt.Errorf("first ROM: %w", err)
+	}
+	songsB, err := Disassemble(b)
+	if err != nil {
+		return nil, fmt.Errorf("second ROM: %w", err)
+	}
+
+	var diffs []RomDifference
+	compare := func(song, frame int, fieldsA, fieldsB []romField) {
+		valuesB := make(map[string]string, len(fieldsB))
+		for _, f := range fieldsB {
+			valuesB[f.name] = f.value
+		}
+		seen := make(map[string]bool, len(fieldsA))
+		for _, f := range fieldsA {
+			seen[f.name] = true
+			if f.value != valuesB[f.name] {
+				diffs = append(diffs, RomDifference{Song: song, Frame: frame, Field: f.name, A: f.value, B: valuesB[f.name]})
+			}
+		}
+		for _, f := range fieldsB {
+			if !seen[f.name] && f.value != "" {
+				diffs = append(diffs, RomDifference{Song: song, Frame: frame, Field: f.name, B: f.value})
+			}
+		}
+	}
+
+	compare(-1, -1, romFields(a, songsA), romFields(b, songsB))
+	for s := range min(len(songsA), len(songsB)) {
+		songA, songB := songsA[s], songsB[s]
+		compare(s, -1, songFields(songA), songFields(songB))
+		for i := range max(len(songA.Frames), len(songB.Frames)) {
+			var fieldsA, fieldsB []romField
+			if i < len(songA.Frames) {
+				fieldsA = frameFields(songA, i)
+			}
+			if i < len(songB.Frames) {
+				fieldsB = frameFields(songB, i)
+			}
+			compare(s, i, fieldsA, fieldsB)
+		}
+	}
+	return diffs, nil
+}
+
+// romFields returns the fields of a ROM as a whole, compared by DiffRoms.
+func romFields(rom []byte, songs []*NmosSong) []romField {
+	fields := []romField{
+		{"Size", fmt.Sprintf("%d bytes", len(rom))},
+		{"Songs", fmt.Sprint(len(songs))},
+	}
+	body, key, signed, err := VerifySignature(rom)
+	if signed && err == nil {
+		fields = append(fields, romField{"Signature key", hex.EncodeToString(key)})
+	}
+	if _, checksum, ok, err := VerifyChecksum(body); ok && err == nil {
+		fields = append(fields, romField{"Checksum", checksum.String()})
+	}
+	return fields
+}
+
+// songFields returns the fields of a song as a whole, compared by DiffRoms.
+func songFields(s *NmosSong) []romField {
+	return []romField{
+		{"Name", s.Name},
+		{"Author", s.Author},
+		{"Initial tempo", fmt.Sprint(s.InitialTempo)},
+		{"Clock divider", fmt.Sprint(s.ClockDiv)},
+		{"Frames", fmt.Sprint(len(s.Frames))},
+		{"Loop target", fmt.Sprintf("frame #%d", s.LoopTarget)},
+	}
+}
+
+// frameFields returns the fields of a frame of a song, compared by DiffRoms. Each channel's commands are one field.
+func frameFields(s *NmosSong, index int) []romField {
+	frame := s.Frames[index]
+	channels := [4][]string{}
+	for _, c := range frame.commands {
+		if int(c.channel) < len(channels) {
+			channels[c.channel] = append(channels[c.channel], c.String())
+		}
+	}
+	fields := []romField{{"Frame delay", fmt.Sprint(frame.FrameDelay)}}
+	for c, commands := range channels {
+		name := fmt.Sprintf("Square %d", c+1)
+		if c == 3 {
+			name = "Noise"
+		}
+		value := "none"
+		if len(commands) > 0 {
+			value = strings.Join(commands, ", ")
+		}
+		fields = append(fields, romField{name, value})
+	}
+	if frame.hasTempoChange {
+		fields = append(fields, romField{"Tempo change", fmt.Sprint(frame.tempo)})
+	}
+	if frame.hasStereo {
+		fields = append(fields, romField{"Stereo", fmt.Sprintf("%08b", frame.stereo)})
+	}
+	if frame.LoopToTarget {
+		fields = append(fields, romField{"Loop to target", "true"})
+	}
+	return fields
+}
@@ -0,0 +1,74 @@
+package nmos
+
+// SaveStateVersion is the version of the save state format, which is increased whenever its fields change meaning.
+const SaveStateVersion = 1
+
+// SaveStates holds the state of the NMOScillator before every frame of every song in a ROM,
+// so an emulator can start playback partway through a song without playing it from the start.
+type SaveStates struct {
+	Version int              `json:"version"`
+	Songs   []SongSaveStates `json:"songs"`
+}
+
+// SongSaveStates holds the state of the NMOScillator before every frame of a single song.
+type SongSaveStates struct {
+	Label             string      `json:"label"`
+	Address           int         `json:"address"`           // ROM address of the song's first frame.
+	LoopTargetAddress int         `json:"loopTargetAddress"` // ROM address of the song's loop target frame.
+	Frames            []SaveState `json:"frames"`
+}
+
+// SaveState is the state of the NMOScillator and its SN76489 just before a frame is read, the first time
+// it's played. Registers which haven't been written yet are -1.
+type SaveState struct {
+	Frame        int    `json:"frame"`
+	Address      int    `json:"address"` // ROM address of the frame, which the emulator should read next.
+	Rows         []int  `json:"rows"`    // Source rows covered by the frame.
+	Tempo        uint8  `json:"tempo"`   // Value of the Tempo Register.
+	Stereo       uint8  `json:"stereo"`  // Value of the stereo control register, on targets which have one.
+	Periods      [3]int `json:"periods"` // Period of each square channel.
+	Attenuations [4]int `json:"attenuations"`
+	NoiseControl int    `json:"noiseControl"` // The noise control register: the noise mode in bit 2, and the noise rate in bits 1-0.
+}
+
+// SaveStates returns the state of the NMOScillator before every frame of the song, if the song starts at
+// the given ROM address. Frames after the loop target are given the state they're first played with.
+func (s *NmosSong) SaveStates(label string, address int) SongSaveStates {
+	out := SongSaveStates{Label: label, Address: address}
+
+	chip := newChipState()
+	tempo, stereo := s.InitialTempo, StereoAll
+	sizes := s.frameSizes()
+	for i, frame := range s.Frames {
+		if i == s.LoopTarget {
+			out.LoopTargetAddress = address
+		}
+
+		out.Frames = append(out.Frames, SaveState{
+			Frame:        i,
+			Address:      address,
+			Rows:         append([]int{}, frame.Rows...),
+			Tempo:        tempo,
+			Stereo:       stereo,
+			Periods:      chip.periods,
+			Attenuations: chip.attenuations,
+			NoiseControl: chip.noiseControl,
+		})
+
+		address += sizes[i]
+		if frame.LoopToTarget {
+			// Nothing else in a loop frame gets executed.
+			continue
+		}
+		for _, c := range frame.commands {
+			chip.apply(c)
+		}
+		if frame.hasTempoChange {
+			tempo = frame.tempo
+		}
+		if frame.hasStereo {
+			stereo = frame.stereo
+		}
+	}
+	return out
+}
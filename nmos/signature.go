@@ -0,0 +1,42 @@
+package nmos
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+)
+
+const (
+	signatureFooter     = "NMSG" // Magic bytes at the very end of a signed ROM.
+	signatureFooterSize = ed25519.SignatureSize + ed25519.PublicKeySize + len(signatureFooter)
+)
+
+// AppendSignature adds a footer to the end of a ROM with an Ed25519 signature of every byte before it, and the
+// public key which checks it, so copies of the ROM which have been changed since it was signed can be found.
+// It should be added after anything else, including the checksum footer (see AppendChecksum).
+func AppendSignature(rom []byte, key ed25519.PrivateKey) []byte {
+	out := append(bytes.Clone(rom), ed25519.Sign(key, rom)...)
+	out = append(out, key.Public().(ed25519.PublicKey)...)
+	return append(out, signatureFooter...)
+}
+
+// VerifySignature checks the signature footer at the end of a ROM against the public key stored in the footer,
+// and returns the ROM without it and the public key. If the ROM has no signature footer, it returns the whole ROM
+// and false.
+//
+// A matching signature only shows the ROM hasn't changed since it was signed with the returned key. Anyone can
+// sign a ROM with their own key, so the key must be compared with the one published by the signer to know who signed it.
+func VerifySignature(rom []byte) ([]byte, ed25519.PublicKey, bool, error) {
+	if len(rom) < signatureFooterSize || !bytes.HasSuffix(rom, []byte(signatureFooter)) {
+		return rom, nil, false, nil
+	}
+	body := rom[:len(rom)-signatureFooterSize]
+	footer := rom[len(body):]
+	signature := footer[:ed25519.SignatureSize]
+	key := ed25519.PublicKey(bytes.Clone(footer[ed25519.SignatureSize : ed25519.SignatureSize+ed25519.PublicKeySize]))
+
+	if !ed25519.Verify(key, body, signature) {
+		return nil, key, true, fmt.Errorf("ROM signature doesn't match its contents, so the ROM has been changed since it was signed")
+	}
+	return body, key, true, nil
+}
@@ -0,0 +1,279 @@
+package nmos
+
+import "fmt"
+
+// A change in what the NMOScillator plays, found by Simulate. Registers which haven't been written yet are -1.
+type PlaybackEvent struct {
+	Cycle        int // The Frame Clock cycle the change happens on, counted from the start of the song.
+	Tempo        uint8
+	Stereo       uint8
+	Periods      [3]int
+	Attenuations [4]int
+	NoiseControl int
+}
+
+// sameState reports whether two events leave the chip and the NMOScillator in the same state.
+func (e PlaybackEvent) sameState(other PlaybackEvent) bool {
+	other.Cycle = e.Cycle
+	return e == other
+}
+
+func (e PlaybackEvent) String() string {
+	return fmt.Sprintf("cycle %d: tempo %d, stereo %08b, periods %v, attenuations %v, noise control %d",
+		e.Cycle, e.Tempo, e.Stereo, e.Periods, e.Attenuations, e.NoiseControl)
+}
+
+// Simulate plays the compiled song through to the end and then through its loop once more, and returns every
+// change to the values of the SN76489's registers, the Tempo Register and the stereo control register, along with
+// the Frame Clock cycle it happens on. Writes which don't change a register's value aren't included, so two songs
+// which sound the same produce the same events. The loop is played twice because the state the loop target is
+// entered with can differ between the first time it's played and every time after that.
+//
+// Every byte of the compiled ROM is played, including the dummy commands which pad frames out, so the events are
+// what the hardware does rather than what the song's frames ask for. If the two differ, such as when a dummy
+// command changes a register, the compiler has a bug, and Simulate returns an error describing the first difference.
+func (s *NmosSong) Simulate() ([]PlaybackEvent, error) {
+	rom, err := s.Compile()
+	if err != nil {
+		return nil, err
+	}
+	played := s.playback(s.romStepper(rom))
+	if err := ComparePlayback(s.playback(s.commandStepper()), played); err != nil {
+		return nil, fmt.Errorf("the compiled ROM doesn't play the song's frames the way they ask for: %w", err)
+	}
+	return played, nil
+}
+
+// A function which plays the frame with the given index, and returns the state after it from the state before,
+// and the frame's delay.
+type playbackStepper func(frame int, current PlaybackEvent) (PlaybackEvent, uint8)
+
+// playback plays the song through to the end and then through its loop once more with the stepper, and returns
+// every change of state (see Simulate).
+func (s *NmosSong) playback(step playbackStepper) []PlaybackEvent {
+	var events []PlaybackEvent
+	current := PlaybackEvent{Tempo: s.InitialTempo, Stereo: StereoAll}
+	cycle := 0
+
+	play := func(from int) {
+		for i := from; i < len(s.Frames); i++ {
+			if s.Frames[i].LoopToTarget {
+				return
+			}
+			next, frameDelay := step(i, current)
+			next.Cycle = cycle
+			if len(events) == 0 || !next.sameState(current) {
+				events = append(events, next)
+				current = next
+			}
+			cycle += int(frameDelay) + 1
+		}
+	}
+
+	play(0)
+	if s.LoopTarget >= 0 && s.LoopTarget < len(s.Frames) {
+		play(s.LoopTarget)
+	}
+	return events
+}
+
+// commandStepper plays the commands, tempo changes and stereo changes of each frame, as the song describes them.
+func (s *NmosSong) commandStepper() playbackStepper {
+	chip := newChipState()
+	return func(i int, current PlaybackEvent) (PlaybackEvent, uint8) {
+		frame := s.Frames[i]
+		for _, c := range frame.commands {
+			chip.apply(c)
+		}
+		next := current
+		next.Periods, next.Attenuations, next.NoiseControl = chip.periods, chip.attenuations, chip.noiseControl
+		if frame.hasTempoChange {
+			next.Tempo = frame.tempo
+		}
+		if frame.hasStereo {
+			next.Stereo = frame.stereo
+		}
+		return next, frame.FrameDelay
+	}
+}
+
+// romStepper plays every byte of each frame in the song's compiled ROM, the way the NMOScillator does.
+func (s *NmosSong) romStepper(rom []byte) playbackStepper {
+	addresses := make([]int, len(s.Frames))
+	address := 0
+	for i, size := range s.frameSizes() {
+		addresses[i] = address
+		address += size
+	}
+
+	chip := newChipRegisters()
+	return func(i int, current PlaybackEvent) (PlaybackEvent, uint8) {
+		next := current
+		var frameDelay uint8
+		commandCount := DecodeFrameHeader(rom[addresses[i]]).CommandCount
+		for b, value := range rom[addresses[i]+1:][:commandCount] {
+			switch index := commandCount - b; {
+			case index == stereoCommandIndex:
+				next.Stereo = value
+			case index == tempoCommandIndex:
+				next.Tempo = value & maxTempo
+			case index == frameDelayCommandIndex:
+				frameDelay = value
+			default:
+				chip.write(value)
+			}
+		}
+		next.Periods, next.Attenuations, next.NoiseControl = chip.periods(), chip.attenuations, chip.noiseControl
+		return next, frameDelay
+	}
+}
+
+// chipRegisters tracks the registers of the SN76489 as the bytes written to it set them. Latch bytes pick the
+// register which later data bytes are written to, so a stray data byte changes whichever register was latched last.
+// A value of -1 means the register's value is unknown.
+type chipRegisters struct {
+	latched               int // The latched register: the channel in bits 2-1, and whether it's the attenuation in bit 0.
+	periodLow, periodHigh [3]int
+	attenuations          [4]int
+	noiseControl          int // Stored like chipState, with the noise mode in bit 2 and the NoiseRate in bits 1-0.
+}
+
+// newChipRegisters returns chipRegisters where every register's value is unknown.
+func newChipRegisters() chipRegisters {
+	return chipRegisters{
+		latched:      -1,
+		periodLow:    [3]int{-1, -1, -1},
+		periodHigh:   [3]int{-1, -1, -1},
+		attenuations: [4]int{-1, -1, -1, -1},
+		noiseControl: -1,
+	}
+}
+
+// write writes a byte to the chip.
+func (r *chipRegisters) write(b byte) {
+	if b&0b10000000 != 0 {
+		r.latched = int(b>>4) & 0b111
+	} else if r.latched < 0 {
+		return // A data byte before any latch byte goes nowhere we know of.
+	}
+
+	channel, isAttenuation := r.latched>>1, r.latched&1 != 0
+	switch {
+	case b&0b10000000 == 0 && !isAttenuation && channel < 3:
+		// Data bytes set the high 6 bits of a square channel's period.
+		r.periodHigh[channel] = int(b & 0b00111111)
+	case isAttenuation:
+		r.attenuations[channel] = int(b & 0x0f)
+	case channel == 3:
+		rate := [4]NoiseRate{HighNoise, MediumNoise, LowNoise, Channel3Noise}[b&0b11]
+		r.noiseControl = int(b>>2&1)<<2 | int(rate)
+	default:
+		r.periodLow[channel] = int(b & 0x0f)
+	}
+}
+
+// periods returns the period of each square channel, or -1 for channels where either half of it is unknown.
+func (r *chipRegisters) periods() [3]int {
+	var periods [3]int
+	for c := range periods {
+		periods[c] = -1
+		if r.periodLow[c] >= 0 && r.periodHigh[c] >= 0 {
+			periods[c] = r.periodHigh[c]<<4 | r.periodLow[c]
+		}
+	}
+	return periods
+}
+
+// ComparePlayback compares the events of two simulated songs (see Simulate), and returns an error describing
+// the first difference between them, or nil if they play the same way.
+func ComparePlayback(a, b []PlaybackEvent) error {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return fmt.Errorf("playback differs at event %d: %v, but %v", i, a[i], b[i])
+		}
+	}
+	if len(a) != len(b) {
+		return fmt.Errorf("playback differs after event %d: one song has %d events and the other has %d", min(len(a), len(b)), len(a), len(b))
+	}
+	return nil
+}
+
+// A register which two simulated songs (see Simulate) set to different values at the same point in time.
+type PlaybackDifference struct {
+	Cycle    int    // The Frame Clock cycle the difference starts on.
+	Register string // The name of the register, such as "Square 2 period" or "Tempo".
+	A, B     int    // The register's value in each song, or -1 if it hasn't been written yet.
+}
+
+func (d PlaybackDifference) String() string {
+	return fmt.Sprintf("cycle %d: %s is %d, but %d", d.Cycle, d.Register, d.A, d.B)
+}
+
+// A named register and its value, used to compare events register by register.
+type playbackRegister struct {
+	name  string
+	value int
+}
+
+// registers returns the value of every register tracked by the event, in a fixed order.
+func (e PlaybackEvent) registers() []playbackRegister {
+	registers := []playbackRegister{{"Tempo", int(e.Tempo)}, {"Stereo", int(e.Stereo)}}
+	for c, period := range e.Periods {
+		registers = append(registers, playbackRegister{fmt.Sprintf("Square %d period", c+1), period})
+	}
+	for c, attenuation := range e.Attenuations {
+		name := fmt.Sprintf("Square %d attenuation", c+1)
+		if c == 3 {
+			name = "Noise attenuation"
+		}
+		registers = append(registers, playbackRegister{name, attenuation})
+	}
+	return append(registers, playbackRegister{"Noise control", e.NoiseControl})
+}
+
+// DiffPlayback lines up the events of two simulated songs (see Simulate) by Frame Clock cycle, and returns
+// the registers which are set to different values in each song. A difference is only reported on the cycle
+// it starts, or when either song changes the register's value again while it still differs.
+// Once the shorter song ends, its last state is compared against the rest of the longer song.
+func DiffPlayback(a, b []PlaybackEvent) []PlaybackDifference {
+	var diffs []PlaybackDifference
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+
+	// The last pair of values reported for each register, so lasting differences aren't reported every cycle.
+	reported := make(map[string][2]int)
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		// Step to the next cycle either song changes on.
+		cycle := -1
+		if i < len(a) {
+			cycle = a[i].Cycle
+		}
+		if j < len(b) && (cycle < 0 || b[j].Cycle < cycle) {
+			cycle = b[j].Cycle
+		}
+		for i < len(a) && a[i].Cycle == cycle {
+			i++
+		}
+		for j < len(b) && b[j].Cycle == cycle {
+			j++
+		}
+
+		// The state of each song on this cycle is its latest event.
+		regsA, regsB := a[max(i-1, 0)].registers(), b[max(j-1, 0)].registers()
+		for r := range regsA {
+			name, valueA, valueB := regsA[r].name, regsA[r].value, regsB[r].value
+			pair := [2]int{valueA, valueB}
+			if valueA != valueB && reported[name] != pair {
+				diffs = append(diffs, PlaybackDifference{Cycle: cycle, Register: name, A: valueA, B: valueB})
+			}
+			if valueA == valueB {
+				delete(reported, name)
+			} else {
+				reported[name] = pair
+			}
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,71 @@
+package nmos
+
+import "testing"
+
+func TestChipRegistersWrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		bytes        []byte
+		periods      [3]int
+		attenuations [4]int
+		noiseControl int
+	}{
+		{"period", []byte{0b1_01_0_1100, 0b0_0_010010}, [3]int{-1, 18<<4 | 12, -1}, [4]int{-1, -1, -1, -1}, -1},
+		{"period without its latch", []byte{0b0_0_010010}, [3]int{-1, -1, -1}, [4]int{-1, -1, -1, -1}, -1},
+		{"attenuation", []byte{0b1_11_1_0011}, [3]int{-1, -1, -1}, [4]int{-1, -1, -1, 3}, -1},
+		{"data byte after an attenuation", []byte{0b1_00_1_0101, 0x00}, [3]int{-1, -1, -1}, [4]int{0, -1, -1, -1}, -1},
+		{"white noise tracking square 3", []byte{0b1_11_0_0111}, [3]int{-1, -1, -1}, [4]int{-1, -1, -1, -1}, int(WhiteNoise)<<2 | int(Channel3Noise)},
+		{"periodic low noise", []byte{0b1_11_0_0010}, [3]int{-1, -1, -1}, [4]int{-1, -1, -1, -1}, int(PeriodicNoise)<<2 | int(LowNoise)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newChipRegisters()
+			for _, b := range tt.bytes {
+				r.write(b)
+			}
+			if got := r.periods(); got != tt.periods {
+				t.Errorf("periods are %v, want %v", got, tt.periods)
+			}
+			if r.attenuations != tt.attenuations {
+				t.Errorf("attenuations are %v, want %v", r.attenuations, tt.attenuations)
+			}
+			if r.noiseControl != tt.noiseControl {
+				t.Errorf("noise control is %d, want %d", r.noiseControl, tt.noiseControl)
+			}
+		})
+	}
+}
+
+func TestSimulatePlaysCompiledBytes(t *testing.T) {
+	var played Frame
+	if err := played.SetAttenuation(0, 5); err != nil {
+		t.Fatal(err)
+	}
+	var tempoOnly Frame
+	if err := tempoOnly.SetNewTempo(50); err != nil {
+		t.Fatal(err)
+	}
+	song := &NmosSong{
+		InitialTempo: 100,
+		Frames:       []Frame{resetFrame(t), played, tempoOnly, {LoopToTarget: true}},
+		LoopTarget:   1,
+	}
+	if _, err := song.Simulate(); err != nil {
+		t.Fatalf("Simulate: %v", err)
+	}
+
+	// The tempo-only frame padded with data bytes, which write 0 to the attenuation square 1 was latched for.
+	rom, err := song.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := song.frameSizes()
+	tempoFrame := rom[sizes[0]+sizes[1]:][:sizes[2]]
+	for i := firstChipCommandIndex; i <= lastChipCommandIndex; i++ {
+		tempoFrame[len(tempoFrame)-i] = 0x00
+	}
+	err = ComparePlayback(song.playback(song.commandStepper()), song.playback(song.romStepper(rom)))
+	if err == nil {
+		t.Error("a ROM which pads with data bytes plays the same as the song's frames")
+	}
+}
@@ -2,11 +2,16 @@ package nmos
 
 import (
 	"fmt"
+	"maps"
 	"math"
+	"slices"
 	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/internal/checked"
 )
 
-const maxSquarePeriod = (1 << 10) - 1
+// MaxSquarePeriod is the largest period a square channel can be set to, which plays its lowest note.
+const MaxSquarePeriod = (1 << 10) - 1
 const maxAttenuation = (1 << 4) - 1
 const maxTempo = (1 << 7) - 1
 
@@ -45,6 +50,14 @@ const (
 	Channel3Noise
 )
 
+// The SN76489 numbers its square (tone) channels 0-2 and its noise channel 3, in the same order as Furnace's
+// channels (Square 1-3, then Noise). In Channel3Noise mode, the noise channel follows the period of
+// TrackedChannel, which Furnace calls Square 3, so the two channels share a single period register.
+const (
+	TrackedChannel = 2
+	NoiseChannel   = 3
+)
+
 func (r NoiseRate) isValid() bool {
 	switch r {
 	case LowNoise, MediumNoise, HighNoise, Channel3Noise:
@@ -56,15 +69,15 @@ func (r NoiseRate) isValid() bool {
 
 // A single song composition. Multiple of these could be loaded onto a single ROM at a time, if desired.
 type NmosSong struct {
-	Name   string // Name of the song.
-	Author string // Author of the song.
+	Name   string `json:"name"`   // Name of the song.
+	Author string `json:"author"` // Author of the song.
 
-	InitialTempo uint8 // Initial tempo of the song.
+	InitialTempo uint8 `json:"initialTempo"` // Initial tempo of the song.
 	// If true, Divides the base clock frequency fed into the chip by 2
 	// (effectively making it run at half speed and lower all notes by an octave).
-	ClockDiv   bool
-	Frames     []Frame
-	LoopTarget int // The index of the frame which will be marked as the Loop Target.
+	ClockDiv   bool    `json:"clockDiv"`
+	Frames     []Frame `json:"frames"`
+	LoopTarget int     `json:"loopTarget"` // The index of the frame which will be marked as the Loop Target.
 }
 
 // A single frame in a song.
@@ -75,7 +88,17 @@ type Frame struct {
 	hasTempoChange bool  // Whether or not this frame should update the value of the Tempo Register.
 	tempo          uint8 // If HasTempoChange is true, this is the new tempo used after this frame (7-bit).
 
+	hasStereo bool  // Whether or not this frame should write to the stereo control register (stereo targets only).
+	stereo    uint8 // If hasStereo is true, the value written to the stereo control register.
+
 	LoopToTarget bool // Whether the song should loop back to the Loop Target at this frame.
+
+	// Indices of the source rows which this frame covers, in the order they were played.
+	// Frames which don't come from the source song (e.g. reset and loop frames) have no rows.
+	Rows []int
+
+	// Comments attached to the source rows, such as section names.
+	Comments []string
 }
 
 // An SN76489 command.
@@ -122,6 +145,97 @@ func (c *command) String() string {
 	}
 }
 
+// FrameForRow returns the index of the first frame which covers the given source row,
+// and false if no frame covers it (e.g. the row was skipped by a jump).
+func (s *NmosSong) FrameForRow(row int) (int, bool) {
+	for i, frame := range s.Frames {
+		if slices.Contains(frame.Rows, row) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// SectionAt returns the last comment attached to the frame at the given index or any frame before it,
+// which is usually the name of the section the frame is in. It returns "" if there is no such comment.
+func (s *NmosSong) SectionAt(frameIndex int) string {
+	for i := min(frameIndex, len(s.Frames)-1); i >= 0; i-- {
+		if comments := s.Frames[i].Comments; len(comments) > 0 {
+			return comments[len(comments)-1]
+		}
+	}
+	return ""
+}
+
+// Where a source row starts playing in a song.
+type RowFrame struct {
+	Pattern int `json:"pattern"` // The index of the pattern (order) the row is in.
+	Row     int `json:"row"`     // The index of the row within its pattern.
+	Frame   int `json:"frame"`   // The index of the first frame which covers the row.
+}
+
+// RowFrames maps every source row the song plays to the first frame which covers it, in the order of the rows,
+// where each pattern of the source song has patternLength rows (or the whole song is one pattern if it's 0). Rows
+// which are never played, such as those skipped by a jump, are left out.
+func (s *NmosSong) RowFrames(patternLength int) []RowFrame {
+	frames := make(map[int]int)
+	for i, frame := range s.Frames {
+		for _, row := range frame.Rows {
+			if _, ok := frames[row]; !ok {
+				frames[row] = i
+			}
+		}
+	}
+	rowFrames := make([]RowFrame, 0, len(frames))
+	for _, row := range slices.Sorted(maps.Keys(frames)) {
+		rowFrame := RowFrame{Row: row, Frame: frames[row]}
+		if patternLength > 0 {
+			rowFrame.Pattern, rowFrame.Row = row/patternLength, row%patternLength
+		}
+		rowFrames = append(rowFrames, rowFrame)
+	}
+	return rowFrames
+}
+
+// RowsForFrame returns the indices of the source rows covered by the frame at the given index.
+func (s *NmosSong) RowsForFrame(frameIndex int) []int {
+	if frameIndex < 0 || frameIndex >= len(s.Frames) {
+		return nil
+	}
+	return s.Frames[frameIndex].Rows
+}
+
+// ValidateLoopTarget checks that the song's loop target points to a frame which exists,
+// and that the target frame doesn't immediately loop back to itself (which would hang the NMOScillator).
+func (s *NmosSong) ValidateLoopTarget() error {
+	if s.LoopTarget < 0 || s.LoopTarget >= len(s.Frames) {
+		return fmt.Errorf("loop target %d is out of range, song only contains %d frames", s.LoopTarget, len(s.Frames))
+	}
+	if s.Frames[s.LoopTarget].LoopToTarget {
+		return fmt.Errorf("loop target frame %d loops back to itself", s.LoopTarget)
+	}
+	return nil
+}
+
+// Clone returns a copy of the frame which shares none of its commands, rows or comments,
+// so changes to one don't affect the other.
+func (f Frame) Clone() Frame {
+	f.commands = slices.Clone(f.commands)
+	f.Rows = slices.Clone(f.Rows)
+	f.Comments = slices.Clone(f.Comments)
+	return f
+}
+
+// Clone returns a copy of the song which shares none of its frames with the original.
+func (s *NmosSong) Clone() *NmosSong {
+	clone := *s
+	clone.Frames = make([]Frame, len(s.Frames))
+	for i, frame := range s.Frames {
+		clone.Frames[i] = frame.Clone()
+	}
+	return &clone
+}
+
 // SetNewTempo makes the frame change the tempo of the song when it is played.
 // Multiple calls of this method to the same frame will return an error.
 func (f *Frame) SetNewTempo(tempo uint8) error {
@@ -155,8 +269,8 @@ func (f *Frame) SetSquarePeriod(channel uint8, period uint16) error {
 	if channel > 2 {
 		return fmt.Errorf("square channel must be 0-2, got %d", channel)
 	}
-	if period > maxSquarePeriod {
-		return fmt.Errorf("square period must be 0-%d, got %d", maxSquarePeriod, period)
+	if period > MaxSquarePeriod {
+		return fmt.Errorf("square period must be 0-%d, got %d", MaxSquarePeriod, period)
 	}
 	if f.commandAlreadyExists(SetSquarePeriodCommand, channel) {
 		return fmt.Errorf("square period already set for channel %d in this frame", channel)
@@ -170,6 +284,20 @@ func (f *Frame) SetSquarePeriod(channel uint8, period uint16) error {
 	return nil
 }
 
+// ReplaceSquarePeriod sets the period of a square wave channel, replacing any period already set for it in the frame.
+func (f *Frame) ReplaceSquarePeriod(channel uint8, period uint16) error {
+	for i, c := range f.commands {
+		if c.commandType == SetSquarePeriodCommand && c.channel == channel {
+			if period > MaxSquarePeriod {
+				return fmt.Errorf("square period must be 0-%d, got %d", MaxSquarePeriod, period)
+			}
+			f.commands[i].period = period
+			return nil
+		}
+	}
+	return f.SetSquarePeriod(channel, period)
+}
+
 // SetAttenuation adds a command to the frame setting the attenuation of a channel (including noise).
 // Multiple calls setting the period of the same channel in the same frame will return an error.
 // Note that "attenuation" and "volume" are different. Attenuation is the inverse of volume, such that
@@ -193,6 +321,20 @@ func (f *Frame) SetAttenuation(channel uint8, attenuation uint8) error {
 	return nil
 }
 
+// ReplaceAttenuation sets the attenuation of a channel, replacing any attenuation already set for it in the frame.
+func (f *Frame) ReplaceAttenuation(channel uint8, attenuation uint8) error {
+	for i, c := range f.commands {
+		if c.commandType == SetAttenuationCommand && c.channel == channel {
+			if attenuation > maxAttenuation {
+				return fmt.Errorf("attenuation must be 0-%d, got %d", maxAttenuation, attenuation)
+			}
+			f.commands[i].attenuation = attenuation
+			return nil
+		}
+	}
+	return f.SetAttenuation(channel, attenuation)
+}
+
 func (f *Frame) SetNoiseControl(mode NoiseMode, rate NoiseRate) error {
 	if !mode.isValid() {
 		return fmt.Errorf("invalid noise mode: %d", mode)
@@ -219,7 +361,8 @@ func (f *Frame) SetNoiseControl(mode NoiseMode, rate NoiseRate) error {
 // numChannels: number of channels/columns to print.
 // headerNames: optional names for each channel (if nil or empty entry, "Channel i" is used).
 // indent: number of spaces to indent the table
-func formatCommandsByChannel(commands []command, numChannels int, headerNames []string, indent int) string {
+// withBytes: if true, each command is followed by the bytes it compiles to.
+func formatCommandsByChannel(commands []command, numChannels int, headerNames []string, indent int, withBytes bool) string {
 	if numChannels <= 0 {
 		numChannels = 4
 	}
@@ -234,6 +377,13 @@ func formatCommandsByChannel(commands []command, numChannels int, headerNames []
 		cols[c.channel] = append(cols[c.channel], c)
 	}
 
+	cellText := func(c command) string {
+		if withBytes {
+			return fmt.Sprintf("%s [% x]", c.String(), c.toBytes())
+		}
+		return c.String()
+	}
+
 	// Find max rows
 	maxRows := 0
 	for _, col := range cols {
@@ -254,7 +404,7 @@ func formatCommandsByChannel(commands []command, numChannels int, headerNames []
 
 		// Cells
 		for _, cmd := range cols[i] {
-			s := cmd.String()
+			s := cellText(cmd)
 			if len(s) > widths[i] {
 				widths[i] = len(s)
 			}
@@ -309,7 +459,7 @@ func formatCommandsByChannel(commands []command, numChannels int, headerNames []
 		for channel := range numChannels {
 			cell := ""
 			if row < len(cols[channel]) {
-				cell = cols[channel][row].String()
+				cell = cellText(cols[channel][row])
 			}
 			b.WriteString("| ")
 			b.WriteString(padRight(cell, widths[channel]))
@@ -331,6 +481,12 @@ func formatCommandsByChannel(commands []command, numChannels int, headerNames []
 
 // Pretty-print
 func (s *NmosSong) String() string {
+	return s.Listing(false)
+}
+
+// Listing returns a table of the song's frames, like String. If hexdump is true, every command is shown with the
+// bytes it compiles to, and every frame with the exact bytes it's written to the ROM as.
+func (s *NmosSong) Listing(hexdump bool) string {
 	var b strings.Builder
 	b.WriteString("NMOScillator Song:\n")
 	fmt.Fprintf(&b, "- Name: %s\n", s.Name)
@@ -344,9 +500,30 @@ func (s *NmosSong) String() string {
 	}
 
 	b.WriteString("- Frames:\n")
+	for _, frame := range s.FrameListings(hexdump) {
+		b.WriteString("\n")
+		b.WriteString(frame)
+	}
 
+	totalSize := s.CalculateSize()
+	fmt.Fprintf(&b, "[Total song size: %d byte", totalSize)
+	if totalSize != 1 {
+		b.WriteString("s") // Pluralise the word "byte" if needed.
+	}
+	b.WriteString("]\n")
+
+	return b.String()
+}
+
+// FrameListings returns the section of Listing describing each frame, with its commands, tempo and stereo changes,
+// frame delay, source rows and size.
+func (s *NmosSong) FrameListings(hexdump bool) []string {
+	listings := make([]string, len(s.Frames))
+	currentTempo := s.InitialTempo  // Used to work out the bytes of frames which re-set the tempo.
+	dummies, _ := s.dummyCommands() // Frames which can't be padded out fail to compile below.
 	for i, frame := range s.Frames {
-		fmt.Fprintf(&b, "\n  - Frame #%d:", i)
+		var b strings.Builder
+		fmt.Fprintf(&b, "  - Frame #%d:", i)
 
 		if s.LoopTarget == i { // If this frame is the loop target
 			b.WriteString(" (loop target)")
@@ -369,14 +546,23 @@ func (s *NmosSong) String() string {
 				"Square 3",
 				"Noise",
 			}
-			table := formatCommandsByChannel(frame.commands, 4, headers, 6)
+			table := formatCommandsByChannel(frame.commands, 4, headers, 6, hexdump)
 			b.WriteString(table)
 		}
 
 		if frame.hasTempoChange {
 			fmt.Fprintf(&b, "    - Change tempo to %d (0x%x)\n", frame.tempo, frame.tempo)
 		}
+		if frame.hasStereo {
+			fmt.Fprintf(&b, "    - Set stereo to %08b\n", frame.stereo)
+		}
 		fmt.Fprintf(&b, "    - Frame delay: %d\n", frame.FrameDelay)
+		if len(frame.Rows) > 0 {
+			fmt.Fprintf(&b, "    - Source rows: %v\n", frame.Rows)
+		}
+		for _, comment := range frame.Comments {
+			fmt.Fprintf(&b, "    - Comment: %s\n", comment)
+		}
 		if frame.LoopToTarget {
 			fmt.Fprintf(&b, "    - Loop to target (frame #%d)\n", s.LoopTarget)
 		}
@@ -387,16 +573,21 @@ func (s *NmosSong) String() string {
 			b.WriteString("s") // Pluralise the word "byte" if needed.
 		}
 		b.WriteString("]\n")
-	}
 
-	totalSize := s.CalculateSize()
-	fmt.Fprintf(&b, "[Total song size: %d byte", totalSize)
-	if totalSize != 1 {
-		b.WriteString("s") // Pluralise the word "byte" if needed.
+		if frame.hasTempoChange && !frame.LoopToTarget {
+			currentTempo = frame.tempo
+		}
+		if hexdump {
+			frameBytes, err := frame.Compile(i == s.LoopTarget, currentTempo, dummies[i])
+			if err != nil {
+				fmt.Fprintf(&b, "    [Bytes: %v]\n", err)
+			} else {
+				fmt.Fprintf(&b, "    [Bytes: % x]\n", frameBytes)
+			}
+		}
+		listings[i] = b.String()
 	}
-	b.WriteString("]\n")
-
-	return b.String()
+	return listings
 }
 
 // effectiveTickRate calculates the effective tick rate for a given Tempo Register value (0..127)
@@ -411,11 +602,11 @@ func bestTempoForDelay(targetRate float64, frameDelay uint8) (bestTempo uint8, b
 	// Ideal float tempo.
 	ideal := 31250/((float64(frameDelay)+1)*targetRate) - 129
 
-	// Consider the nearest integer tempos.
-	candidates := []uint8{
-		uint8(math.Floor(ideal)),
-		uint8(math.Ceil(ideal)),
-	}
+	// Consider the nearest integer tempos. Ideal tempos outside the range of a uint8 saturate,
+	// and are then limited to the highest tempo below.
+	floor, _ := checked.Saturate[uint8](math.Floor(ideal))
+	ceil, _ := checked.Saturate[uint8](math.Ceil(ideal))
+	candidates := []uint8{floor, ceil}
 
 	bestErr = math.Inf(1)
 	bestTempo = 0
@@ -436,33 +627,57 @@ func bestTempoForDelay(targetRate float64, frameDelay uint8) (bestTempo uint8, b
 	return bestTempo, bestAchieved, bestErr
 }
 
-// 1.0% tolerance.
-const maxRateError float64 = 0.01
+// DefaultRateTolerance is the relative error allowed between a requested tick rate and the rate actually played
+// (1.0%), unless a different tolerance is chosen.
+const DefaultRateTolerance float64 = 0.01
 
 // FindBestRate searched frameDelay values in ascending order and returns
 // the smallest frameDelay for which some tempo yields relative error <= maxRelError.
 // If maxRelError <= 0 the function returns ok=false immediately (invalid tolerance).
 // If no combination meets the tolerance, ok=false.
-func FindBestRate(targetRate float64) (tempo uint8, frameDelay uint8, achieved float64, relErr float64, ok bool) {
-	if maxRateError <= 0 {
+func FindBestRate(targetRate float64, maxRelError float64) (tempo uint8, frameDelay uint8, achieved float64, relErr float64, ok bool) {
+	if maxRelError <= 0 {
 		return 0, 0, 0, 0, false // Return ok=false
 	}
 
 	for fd := range 255 {
 		t, a, rel := bestTempoForDelay(targetRate, uint8(fd))
-		if rel <= maxRateError {
+		if rel <= maxRelError {
 			return t, uint8(fd), a, rel, true
 		}
 	}
 	return 0, 0, 0, 0, false // Return ok=false
 }
 
+// ClosestRate returns the tempo and frame delay which play closest to targetRate, however large the error is.
+// It's used to explain why FindBestRate failed.
+func ClosestRate(targetRate float64) (tempo uint8, frameDelay uint8, achieved float64, relErr float64) {
+	relErr = math.Inf(1)
+	for fd := range 255 {
+		t, a, rel := bestTempoForDelay(targetRate, uint8(fd))
+		if rel < relErr {
+			tempo, frameDelay, achieved, relErr = t, uint8(fd), a, rel
+		}
+	}
+	return tempo, frameDelay, achieved, relErr
+}
+
+// TickRateRange returns the slowest and fastest tick rates (in Hz) which the tempo model can play,
+// not including the tolerance allowed by FindBestRate.
+func TickRateRange() (slowest float64, fastest float64) {
+	return effectiveTickRate(maxTempo, 255), effectiveTickRate(0, 0)
+}
+
 // CalculateSquarePeriod computes the (rounded) period of a square channel from a given frequency and clock rate.
+// The result saturates at the maximum value of a uint16.
 func CalculateSquarePeriod(freq float64, clockRate float64) uint16 {
-	return uint16(math.RoundToEven(clockRate / (32 * freq)))
+	period, _ := checked.Saturate[uint16](math.RoundToEven(clockRate / (32 * freq)))
+	return period
 }
 
 // CalculateNoisePeriod computes the (rounded) period of the noise channel from a given frequency and clock rate.
+// The result saturates at the maximum value of a uint16.
 func CalculateNoisePeriod(freq float64, clockRate float64) uint16 {
-	return uint16(math.RoundToEven(clockRate / (30 * freq)))
+	period, _ := checked.Saturate[uint16](math.RoundToEven(clockRate / (30 * freq)))
+	return period
 }
@@ -0,0 +1,99 @@
+package nmos
+
+// What a byte of a compiled frame holds.
+type BytePart int
+
+const (
+	HeaderByte     BytePart = iota // The frame header.
+	CommandByte                    // A byte of a command written to the chip.
+	PaddingByte                    // A repeated command byte, which pads a frame out to its tempo or stereo byte.
+	FrameDelayByte                 // The frame delay.
+	TempoByte                      // A tempo change, or the song's initial tempo in its first frame.
+	StereoByte                     // The value written to the stereo control register.
+)
+
+func (p BytePart) String() string {
+	switch p {
+	case HeaderByte:
+		return "frame header"
+	case CommandByte:
+		return "chip command"
+	case PaddingByte:
+		return "padding"
+	case FrameDelayByte:
+		return "frame delay"
+	case TempoByte:
+		return "tempo"
+	case StereoByte:
+		return "stereo"
+	default:
+		return "unknown"
+	}
+}
+
+// ByteSource describes what produced a byte of a compiled song, so a ROM address can be traced back to the
+// frame, and from there the source rows, which wrote it.
+type ByteSource struct {
+	Frame   int      // The index of the frame the byte is in.
+	Part    BytePart // What the byte holds.
+	Channel int      // The channel written by the command the byte is part of, or -1 if it isn't part of a command.
+	Command string   // A description of the command the byte is part of, or "" if it isn't part of a command.
+	Rows    []int    // The source rows the frame plays, which is empty for frames added by the compiler.
+}
+
+// SourceOf returns what produced the byte at the given ROM address, when the song starts at the address start.
+// It returns false if the address isn't part of the song.
+func (s *NmosSong) SourceOf(start, address int) (ByteSource, bool) {
+	addresses := s.FrameAddresses(start)
+	sizes := s.frameSizes()
+	for i := range s.Frames {
+		if address < addresses[i] || address >= addresses[i]+sizes[i] {
+			continue
+		}
+		frame := s.Frames[i]
+		if i == 0 {
+			// The first frame holds the initial tempo, as it does when compiled (see Compile).
+			frame.SetNewTempo(s.InitialTempo)
+		}
+		source := frame.byteSource(address-addresses[i], sizes[i]-1)
+		source.Frame = i
+		source.Rows = frame.Rows
+		return source, true
+	}
+	return ByteSource{}, false
+}
+
+// byteSource returns what produced the byte at the given offset into the compiled frame, which has numCommands
+// command indices. Command indices are written from the highest down, in the same order as Compile.
+func (f *Frame) byteSource(offset int, numCommands int) ByteSource {
+	source := ByteSource{Channel: -1}
+	if offset == 0 {
+		source.Part = HeaderByte
+		return source
+	}
+
+	index := numCommands - (offset - 1)
+	switch {
+	case index == stereoCommandIndex:
+		source.Part = StereoByte
+	case index == tempoCommandIndex:
+		source.Part = TempoByte
+	case index == frameDelayCommandIndex:
+		source.Part = FrameDelayByte
+	default:
+		// Chip commands fill the chip command indices from the highest one the frame has.
+		chipOffset := min(numCommands, lastChipCommandIndex) - index
+		for _, c := range f.commands {
+			size := len(c.toBytes())
+			if chipOffset < size {
+				source.Part = CommandByte
+				source.Channel = int(c.channel)
+				source.Command = c.String()
+				return source
+			}
+			chipOffset -= size
+		}
+		source.Part = PaddingByte
+	}
+	return source
+}
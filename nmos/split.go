@@ -0,0 +1,53 @@
+package nmos
+
+// SplitNoise splits the song into two songs which are meant to be played side by side:
+// one containing the square channels, and one containing only the noise channel.
+//
+// Both songs keep every frame, along with their frame delays, tempo changes and loop points,
+// so they stay in sync when played at the same time. While the noise channel tracks the period of
+// square channel 3, that channel's period commands are written to both songs.
+func (s *NmosSong) SplitNoise() (tone *NmosSong, noise *NmosSong) {
+	tone = &NmosSong{
+		Name:         s.Name,
+		Author:       s.Author,
+		InitialTempo: s.InitialTempo,
+		ClockDiv:     s.ClockDiv,
+		LoopTarget:   s.LoopTarget,
+	}
+	noiseSong := *tone
+	noise = &noiseSong
+
+	// The reset frame at the start of every song sets the noise to track square channel 3.
+	tracksChannel3 := true
+	for _, frame := range s.Frames {
+		toneFrame, noiseFrame := frame, frame
+		toneFrame.commands, noiseFrame.commands = nil, nil
+		toneFrame.Rows = append([]int(nil), frame.Rows...)
+		noiseFrame.Rows = append([]int(nil), frame.Rows...)
+		toneFrame.Comments = append([]string(nil), frame.Comments...)
+		noiseFrame.Comments = append([]string(nil), frame.Comments...)
+
+		for _, c := range frame.commands {
+			if c.commandType == SetNoiseControlCommand {
+				tracksChannel3 = c.noiseRate == Channel3Noise
+			}
+		}
+
+		for _, c := range frame.commands {
+			switch {
+			case c.channel == NoiseChannel:
+				noiseFrame.commands = append(noiseFrame.commands, c)
+			case c.commandType == SetSquarePeriodCommand && c.channel == TrackedChannel && tracksChannel3:
+				toneFrame.commands = append(toneFrame.commands, c)
+				noiseFrame.commands = append(noiseFrame.commands, c)
+			default:
+				toneFrame.commands = append(toneFrame.commands, c)
+			}
+		}
+
+		tone.Frames = append(tone.Frames, toneFrame)
+		noise.Frames = append(noise.Frames, noiseFrame)
+	}
+
+	return tone, noise
+}
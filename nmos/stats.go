@@ -0,0 +1,81 @@
+package nmos
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stats summarises a song, to help with fitting songs into limited ROM space.
+type Stats struct {
+	Frames           int     // Number of frames.
+	Size             int     // Size of the compiled song in bytes.
+	RowRate          float64 // Rows played per second at the start of the song, or 0 if the song has no rows.
+	TempoChanges     int     // Number of tempo changes after the initial tempo.
+	ChannelFrames    [4]int  // Number of frames which write to each channel (square channels 0-2, then noise).
+	LargestFrame     int     // Index of the largest frame.
+	LargestFrameSize int     // Size of the largest frame in bytes.
+	MergedRows       int     // Number of blank rows merged into the frame delay of an earlier frame.
+	MergedBytes      int     // Bytes saved by merging blank rows, compared to giving each of them a frame.
+}
+
+// Stats calculates statistics about the song.
+func (s *NmosSong) Stats() Stats {
+	st := Stats{Frames: len(s.Frames), Size: s.CalculateSize()}
+
+	for i, frame := range s.Frames {
+		if i == 0 {
+			// The initial tempo is written to the first frame when compiling.
+			frame.SetNewTempo(s.InitialTempo)
+		} else if frame.hasTempoChange && !frame.LoopToTarget {
+			st.TempoChanges++
+		}
+
+		if size := frame.CalculateSize(); size > st.LargestFrameSize {
+			st.LargestFrame, st.LargestFrameSize = i, size
+		}
+
+		var written [4]bool
+		for _, c := range frame.commands {
+			written[c.channel] = true
+		}
+		for c, ok := range written {
+			if ok {
+				st.ChannelFrames[c]++
+			}
+		}
+
+		if rows := len(frame.Rows); rows > 0 {
+			if st.RowRate == 0 {
+				delay := (int(frame.FrameDelay)+1)/rows - 1
+				st.RowRate = effectiveTickRate(s.InitialTempo, uint8(delay))
+			}
+			// Without merging, every blank row would be a frame containing a header and a frame delay.
+			st.MergedRows += rows - 1
+			st.MergedBytes += (rows - 1) * 2
+		}
+	}
+
+	return st
+}
+
+func (st Stats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d frames, %d bytes, %d tempo changes, largest frame is frame %d (%d bytes)",
+		st.Frames, st.Size, st.TempoChanges, st.LargestFrame, st.LargestFrameSize)
+
+	b.WriteString(", channel utilization:")
+	names := [4]string{"square 1", "square 2", "square 3", "noise"}
+	for c, frames := range st.ChannelFrames {
+		utilization := 0.0
+		if st.Frames > 0 {
+			utilization = float64(frames) / float64(st.Frames) * 100
+		}
+		fmt.Fprintf(&b, " %s %.1f%%", names[c], utilization)
+		if c < len(names)-1 {
+			b.WriteString(",")
+		}
+	}
+
+	fmt.Fprintf(&b, ", merging %d blank rows saved %d bytes", st.MergedRows, st.MergedBytes)
+	return b.String()
+}
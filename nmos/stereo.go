@@ -0,0 +1,116 @@
+package nmos
+
+import (
+	"fmt"
+	"slices"
+)
+
+// StereoAll is the value of the stereo control register when every channel is sent to both outputs.
+// This is the register's value after a reset.
+const StereoAll uint8 = 0xff
+
+// StereoBits returns the bits of the stereo control register which send a channel (0-3) to the left and right outputs.
+// Like the Game Gear, the upper nibble controls the left output and the lower nibble controls the right output.
+func StereoBits(channel uint8) (left, right uint8) {
+	return 1 << (4 + channel), 1 << channel
+}
+
+// SetStereo makes the frame write a value to the stereo control register of the target.
+// Only targets with Target.Stereo set have this register, and on any other target the byte is ignored.
+// The byte is stored at command index 15, so the frame is always 16 bytes long. The byte at index 14
+// is still treated as a tempo change, so unless the frame also changes the tempo, the current tempo is re-set.
+// Multiple calls of this method to the same frame will return an error.
+func (f *Frame) SetStereo(value uint8) error {
+	if f.hasStereo {
+		return fmt.Errorf("frame already sets the stereo control register")
+	}
+
+	f.stereo = value
+	f.hasStereo = true
+	return nil
+}
+
+// RestoreStereoAtLoopTarget makes sure the stereo control register has the right value when the song loops.
+//
+// If the value of the register at the end of the song differs from its value when the loop target is first played,
+// the loop target frame is made to set the register again. Songs which never write to the register are left unchanged.
+// The frame re-sets the tempo as well, so if the song loops at another tempo, call RepeatStereoBeforeLoopTempo after.
+func (s *NmosSong) RestoreStereoAtLoopTarget() error {
+	if s.LoopTarget < 0 || s.LoopTarget >= len(s.Frames) {
+		return fmt.Errorf("loop target %d is out of range, song only contains %d frames", s.LoopTarget, len(s.Frames))
+	}
+
+	usesStereo := false
+	stereo := StereoAll
+	var targetStereo uint8
+	for i, frame := range s.Frames {
+		if i == s.LoopTarget {
+			targetStereo = stereo
+		}
+		if frame.LoopToTarget {
+			// Nothing else in a loop frame gets executed.
+			continue
+		}
+		if frame.hasStereo {
+			stereo = frame.stereo
+			usesStereo = true
+		}
+	}
+
+	target := &s.Frames[s.LoopTarget]
+	if !usesStereo || target.hasStereo || stereo == targetStereo {
+		return nil
+	}
+
+	target.SetStereo(targetStereo)
+	return nil
+}
+
+// RepeatStereoBeforeLoopTempo makes frames which write to the stereo control register keep the right tempo after
+// the song loops, and returns the number of frames added.
+//
+// Frames which write to the stereo control register always write to the Tempo Register as well, re-setting the tempo
+// in effect when they're compiled. In the looped part of the song, before its first tempo change, that's the tempo
+// the loop target is first played at, but if the song changes the tempo before looping, the loop is played at
+// another tempo the next time round, which these frames would undo. So the frames from the loop target up to the
+// last such frame are repeated before the song loops, where they re-set the tempo the song loops at, and the song
+// loops back to the frame after them instead.
+func (s *NmosSong) RepeatStereoBeforeLoopTempo() (int, error) {
+	if s.LoopTarget < 0 || s.LoopTarget >= len(s.Frames) {
+		return 0, fmt.Errorf("loop target %d is out of range, song only contains %d frames", s.LoopTarget, len(s.Frames))
+	}
+	loopFrame := slices.IndexFunc(s.Frames, func(f Frame) bool { return f.LoopToTarget })
+	if loopFrame < s.LoopTarget {
+		return 0, nil // The song never loops back.
+	}
+
+	// The tempo when the loop target is first played, and when the song loops back to it.
+	firstTempo := s.tempoBefore(s.LoopTarget)
+	loopTempo := s.tempoBefore(loopFrame)
+	if s.LoopTarget == 0 || s.Frames[s.LoopTarget].hasTempoChange || firstTempo == loopTempo {
+		// The first frame always gets the initial tempo when compiling, so like a loop target which changes the
+		// tempo, it sets the same tempo every time it's played.
+		return 0, nil
+	}
+
+	// The last frame before the loop's first tempo change which writes to the stereo control register.
+	last := -1
+	for i := s.LoopTarget; i < loopFrame && !s.Frames[i].hasTempoChange; i++ {
+		if s.Frames[i].hasStereo {
+			last = i
+		}
+	}
+	if last < 0 {
+		return 0, nil
+	}
+
+	// The loop has a tempo change after last (or firstTempo and loopTempo would be the same), so the song still
+	// loops back to a frame which plays.
+	repeated := make([]Frame, 0, last+1-s.LoopTarget)
+	for _, frame := range s.Frames[s.LoopTarget : last+1] {
+		repeated = append(repeated, frame.Clone())
+	}
+	s.Frames = slices.Insert(s.Frames, loopFrame, repeated...)
+	s.LoopTarget = last + 1
+	return len(repeated), nil
+}
@@ -0,0 +1,96 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	gd3Header  = "Gd3 "     // Magic bytes at the start of a GD3 tag.
+	gd3Version = 0x00000100 // The version of the GD3 format written by WriteGD3.
+	gd3System  = "NMOScillator (SN76489)"
+)
+
+// RomTags describes a ROM and the songs in it, so tools which catalogue ROMs don't need to parse the songs again.
+// It's written alongside the ROM as JSON, or as a GD3 tag like those used by VGM files (see WriteGD3).
+type RomTags struct {
+	Title          string     `json:"title"`
+	Author         string     `json:"author"`
+	Album          string     `json:"album"`
+	FurnaceVersion int        `json:"furnaceVersion"` // The version of Furnace which exported the song, or 0 if it wasn't a Furnace export.
+	Compiler       string     `json:"compiler"`       // The name and version of the compiler which built the ROM.
+	Target         string     `json:"target"`
+	Size           int        `json:"size"` // Size of the whole ROM in bytes, including any footers.
+	Songs          []SongTags `json:"songs"`
+}
+
+// SongTags describes a single song in a ROM.
+type SongTags struct {
+	Label             string `json:"label"`
+	Name              string `json:"name"`
+	Address           int    `json:"address"`           // ROM address of the song's first frame.
+	Size              int    `json:"size"`              // Size of the song in bytes.
+	Frames            int    `json:"frames"`            // The number of frames in the song.
+	LoopTarget        int    `json:"loopTarget"`        // Index of the song's loop target frame.
+	LoopTargetAddress int    `json:"loopTargetAddress"` // ROM address of the song's loop target frame.
+}
+
+// Tags returns the tags of the song, if it starts at the given ROM address.
+func (s *NmosSong) Tags(label string, address int) SongTags {
+	return SongTags{
+		Label:             label,
+		Name:              s.Name,
+		Address:           address,
+		Size:              s.CalculateSize(),
+		Frames:            len(s.Frames),
+		LoopTarget:        s.LoopTarget,
+		LoopTargetAddress: s.LoopTargetAddress(address),
+	}
+}
+
+// WriteGD3 writes the tags as a GD3 tag: the magic bytes "Gd3 ", the version and the size of the data as
+// little-endian 32-bit integers, and then eleven null-terminated UTF-16LE strings. The track, game, system and
+// author are given in English only, and the Furnace version and the address, size and loop target of every
+// song are listed in the notes.
+func (t RomTags) WriteGD3(w io.Writer) error {
+	var notes strings.Builder
+	if t.FurnaceVersion != 0 {
+		fmt.Fprintf(&notes, "Furnace version %d\n", t.FurnaceVersion)
+	}
+	if t.Target != "" {
+		fmt.Fprintf(&notes, "Target %s\n", t.Target)
+	}
+	fmt.Fprintf(&notes, "ROM size %d bytes\n", t.Size)
+	for _, song := range t.Songs {
+		fmt.Fprintf(&notes, "%s: %q, address %d, size %d bytes, %d frames, loops to frame #%d at address %d\n",
+			song.Label, song.Name, song.Address, song.Size, song.Frames, song.LoopTarget, song.LoopTargetAddress)
+	}
+
+	fields := []string{
+		t.Title, "", // Track name, in English and Japanese.
+		t.Album, "", // Game name.
+		gd3System, "", // System name.
+		t.Author, "", // Original author.
+		"", // Release date.
+		t.Compiler,
+		strings.TrimSuffix(notes.String(), "\n"),
+	}
+	var data bytes.Buffer
+	for _, field := range fields {
+		for _, unit := range utf16.Encode([]rune(field)) {
+			data.Write(binary.LittleEndian.AppendUint16(nil, unit))
+		}
+		data.Write([]byte{0, 0})
+	}
+
+	out := []byte(gd3Header)
+	out = binary.LittleEndian.AppendUint32(out, gd3Version)
+	out = binary.LittleEndian.AppendUint32(out, uint32(data.Len()))
+	out = append(out, data.Bytes()...)
+	_, err := w.Write(out)
+	return err
+}
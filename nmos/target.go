@@ -0,0 +1,76 @@
+package nmos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Target describes the timing characteristics of the hardware which plays a ROM.
+// All cycle counts are in cycles of the base clock (usually 4 MHz).
+type Target struct {
+	Name string `json:"name"`
+	// The name of the SN76489 variant used by the target (see ChipVariants).
+	Chip string `json:"chip"`
+
+	// The number of cycles needed to fetch and handle a single byte of a frame.
+	CyclesPerByte int `json:"cyclesPerByte"`
+	// The number of extra cycles needed for the SN76489 to latch a command byte.
+	CyclesPerChipWrite int `json:"cyclesPerChipWrite"`
+	// The number of cycles available to process a frame in a single tick.
+	// If 0, the budget is one Frame Clock cycle, which depends on the current tempo.
+	TickCycles int `json:"tickCycles"`
+	// The most bytes which can be written to the SN76489 in a single tick, including dummy commands.
+	// Frames which write more are split across ticks (see NmosSong.ThrottleWrites). If 0, there's no limit.
+	MaxChipWrites int `json:"maxChipWrites"`
+
+	// Whether the target has a Game Gear style stereo control register, written using command index 15.
+	// Panning effects are ignored when converting songs for targets without one.
+	Stereo bool `json:"stereo"`
+}
+
+// DefaultTarget describes the NMOScillator hardware.
+var DefaultTarget = Target{
+	Name:               "NMOScillator",
+	Chip:               "sn76489",
+	CyclesPerByte:      128, // One byte is read every cycle of the divide-by-128 stage.
+	CyclesPerChipWrite: 32,  // The SN76489 needs 32 clock cycles to latch each write.
+	TickCycles:         0,
+	Stereo:             false,
+}
+
+// BuiltinTargets contains the target descriptions which can be referred to by name.
+var BuiltinTargets = map[string]Target{
+	"nmoscillator": DefaultTarget,
+}
+
+// ParseTarget reads a target description in JSON format.
+// Any fields which are missing keep their values from DefaultTarget.
+func ParseTarget(r io.Reader) (Target, error) {
+	target := DefaultTarget
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&target); err != nil {
+		return Target{}, fmt.Errorf("invalid target description: %w", err)
+	}
+	if target.CyclesPerByte < 0 || target.CyclesPerChipWrite < 0 || target.TickCycles < 0 {
+		return Target{}, fmt.Errorf("invalid target description: cycle counts can't be negative")
+	}
+	if target.MaxChipWrites != 0 && target.MaxChipWrites < 2 {
+		// Setting a square channel's period takes two writes, which can't be split.
+		return Target{}, fmt.Errorf("invalid target description: maxChipWrites must be 0 or at least 2, got %d", target.MaxChipWrites)
+	}
+	if _, err := LookupChipVariant(target.Chip); err != nil {
+		return Target{}, fmt.Errorf("invalid target description: %w", err)
+	}
+	return target, nil
+}
+
+// tickCycles returns the number of cycles available to process a frame, given the current tempo.
+func (t Target) tickCycles(tempo uint8) int {
+	if t.TickCycles > 0 {
+		return t.TickCycles
+	}
+	// The Frame Clock divides the base clock by 128, then by (tempo + 129).
+	return 128 * (int(tempo) + 129)
+}
@@ -0,0 +1,52 @@
+package nmos
+
+import (
+	"fmt"
+	"slices"
+)
+
+// RateOption is a combination of tempo and frame delay, and the tick rate it plays at.
+type RateOption struct {
+	Tempo      uint8
+	FrameDelay uint8
+	Achieved   float64 // The tick rate played, in Hz.
+	RelErr     float64 // The relative error from the requested tick rate.
+}
+
+func (o RateOption) String() string {
+	return fmt.Sprintf("tempo %d, frame delay %d: %.3f Hz (%.3f%% off)", o.Tempo, o.FrameDelay, o.Achieved, o.RelErr*100)
+}
+
+// PlanTempo works out how the NMOScillator would play the given tick rate.
+//
+// best is the combination the compiler would choose with the given tolerance: the smallest frame delay
+// within the tolerance, or the closest rate if none are (in which case ok is false).
+// alternatives lists the best tempo for every frame delay, closest first, and is cut short to at most
+// count options.
+func PlanTempo(targetRate float64, maxRelError float64, count int) (best RateOption, alternatives []RateOption, ok bool) {
+	if tempo, frameDelay, achieved, relErr, found := FindBestRate(targetRate, maxRelError); found {
+		best = RateOption{tempo, frameDelay, achieved, relErr}
+		ok = true
+	} else {
+		tempo, frameDelay, achieved, relErr := ClosestRate(targetRate)
+		best = RateOption{tempo, frameDelay, achieved, relErr}
+	}
+
+	for fd := range 255 {
+		tempo, achieved, relErr := bestTempoForDelay(targetRate, uint8(fd))
+		alternatives = append(alternatives, RateOption{tempo, uint8(fd), achieved, relErr})
+	}
+	// Stable, so equally close options keep the smallest frame delay first.
+	slices.SortStableFunc(alternatives, func(a, b RateOption) int {
+		switch {
+		case a.RelErr < b.RelErr:
+			return -1
+		case a.RelErr > b.RelErr:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return best, alternatives[:min(count, len(alternatives))], ok
+}
@@ -0,0 +1,83 @@
+package nmos
+
+import (
+	"fmt"
+	"slices"
+)
+
+// A frame which writes more bytes to the SN76489 than the target allows in a single tick, and which
+// ThrottleWrites couldn't split.
+type ThrottleWarning struct {
+	Frame  int // Index of the frame.
+	Writes int // Number of bytes the frame writes to the SN76489, including dummy commands.
+	Limit  int // Number of bytes the target allows in a single tick.
+	Reason string
+}
+
+func (w ThrottleWarning) String() string {
+	return fmt.Sprintf("frame %d writes %d bytes to the SN76489, but only %d are allowed in one tick: %s", w.Frame, w.Writes, w.Limit, w.Reason)
+}
+
+// chipWrites returns the number of bytes the frame writes to the SN76489, including dummy commands.
+func (f *Frame) chipWrites() int {
+	// Command bytes with indices 2..13 are streamed to the SN76489.
+	numCommands := f.CalculateSize() - 1
+	return max(0, min(numCommands, lastChipCommandIndex)-(firstChipCommandIndex-1))
+}
+
+// ThrottleWrites splits every frame of the song which writes more than limit bytes to the SN76489, so no tick
+// writes more than the chip can take. The commands which don't fit are moved to a new frame straight after it,
+// which takes over all but one cycle of the frame's delay, so the song keeps its timing and the commands are
+// only written a tick later. The new frame is split again if it's still too full.
+//
+// Frames without a frame delay can't be split without slowing the song down, and frames which change the tempo or
+// the stereo control register always write 12 bytes (the first frame of every song sets the initial tempo), so a
+// warning is returned for each of these instead. It also returns the number of frames added.
+func (s *NmosSong) ThrottleWrites(limit int) (int, []ThrottleWarning) {
+	var warnings []ThrottleWarning
+	added := 0
+	for i := 0; i < len(s.Frames); i++ {
+		frame := s.Frames[i]
+		if i == 0 {
+			// The initial tempo is written to the first frame when compiling, so account for it here too.
+			frame.SetNewTempo(s.InitialTempo)
+		}
+		writes := frame.chipWrites()
+		if writes <= limit || frame.LoopToTarget {
+			continue
+		}
+		warning := ThrottleWarning{Frame: i, Writes: writes, Limit: limit}
+		switch {
+		case frame.hasTempoChange || frame.hasStereo:
+			warning.Reason = "frames which change the tempo or stereo always write 12 bytes"
+			warnings = append(warnings, warning)
+			continue
+		case frame.FrameDelay == 0:
+			warning.Reason = "it has no frame delay to split it over"
+			warnings = append(warnings, warning)
+			continue
+		}
+
+		// Keep as many commands as fit, counting the bytes each one writes.
+		kept, keptWrites := 0, 0
+		for _, c := range frame.commands {
+			if keptWrites+len(c.toBytes()) > limit {
+				break
+			}
+			keptWrites += len(c.toBytes())
+			kept++
+		}
+		rest := Frame{
+			commands:   slices.Clone(frame.commands[kept:]),
+			FrameDelay: frame.FrameDelay - 1,
+		}
+		s.Frames[i].commands = frame.commands[:kept:kept]
+		s.Frames[i].FrameDelay = 0
+		s.Frames = slices.Insert(s.Frames, i+1, rest)
+		if s.LoopTarget > i {
+			s.LoopTarget++
+		}
+		added++
+	}
+	return added, warnings
+}
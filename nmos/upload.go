@@ -0,0 +1,200 @@
+package nmos
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// Bytes of the serial upload protocol. Every packet sent to the NMOScillator starts with a packet type,
+// and is answered with a single ACK or NAK byte.
+const (
+	uploadStartPacket = 'S' // Followed by the ROM's length and its CRC-32 (IEEE), both 4 bytes little-endian.
+	uploadDataPacket  = 'D' // Followed by the address (4 bytes little-endian), length, data, and checksum.
+	uploadEndPacket   = 'E' // Answered with ACK once the CRC-32 of the written ROM matches the start packet.
+	uploadReadPacket  = 'R' // Followed by the address (4 bytes little-endian) and length. The ACK is followed by the data and checksum.
+	uploadAck         = 0x06
+	uploadNak         = 0x15
+)
+
+// UploadBlockSize is the largest number of ROM bytes sent in a single data packet.
+const UploadBlockSize = 64
+
+// UploadPort is a connection to the NMOScillator, usually a serial port.
+type UploadPort interface {
+	io.ReadWriter
+	// SetReadDeadline makes reads fail once the given time has passed, like os.File.SetReadDeadline.
+	SetReadDeadline(t time.Time) error
+}
+
+// Options for Upload. A Timeout of 0 waits a second for each answer.
+type UploadOptions struct {
+	Timeout  time.Duration         // How long to wait for the NMOScillator to answer a packet.
+	Retries  int                   // How many times a packet is resent after a NAK or timeout.
+	Progress func(sent, total int) // Called after every data packet, if not nil.
+}
+
+// Upload sends a ROM to the NMOScillator over the serial upload protocol. The ROM is announced with a start
+// packet, sent in data packets of at most UploadBlockSize bytes, then confirmed with an end packet.
+// Each data packet ends with the sum of its address, length and data bytes (modulo 256), and packets which are
+// answered with a NAK, or not answered in time, are sent again.
+func Upload(port UploadPort, rom []byte, opts UploadOptions) error {
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+
+	start := []byte{uploadStartPacket}
+	start = binary.LittleEndian.AppendUint32(start, uint32(len(rom)))
+	start = binary.LittleEndian.AppendUint32(start, crc32.ChecksumIEEE(rom))
+	if err := sendPacket(port, start, opts); err != nil {
+		return fmt.Errorf("start packet: %w", err)
+	}
+
+	for address := 0; address < len(rom); address += UploadBlockSize {
+		block := rom[address:min(address+UploadBlockSize, len(rom))]
+		packet := []byte{uploadDataPacket}
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(address))
+		packet = append(packet, byte(len(block)))
+		packet = append(packet, block...)
+		packet = append(packet, packetSum(packet[1:]))
+
+		if err := sendPacket(port, packet, opts); err != nil {
+			return fmt.Errorf("data packet at address %d: %w", address, err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(address+len(block), len(rom))
+		}
+	}
+
+	if err := sendPacket(port, []byte{uploadEndPacket}, opts); err != nil {
+		return fmt.Errorf("end packet: %w", err)
+	}
+	return nil
+}
+
+// ReadBack reads the first length bytes of the EEPROM back from the NMOScillator over the serial upload protocol,
+// so a ROM can be checked after it's been written. The EEPROM is read in blocks of at most UploadBlockSize bytes,
+// each requested with a read packet. The NMOScillator answers each one with an ACK, the block, and the sum of the
+// read packet's address and length bytes and the block (modulo 256). Blocks which are answered with a NAK, not
+// answered in time, or don't match their checksum are requested again.
+func ReadBack(port UploadPort, length int, opts UploadOptions) ([]byte, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+
+	data := make([]byte, 0, length)
+	for address := 0; address < length; address += UploadBlockSize {
+		packet := []byte{uploadReadPacket}
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(address))
+		packet = append(packet, byte(min(UploadBlockSize, length-address)))
+
+		block, err := requestBlock(port, packet, opts)
+		if err != nil {
+			return nil, fmt.Errorf("read packet at address %d: %w", address, err)
+		}
+		data = append(data, block...)
+		if opts.Progress != nil {
+			opts.Progress(len(data), length)
+		}
+	}
+	return data, nil
+}
+
+// requestBlock sends a read packet and returns the block it's answered with, sending it again after a NAK,
+// timeout or checksum mismatch.
+func requestBlock(port UploadPort, packet []byte, opts UploadOptions) ([]byte, error) {
+	length := int(packet[len(packet)-1])
+	var lastErr error
+	for range opts.Retries + 1 {
+		if _, err := port.Write(packet); err != nil {
+			return nil, err
+		}
+
+		answer, err := readAnswer(port, opts.Timeout)
+		switch {
+		case err != nil:
+			lastErr = err
+			continue
+		case answer == uploadNak:
+			lastErr = errors.New("NMOScillator rejected the packet")
+			continue
+		case answer != uploadAck:
+			lastErr = fmt.Errorf("unexpected answer 0x%02x", answer)
+			continue
+		}
+
+		// The block is followed by its checksum.
+		block, err := readBytes(port, length+1, opts.Timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		sum := packetSum(packet[1:]) + packetSum(block[:length])
+		if block[length] != sum {
+			lastErr = fmt.Errorf("checksum 0x%02x doesn't match the block, expected 0x%02x", block[length], sum)
+			continue
+		}
+		return block[:length], nil
+	}
+	return nil, fmt.Errorf("gave up after %d attempts: %w", opts.Retries+1, lastErr)
+}
+
+// packetSum returns the sum of the bytes (modulo 256), which ends data packets and the blocks sent back for read packets.
+func packetSum(bytes []byte) byte {
+	var sum byte
+	for _, b := range bytes {
+		sum += b
+	}
+	return sum
+}
+
+// sendPacket sends a packet and waits for it to be acknowledged, sending it again after a NAK or timeout.
+func sendPacket(port UploadPort, packet []byte, opts UploadOptions) error {
+	var lastErr error
+	for range opts.Retries + 1 {
+		if _, err := port.Write(packet); err != nil {
+			return err
+		}
+
+		answer, err := readAnswer(port, opts.Timeout)
+		switch {
+		case err != nil:
+			lastErr = err
+		case answer == uploadAck:
+			return nil
+		case answer == uploadNak:
+			lastErr = errors.New("NMOScillator rejected the packet")
+		default:
+			lastErr = fmt.Errorf("unexpected answer 0x%02x", answer)
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", opts.Retries+1, lastErr)
+}
+
+// readAnswer reads a single byte from the port, waiting at most timeout for it.
+func readAnswer(port UploadPort, timeout time.Duration) (byte, error) {
+	answer, err := readBytes(port, 1, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return answer[0], nil
+}
+
+// readBytes reads n bytes from the port, waiting at most timeout for all of them.
+func readBytes(port UploadPort, n int, timeout time.Duration) ([]byte, error) {
+	if err := port.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(port, data); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errors.New("timed out waiting for an answer")
+		}
+		return nil, err
+	}
+	return data, nil
+}
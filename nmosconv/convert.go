@@ -0,0 +1,1287 @@
+// Package nmosconv converts songs parsed from Furnace text exports into NMOScillator songs.
+package nmosconv
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/QEStudios/NMOScillatorCompiler/internal/checked"
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// A non-fatal problem found while converting a song, placed at the subsong and row which caused it.
+type Warning = diag.Diagnostic
+
+// pitchToFreq converts a Midi note number to a frequency, given a specific tuning of A4
+// and a detune in cents.
+func pitchToFreq(pitch furnace.NotePitch, tuning float64, detune int) float64 {
+	// For some reason, furnace notates the octaves as being two octaves *lower* than what they really sound like.
+	// So we need to offset it by bumping the note pitch up two octaves before converting.
+	offsetPitch := pitch + 24
+	freq := tuning * math.Pow(2, float64(offsetPitch-69)/12)
+	if detune != 0 {
+		freq *= math.Pow(2, float64(detune)/1200)
+	}
+	return freq
+}
+
+// pitchToFixedFreq is the integer-only equivalent of pitchToFreq, where the tuning of A4 is given in millihertz.
+func pitchToFixedFreq(pitch furnace.NotePitch, tuningMilliHz uint64, detune int) nmos.FixedFreq {
+	// Same two octave offset as pitchToFreq.
+	offsetPitch := pitch + 24
+	if detune == 0 {
+		return nmos.FixedFreqFromSemitones(tuningMilliHz, int(offsetPitch-69))
+	}
+	return nmos.FixedFreqFromCents(tuningMilliHz, int(offsetPitch-69)*100+detune)
+}
+
+// Options which change how a parsed song is converted into an NMOScillator song.
+// The zero value converts the first subsong using the default behaviour.
+type Options struct {
+	// The index of the subsong to convert.
+	Subsong int
+
+	// If true, periods are calculated using integer-only fixed-point arithmetic instead of floating point,
+	// so the output is bit-identical across architectures and Go versions.
+	FixedPointPeriods bool
+
+	// The name of the SN76489 variant to calculate periods for (see nmos.ChipVariants).
+	// If empty, nmos.DefaultChipVariant is used.
+	Chip string
+
+	// How noise periods are calculated while the noise channel tracks the period of square channel 3.
+	NoiseTuning nmos.NoiseTuning
+
+	// The number of semitones to transpose each channel by (square channels 1-3, then noise).
+	// The noise channel is only transposed while it tracks the period of square channel 3,
+	// as transposing the preset noise rates would pick a different preset.
+	Transpose [4]int
+	// The number of cents to detune each channel by, in the same order as Transpose.
+	Detune [4]int
+
+	// The largest relative error allowed between the song's tick rate and the rate actually played.
+	// If zero, nmos.DefaultRateTolerance is used.
+	RateTolerance float64
+
+	// How note slides are played.
+	SlideMode SlideMode
+
+	// Which channel's period is kept when square channel 3 and the noise channel both set the period of
+	// square channel 3 on the same row, while the noise channel tracks it.
+	Ch3Latch Ch3Latch
+
+	// If true, panning effects are converted into writes to the target's stereo control register
+	// (see nmos.Target.Stereo). Otherwise they're ignored, and every channel plays on both outputs.
+	Stereo bool
+
+	// What happens to notes whose period is outside the range the chip can play.
+	NoteRange NoteRange
+
+	// What happens to notes on the noise channel other than C, C# and D while it uses the preset noise rates.
+	NoisePreset NoisePreset
+
+	// How many steps a note release (===) raises a channel's attenuation by, from 1 to 15, unless the channel's
+	// instrument has a volume macro with a release point to carry on from instead. By default (0 or 15) a release
+	// silences the channel like a note off. Smaller steps leave the note playing more quietly, until the next note
+	// restores the channel's volume.
+	ReleaseAttenuation uint8
+
+	// The most ticks after the start of a note that instrument macros are played for, or 0 for no limit. Macros
+	// hold their value after that, which saves the frames looping macros would otherwise add to every tick.
+	MacroTicks int
+
+	// If not nil, Progress is called before each row is converted and once more when converting finishes,
+	// with the index of the row, the number of rows in the subsong, and the number of frames made so far.
+	// Jumps can move the row index backwards.
+	Progress func(row, rows, frames int)
+
+	// If not nil, Trace is called with the index of a row and a description of how the row changes the course of
+	// the conversion, such as a change of speed or tick rate, a jump, or the song halting or looping, for
+	// troubleshooting conversions.
+	Trace func(row int, message string)
+
+	// If not nil, NoteChanged is called with the index of a row and a description of the change for every note on
+	// it which is played as a different note or left out, because of NoteRange or NoisePreset. Unlike the warnings
+	// about them, which only cover the first such note on each channel, it's called for every one.
+	NoteChanged func(row int, message string)
+}
+
+type noiseRateTypeEnum int
+
+const (
+	noiseRateCh3 noiseRateTypeEnum = iota
+	noiseRatePreset
+)
+
+// RowRate returns the number of rows a subsong plays per second at its start, which the converted song should match.
+// Songs which alternate between several speeds play at their average speed.
+func RowRate(subsong *furnace.Subsong) float64 {
+	total := 0
+	for _, speed := range subsong.Speeds {
+		total += int(speed)
+	}
+	speed := float64(total) / float64(len(subsong.Speeds))
+	return subsong.TickRate / (speed * float64(subsong.TimeBase+1))
+}
+
+// Convert converts a subsong of a parsed Furnace song into an NMOScillator song,
+// along with any non-fatal warnings encountered while converting.
+func Convert(parsedSong *furnace.Song, opts Options) (*nmos.NmosSong, []Warning, error) {
+	if opts.Subsong < 0 || opts.Subsong >= len(parsedSong.Subsongs) {
+		return nil, nil, fmt.Errorf("subsong %d does not exist; song only contains %d subsongs (allowed range 0..%d)",
+			opts.Subsong,
+			len(parsedSong.Subsongs), len(parsedSong.Subsongs)-1,
+		)
+	}
+	subsong := parsedSong.Subsongs[opts.Subsong]
+	if subsong.Skipped {
+		return nil, nil, fmt.Errorf("subsong %d was skipped while parsing", opts.Subsong)
+	}
+	return convert(parsedSong, subsong, sliceRows(subsong.Rows), opts)
+}
+
+// convert converts a subsong whose rows are read from rows, for Convert and StreamConverter. The subsong's Rows
+// aren't read, as they may still be being parsed.
+func convert(parsedSong *furnace.Song, subsong *furnace.Subsong, rows rowSource, opts Options) (*nmos.NmosSong, []Warning, error) {
+	var warnings []Warning
+	// row is -1 for warnings which don't apply to a specific row.
+	warn := func(row int, code string, format string, args ...any) {
+		warnings = append(warnings, diag.Warningf(code, format, args...).AtRow(opts.Subsong, row))
+	}
+	trace := func(row int, format string, args ...any) {
+		if opts.Trace != nil {
+			opts.Trace(row, fmt.Sprintf(format, args...))
+		}
+	}
+
+	song := nmos.NmosSong{}
+
+	if opts.ReleaseAttenuation > 0xf {
+		return nil, warnings, fmt.Errorf("release attenuation must be 0-15, got %d", opts.ReleaseAttenuation)
+	}
+	releaseAttenuation := opts.ReleaseAttenuation
+	if releaseAttenuation == 0 {
+		releaseAttenuation = 0xf
+	}
+	if opts.MacroTicks < 0 {
+		return nil, warnings, fmt.Errorf("macro ticks must not be negative, got %d", opts.MacroTicks)
+	}
+
+	if len(parsedSong.SoundChips) > 1 {
+		warn(-1, "multiple-chips", "found %d sound chips, output will use the first one", len(parsedSong.SoundChips))
+	}
+
+	// Currently only one sound chip exists on the NMOScillator, so just assume the first sound chip is the one to use.
+	const soundchipIndex = 0
+
+	song.Name = ""
+	if parsedSong.Name != "" {
+		song.Name += parsedSong.Name
+		if subsong.Name != "" {
+			song.Name += " - "
+		}
+	}
+	if subsong.Name != "" {
+		song.Name += subsong.Name
+	}
+	if parsedSong.Album != "" {
+		song.Name += fmt.Sprintf(" (from %s)", parsedSong.Album)
+	}
+	song.Author = parsedSong.Author
+
+	tolerance := opts.RateTolerance
+	if tolerance == 0 {
+		tolerance = nmos.DefaultRateTolerance
+	}
+	// findRate finds the tempo and base frame delay to play rows at the given rate.
+	findRate := func(rate float64) (tempo uint8, frameDelay uint8, err error) {
+		tempo, frameDelay, _, _, ok := nmos.FindBestRate(rate, tolerance)
+		if !ok {
+			tempo, frameDelay, achieved, relErr := nmos.ClosestRate(rate)
+			return 0, 0, fmt.Errorf("unable to play a tick rate of %.3f Hz within %g%%: the closest is %.3f Hz (%.2f%% off) with tempo %d and frame delay %d",
+				rate, tolerance*100, achieved, relErr*100, tempo, frameDelay)
+		}
+		return tempo, frameDelay, nil
+	}
+
+	// Songs which alternate between several speeds are timed by the tick instead of by the row,
+	// so each row's frame delay can be worked out from its own speed.
+	grooved := len(subsong.Speeds) > 1
+	speeds := slices.Clone(subsong.Speeds)
+	var baseFrameDelay uint8 // The frame delay of a single row.
+	var tickDelay uint8      // The frame delay of a single tick, if the song is grooved.
+
+	// retime finds the tempo and frame delays to play the given tick rate at the given speed.
+	retime := func(tickRate float64, speed uint8) (tempo uint8, err error) {
+		if grooved {
+			tempo, tickDelay, err = findRate(tickRate)
+			return tempo, err
+		}
+		tempo, baseFrameDelay, err = findRate(tickRate / (float64(speed) * float64(subsong.TimeBase+1)))
+		return tempo, err
+	}
+
+	tempo, err := retime(subsong.TickRate, speeds[0])
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	song.InitialTempo = tempo
+	song.ClockDiv = parsedSong.SoundChips[soundchipIndex].ClockDiv
+
+	var clockRate float64
+	if song.ClockDiv {
+		clockRate = 2_000_000
+	} else {
+		clockRate = 4_000_000
+	}
+
+	if clockRate == 2_000_000 {
+		// NMOScillator doesn't currently support using the ClockDiv option.
+		return nil, warnings, fmt.Errorf("Clock rate of 2 MHz is not currently supported by the NMOScillator")
+	}
+
+	chip, err := nmos.LookupChipVariant(opts.Chip)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	// Helpers to calculate channel periods from note pitches, using either floating or fixed-point arithmetic.
+	tuningMilliHz := uint64(math.Round(parsedSong.Tuning * 1000))
+	state := rowState{
+		volumes:     [4]uint8{0xf, 0xf, 0xf, 0xf},
+		offs:        [4]bool{true, true, true, true},
+		instruments: [4]int{-1, -1, -1, -1},
+	}
+	warnedNoiseSlide := false
+	warnedNoisePreset := false
+
+	squarePeriod := func(pitch furnace.NotePitch, channel furnace.Channel) uint16 {
+		pitch += furnace.NotePitch(opts.Transpose[channel])
+		detune := opts.Detune[channel] + state.finePitch[channel]
+		if channel < 3 {
+			if state.arpMacros[channel].hasValue {
+				pitch += furnace.NotePitch(state.arpMacros[channel].value)
+			}
+			detune += int(math.Round(state.slides[channel].cents + float64(state.macroPitch[channel]+state.slidPitch[channel])*centsPerPitchUnit))
+		}
+		if opts.FixedPointPeriods {
+			return chip.SquarePeriodFixed(pitchToFixedFreq(pitch, tuningMilliHz, detune), uint64(clockRate))
+		}
+		return chip.SquarePeriod(pitchToFreq(pitch, parsedSong.Tuning, detune), clockRate)
+	}
+	noisePeriod := func(pitch furnace.NotePitch) uint16 {
+		pitch += furnace.NotePitch(opts.Transpose[3])
+		detune := opts.Detune[3] + state.finePitch[3]
+		if opts.NoiseTuning == nmos.NoiseTuningLegacy {
+			if opts.FixedPointPeriods {
+				return nmos.CalculateNoisePeriodFixed(pitchToFixedFreq(pitch, tuningMilliHz, detune), uint64(clockRate))
+			}
+			return nmos.CalculateNoisePeriodFromCh3(pitchToFreq(pitch, parsedSong.Tuning, detune), clockRate, nmos.LegacyNoiseCorrection)
+		}
+		if opts.FixedPointPeriods {
+			return chip.NoisePeriodFixed(pitchToFixedFreq(pitch, tuningMilliHz, detune), uint64(clockRate))
+		}
+		return chip.NoisePeriod(pitchToFreq(pitch, parsedSong.Tuning, detune), clockRate)
+	}
+
+	// fitPeriod returns the period to play a note on a channel with, after opts.NoteRange has dealt with notes
+	// outside the chip's range. It returns false if the note should be left out, and a description of the change
+	// if the note was moved or left out.
+	var warnedRange [4]bool
+	fitPeriod := func(rowIndex int, pitch furnace.NotePitch, channel furnace.Channel) (uint16, bool, string, error) {
+		period := func(pitch furnace.NotePitch) uint16 {
+			if channel == nmos.NoiseChannel {
+				return noisePeriod(pitch)
+			}
+			return squarePeriod(pitch, channel)
+		}
+		inRange := func(period uint16) bool {
+			return period >= 1 && period <= nmos.MaxSquarePeriod
+		}
+
+		p := period(pitch)
+		if inRange(p) {
+			return p, true, "", nil
+		}
+		direction, step := "low", furnace.NotePitch(12)
+		if p == 0 {
+			direction, step = "high", -12
+		}
+
+		switch opts.NoteRange {
+		case NoteRangeOctave:
+			for octaves := 1; octaves <= 10; octaves++ {
+				moved := pitch + step*furnace.NotePitch(octaves)
+				if p := period(moved); inRange(p) {
+					change := fmt.Sprintf("note %v on %s is too %s for the chip's periods, playing it as %v instead",
+						pitch, channelName(int(channel)), direction, moved)
+					if !warnedRange[channel] {
+						warn(rowIndex, "note-out-of-range", "%s", change)
+						warnedRange[channel] = true
+					}
+					return p, true, change, nil
+				}
+			}
+		case NoteRangeDrop:
+			change := fmt.Sprintf("note %v on %s is too %s for the chip's periods, leaving it out",
+				pitch, channelName(int(channel)), direction)
+			if !warnedRange[channel] {
+				warn(rowIndex, "note-out-of-range", "%s", change)
+				warnedRange[channel] = true
+			}
+			return 0, false, change, nil
+		}
+		return 0, false, "", diag.Errorf("note-out-of-range", "note %v on %s is too %s for the chip's periods", pitch, channelName(int(channel)), direction).
+			Suggest("transpose the channel, or pass --note-range octave or --note-range drop").AtRow(opts.Subsong, rowIndex)
+	}
+
+	stereo := nmos.StereoAll
+	warnedPanning := false
+
+	var currentTickRate float64
+	var loopTargetIndex int
+	var loopTargetRow int // The row which a backward jump loops back to.
+	speedStep := 0        // How many rows have been played, which picks the speed of grooved rows.
+	warnedGroove := false
+	warnedJumpRow := false
+	warnedJumpPattern := false
+	// A streamed 0Bxx jumping forward, which is warned about if the rows run out before the pattern it jumps to.
+	var pendingJumpPattern *pendingJump
+	warnJumpPattern := func(rowIndex int, pattern int) {
+		if !warnedJumpPattern {
+			warn(rowIndex, "jump-pattern", "0B%02X jumps to pattern %d, but the song only has %d patterns, so it loops back to the start instead",
+				pattern, pattern, rows.count()/int(subsong.PatternLength))
+			warnedJumpPattern = true
+		}
+	}
+
+	currentTickRate = subsong.TickRate
+
+	var isHalted bool // Does the song now halt? (used for breaking out of the loop)
+	var isLooped bool // Does the song now loop back to an earlier point? (used for breaking out of the loop)
+
+	resetFrame := nmos.Frame{}
+	err = resetFrame.SetNoiseControl(nmos.WhiteNoise, nmos.Channel3Noise)
+	if err != nil {
+		return nil, warnings, fmt.Errorf("error generating reset frame: %v", err)
+	}
+
+	for c := 0; c < 4; c++ {
+		resetFrame.SetAttenuation(uint8(c), 0xf)
+	}
+
+	song.Frames = append(song.Frames, resetFrame)
+
+	// Rows which may be jumped back to. These always start a new frame, even when blank,
+	// so that coalescing them into the previous frame doesn't move the loop point. Rows which are still being parsed
+	// can't be searched ahead of time, so blank rows are coalesced anyway, and split back out of their frame if a jump
+	// back to them is found.
+	loopTargetRows, streamed := rows.loopTargets(subsong)
+	coalescedRows := make(map[int]coalescedRow)
+	// The index of the first frame of every row converted so far, which loops are resolved against.
+	rowFrames := make(map[int]int)
+
+	// advanceSlide moves the slide on a channel on by a tick, and reports whether it reached its target note.
+	advanceSlide := func(c int) bool {
+		semitones := state.slides[c].semitones
+		if !state.slides[c].advance() {
+			return false
+		}
+		state.lastPitch[c] += furnace.NotePitch(semitones)
+		return true
+	}
+
+	// advancePitchSlide moves the pitch slide on a square channel on by a tick, and reports whether it moved the pitch.
+	// Like Furnace, the slide stops at the lowest and highest periods the chip can play.
+	advancePitchSlide := func(c int) bool {
+		if !state.hasLastPitch[c] {
+			return false
+		}
+		state.slidPitch[c] += state.pitchSlides[c]
+		if p := squarePeriod(state.lastPitch[c], furnace.Channel(c)); p < 1 || p > nmos.MaxSquarePeriod {
+			state.slidPitch[c] -= state.pitchSlides[c]
+			state.pitchSlides[c] = 0
+			return false
+		}
+		return true
+	}
+
+	// volumeMacro, arpMacro and pitchMacro return a macro of the instrument a channel plays, or nil if it has none.
+	volumeMacro := func(c int) *furnace.Macro {
+		if instrument := parsedSong.Instrument(state.instruments[c]); instrument != nil {
+			return instrument.Volume
+		}
+		return nil
+	}
+	arpMacro := func(c int) *furnace.Macro {
+		if instrument := parsedSong.Instrument(state.instruments[c]); instrument != nil {
+			return instrument.Arpeggio
+		}
+		return nil
+	}
+	pitchMacro := func(c int) *furnace.Macro {
+		if instrument := parsedSong.Instrument(state.instruments[c]); instrument != nil {
+			return instrument.Pitch
+		}
+		return nil
+	}
+
+	// attenuation returns the attenuation of a channel at its volume, after its volume macro.
+	attenuation := func(c int) uint8 {
+		return volumeAttenuation(state.volumes[c], state.volumeMacros[c])
+	}
+	// tickVolumeMacro moves the volume macro of a channel on by a tick, and reports whether it changed the channel's attenuation.
+	tickVolumeMacro := func(c int) bool {
+		before := attenuation(c)
+		if m := volumeMacro(c); m != nil {
+			state.volumeMacros[c].tick(m, true, opts.MacroTicks)
+		}
+		return attenuation(c) != before
+	}
+
+	// advanceVolumeSlide moves the volume slide on a channel on by a tick, and reports whether it changed the channel's attenuation.
+	advanceVolumeSlide := func(c int) bool {
+		before := attenuation(c)
+		var carriesOn bool
+		state.volumes[c], state.volumeFractions[c], carriesOn = slideVolume(state.volumes[c], state.volumeFractions[c], state.volumeSlides[c])
+		if !carriesOn {
+			state.volumeSlides[c] = 0
+		}
+		return attenuation(c) != before
+	}
+
+	// applyPitchMacro applies the value the pitch macro of a square channel just read, and reports whether it
+	// changed the channel's pitch. Relative pitch macros add their values up on every step.
+	applyPitchMacro := func(c int, m *furnace.Macro) bool {
+		before := state.macroPitch[c]
+		if m.Mode == furnace.MacroModeRelative {
+			state.macroPitch[c] += state.pitchMacros[c].value
+		} else {
+			state.macroPitch[c] = state.pitchMacros[c].value
+		}
+		return state.macroPitch[c] != before
+	}
+	// startPitchMacros starts the arpeggio and pitch macros of a square channel's instrument over, for a new note.
+	startPitchMacros := func(c int) {
+		state.arpMacros[c], state.pitchMacros[c], state.macroPitch[c] = macroPlayer{}, macroPlayer{}, 0
+		if m := arpMacro(c); m != nil {
+			state.arpMacros[c].start(m)
+		}
+		if m := pitchMacro(c); m != nil && state.pitchMacros[c].start(m) {
+			applyPitchMacro(c, m)
+		}
+	}
+	// tickPitchMacros moves the arpeggio and pitch macros of a square channel on by a tick, and reports whether
+	// they changed the channel's pitch.
+	tickPitchMacros := func(c int) bool {
+		changed := false
+		if m := arpMacro(c); m != nil {
+			before := state.arpMacros[c].value
+			if state.arpMacros[c].tick(m, false, opts.MacroTicks) && state.arpMacros[c].value != before {
+				changed = true
+			}
+		}
+		if m := pitchMacro(c); m != nil && state.pitchMacros[c].tick(m, false, opts.MacroTicks) {
+			changed = applyPitchMacro(c, m) || changed
+		}
+		return changed
+	}
+	// stopMacros stops every macro playing on a channel, when it's cut or turned off.
+	stopMacros := func(c int) {
+		state.volumeMacros[c] = macroPlayer{}
+		if c < 3 {
+			state.arpMacros[c], state.pitchMacros[c], state.macroPitch[c] = macroPlayer{}, macroPlayer{}, 0
+		}
+	}
+
+	var newIndex int // The index of the next row to play.
+
+	// convertRow converts a row into a frame, along with the period changes written partway through it by slides.
+	// It also sets the next row to play, and whether the song halts or loops after the row.
+	convertRow := func(rowIndex int, row furnace.Row) (convertedRow, error) {
+		frame := nmos.Frame{}
+
+		isBlank := true
+		newStereo := stereo
+		var cut [4]bool      // Channels cut by a note cut effect on this row.
+		var repitch [4]bool  // Channels whose fine pitch changed on this row.
+		var revolume [4]bool // Channels whose volume macro or slide changed their attenuation at the start of this row.
+		var slideEffects [3]*furnace.Effect
+		var pitchSlideEffects [3]*furnace.Effect
+		var volumeSlideEffects [4]*furnace.Effect
+		var noteChanges []string // Notes on this row which are moved or left out, for opts.NoteChanged.
+
+		// setTrackedPeriod sets the period of the square channel which the noise channel can track, for either
+		// that square channel or the noise channel. If both set it on this row, opts.Ch3Latch picks the one kept.
+		var trackedBySquare, trackedByNoise bool
+		setTrackedPeriod := func(byNoise bool, period uint16) error {
+			if byNoise && trackedBySquare && opts.Ch3Latch == Ch3LatchSquare ||
+				!byNoise && trackedByNoise && opts.Ch3Latch == Ch3LatchNoise {
+				return nil
+			}
+			if byNoise {
+				trackedByNoise = true
+			} else {
+				trackedBySquare = true
+			}
+			return frame.ReplaceSquarePeriod(nmos.TrackedChannel, period)
+		}
+		setSquarePeriod := func(channel uint8, period uint16) error {
+			if channel == nmos.TrackedChannel {
+				return setTrackedPeriod(false, period)
+			}
+			return frame.SetSquarePeriod(channel, period)
+		}
+
+		// Macros move on at the start of every row. Volume changes which couldn't be written in the last row are
+		// caught up on here too, as pitch changes are with slides below.
+		for c := range state.volumeMacros {
+			if tickVolumeMacro(c) || state.volumeCatchUp[c] {
+				revolume[c] = true
+			}
+			state.volumeCatchUp[c] = false
+			if c < 3 && tickPitchMacros(c) {
+				repitch[c] = true
+			}
+		}
+
+		// Effects are read in the order of their channels and columns, but like in Furnace, the order only matters
+		// between effects of the same kind, where the last one wins. Changes of speed and tick rate are applied
+		// together, and jumps are resolved, once every effect on the row has been read.
+		newSpeed := false
+		newTickRate := "" // A description of the last tick rate set on the row, for tracing.
+		for _, effect := range row.Effects {
+			switch effect.Type {
+			case furnace.EffectJumpToPattern, furnace.EffectJumpToNextPattern:
+				// Resolved below by findJump.
+
+			case furnace.EffectGroove, furnace.EffectSpeed:
+				if effect.Value == 0 { // Furnace ignores speeds of 0.
+					continue
+				}
+				speed, err := checked.Narrow[uint8](effect.Value)
+				if err != nil {
+					return convertedRow{}, fmt.Errorf("row %d: speed is out of range: %w", rowIndex, err)
+				}
+
+				// 09xx selects a groove pattern, or sets speed 1 if the song has none. 0Fxx sets speed 2
+				// if the song alternates between two speeds, and speed 1 otherwise.
+				switch {
+				case effect.Type == furnace.EffectGroove:
+					if !warnedGroove {
+						warn(rowIndex, "groove-pattern", "groove patterns aren't included in text exports, so set groove pattern (09xx) is treated as set speed 1")
+						warnedGroove = true
+					}
+					speeds[0] = speed
+				case len(speeds) == 2:
+					speeds[1] = speed
+				default:
+					speeds[0] = speed
+				}
+
+				// The frame delay of each row of grooved songs already follows its speed.
+				newSpeed = !grooved
+
+			case furnace.EffectNoiseControl:
+				rateVal := effect.Value >> 4
+				modeVal := effect.Value % 16
+
+				if rateVal == 1 {
+					state.noiseRateType = noiseRateCh3
+				} else {
+					state.noiseRateType = noiseRatePreset
+				}
+
+				if modeVal == 1 {
+					state.noiseMode = nmos.WhiteNoise
+				} else {
+					state.noiseMode = nmos.PeriodicNoise
+				}
+
+				if state.noiseRateType == noiseRateCh3 {
+					err := frame.SetNoiseControl(state.noiseMode, nmos.Channel3Noise)
+					if err != nil {
+						return convertedRow{}, fmt.Errorf("error setting noise control values: %v", err)
+					}
+				}
+				// If not ch3 noise, noise uses preset frequency, and this means the noise control should be updated
+				// only when changing the preset (with a note pitch set in the noise channel).
+				isBlank = false
+
+			case furnace.EffectTickRateHz:
+				currentTickRate = float64(effect.Value)
+				newTickRate = fmt.Sprintf("%g Hz", currentTickRate)
+
+			case furnace.EffectTickRateBpm:
+				currentTickRate = float64(effect.Value) * 24 / 60 // Furnace assumes 24 ticks per beat, I had to figure this out the hard way.
+				newTickRate = fmt.Sprintf("%g Hz (%d BPM)", currentTickRate, effect.Value)
+
+			case furnace.EffectStopSong:
+				// We can stop parsing the song after this frame.
+				// Since the NMOScillator has no way of actually halting the playback,
+				// we instead send it into an infinite loop at the end of the song.
+				isHalted = true
+				isBlank = false
+				trace(rowIndex, "song halts after this row")
+
+			case furnace.EffectPanning:
+				if !opts.Stereo {
+					if !warnedPanning {
+						warn(rowIndex, "no-stereo", "target has no stereo support, ignoring panning effects")
+						warnedPanning = true
+					}
+					continue
+				}
+				// The upper nibble is the left volume, and the lower nibble is the right volume.
+				// The stereo register can only turn each side on or off, so any non-zero volume turns that side on.
+				left, right := nmos.StereoBits(uint8(effect.Channel))
+				newStereo &^= left | right
+				if effect.Value>>4 != 0 {
+					newStereo |= left
+				}
+				if effect.Value&0x0f != 0 {
+					newStereo |= right
+				}
+
+			case furnace.EffectSetPitch:
+				// 0x80 is the centre, and the full range covers one semitone either side.
+				state.finePitch[effect.Channel] = (int(effect.Value) - 0x80) * 100 / 0x80
+				repitch[effect.Channel] = true
+
+			case furnace.EffectNoteSlideUp, furnace.EffectNoteSlideDown:
+				if effect.Channel > 2 {
+					if !warnedNoiseSlide {
+						warn(rowIndex, "noise-slide", "note and pitch slides on the noise channel aren't supported, ignoring")
+						warnedNoiseSlide = true
+					}
+					continue
+				}
+				slideEffects[effect.Channel] = &effect
+
+			case furnace.EffectPitchSlideUp, furnace.EffectPitchSlideDown:
+				if effect.Channel > 2 {
+					if !warnedNoiseSlide {
+						warn(rowIndex, "noise-slide", "note and pitch slides on the noise channel aren't supported, ignoring")
+						warnedNoiseSlide = true
+					}
+					continue
+				}
+				pitchSlideEffects[effect.Channel] = &effect
+
+			case furnace.EffectVolumeSlide:
+				volumeSlideEffects[effect.Channel] = &effect
+
+			case furnace.EffectLegato:
+				// Legato stops new notes from retriggering the instrument. Notes on the SN76489 only
+				// change the channel's period and never retrigger anything, so every note is already legato.
+
+			case furnace.EffectNoteCut:
+				if effect.Value == 0 {
+					cut[effect.Channel] = true
+				} else {
+					warn(rowIndex, "note-cut-timing", "note cut after %d ticks can't be placed partway through a row, ignoring", effect.Value)
+				}
+
+			default:
+				panic(fmt.Sprintf("unknown effect type %d", effect.Type))
+			}
+		}
+
+		if newSpeed || newTickRate != "" {
+			tempo, err := retime(currentTickRate, speeds[0])
+			if err != nil {
+				return convertedRow{}, fmt.Errorf("row %d: %w", rowIndex, err)
+			}
+
+			err = frame.SetNewTempo(tempo)
+			if err != nil {
+				return convertedRow{}, fmt.Errorf("error setting frame tempo: %v", err)
+			}
+			isBlank = false
+			switch {
+			case newSpeed && newTickRate != "":
+				trace(rowIndex, "new speed %d and tick rate %s, tempo %d", speeds[0], newTickRate, tempo)
+			case newSpeed:
+				trace(rowIndex, "new speed %d, tempo %d", speeds[0], tempo)
+			default:
+				trace(rowIndex, "new tick rate %s, tempo %d", newTickRate, tempo)
+			}
+		}
+
+		if jump, ok := findJump(row); ok {
+			if jump.row >= int(subsong.PatternLength) && !warnedJumpRow {
+				warn(rowIndex, "jump-row", "0D%02X jumps to row %d, but patterns only have %d rows, so it jumps to row 0 instead",
+					jump.row, jump.row, subsong.PatternLength)
+				warnedJumpRow = true
+			}
+			if jump.pattern >= 0 && streamed {
+				// Streamed rows are only counted as they're received, so whether the pattern exists isn't known
+				// until the rows run out before reaching it.
+				pendingJumpPattern = &pendingJump{row: rowIndex, pattern: jump.pattern}
+			} else if jump.pattern*int(subsong.PatternLength) >= rows.count() {
+				warnJumpPattern(rowIndex, jump.pattern)
+			}
+			target := jump.target(rowIndex, int(subsong.PatternLength))
+			switch {
+			case target > rowIndex: // skip forward
+				newIndex = target
+				trace(rowIndex, "jump to pattern %d, skipping forward to row %d", target/int(subsong.PatternLength), newIndex)
+			default: // loop backward
+				// The loop target frame is resolved once every row has been converted,
+				// because blank rows don't produce frames of their own.
+				loopTargetRow = target
+				isLooped = true
+				isBlank = false
+				trace(rowIndex, "jump to pattern %d, looping back to row %d", target/int(subsong.PatternLength), loopTargetRow)
+			}
+		}
+
+		// Start new pitch slides, and move those already playing on by a tick. New notes on this row play from their
+		// own pitch, so this is done before them.
+		for c := range state.pitchSlides {
+			if e := pitchSlideEffects[c]; e != nil {
+				state.pitchSlides[c] = pitchSlideSpeed(e.Value, e.Type == furnace.EffectPitchSlideUp)
+			} else if state.pitchSlides[c] != 0 && advancePitchSlide(c) {
+				repitch[c] = true
+			}
+		}
+
+		for c := range cut {
+			if !cut[c] {
+				continue
+			}
+			err := frame.SetAttenuation(uint8(c), 0xf)
+			if err != nil {
+				return convertedRow{}, fmt.Errorf("error cutting note: %v", err)
+			}
+			state.offs[c] = true
+			stopMacros(c)
+			isBlank = false
+		}
+
+		if newStereo != stereo {
+			err := frame.SetStereo(newStereo)
+			if err != nil {
+				return convertedRow{}, fmt.Errorf("error setting stereo: %v", err)
+			}
+			// The byte before the stereo control byte is always a tempo change, which re-sets the current tempo
+			// when the song is compiled, unless the frame changes it itself.
+			stereo = newStereo
+			isBlank = false
+		}
+
+		// Furnace moves on to the next speed on every row.
+		rowSpeed := speeds[speedStep%len(speeds)]
+		speedStep++
+		if grooved {
+			delay := int(rowSpeed)*(subsong.TimeBase+1)*(int(tickDelay)+1) - 1
+			if baseFrameDelay, err = checked.Narrow[uint8](delay); err != nil {
+				return convertedRow{}, fmt.Errorf("row %d: speed %d is too slow to play at this tick rate: %w", rowIndex, rowSpeed, err)
+			}
+		}
+		frame.FrameDelay = baseFrameDelay
+
+		// Notes
+		for _, note := range row.Notes {
+			if note.HasInstrument {
+				state.instruments[note.Channel] = note.Instrument
+			}
+
+			if note.Channel < 3 && (note.HasPitch || note.Off) {
+				// New notes and note offs stop slides, unless the row starts a new one.
+				state.slides[note.Channel] = noteSlide{}
+				state.slideCatchUp[note.Channel] = false
+			}
+			if note.Channel < 3 && note.HasPitch {
+				// Pitch slides carry on into new notes, but from the new note's own pitch.
+				state.slidPitch[note.Channel] = 0
+			}
+
+			if note.Off && !cut[note.Channel] {
+				err := frame.SetAttenuation(uint8(note.Channel), 0xf)
+				if err != nil {
+					return convertedRow{}, fmt.Errorf("error setting channel off: %v", err)
+				}
+				state.offs[note.Channel] = true
+				stopMacros(int(note.Channel))
+				isBlank = false
+			}
+
+			if note.Release && !cut[note.Channel] && !state.offs[note.Channel] {
+				if note.Channel < 3 {
+					if m := arpMacro(int(note.Channel)); m != nil {
+						state.arpMacros[note.Channel].release(m)
+					}
+					if m := pitchMacro(int(note.Channel)); m != nil {
+						state.pitchMacros[note.Channel].release(m)
+					}
+				}
+				before := attenuation(int(note.Channel))
+				if m := volumeMacro(int(note.Channel)); m != nil && state.volumeMacros[note.Channel].release(m) {
+					// The instrument's volume macro plays the release instead.
+					revolume[note.Channel] = attenuation(int(note.Channel)) != before
+				} else {
+					// The channel counts as off, so the next note restores its volume.
+					released := min(attenuation(int(note.Channel))+releaseAttenuation, 0xf)
+					err := frame.SetAttenuation(uint8(note.Channel), released)
+					if err != nil {
+						return convertedRow{}, fmt.Errorf("error releasing note: %v", err)
+					}
+					state.offs[note.Channel] = true
+					isBlank = false
+				}
+			}
+
+			if note.HasVolume {
+				vol := uint8(note.Volume)
+				if !state.offs[note.Channel] {
+					err := frame.SetAttenuation(uint8(note.Channel), volumeAttenuation(vol, state.volumeMacros[note.Channel]))
+					if err != nil {
+						return convertedRow{}, fmt.Errorf("error setting channel attenuation off: %v", err)
+					}
+				}
+				state.volumes[note.Channel], state.volumeFractions[note.Channel] = vol, 0
+				isBlank = false
+			}
+
+			// New notes start the macros of the channel's instrument over, which arpeggio and pitch macros
+			// do before the note's period is worked out.
+			if note.HasPitch && note.Channel < 3 {
+				startPitchMacros(int(note.Channel))
+			}
+
+			// Notes on the noise channel which don't pick one of the preset rates track square channel 3 instead,
+			// if opts.NoisePreset says so.
+			trackNoise := false
+			if note.HasPitch && note.Channel == nmos.NoiseChannel && state.noiseRateType == noiseRatePreset {
+				_, isPreset := presetNoiseRate(note.Pitch)
+				trackNoise = !isPreset && opts.NoisePreset == NoisePresetTrack
+			}
+
+			// Notes outside the chip's range are moved or left out, as opts.NoteRange says.
+			var period uint16
+			if note.HasPitch && (note.Channel < 3 || state.noiseRateType == noiseRateCh3 || trackNoise) {
+				var ok bool
+				var change string
+				var err error
+				period, ok, change, err = fitPeriod(rowIndex, note.Pitch, note.Channel)
+				if err != nil {
+					return convertedRow{}, err
+				}
+				if change != "" {
+					noteChanges = append(noteChanges, change)
+				}
+				if !ok {
+					continue
+				}
+			}
+
+			if note.HasPitch {
+				before := attenuation(int(note.Channel))
+				state.volumeMacros[note.Channel] = macroPlayer{}
+				if m := volumeMacro(int(note.Channel)); m != nil {
+					state.volumeMacros[note.Channel].start(m)
+				}
+				revolume[note.Channel] = revolume[note.Channel] || attenuation(int(note.Channel)) != before
+			}
+
+			if note.HasPitch && note.Channel < 3 { // Set pitch for square channels.
+				err := setSquarePeriod(uint8(note.Channel), period)
+				if err != nil {
+					return convertedRow{}, fmt.Errorf("error setting channel period: %v", err)
+				}
+				state.lastPitch[note.Channel], state.hasLastPitch[note.Channel] = note.Pitch, true
+				repitch[note.Channel] = false
+				if state.offs[note.Channel] && !cut[note.Channel] {
+					err := frame.SetAttenuation(uint8(note.Channel), attenuation(int(note.Channel)))
+					if err != nil {
+						return convertedRow{}, fmt.Errorf("error setting channel on: %v", err)
+					}
+					state.offs[note.Channel] = false
+				}
+				isBlank = false
+			} else if note.HasPitch && note.Channel == nmos.NoiseChannel { // Set pitch for noise channel
+				if state.noiseRateType == noiseRateCh3 || trackNoise {
+					if trackNoise {
+						err := frame.SetNoiseControl(state.noiseMode, nmos.Channel3Noise)
+						if err != nil {
+							return convertedRow{}, fmt.Errorf("error setting noise control values: %v", err)
+						}
+					}
+					err := setTrackedPeriod(true, period)
+					if err != nil {
+						return convertedRow{}, fmt.Errorf("error setting noise period: %v", err)
+					}
+					if state.offs[3] && !cut[3] {
+						err := frame.SetAttenuation(3, attenuation(3))
+						if err != nil {
+							return convertedRow{}, fmt.Errorf("error setting noise attenuation: %v", err)
+						}
+						state.offs[3] = false
+					}
+				} else {
+					// Noise mode is set to preset, so C = LOW, C# = MED, and D = HIGH.
+					preset, ok := presetNoiseRate(note.Pitch)
+					if !ok {
+						if opts.NoisePreset != NoisePresetSnap {
+							return convertedRow{}, diag.Errorf("noise-preset", "unable to convert noise pitch %v into a noise mode preset", note.Pitch).
+								Suggest("use C, C# or D, or pass --noise-preset snap or --noise-preset track").AtRow(opts.Subsong, rowIndex)
+						}
+						preset = nearestPresetNoiseRate(note.Pitch)
+						name, _ := preset.MarshalText()
+						change := fmt.Sprintf("noise pitch %v isn't C, C# or D, so it plays the nearest preset, the %s rate", note.Pitch, name)
+						noteChanges = append(noteChanges, change)
+						if !warnedNoisePreset {
+							warn(rowIndex, "noise-preset", "%s", change)
+							warnedNoisePreset = true
+						}
+					}
+
+					err := frame.SetNoiseControl(state.noiseMode, preset)
+					if err != nil {
+						return convertedRow{}, fmt.Errorf("error setting noise control values: %v", err)
+					}
+					if state.offs[3] && !cut[3] {
+						err := frame.SetAttenuation(3, attenuation(3))
+						if err != nil {
+							return convertedRow{}, fmt.Errorf("error setting noise attenuation: %v", err)
+						}
+						state.offs[3] = false
+					}
+				}
+				isBlank = false
+			}
+		}
+
+		// Start new volume slides, and move those already playing on by a tick.
+		for c := range state.volumeSlides {
+			if e := volumeSlideEffects[c]; e != nil {
+				state.volumeSlides[c] = volumeSlideSpeed(e.Value)
+			} else if state.volumeSlides[c] != 0 && advanceVolumeSlide(c) {
+				revolume[c] = true
+			}
+		}
+
+		// Write the volume of channels whose volume macros or slides changed, if they're playing.
+		for c := range revolume {
+			if revolume[c] && !state.offs[c] && !cut[c] {
+				if err := frame.ReplaceAttenuation(uint8(c), attenuation(c)); err != nil {
+					return convertedRow{}, fmt.Errorf("error setting volume macro attenuation: %v", err)
+				}
+				isBlank = false
+			}
+		}
+
+		// Start new slides, and move slides which are already playing on by a tick.
+		for c := range state.slides {
+			if state.slideCatchUp[c] {
+				repitch[c] = true
+				state.slideCatchUp[c] = false
+			}
+			if e := slideEffects[c]; e != nil {
+				state.slides[c].start(e.Value, e.Type == furnace.EffectNoteSlideUp)
+			} else if state.slides[c].active {
+				if done := advanceSlide(c); done || opts.SlideMode == SlideTicks {
+					repitch[c] = true
+				}
+			}
+		}
+
+		// Apply fine pitch changes to notes which are already playing.
+		for c := range state.lastPitch {
+			if repitch[c] && state.hasLastPitch[c] {
+				period, ok, _, err := fitPeriod(rowIndex, state.lastPitch[c], furnace.Channel(c))
+				if err != nil {
+					return convertedRow{}, err
+				} else if !ok {
+					continue
+				}
+				err = setSquarePeriod(uint8(c), period)
+				if err != nil {
+					return convertedRow{}, fmt.Errorf("error setting channel period: %v", err)
+				}
+				isBlank = false
+			}
+		}
+
+		// Slides and arpeggio and pitch macros change the period on the ticks after the first, which are written
+		// partway through the row.
+		var slideWrites []periodWrite
+		ticks := int(rowSpeed) * (subsong.TimeBase + 1)
+		cycles := int(baseFrameDelay) + 1
+		for c := range state.slides {
+			macrosPlaying := state.arpMacros[c].active && !state.arpMacros[c].finished ||
+				state.pitchMacros[c].active && !state.pitchMacros[c].finished
+			if !state.slides[c].active && state.pitchSlides[c] == 0 && !macrosPlaying || !state.hasLastPitch[c] {
+				continue
+			}
+			lastPeriod, _, _, err := fitPeriod(rowIndex, state.lastPitch[c], furnace.Channel(c))
+			if err != nil {
+				return convertedRow{}, err
+			}
+			for t := 1; t < ticks; t++ {
+				slid := state.slides[c].active && (advanceSlide(c) || opts.SlideMode == SlideTicks)
+				slid = state.pitchSlides[c] != 0 && advancePitchSlide(c) || slid
+				if !tickPitchMacros(c) && !slid {
+					continue
+				}
+				period, ok, _, err := fitPeriod(rowIndex, state.lastPitch[c], furnace.Channel(c))
+				if err != nil {
+					return convertedRow{}, err
+				}
+				if !ok || period == lastPeriod {
+					continue
+				}
+				// Ticks before the end of the first Frame Clock cycle are written at the start of the next one.
+				// Rows only one cycle long can't be split, so the change is written at the start of the next row.
+				cycle := t * cycles / ticks
+				if cycle == 0 && cycles == 1 {
+					state.slideCatchUp[c] = true
+					continue
+				}
+				slideWrites = append(slideWrites, periodWrite{cycle: max(cycle, 1), channel: uint8(c), period: period})
+				lastPeriod = period
+			}
+		}
+		if len(slideWrites) > 0 {
+			isBlank = false
+		}
+
+		// Volume macros and slides change the volume on every tick after the first, which are also written partway through the row.
+		var attenuationWrites []attenuationWrite
+		for c := range state.volumeMacros {
+			if (!state.volumeMacros[c].active || state.volumeMacros[c].finished) && state.volumeSlides[c] == 0 {
+				continue
+			}
+			for t := 1; t < ticks; t++ {
+				changed := tickVolumeMacro(c)
+				changed = state.volumeSlides[c] != 0 && advanceVolumeSlide(c) || changed
+				if !changed || state.offs[c] {
+					continue
+				}
+				cycle := t * cycles / ticks
+				if cycle == 0 && cycles == 1 {
+					state.volumeCatchUp[c] = true
+					continue
+				}
+				attenuationWrites = append(attenuationWrites, attenuationWrite{cycle: max(cycle, 1), channel: uint8(c), attenuation: attenuation(c)})
+			}
+		}
+		if len(attenuationWrites) > 0 {
+			isBlank = false
+		}
+
+		return convertedRow{frame: frame, slideWrites: slideWrites, attenuationWrites: attenuationWrites, isBlank: isBlank, noteChanges: noteChanges}, nil
+	}
+
+	// Rows without effects are often repeated with the same state, so their conversions are cached.
+	cache := make(rowCache)
+
+	for rowIndex := 0; ; {
+		row, ok, err := rows.at(rowIndex)
+		if err != nil {
+			return nil, warnings, err
+		}
+		if !ok {
+			if p := pendingJumpPattern; p != nil && p.pattern*int(subsong.PatternLength) >= rows.count() {
+				warnJumpPattern(p.row, p.pattern)
+			}
+			break
+		}
+		pendingJumpPattern = nil
+		if opts.Progress != nil {
+			opts.Progress(rowIndex, rows.count(), len(song.Frames))
+		}
+		newIndex = rowIndex + 1
+
+		var converted convertedRow
+		key, cacheable := cache.key(row, state, speeds[speedStep%len(speeds)], baseFrameDelay, tickDelay)
+		if cached, ok := cache[key]; cacheable && ok {
+			converted = cached.row
+			converted.frame = converted.frame.Clone()
+			state = cached.after
+			baseFrameDelay = converted.frame.FrameDelay // Grooved rows set the base frame delay from their speed.
+			speedStep++
+		} else {
+			converted, err = convertRow(rowIndex, row)
+			if err != nil {
+				return nil, warnings, err
+			}
+			if cacheable {
+				cache[key] = cachedRow{row: converted, after: state}
+				converted.frame = converted.frame.Clone()
+			}
+		}
+		if opts.NoteChanged != nil {
+			for _, change := range converted.noteChanges {
+				opts.NoteChanged(rowIndex, change)
+			}
+		}
+		frame, slideWrites, attenuationWrites, isBlank := converted.frame, converted.slideWrites, converted.attenuationWrites, converted.isBlank
+		cycles := int(baseFrameDelay) + 1
+
+		rowIndex = newIndex
+
+		// If this frame will be empty, increase the frame delay of the previous frame
+		// instead of making a new frame. Only make a new frame if the previous frame's delay can't get higher.
+		if isBlank && !loopTargetRows[row.Index] {
+			prevFrame := &song.Frames[len(song.Frames)-1]
+
+			if int(prevFrame.FrameDelay)+int(baseFrameDelay)+1 <= 255 { // Frame delay can be increased.
+				if streamed {
+					coalescedRows[row.Index] = coalescedRow{frame: len(song.Frames) - 1, frameDelay: prevFrame.FrameDelay,
+						rows: len(prevFrame.Rows), comments: len(prevFrame.Comments)}
+				}
+				prevFrame.FrameDelay += (baseFrameDelay + 1)
+				rowFrames[row.Index] = len(song.Frames) - 1
+				prevFrame.Rows = append(prevFrame.Rows, row.Index)
+				prevFrame.Comments = append(prevFrame.Comments, row.Comments...)
+				continue // Don't append this blank frame.
+			}
+		}
+
+		frame.Rows = append(frame.Rows, row.Index)
+		frame.Comments = append(frame.Comments, row.Comments...)
+
+		splitFrames, err := splitRow(frame, cycles, slideWrites, attenuationWrites)
+		if err != nil {
+			return nil, warnings, fmt.Errorf("error splitting row: %v", err)
+		}
+		rowFrames[row.Index] = len(song.Frames)
+
+		if isHalted { // Break out of the loop early if we encountered a halt frame.
+			song.Frames = append(song.Frames, splitFrames...)
+
+			loopTargetIndex = len(song.Frames)
+			song.LoopTarget = loopTargetIndex
+
+			song.Frames = append(song.Frames, resetFrame) // silent reset frame to target in the loop (constantly silences all channels)
+
+			haltFrame := nmos.Frame{
+				LoopToTarget: true,
+			}
+			song.Frames = append(song.Frames, haltFrame)
+			break
+		}
+
+		song.Frames = append(song.Frames, splitFrames...)
+
+		if isLooped { // Finish parsing if the song will loop forever from this point.
+			if c, ok := coalescedRows[loopTargetRow]; ok {
+				c.split(&song, rowFrames)
+			}
+			target, ok := loopTargetFrame(rowFrames, loopTargetRow, rows.count())
+			if !ok {
+				warn(row.Index, "unreached-loop-target", "loop target row %d was never reached, looping back to the start of the song instead", loopTargetRow)
+			}
+			song.LoopTarget = target
+			trace(row.Index, "song loops back to frame %d", target)
+
+			loopFrame := nmos.Frame{
+				LoopToTarget: true,
+			}
+			song.Frames = append(song.Frames, loopFrame)
+			break
+		}
+	}
+
+	if !(isHalted || isLooped) {
+		// Song has no loop or halt effects, so default to looping back to the start (this is what furnace does).
+
+		loopFrame := nmos.Frame{
+			LoopToTarget: true,
+		}
+		song.Frames = append(song.Frames, loopFrame)
+		song.LoopTarget = 0 // This should be the default value regardless but I like being explicit.
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(rows.count(), rows.count(), len(song.Frames))
+	}
+
+	if err := song.ValidateLoopTarget(); err != nil {
+		return nil, warnings, fmt.Errorf("invalid loop target: %v", err)
+	}
+	if err := song.RestoreStereoAtLoopTarget(); err != nil {
+		return nil, warnings, fmt.Errorf("error restoring stereo at loop target: %v", err)
+	}
+	if _, err := song.RepeatStereoBeforeLoopTempo(); err != nil {
+		return nil, warnings, fmt.Errorf("error repeating stereo before the loop: %v", err)
+	}
+
+	return &song, warnings, nil
+}
+
+// A jump made by the effects of a row.
+type rowJump struct {
+	pattern int // The pattern jumped to by the last 0Bxx on the row, or -1 to move on to the next pattern.
+	row     int // The row of the pattern to land on, given by the last 0Dxx on the row.
+}
+
+// A 0Bxx jump whose pattern may be past the end of the song, which can't be known until every row has been received.
+type pendingJump struct {
+	row     int // The row the jump is on.
+	pattern int // The pattern jumped to.
+}
+
+// findJump returns the jump made by the effects of a row, and false if it doesn't jump. Like in Furnace, 0Bxx picks
+// the pattern to jump to wherever it is on the row, and 0Dxx moves on to the next pattern if the row has no 0Bxx.
+// Either way, the value of 0Dxx is the row to land on.
+func findJump(row furnace.Row) (rowJump, bool) {
+	jump := rowJump{pattern: -1}
+	found := false
+	for _, effect := range row.Effects {
+		switch effect.Type {
+		case furnace.EffectJumpToPattern:
+			jump.pattern = int(effect.Value)
+			found = true
+		case furnace.EffectJumpToNextPattern:
+			jump.row = int(effect.Value)
+			found = true
+		}
+	}
+	return jump, found
+}
+
+// target returns the index of the row jumped to from the row with the given index. Rows past the end of the pattern
+// land on its first row instead.
+func (j rowJump) target(rowIndex int, patternLength int) int {
+	pattern := j.pattern
+	if pattern < 0 {
+		pattern = rowIndex/patternLength + 1
+	}
+	row := j.row
+	if row >= patternLength {
+		row = 0
+	}
+	return pattern*patternLength + row
+}
+
+// findLoopTargetRows returns the set of rows which are the target of a backward jump somewhere in the subsong.
+func findLoopTargetRows(subsong *furnace.Subsong) map[int]bool {
+	targets := make(map[int]bool)
+	for rowIndex, row := range subsong.Rows {
+		if jump, ok := findJump(row); ok {
+			if target := jump.target(rowIndex, int(subsong.PatternLength)); target <= rowIndex {
+				targets[target] = true
+			}
+		}
+	}
+	return targets
+}
+
+// loopTargetFrame returns the index of the frame which a loop back to the given row should target, given the first
+// frame of every converted row. If the row itself was never reached (e.g. it was skipped by a jump), the first
+// reached row after it is used instead. If no row at or after the target row was reached, it returns frame 0 and false.
+func loopTargetFrame(rowFrames map[int]int, targetRow int, numRows int) (int, bool) {
+	for row := max(targetRow, 0); row < numRows; row++ {
+		if frameIndex, ok := rowFrames[row]; ok {
+			return frameIndex, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,291 @@
+package nmosconv
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// parseSelfTestSong parses one of the songs run by the compiler's selftest subcommand.
+func parseSelfTestSong(t *testing.T, name string) *furnace.Song {
+	t.Helper()
+	f, err := os.Open(filepath.Join("..", "cmd", "compiler", "selftest", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	song, _, err := furnace.Parse(f)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", name, err)
+	}
+	return song
+}
+
+// convertSelfTestSong converts one of the songs run by the compiler's selftest subcommand, failing on any warning.
+func convertSelfTestSong(t *testing.T, name string, opts Options) *nmos.NmosSong {
+	t.Helper()
+	opts.FixedPointPeriods = true
+	song, warnings, err := Convert(parseSelfTestSong(t, name), opts)
+	if err != nil {
+		t.Fatalf("converting %s: %v", name, err)
+	}
+	if len(warnings) > 0 {
+		t.Fatalf("converting %s: unexpected warning: %v", name, warnings[0])
+	}
+	return song
+}
+
+// frameWrites returns the bytes written to the SN76489 by the frame the first time it's played.
+func frameWrites(t *testing.T, song *nmos.NmosSong, frame int) []byte {
+	t.Helper()
+	writes, err := song.PredictWrites(nmos.DefaultTarget, 4e6)
+	if err != nil {
+		t.Fatalf("PredictWrites: %v", err)
+	}
+	var values []byte
+	for _, w := range writes {
+		if w.Frame == frame {
+			values = append(values, w.Value)
+		}
+		if w.Frame > frame {
+			break
+		}
+	}
+	return values
+}
+
+func TestPanningOnlyRowsPadWithHarmlessWrites(t *testing.T) {
+	song := convertSelfTestSong(t, "stereo.txt", Options{Stereo: true})
+
+	// Row 4 of the second pattern only pans square 1, so its frame has no chip commands of its own, but still has to
+	// pad out the chip command indexes up to the stereo control byte.
+	frame, ok := song.FrameForRow(16 + 4)
+	if !ok {
+		t.Fatal("the panning row has no frame")
+	}
+	writes := frameWrites(t, song, frame)
+	if len(writes) != 12 {
+		t.Fatalf("frame %d writes % x to the chip, want 12 bytes", frame, writes)
+	}
+	// Square 1 plays at attenuation 0 from the start of the pattern, so re-setting it changes nothing.
+	for i, b := range writes {
+		if b != 0b1_00_1_0000 {
+			t.Errorf("frame %d writes 0x%02x as byte %d, want 0x90 (square 1 attenuation 0)", frame, b, i)
+		}
+	}
+}
+
+// streamSelfTestSong converts the first subsong of one of the selftest songs with a StreamConverter, adding its rows
+// one at a time as if they were being parsed.
+func streamSelfTestSong(t *testing.T, name string, opts Options) (*nmos.NmosSong, []Warning) {
+	t.Helper()
+	parsed := parseSelfTestSong(t, name)
+	subsong := *parsed.Subsongs[0]
+	rows := subsong.Rows
+	subsong.Rows = nil
+	c := NewStreamConverter(parsed, &subsong, opts)
+	for _, row := range rows {
+		c.Add(row)
+	}
+	song, warnings, err := c.Finish()
+	if err != nil {
+		t.Fatalf("converting %s: %v", name, err)
+	}
+	return song, warnings
+}
+
+func TestStreamWarnsAboutMissingJumpPattern(t *testing.T) {
+	tests := []struct {
+		file string
+		want string // The warning expected, or empty if there should be none.
+	}{
+		// 0B02 skips forward to a pattern which hasn't been received when the jump is converted.
+		{"effects.txt", ""},
+		{"jumps.txt", ""},
+		{"loop-missing.txt", "0B05 jumps to pattern 5, but the song only has 2 patterns, so it loops back to the start instead"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			_, warnings := streamSelfTestSong(t, tt.file, Options{})
+			var got []string
+			for _, w := range warnings {
+				got = append(got, w.Message)
+			}
+			switch {
+			case tt.want == "" && len(got) > 0:
+				t.Errorf("warnings %q, want none", got)
+			case tt.want != "" && (len(got) != 1 || got[0] != tt.want):
+				t.Errorf("warnings %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopTargetFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		rows     []int          // The rows the loop target frame plays.
+		commands []nmos.Command // The commands the loop target frame writes.
+	}{
+		// 0B00 loops back to the first row, which is the frame after the reset frame.
+		{"first row", "loop-start.txt", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, []nmos.Command{
+			{Type: nmos.SetSquarePeriodCommand, Channel: 0, Period: 239},
+			{Type: nmos.SetAttenuationCommand, Channel: 0, Attenuation: 0},
+		}},
+		// 0B01 0D06 loops back to a blank row in the middle of a rest, which mustn't be added to the delay of the
+		// frame before it, but still takes the blank row after it.
+		{"blank row mid-rest", "jumps.txt", []int{16 + 6, 16 + 7}, []nmos.Command{}},
+	}
+	for _, tt := range tests {
+		check := func(t *testing.T, song *nmos.NmosSong) {
+			t.Helper()
+			if song.LoopTarget <= 0 || song.LoopTarget >= len(song.Frames) {
+				t.Fatalf("loop target is frame %d of %d", song.LoopTarget, len(song.Frames))
+			}
+			if frame, _ := song.FrameForRow(tt.rows[0]); frame != song.LoopTarget {
+				t.Errorf("loop target is frame %d, but row %d is in frame %d", song.LoopTarget, tt.rows[0], frame)
+			}
+			target := song.Frames[song.LoopTarget]
+			if !slices.Equal(target.Rows, tt.rows) {
+				t.Errorf("loop target frame plays rows %v, want %v", target.Rows, tt.rows)
+			}
+			if got := target.Commands(); !slices.Equal(got, tt.commands) {
+				t.Errorf("loop target frame writes %v, want %v", got, tt.commands)
+			}
+			if before := song.Frames[song.LoopTarget-1].Rows; len(before) > 0 && before[len(before)-1] >= tt.rows[0] {
+				t.Errorf("frame before the loop target plays rows %v", before)
+			}
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			check(t, convertSelfTestSong(t, tt.file, Options{}))
+		})
+		t.Run(tt.name+" streamed", func(t *testing.T) {
+			song, warnings := streamSelfTestSong(t, tt.file, Options{FixedPointPeriods: true})
+			if len(warnings) > 0 {
+				t.Fatalf("unexpected warning: %v", warnings[0])
+			}
+			check(t, song)
+		})
+	}
+}
+
+// pitch returns the note with the given name, written the way Furnace does, such as "C-3" or "C_1".
+func pitch(t *testing.T, name string) furnace.NotePitch {
+	t.Helper()
+	for p := furnace.NotePitch(-120); p < 240; p++ {
+		if p.String() == name {
+			return p
+		}
+	}
+	t.Fatalf("no note is called %q", name)
+	return 0
+}
+
+func TestNoiseControl(t *testing.T) {
+	// The noise control byte is 11100, then the feedback bit (1 for white noise) and the two rate bits: 00 for the
+	// high rate, 01 medium, 10 low, and 11 to track square channel 3's period.
+	const (
+		periodicHigh = 0b11100_0_00
+		periodicCh3  = 0b11100_0_11
+		whiteHigh    = 0b11100_1_00
+		whiteMedium  = 0b11100_1_01
+		whiteLow     = 0b11100_1_10
+		whiteCh3     = 0b11100_1_11
+	)
+	// Periods of square channel 3 for notes played by the noise channel while it tracks it, which are longer than
+	// a square channel's for the same note (see nmos.ChipVariant.NoisePeriod), and for a note on square channel 3.
+	const (
+		noiseC3  = 255
+		noiseE3  = 202
+		squareA3 = 142
+	)
+	tests := []struct {
+		name    string
+		control uint16 // The value of the row's 20xx effect.
+		noise   string // The note played on the noise channel.
+		square  string // The note played on square channel 3, if any.
+		opts    Options
+
+		want       byte   // The noise control byte written, or 0 if converting the row fails.
+		wantPeriod uint16 // The period of square channel 3 written, or 0 if it isn't written.
+		wantWarn   string // Text in the warning about the row, if there is one.
+	}{
+		{name: "preset C", control: 0x01, noise: "C-3", want: whiteLow},
+		{name: "preset C#", control: 0x01, noise: "C#3", want: whiteMedium},
+		{name: "preset D", control: 0x01, noise: "D-3", want: whiteHigh},
+		{name: "preset periodic", control: 0x00, noise: "D-5", want: periodicHigh},
+		{name: "preset in the lowest octave", control: 0x01, noise: "C#0", want: whiteMedium},
+		{name: "preset in a negative octave", control: 0x01, noise: "C_1", want: whiteLow},
+		{name: "snap B in a negative octave", control: 0x01, noise: "B_2", opts: Options{NoisePreset: NoisePresetSnap}, want: whiteLow, wantWarn: "the low rate"},
+		{name: "preset not C, C# or D", control: 0x01, noise: "D#3", opts: Options{NoisePreset: NoisePresetFail}},
+		{name: "snap D#", control: 0x01, noise: "D#3", opts: Options{NoisePreset: NoisePresetSnap}, want: whiteHigh, wantWarn: "the high rate"},
+		{name: "snap G", control: 0x01, noise: "G-3", opts: Options{NoisePreset: NoisePresetSnap}, want: whiteHigh, wantWarn: "the high rate"},
+		{name: "snap G#", control: 0x01, noise: "G#3", opts: Options{NoisePreset: NoisePresetSnap}, want: whiteLow, wantWarn: "the low rate"},
+		{name: "snap B", control: 0x01, noise: "B-3", opts: Options{NoisePreset: NoisePresetSnap}, want: whiteLow, wantWarn: "the low rate"},
+		{name: "track E", control: 0x01, noise: "E-3", opts: Options{NoisePreset: NoisePresetTrack}, want: whiteCh3, wantPeriod: noiseE3},
+		{name: "track ignores C", control: 0x01, noise: "C-3", opts: Options{NoisePreset: NoisePresetTrack}, want: whiteLow},
+		{name: "ch3 white", control: 0x11, noise: "E-3", want: whiteCh3, wantPeriod: noiseE3},
+		{name: "ch3 periodic", control: 0x10, noise: "E-3", want: periodicCh3, wantPeriod: noiseE3},
+		{name: "ch3 C doesn't pick a preset", control: 0x11, noise: "C-3", want: whiteCh3, wantPeriod: noiseC3},
+		{name: "ch3 latch noise", control: 0x11, noise: "E-3", square: "A-3", opts: Options{Ch3Latch: Ch3LatchNoise}, want: whiteCh3, wantPeriod: noiseE3},
+		{name: "ch3 latch square", control: 0x11, noise: "E-3", square: "A-3", opts: Options{Ch3Latch: Ch3LatchSquare}, want: whiteCh3, wantPeriod: squareA3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed := parseSelfTestSong(t, "loop-start.txt")
+			row := furnace.Row{
+				Notes:   []furnace.Note{{Channel: nmos.NoiseChannel, Pitch: pitch(t, tt.noise), HasPitch: true}},
+				Effects: []furnace.Effect{{Type: furnace.EffectNoiseControl, Value: tt.control, Channel: nmos.NoiseChannel}},
+			}
+			if tt.square != "" {
+				row.Notes = append(row.Notes, furnace.Note{Channel: nmos.TrackedChannel, Pitch: pitch(t, tt.square), HasPitch: true})
+			}
+			parsed.Subsongs[0].Rows = []furnace.Row{row}
+
+			opts := tt.opts
+			opts.FixedPointPeriods = true
+			song, warnings, err := Convert(parsed, opts)
+			if tt.want == 0 {
+				if err == nil {
+					t.Fatal("converting the row succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("converting the row: %v", err)
+			}
+			switch {
+			case tt.wantWarn == "" && len(warnings) > 0:
+				t.Errorf("unexpected warning: %v", warnings[0])
+			case tt.wantWarn != "" && (len(warnings) != 1 || !strings.Contains(warnings[0].Message, tt.wantWarn)):
+				t.Errorf("warnings %v, want one about %q", warnings, tt.wantWarn)
+			}
+
+			// The frame's last byte is repeated to pad it out, which may be the noise control byte.
+			var controls []byte
+			for _, b := range frameWrites(t, song, 1) {
+				if b&0b1111_0000 == 0b1110_0000 {
+					controls = append(controls, b)
+				}
+			}
+			if len(controls) == 0 || slices.ContainsFunc(controls, func(b byte) bool { return b != tt.want }) {
+				t.Errorf("noise control writes are % x, want %02x", controls, tt.want)
+			}
+			var period uint16
+			for _, c := range song.Frames[1].Commands() {
+				if c.Type == nmos.SetSquarePeriodCommand && c.Channel == nmos.TrackedChannel {
+					period = c.Period
+				}
+			}
+			if period != tt.wantPeriod {
+				t.Errorf("square channel 3's period is %d, want %d", period, tt.wantPeriod)
+			}
+		})
+	}
+}
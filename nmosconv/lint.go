@@ -0,0 +1,249 @@
+package nmosconv
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// outOfRangeNotes gathers the notes on one channel of a subsong which the chip can't play.
+type outOfRangeNotes struct {
+	count    int
+	firstRow int
+	worst    furnace.NotePitch // The note furthest out of range.
+}
+
+// Lint checks every subsong of a parsed song for things the NMOScillator can't play, without converting it:
+// more than one chip, a halved clock, tick rates the tempo model can't reach, notes outside the range of
+// the SN76489's periods, noise presets other than C, C# and D, and effects which are only partly supported.
+// Problems which would stop Convert are errors, and the rest are warnings. opts.Subsong is ignored.
+//
+// Rows are checked in the order they're written rather than the order they're played, so jumps aren't followed.
+func Lint(parsedSong *furnace.Song, opts Options) []diag.Diagnostic {
+	var diagnostics []diag.Diagnostic
+
+	if len(parsedSong.SoundChips) > 1 {
+		diagnostics = append(diagnostics, diag.Warningf("multiple-chips",
+			"found %d sound chips, but the NMOScillator only has one SN76489, so only the first is compiled", len(parsedSong.SoundChips)).
+			Suggest("move every channel onto the first chip, or split the song into one file per chip"))
+	}
+	if len(parsedSong.SoundChips) > 0 && parsedSong.SoundChips[0].ClockDiv {
+		diagnostics = append(diagnostics, diag.Errorf("clock-div",
+			"the chip's clock is divided by 2, which the NMOScillator doesn't support").
+			Suggest("turn off the clock divider in the chip's settings and transpose the song down an octave instead"))
+	}
+
+	chip, err := nmos.LookupChipVariant(opts.Chip)
+	if err != nil {
+		return append(diagnostics, diag.Errorf("chip", "%v", err))
+	}
+	tolerance := opts.RateTolerance
+	if tolerance == 0 {
+		tolerance = nmos.DefaultRateTolerance
+	}
+
+	for i := range parsedSong.Subsongs {
+		diagnostics = append(diagnostics, lintSubsong(parsedSong, i, chip, tolerance, opts)...)
+	}
+	return diagnostics
+}
+
+// lintSubsong checks a single subsong for Lint.
+func lintSubsong(parsedSong *furnace.Song, index int, chip nmos.ChipVariant, tolerance float64, opts Options) []diag.Diagnostic {
+	var diagnostics []diag.Diagnostic
+	report := func(d diag.Diagnostic, row int) {
+		diagnostics = append(diagnostics, d.AtRow(index, row))
+	}
+	subsong := parsedSong.Subsongs[index]
+
+	// period returns the period a note is played with, before it's limited to the chip's range.
+	period := func(pitch furnace.NotePitch, channel furnace.Channel) int {
+		pitch += furnace.NotePitch(opts.Transpose[channel])
+		freq := pitchToFreq(pitch, parsedSong.Tuning, opts.Detune[channel])
+		if channel == nmos.NoiseChannel {
+			return int(chip.NoisePeriod(freq, 4_000_000))
+		}
+		return int(chip.SquarePeriod(freq, 4_000_000))
+	}
+
+	// Tick rates are checked the same way Convert sets them, reporting each rate which can't be played once.
+	tickRate := subsong.TickRate
+	speeds := slices.Clone(subsong.Speeds)
+	grooved := len(speeds) > 1
+	checkedRates := make(map[float64]bool)
+	checkRate := func(row int) {
+		rate := tickRate
+		if !grooved {
+			rate /= float64(speeds[0]) * float64(subsong.TimeBase+1)
+		}
+		if checkedRates[rate] {
+			return
+		}
+		checkedRates[rate] = true
+		if _, _, _, _, ok := nmos.FindBestRate(rate, tolerance); ok {
+			return
+		}
+		tempo, frameDelay, achieved, relErr := nmos.ClosestRate(rate)
+		slowest, fastest := nmos.TickRateRange()
+		ticksPerRow := 1.0 // Grooved songs are timed by the tick.
+		if !grooved {
+			ticksPerRow = float64(speeds[0]) * float64(subsong.TimeBase+1)
+		}
+		suggestion := fmt.Sprintf("use a tick rate of %.3f Hz (tempo %d, frame delay %d), or raise --rate-tolerance above %.2f%%",
+			achieved*ticksPerRow, tempo, frameDelay, relErr*100)
+		if rate > fastest || rate < slowest {
+			suggestion = fmt.Sprintf("the NMOScillator plays rows at %.3f to %.3f Hz, so change the song's speed or tick rate to fit", slowest, fastest)
+		}
+		report(diag.Errorf("tick-rate", "rows play at %.3f Hz, which can't be played within %g%%: the closest is %.3f Hz (%.2f%% off)",
+			rate, tolerance*100, achieved, relErr*100).Suggest(suggestion), row)
+	}
+	checkRate(-1)
+
+	var tooLow, tooHigh [4]*outOfRangeNotes
+	var badPresets *outOfRangeNotes
+	noiseTracksCh3 := true
+	warned := make(map[string]bool)
+	warnOnce := func(row int, code, suggestion, format string, args ...any) {
+		if warned[code] {
+			return
+		}
+		warned[code] = true
+		report(diag.Warningf(code, format, args...).Suggest(suggestion), row)
+	}
+	addNote := func(notes **outOfRangeNotes, row int, pitch furnace.NotePitch, worse bool) {
+		if *notes == nil {
+			*notes = &outOfRangeNotes{firstRow: row, worst: pitch}
+		}
+		(*notes).count++
+		if worse {
+			(*notes).worst = pitch
+		}
+	}
+
+	for _, row := range subsong.Rows {
+		// Like Convert, the rate is only checked once every change of speed and tick rate on the row is applied.
+		newRate := false
+		for _, effect := range row.Effects {
+			switch effect.Type {
+			case furnace.EffectTickRateHz:
+				tickRate = float64(effect.Value)
+				newRate = true
+			case furnace.EffectTickRateBpm:
+				tickRate = float64(effect.Value) * 24 / 60
+				newRate = true
+			case furnace.EffectGroove, furnace.EffectSpeed:
+				if effect.Value == 0 || effect.Value > math.MaxUint8 {
+					continue
+				}
+				if effect.Type == furnace.EffectGroove {
+					warnOnce(row.Index, "groove-pattern", "set each row's speed with 0Fxx instead, or list the groove's speeds as the song's speed",
+						"groove patterns aren't included in text exports, so set groove pattern (09xx) is treated as set speed 1")
+				}
+				if effect.Type == furnace.EffectSpeed && len(speeds) == 2 {
+					speeds[1] = uint8(effect.Value)
+				} else {
+					speeds[0] = uint8(effect.Value)
+				}
+				newRate = true
+			case furnace.EffectNoiseControl:
+				noiseTracksCh3 = effect.Value>>4 == 1
+			case furnace.EffectNoteSlideUp, furnace.EffectNoteSlideDown, furnace.EffectPitchSlideUp, furnace.EffectPitchSlideDown:
+				if effect.Channel == nmos.NoiseChannel {
+					warnOnce(row.Index, "noise-slide", "slide square channel 3 while the noise channel tracks it instead",
+						"note and pitch slides on the noise channel aren't supported, and are ignored")
+				}
+			case furnace.EffectNoteCut:
+				if effect.Value != 0 {
+					warnOnce(row.Index, "note-cut-timing", "move the note cut (EC00) or a note off to the row the note should stop on",
+						"note cut after %d ticks can't be placed partway through a row, and is ignored", effect.Value)
+				}
+			case furnace.EffectPanning:
+				if !opts.Stereo {
+					warnOnce(row.Index, "no-stereo", "compile for a target with stereo support, or remove the panning effects",
+						"the target has no stereo support, so panning effects are ignored")
+				}
+			}
+		}
+		if newRate {
+			checkRate(row.Index)
+		}
+
+		for _, note := range row.Notes {
+			if !note.HasPitch {
+				continue
+			}
+			if note.Channel == nmos.NoiseChannel && !noiseTracksCh3 {
+				if _, ok := presetNoiseRate(note.Pitch); ok {
+					continue
+				}
+				if opts.NoisePreset != NoisePresetTrack {
+					addNote(&badPresets, row.Index, note.Pitch, false)
+					continue
+				}
+				// The note tracks square channel 3, so its period is checked like any other.
+			}
+			p := period(note.Pitch, note.Channel)
+			if p > nmos.MaxSquarePeriod {
+				addNote(&tooLow[note.Channel], row.Index, note.Pitch, tooLow[note.Channel] != nil && note.Pitch < tooLow[note.Channel].worst)
+			} else if p == 0 {
+				addNote(&tooHigh[note.Channel], row.Index, note.Pitch, tooHigh[note.Channel] != nil && note.Pitch > tooHigh[note.Channel].worst)
+			}
+		}
+	}
+
+	// Notes out of range stop the conversion, unless opts.NoteRange moves or drops them.
+	rangeProblem := diag.Errorf
+	consequence := ""
+	switch opts.NoteRange {
+	case NoteRangeOctave:
+		rangeProblem, consequence = diag.Warningf, ", so they're moved by octaves"
+	case NoteRangeDrop:
+		rangeProblem, consequence = diag.Warningf, ", so they're left out"
+	}
+	for c := range tooLow {
+		name := channelName(c)
+		if notes := tooLow[c]; notes != nil {
+			lowest := notes.worst
+			for period(lowest, furnace.Channel(c)) > nmos.MaxSquarePeriod {
+				lowest++
+			}
+			report(rangeProblem("note-out-of-range", "%s plays %d notes too low for the chip's periods, down to %v%s",
+				name, notes.count, notes.worst, consequence).
+				Suggest(fmt.Sprintf("the lowest note it can play is %v, so move them up, or transpose the channel up by %d semitones",
+					lowest, lowest-notes.worst)), notes.firstRow)
+		}
+		if notes := tooHigh[c]; notes != nil {
+			highest := notes.worst
+			for period(highest, furnace.Channel(c)) == 0 {
+				highest--
+			}
+			report(rangeProblem("note-out-of-range", "%s plays %d notes too high for the chip's periods, up to %v%s",
+				name, notes.count, notes.worst, consequence).
+				Suggest(fmt.Sprintf("the highest note it can play is %v, so move them down, or transpose the channel down by %d semitones",
+					highest, notes.worst-highest)), notes.firstRow)
+		}
+	}
+	if badPresets != nil {
+		// They stop the conversion, unless opts.NoisePreset snaps them to the nearest preset.
+		presetProblem, consequence := diag.Errorf, ""
+		if opts.NoisePreset == NoisePresetSnap {
+			presetProblem, consequence = diag.Warningf, ", so they play the nearest preset"
+		}
+		report(presetProblem("noise-preset", "the noise channel plays %d notes other than C, C# or D while it uses the preset rates, starting with %v%s",
+			badPresets.count, badPresets.worst, consequence).
+			Suggest("use C for the low rate, C# for medium and D for high, or make it track square channel 3 with 2010 or 2011 to play other notes"), badPresets.firstRow)
+	}
+	return diagnostics
+}
+
+// channelName names a channel the way Furnace's SN76489 channels are shown.
+func channelName(channel int) string {
+	if channel == nmos.NoiseChannel {
+		return "the noise channel"
+	}
+	return fmt.Sprintf("square channel %d", channel+1)
+}
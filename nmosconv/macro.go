@@ -0,0 +1,117 @@
+package nmosconv
+
+import "github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+
+// Pitch macros are in Furnace's pitch units of 1/128 semitone.
+const centsPerPitchUnit = 100.0 / 128
+
+// An instrument macro playing on a channel, stepping through the macro's values from the start of a note.
+// It only holds positions, rather than the macro itself, so rows can still be cached by the channel state.
+type macroPlayer struct {
+	active   bool
+	pos      int  // The index of the macro value playing.
+	delay    int  // The number of ticks left before the macro starts.
+	wait     int  // The number of ticks left before moving on to the next value.
+	elapsed  int  // The number of ticks since the macro started.
+	released bool // Whether the note has been released, so the macro carries on past its release point.
+	finished bool // Whether the macro has stopped, leaving its last value in place.
+
+	value    int
+	hasValue bool // Whether the macro has reached its first value, after its delay.
+}
+
+// start starts the macro from the beginning, on the tick a note starts, and reports whether it read a value.
+func (p *macroPlayer) start(m *furnace.Macro) bool {
+	*p = macroPlayer{active: true, delay: m.Delay, wait: m.Speed}
+	if p.delay > 0 {
+		return false
+	}
+	p.value, p.hasValue = m.Values[0], true
+	return true
+}
+
+// tick moves the macro on by a single tick, and reports whether it read a value. Macros which linger hold their
+// last value rather than stopping, which makes no difference except to pitch macros adding up their values.
+// If limit isn't 0, the macro stops after that many ticks.
+func (p *macroPlayer) tick(m *furnace.Macro, linger bool, limit int) bool {
+	if !p.active || p.finished {
+		return false
+	}
+	p.elapsed++
+	if limit > 0 && p.elapsed >= limit {
+		p.finished = true
+		return false
+	}
+	if p.delay > 0 {
+		p.delay--
+		if p.delay > 0 {
+			return false
+		}
+		p.value, p.hasValue = m.Values[p.pos], true
+		return true
+	}
+	p.wait--
+	if p.wait > 0 {
+		return false
+	}
+	p.wait = m.Speed
+	next, ok := p.next(m, linger)
+	if !ok {
+		p.finished = true
+		return false
+	}
+	p.pos = next
+	p.value = m.Values[p.pos]
+	return true
+}
+
+// next returns the position of the value after the one playing, the way Furnace steps through macros.
+// Macros hold at their release point until the note is released, looping back to their loop point if it's before it.
+// After their last value, they loop back to their loop point, or stop if they don't loop (holding their last
+// value if they linger).
+func (p *macroPlayer) next(m *furnace.Macro, linger bool) (int, bool) {
+	if m.Release >= 0 && p.pos == m.Release && !p.released {
+		if m.Loop >= 0 && m.Loop < m.Release {
+			return m.Loop, true
+		}
+		return p.pos, true
+	}
+	if p.pos+1 < len(m.Values) {
+		return p.pos + 1, true
+	}
+	if m.Loop >= 0 && (m.Release < 0 || m.Loop >= m.Release) {
+		return m.Loop, true
+	}
+	return p.pos, linger
+}
+
+// release releases the note, jumping the macro to its release point if it hasn't reached it yet.
+// It reports whether the macro has a release point, and otherwise leaves the macro alone.
+func (p *macroPlayer) release(m *furnace.Macro) bool {
+	if !p.active || m.Release < 0 {
+		return false
+	}
+	p.released = true
+	if p.pos < m.Release && !p.finished {
+		p.pos, p.delay, p.wait = m.Release, 0, m.Speed
+		p.value, p.hasValue = m.Values[p.pos], true
+	}
+	return true
+}
+
+// volumeAttenuation returns the attenuation of a channel playing at the given volume with a volume macro. Like
+// Furnace, the macro scales the volume logarithmically, so the attenuations of the volume and the macro add together.
+func volumeAttenuation(volume uint8, p macroPlayer) uint8 {
+	if !p.hasValue {
+		return 0xf - volume
+	}
+	level := uint8(min(max(p.value, 0), 0xf))
+	return min(0xf-volume+0xf-level, 0xf)
+}
+
+// A change of a channel's attenuation partway through a row, made by its volume macro.
+type attenuationWrite struct {
+	cycle       int // The Frame Clock cycle of the row the attenuation changes on.
+	channel     uint8
+	attenuation uint8
+}
@@ -0,0 +1,87 @@
+package nmosconv
+
+import (
+	"fmt"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// Ch3Latch selects which period is kept when square channel 3 and the noise channel both set the period of
+// square channel 3 on the same row, while the noise channel tracks it (see nmos.TrackedChannel).
+// The SN76489 only has one period register for both, so only one of the notes can be heard.
+type Ch3Latch int
+
+const (
+	// Keeps the noise channel's period, like Furnace, which writes the noise channel's period after square channel 3's.
+	Ch3LatchNoise Ch3Latch = iota
+	// Keeps square channel 3's period.
+	Ch3LatchSquare
+)
+
+// ParseCh3Latch returns the Ch3Latch with the given name.
+func ParseCh3Latch(name string) (Ch3Latch, error) {
+	switch name {
+	case "noise":
+		return Ch3LatchNoise, nil
+	case "square":
+		return Ch3LatchSquare, nil
+	default:
+		return 0, fmt.Errorf("unknown channel 3 latch %q, expected noise or square", name)
+	}
+}
+
+// NoisePreset selects what happens to notes on the noise channel other than C, C# and D while it uses the preset
+// noise rates, which only have a note for each of the three rates. Songs imported from MIDI rarely play their
+// percussion on exactly these notes.
+type NoisePreset int
+
+const (
+	// Stops the conversion with an error.
+	NoisePresetFail NoisePreset = iota
+	// Plays the preset of the nearest of C, C# and D, with a warning.
+	NoisePresetSnap
+	// Makes the noise channel track square channel 3 for the note, like 2010 or 2011 would, so it plays at the
+	// note's pitch. This takes over square channel 3's period. The next C, C# or D goes back to the preset rates.
+	NoisePresetTrack
+)
+
+// ParseNoisePreset returns the NoisePreset with the given name.
+func ParseNoisePreset(name string) (NoisePreset, error) {
+	switch name {
+	case "fail":
+		return NoisePresetFail, nil
+	case "snap":
+		return NoisePresetSnap, nil
+	case "track":
+		return NoisePresetTrack, nil
+	default:
+		return 0, fmt.Errorf("unknown noise preset policy %q, expected fail, snap or track", name)
+	}
+}
+
+// presetNoiseRate returns the preset noise rate a note on the noise channel plays, regardless of its octave:
+// C is the low rate, C# medium, and D high. It returns false for any other note.
+func presetNoiseRate(pitch furnace.NotePitch) (nmos.NoiseRate, bool) {
+	switch (pitch%12 + 12) % 12 {
+	case 0: // C
+		return nmos.LowNoise, true
+	case 1: // C#
+		return nmos.MediumNoise, true
+	case 2: // D
+		return nmos.HighNoise, true
+	}
+	return 0, false
+}
+
+// nearestPresetNoiseRate returns the preset noise rate of the nearest of C, C# and D to a note, in either direction.
+// Notes from D# to G are nearest to D, and those from G# to B to the C above.
+func nearestPresetNoiseRate(pitch furnace.NotePitch) nmos.NoiseRate {
+	if rate, ok := presetNoiseRate(pitch); ok {
+		return rate
+	}
+	if (pitch%12+12)%12 <= 7 {
+		return nmos.HighNoise
+	}
+	return nmos.LowNoise
+}
@@ -0,0 +1,30 @@
+package nmosconv
+
+import "fmt"
+
+// NoteRange selects what happens to notes whose period is outside the range the chip can play,
+// such as very low basslines, or notes transposed too far.
+type NoteRange int
+
+const (
+	// Stops the conversion with an error.
+	NoteRangeFail NoteRange = iota
+	// Moves the note by as many octaves as it takes to bring it into range, with a warning.
+	NoteRangeOctave
+	// Leaves the note out with a warning, so the channel keeps playing its previous note.
+	NoteRangeDrop
+)
+
+// ParseNoteRange returns the NoteRange with the given name.
+func ParseNoteRange(name string) (NoteRange, error) {
+	switch name {
+	case "fail":
+		return NoteRangeFail, nil
+	case "octave":
+		return NoteRangeOctave, nil
+	case "drop":
+		return NoteRangeDrop, nil
+	default:
+		return 0, fmt.Errorf("unknown note range policy %q, expected fail, octave or drop", name)
+	}
+}
@@ -0,0 +1,81 @@
+package nmosconv
+
+import (
+	"fmt"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// The state of each channel carried from one row to the next.
+type rowState struct {
+	volumes [4]uint8
+	offs    [4]bool // Whether each channel is off.
+
+	finePitch    [4]int       // Per-channel fine pitch set by E5xx effects, in cents.
+	slides       [3]noteSlide // Note slides in progress on each square channel.
+	slideCatchUp [3]bool      // Whether a slide or macro changed a channel's pitch too late in the last row to be written.
+
+	// Effect memory: pitch and volume slides carry on from row to row, like in Furnace, until a value of 00 stops them.
+	pitchSlides     [3]int   // The speed of the 01xx or 02xx pitch slide on each square channel, in 1/128 semitones per tick.
+	slidPitch       [3]int   // How far each square channel's note has moved by pitch slides, in 1/128 semitones.
+	volumeSlides    [4]int   // The speed of the 0Axy volume slide on each channel, in 1/256 steps of volume per tick.
+	volumeFractions [4]uint8 // The part of each channel's volume below a whole step, in 1/256 steps, left by volume slides.
+
+	// The last pitch played on each square channel, so fine pitch changes can be applied to notes which are already playing.
+	lastPitch    [3]furnace.NotePitch
+	hasLastPitch [3]bool
+
+	noiseRateType noiseRateTypeEnum
+	noiseMode     nmos.NoiseMode
+
+	instruments   [4]int         // The instrument each channel plays, or -1 before the instrument column sets one.
+	volumeMacros  [4]macroPlayer // Volume macros playing on each channel.
+	volumeCatchUp [4]bool        // Whether a volume macro changed a channel's volume too late in the last row to be written.
+	arpMacros     [3]macroPlayer // Arpeggio macros playing on each square channel.
+	pitchMacros   [3]macroPlayer // Pitch macros playing on each square channel.
+	macroPitch    [3]int         // The pitch change made by each square channel's pitch macro, in 1/128 semitones.
+}
+
+// A row converted into a frame, before it's split by slides and coalesced with blank rows.
+type convertedRow struct {
+	frame             nmos.Frame
+	slideWrites       []periodWrite
+	attenuationWrites []attenuationWrite
+	isBlank           bool
+	noteChanges       []string // Notes which were moved or left out (see Options.NoteChanged).
+}
+
+// Identifies the conversion of a row without effects. Such rows only read and change the channel state,
+// so two of them with the same notes, state and timing are converted into the same frame.
+type rowKey struct {
+	notes      string
+	state      rowState
+	speed      uint8
+	frameDelay uint8 // The base frame delay of the row, if the song isn't grooved.
+	tickDelay  uint8 // The frame delay of a tick, if the song is grooved.
+}
+
+type cachedRow struct {
+	row   convertedRow
+	after rowState // The channel state after the row.
+}
+
+// A cache of rows which have already been converted. Long songs often repeat the same rows over and over,
+// so this saves converting them again.
+type rowCache map[rowKey]cachedRow
+
+// key returns the key of a row converted from the given state, and false if the row can't be cached
+// because its effects change more than the channel state.
+func (c rowCache) key(row furnace.Row, state rowState, speed uint8, frameDelay uint8, tickDelay uint8) (rowKey, bool) {
+	if len(row.Effects) > 0 {
+		return rowKey{}, false
+	}
+	return rowKey{
+		notes:      fmt.Sprint(row.Notes),
+		state:      state,
+		speed:      speed,
+		frameDelay: frameDelay,
+		tickDelay:  tickDelay,
+	}, true
+}
@@ -0,0 +1,188 @@
+package nmosconv
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+)
+
+// SlideMode selects how note slides (E1xy and E2xy) are played, as the period can only change at frame boundaries.
+type SlideMode int
+
+const (
+	// Changes the period on every tick of the slide, splitting rows into extra frames.
+	SlideTicks SlideMode = iota
+	// Jumps straight to the target note on the tick the slide would reach it, which only needs one extra frame.
+	SlideSnap
+)
+
+// ParseSlideMode returns the SlideMode with the given name.
+func ParseSlideMode(name string) (SlideMode, error) {
+	switch name {
+	case "ticks":
+		return SlideTicks, nil
+	case "snap":
+		return SlideSnap, nil
+	default:
+		return 0, fmt.Errorf("unknown slide mode %q, expected ticks or snap", name)
+	}
+}
+
+// The pitch change of one unit of slide speed, in cents per tick. Furnace moves the pitch by 4 units of
+// 1/128 semitone per tick for every step of the slide speed.
+const centsPerSlideSpeed = 100.0 * 4 / 128
+
+// A note slide in progress on a square channel.
+type noteSlide struct {
+	active    bool
+	cents     float64 // How far the pitch has slid from the channel's note so far.
+	semitones int     // The distance to the target note, which is negative when sliding down.
+	step      float64 // The change in cents on every tick.
+}
+
+// start starts a slide from the current pitch, given the value of an E1xy or E2xy effect
+// (x is the speed and y is the number of semitones). A value with a speed or distance of 0 stops the slide.
+func (s *noteSlide) start(value uint16, up bool) {
+	speed, semitones := int(value>>4), int(value&0x0f)
+	if speed == 0 || semitones == 0 {
+		*s = noteSlide{}
+		return
+	}
+	if !s.active {
+		s.cents = 0
+	}
+	s.active = true
+	s.semitones = semitones
+	s.step = float64(speed) * centsPerSlideSpeed
+	if !up {
+		s.semitones = -semitones
+		s.step = -s.step
+	}
+}
+
+// advance moves the slide on by a single tick, and reports whether it reached the target note.
+func (s *noteSlide) advance() (done bool) {
+	target := float64(s.semitones * 100)
+	s.cents += s.step
+	if (s.step > 0 && s.cents >= target) || (s.step < 0 && s.cents <= target) {
+		s.active = false
+		s.cents = 0
+		return true
+	}
+	return false
+}
+
+// The pitch change of one unit of pitch slide speed (01xx and 02xx), in 1/128 semitones per tick. Furnace moves
+// the pitch by the same amount as a note slide of the same speed.
+const pitchUnitsPerSlideSpeed = 4
+
+// pitchSlideSpeed returns the change in pitch on every tick of an 01xx or 02xx pitch slide, in 1/128 semitones.
+// A value of 0 stops the slide.
+func pitchSlideSpeed(value uint16, up bool) int {
+	if up {
+		return int(value) * pitchUnitsPerSlideSpeed
+	}
+	return -int(value) * pitchUnitsPerSlideSpeed
+}
+
+// Furnace keeps volumes in 1/256 steps, and a volume slide of speed 1 changes the volume by a quarter of a step per tick.
+const volumeUnitsPerSlideSpeed = 64
+
+// volumeSlideSpeed returns the change in volume on every tick of an 0Axy volume slide, in 1/256 steps of volume.
+// Like Furnace, the slide goes down at speed y if y isn't 0, and up at speed x otherwise, and a value of 0 stops it.
+func volumeSlideSpeed(value uint16) int {
+	if down := int(value & 0x0f); down != 0 {
+		return -down * volumeUnitsPerSlideSpeed
+	}
+	return int(value>>4) * volumeUnitsPerSlideSpeed
+}
+
+// slideVolume moves a volume, with fraction in 1/256 steps below it, on by a tick of a volume slide at the given
+// speed. It returns the new volume and fraction, and whether the slide carries on, as it stops at the lowest and
+// highest volumes.
+func slideVolume(volume, fraction uint8, speed int) (uint8, uint8, bool) {
+	v := int(volume)<<8 + int(fraction) + speed
+	switch {
+	case v >= 0xf<<8:
+		return 0xf, 0, false
+	case v <= 0:
+		return 0, 0, false
+	}
+	return uint8(v >> 8), uint8(v), true
+}
+
+// A change of a square channel's period partway through a row.
+type periodWrite struct {
+	cycle   int // The Frame Clock cycle of the row the period changes on.
+	channel uint8
+	period  uint16
+}
+
+// splitRow splits the frame of a row lasting the given number of Frame Clock cycles, so the period changes
+// in writes and the attenuation changes in attenuations are written on their cycles. Later writes to the same
+// channel on the same cycle replace earlier ones. The first frame returned is the row's own frame, with its
+// frame delay shortened to end at the first write.
+func splitRow(frame nmos.Frame, cycles int, writes []periodWrite, attenuations []attenuationWrite) ([]nmos.Frame, error) {
+	periods := make(map[int]*[3]int)        // The period written to each channel on each cycle, or -1 for none.
+	attenuationsAt := make(map[int]*[4]int) // The attenuation written to each channel on each cycle, or -1 for none.
+	var starts []int
+	for _, w := range writes {
+		if periods[w.cycle] == nil {
+			periods[w.cycle] = &[3]int{-1, -1, -1}
+			if attenuationsAt[w.cycle] == nil {
+				starts = append(starts, w.cycle)
+			}
+		}
+		periods[w.cycle][w.channel] = int(w.period)
+	}
+	for _, w := range attenuations {
+		if attenuationsAt[w.cycle] == nil {
+			attenuationsAt[w.cycle] = &[4]int{-1, -1, -1, -1}
+			if periods[w.cycle] == nil {
+				starts = append(starts, w.cycle)
+			}
+		}
+		attenuationsAt[w.cycle][w.channel] = int(w.attenuation)
+	}
+	slices.Sort(starts)
+
+	frames := []nmos.Frame{frame}
+	for _, start := range starts {
+		frames[len(frames)-1].FrameDelay = uint8(start - cyclesBefore(frames) - 1)
+
+		var sub nmos.Frame
+		if periods[start] != nil {
+			for channel, period := range periods[start] {
+				if period < 0 {
+					continue
+				}
+				if err := sub.SetSquarePeriod(uint8(channel), uint16(period)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if attenuationsAt[start] != nil {
+			for channel, attenuation := range attenuationsAt[start] {
+				if attenuation < 0 {
+					continue
+				}
+				if err := sub.SetAttenuation(uint8(channel), uint8(attenuation)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		frames = append(frames, sub)
+	}
+	frames[len(frames)-1].FrameDelay = uint8(cycles - cyclesBefore(frames) - 1)
+	return frames, nil
+}
+
+// cyclesBefore returns the number of Frame Clock cycles taken by every frame but the last.
+func cyclesBefore(frames []nmos.Frame) int {
+	cycles := 0
+	for _, f := range frames[:len(frames)-1] {
+		cycles += int(f.FrameDelay) + 1
+	}
+	return cycles
+}
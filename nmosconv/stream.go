@@ -0,0 +1,144 @@
+package nmosconv
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/QEStudios/NMOScillatorCompiler/nmos"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// The rows of a subsong being converted, which are either all parsed already or still being parsed.
+type rowSource interface {
+	// at returns the row with the given index, or false if the subsong has no such row.
+	at(index int) (furnace.Row, bool, error)
+	// count returns the number of rows in the subsong, or the number parsed so far if it's still being parsed.
+	count() int
+	// loopTargets returns the rows which are the target of a backward jump, and whether the rows are streamed, in
+	// which case the targets can't be known until the jump is reached.
+	loopTargets(subsong *furnace.Subsong) (map[int]bool, bool)
+}
+
+// The rows of a subsong which has been parsed in full.
+type sliceRows []furnace.Row
+
+func (r sliceRows) at(index int) (furnace.Row, bool, error) {
+	if index < 0 || index >= len(r) {
+		return furnace.Row{}, false, nil
+	}
+	return r[index], true, nil
+}
+
+func (r sliceRows) count() int {
+	return len(r)
+}
+
+func (r sliceRows) loopTargets(subsong *furnace.Subsong) (map[int]bool, bool) {
+	return findLoopTargetRows(subsong), false
+}
+
+// The rows of a subsong which is still being parsed, received in order. Conversion only ever moves forward through
+// the rows (a jump back ends it with a loop), so every row before the one asked for is dropped once it's passed.
+type streamRows struct {
+	rows     <-chan furnace.Row
+	current  furnace.Row
+	received int // The number of rows received so far.
+}
+
+func (r *streamRows) at(index int) (furnace.Row, bool, error) {
+	if r.received > 0 && r.current.Index > index {
+		return furnace.Row{}, false, fmt.Errorf("row %d was asked for after row %d, but streamed rows can only be read in order", index, r.current.Index)
+	}
+	for r.received == 0 || r.current.Index < index {
+		row, ok := <-r.rows
+		if !ok {
+			return furnace.Row{}, false, nil
+		}
+		r.current = row
+		r.received++
+	}
+	return r.current, r.current.Index == index, nil
+}
+
+func (r *streamRows) count() int {
+	return r.received
+}
+
+func (r *streamRows) loopTargets(*furnace.Subsong) (map[int]bool, bool) {
+	return nil, true
+}
+
+// A blank row which was added to the delay of an earlier frame while streaming, kept so it can be split back out
+// into a frame of its own if it turns out to be a loop target.
+type coalescedRow struct {
+	frame      int   // The index of the frame the row was added to.
+	frameDelay uint8 // The frame's delay before the row was added.
+	rows       int   // The number of rows the frame covered before the row was added.
+	comments   int   // The number of comments the frame had before the row was added.
+}
+
+// split moves the row, and every row added to the frame after it, into a new blank frame after the frame, and updates
+// the first frame of every row in rowFrames to match.
+func (c coalescedRow) split(song *nmos.NmosSong, rowFrames map[int]int) {
+	frame := &song.Frames[c.frame]
+	for row, i := range rowFrames {
+		if i > c.frame {
+			rowFrames[row] = i + 1
+		}
+	}
+	for _, row := range frame.Rows[c.rows:] {
+		rowFrames[row] = c.frame + 1
+	}
+	rest := nmos.Frame{
+		FrameDelay: frame.FrameDelay - c.frameDelay - 1,
+		Rows:       slices.Clone(frame.Rows[c.rows:]),
+		Comments:   slices.Clone(frame.Comments[c.comments:]),
+	}
+	frame.FrameDelay = c.frameDelay
+	frame.Rows = frame.Rows[:c.rows:c.rows]
+	frame.Comments = frame.Comments[:c.comments:c.comments]
+	song.Frames = slices.Insert(song.Frames, c.frame+1, rest)
+}
+
+// A StreamConverter converts a subsong while it's being parsed, a row at a time, so songs with any number of rows
+// can be converted without holding them all in memory (see furnace.ParseOptions.Rows). Its rows are converted on
+// another goroutine, which calls Options.Progress and Options.Trace.
+//
+// Blank rows are added to the delay of the frame before them, and split back out into frames of their own if the
+// song loops back to them. This only differs from Convert if the frame's delay was already too long to add another
+// row to, in which case the loop target may have an extra blank frame before it.
+type StreamConverter struct {
+	rows chan furnace.Row
+	done chan struct{}
+
+	song     *nmos.NmosSong
+	warnings []Warning
+	err      error
+}
+
+// NewStreamConverter starts converting a subsong of song. Everything except the subsong's rows must already be
+// parsed, and the rows are given to Add instead of being read from the subsong.
+func NewStreamConverter(song *furnace.Song, subsong *furnace.Subsong, opts Options) *StreamConverter {
+	c := &StreamConverter{rows: make(chan furnace.Row, 64), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		c.song, c.warnings, c.err = convert(song, subsong, &streamRows{rows: c.rows}, opts)
+	}()
+	return c
+}
+
+// Add converts the next row of the subsong. Rows after the song halts or loops are dropped.
+func (c *StreamConverter) Add(row furnace.Row) {
+	select {
+	case c.rows <- row:
+	case <-c.done:
+	}
+}
+
+// Finish waits for every row which was added to be converted, and returns the converted song and any warnings,
+// like Convert.
+func (c *StreamConverter) Finish() (*nmos.NmosSong, []Warning, error) {
+	close(c.rows)
+	<-c.done
+	return c.song, c.warnings, c.err
+}
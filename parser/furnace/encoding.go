@@ -0,0 +1,129 @@
+package furnace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Byte order marks which may start a text export.
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// The number of bytes at the start of a file checked for UTF-16 without a byte order mark.
+const utf16SniffLength = 512
+
+// decodeText returns a reader which converts a text export to UTF-8 as it's read. Furnace always writes UTF-8, but
+// some Windows editors re-save files as UTF-16, with or without a byte order mark, which is detected from the start
+// of the file. The name of the encoding the file is converted from is returned, or an empty string if it's already
+// UTF-8.
+func decodeText(r io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(r)
+	start, err := br.Peek(utf16SniffLength)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	switch {
+	case bytes.HasPrefix(start, bomUTF8):
+		br.Discard(len(bomUTF8))
+		return br, "", nil
+	case bytes.HasPrefix(start, bomUTF16LE):
+		br.Discard(len(bomUTF16LE))
+		return &utf16Reader{r: br, order: binary.LittleEndian}, "UTF-16 (little endian)", nil
+	case bytes.HasPrefix(start, bomUTF16BE):
+		br.Discard(len(bomUTF16BE))
+		return &utf16Reader{r: br, order: binary.BigEndian}, "UTF-16 (big endian)", nil
+	}
+
+	// Exports are almost entirely ASCII, so without a byte order mark UTF-16 shows up as
+	// every other byte being zero. UTF-8 text never contains zero bytes.
+	var evenZeros, oddZeros int
+	for i, b := range start {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	pairs := len(start) / 2
+	switch {
+	case pairs > 0 && oddZeros > pairs/2 && evenZeros == 0:
+		return &utf16Reader{r: br, order: binary.LittleEndian}, "UTF-16 (little endian, without a byte order mark)", nil
+	case pairs > 0 && evenZeros > pairs/2 && oddZeros == 0:
+		return &utf16Reader{r: br, order: binary.BigEndian}, "UTF-16 (big endian, without a byte order mark)", nil
+	}
+	return br, "", nil
+}
+
+// utf16Reader converts UTF-16 text with the given byte order to UTF-8 as it's read.
+type utf16Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	out   []byte // Text which has been converted but not read yet.
+
+	// A code unit which followed an unpaired surrogate, so has to be converted on its own.
+	pending    uint16
+	hasPending bool
+}
+
+func (u *utf16Reader) Read(b []byte) (int, error) {
+	for len(u.out) < len(b) {
+		r, err := u.readRune()
+		if err == io.EOF && len(u.out) > 0 {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		u.out = utf8.AppendRune(u.out, r)
+	}
+	n := copy(b, u.out)
+	u.out = u.out[:copy(u.out, u.out[n:])]
+	return n, nil
+}
+
+// readRune converts the next character, which may be made of a surrogate pair.
+func (u *utf16Reader) readRune() (rune, error) {
+	first, err := u.readUnit()
+	if err != nil {
+		return 0, err
+	}
+	if !utf16.IsSurrogate(rune(first)) {
+		return rune(first), nil
+	}
+	second, err := u.readUnit()
+	if err == io.EOF {
+		return utf8.RuneError, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if r := utf16.DecodeRune(rune(first), rune(second)); r != utf8.RuneError {
+		return r, nil
+	}
+	u.pending, u.hasPending = second, true
+	return utf8.RuneError, nil
+}
+
+// readUnit reads the next code unit.
+func (u *utf16Reader) readUnit() (uint16, error) {
+	if u.hasPending {
+		u.hasPending = false
+		return u.pending, nil
+	}
+	var unit [2]byte
+	if _, err := io.ReadFull(u.r, unit[:]); err == io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("file looks like UTF-16 text, but has an odd number of bytes")
+	} else if err != nil {
+		return 0, err
+	}
+	return u.order.Uint16(unit[:]), nil
+}
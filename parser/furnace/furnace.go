@@ -2,92 +2,140 @@ package furnace
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/QEStudios/NMOScillatorCompiler/internal/checked"
 	"github.com/QEStudios/NMOScillatorCompiler/nmos"
 )
 
-// A struct to store a range of Furnace version numbers, used for checking version compatibility for the text exports.
-type versionRange struct {
-	min, max int
-}
+// A song composition, which can contain multiple subsongs.
+type Song struct {
+	Version int     `json:"version"` // The version integer of Furnace that exported this song
+	Name    string  `json:"name"`    // The name of the song.
+	Author  string  `json:"author"`  // The author of the song.
+	Album   string  `json:"album"`   // The album the song is a part of.
+	Tuning  float64 `json:"tuning"`  // The frequency that A4 maps to in this song (usually 440 hz).
 
-// A slice containing the compatible versions of Furnace text exports that this parser can handle.
-var supportedRanges = []versionRange{
-	{232, 232},
+	// A slice of sound chips used in the song.
+	SoundChips []*SoundChip `json:"soundChips"`
+
+	// A slice of subsongs in the song.
+	Subsongs []*Subsong `json:"subsongs"`
+
+	// The instruments defined in the song, in the order they're listed.
+	Instruments []*Instrument `json:"instruments"`
+
+	// Parts of the export which have no influence on the converted song.
+	Ignored IgnoredData `json:"ignored"`
 }
 
-// isVersionSupported checks if the given Furnace version number is supported by this parser, and returns true if it is, else it returns false.
-func isVersionSupported(version int) bool {
-	for _, r := range supportedRanges {
-		if version >= r.min && version <= r.max {
-			return true
+// Instrument returns the instrument with the given index, or nil if the song doesn't define it.
+func (s *Song) Instrument(index int) *Instrument {
+	for _, instrument := range s.Instruments {
+		if instrument.Index == index {
+			return instrument
 		}
 	}
-	return false
+	return nil
 }
 
-// A song composition, which can contain multiple subsongs.
-type Song struct {
-	Version int     // The version integer of Furnace that exported this song
-	Name    string  // The name of the song.
-	Author  string  // The author of the song.
-	Album   string  // The album the song is a part of.
-	Tuning  float64 // The frequency that A4 maps to in this song (usually 440 hz).
+// IgnoredData counts the parts of an export which were skipped by the parser.
+type IgnoredData struct {
+	Instruments     int      `json:"instruments"` // Instruments are only read for their volume macros, and the rest of each is skipped.
+	Wavetables      int      `json:"wavetables"`
+	Samples         int      `json:"samples"`
+	Orders          int      `json:"orders"`          // Rows of every subsong's order table. Patterns are read in the order they're played instead.
+	UnknownSections []string `json:"unknownSections"` // Headers of sections which the parser doesn't recognise.
+}
 
-	// A slice of sound chips used in the song.
-	SoundChips []*SoundChip
+// IsZero reports whether nothing was ignored.
+func (d IgnoredData) IsZero() bool {
+	return d.Instruments == 0 && d.Wavetables == 0 && d.Samples == 0 && d.Orders == 0 && len(d.UnknownSections) == 0
+}
 
-	// A slice of subsongs in the song.
-	Subsongs []*Subsong
+func (d IgnoredData) String() string {
+	parts := []string{
+		fmt.Sprintf("%d instruments", d.Instruments),
+		fmt.Sprintf("%d wavetables", d.Wavetables),
+		fmt.Sprintf("%d samples", d.Samples),
+		fmt.Sprintf("%d order table rows", d.Orders),
+	}
+	if len(d.UnknownSections) > 0 {
+		parts = append(parts, fmt.Sprintf("unknown sections %s", strings.Join(d.UnknownSections, ", ")))
+	}
+	return strings.Join(parts, ", ")
 }
 
 // A single SN76489 sound chip configuration.
 type SoundChip struct {
-	Index int
+	Index int `json:"index"`
 	// If true, Divides the base clock frequency fed into the chip by 2 (effectively making it run at half speed and lower all notes by an octave).
-	ClockDiv bool
+	ClockDiv bool `json:"clockDiv"`
 }
 
 // A single subsong inside a whole song composition.
 type Subsong struct {
-	Index         int
-	Name          string  // The name of the subsong (can be blank).
-	TickRate      float64 // The (starting) tick rate of the song.
-	PatternLength uint8   // The length of each pattern in the song.
+	Index         int     `json:"index"`
+	Name          string  `json:"name"`          // The name of the subsong (can be blank).
+	TickRate      float64 `json:"tickRate"`      // The (starting) tick rate of the song.
+	PatternLength uint8   `json:"patternLength"` // The length of each pattern in the song.
 
 	// A slice of up to 16 speed values, where the values cycle every tick.
 	// The final update speed is calculated as the Tick Rate divided by the Frame Speed.
-	Speeds   []uint8
-	TimeBase int // Not sure what this value means, the Furnace code seems to multiply the speeds by this number + 1, so when this is 0 the speeds remain unchanged.
+	Speeds   []uint8 `json:"speeds"`
+	TimeBase int     `json:"timeBase"` // Not sure what this value means, the Furnace code seems to multiply the speeds by this number + 1, so when this is 0 the speeds remain unchanged.
 
 	// A slice of every frame in the subsong.
-	Rows []Row
+	Rows []Row `json:"rows"`
+
+	// Whether the subsong's rows were skipped while parsing, because it wasn't one of ParseOptions.Subsongs.
+	// Skipped subsongs have no rows, so they can't be converted.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// PatternPosition returns the order and the row within its pattern of the row with the given index,
+// which is how Furnace shows where a row is. Rows are numbered through the whole subsong in order.
+func (s *Subsong) PatternPosition(row int) (order int, patternRow int) {
+	if s.PatternLength == 0 {
+		return 0, row
+	}
+	return row / int(s.PatternLength), row % int(s.PatternLength)
 }
 
 // A row in the (sub)song.
 type Row struct {
-	Index   int
-	Notes   []Note
-	Effects []Effect
+	Index   int      `json:"index"`
+	Notes   []Note   `json:"notes"`
+	Effects []Effect `json:"effects"`
+
+	// Comments given on "//" lines before the row, such as section names. Comments after the last row
+	// of a subsong are attached to that row.
+	Comments []string `json:"comments,omitempty"`
 }
 
 type Note struct {
-	Pitch    NotePitch
-	HasPitch bool
+	Pitch    NotePitch `json:"pitch"`
+	HasPitch bool      `json:"hasPitch"`
 
-	Volume    NoteVolume
-	HasVolume bool
+	Volume    NoteVolume `json:"volume"`
+	HasVolume bool       `json:"hasVolume"`
 
-	Off bool // if true, is a note-off
+	Instrument    int  `json:"instrument"` // The instrument the channel plays from this note on.
+	HasInstrument bool `json:"hasInstrument"`
 
-	Channel Channel
+	Off     bool `json:"off"`     // if true, is a note-off
+	Release bool `json:"release"` // if true, is a note release (===), which Furnace uses to start the release of an instrument.
+
+	Channel Channel `json:"channel"`
 }
 
 type Channel uint8
@@ -95,27 +143,105 @@ type NotePitch int    // A single note (stored as a Midi note number).
 type NoteVolume uint8 // A single note's volume (4-bit).
 type EffectType int
 
-// pitchToFreq converts a Midi note number to a frequency, given a specific tuning of A4.
-func pitchToFreq(pitch NotePitch, tuning float64) float64 {
-	// For some reason, furnace notates the octaves as being two octaves *lower* than what they really sound like.
-	// So we need to offset it by bumping the note pitch up two octaves before converting.
-	offsetPitch := pitch + 24
-	return tuning * math.Pow(2, float64(offsetPitch-69)/12)
-}
-
 const (
 	EffectJumpToPattern EffectType = iota
 	EffectJumpToNextPattern
-	EffectSpeed
+	EffectSpeed // 0Fxx, sets speed 2 if the song alternates between two speeds, and speed 1 otherwise.
 	EffectNoiseControl
 	EffectTickRateHz
 	EffectTickRateBpm
 	EffectStopSong
+	EffectPanning
+	EffectSetPitch       // E5xx, fine pitch where 0x80 is the centre.
+	EffectLegato         // EAxx, notes never retrigger on the SN76489 so this has no effect.
+	EffectNoteCut        // ECxx, cuts the note after xx ticks.
+	EffectNoteSlideUp    // E1xy, slides up y semitones at speed x.
+	EffectNoteSlideDown  // E2xy, slides down y semitones at speed x.
+	EffectGroove         // 09xx, selects groove pattern xx, or sets speed 1 if the song has no groove patterns.
+	EffectPitchSlideUp   // 01xx, slides the pitch up at speed xx on every tick until 0100 stops it.
+	EffectPitchSlideDown // 02xx, slides the pitch down at speed xx on every tick until 0200 stops it.
+	EffectVolumeSlide    // 0Axy, slides the volume up at speed x, or down at speed y, on every tick until 0A00 stops it.
 )
 
+// An effect which is parsed into an Effect, and its name.
+type supportedEffect struct {
+	effectType EffectType
+	name       string
+}
+
+// Effects which are parsed, by effect ID. Set tick rate (hz) is every ID from C0 to CF, as its value is 12 bits,
+// so it's parsed on its own instead.
+var supportedEffects = map[uint64]supportedEffect{
+	0x01: {EffectPitchSlideUp, "pitch slide up"},
+	0x02: {EffectPitchSlideDown, "pitch slide down"},
+	0x08: {EffectPanning, "set panning"},
+	0x09: {EffectGroove, "set groove pattern"},
+	0x0A: {EffectVolumeSlide, "volume slide"},
+	0x0B: {EffectJumpToPattern, "jump to pattern"},
+	0x0D: {EffectJumpToNextPattern, "jump to next pattern"},
+	0x0F: {EffectSpeed, "set speed"},
+	0x20: {EffectNoiseControl, "set noise mode"},
+	0xE1: {EffectNoteSlideUp, "note slide up"},
+	0xE2: {EffectNoteSlideDown, "note slide down"},
+	0xE5: {EffectSetPitch, "set pitch"},
+	0xEA: {EffectLegato, "legato"},
+	0xEC: {EffectNoteCut, "note cut"},
+	0xF0: {EffectTickRateBpm, "set tick rate (bpm)"},
+	0xFF: {EffectStopSong, "stop song"},
+}
+
+// An effect which text exports can contain, and whether it's played or skipped.
+type EffectInfo struct {
+	ID        string `json:"id"` // The effect as it's written in patterns, such as "0Bxx".
+	Name      string `json:"name"`
+	Supported bool   `json:"supported"` // Whether the effect is played, rather than skipped with a warning.
+}
+
+// Effects returns every effect the parser recognises, ordered by ID.
+func Effects() []EffectInfo {
+	effects := []EffectInfo{{ID: "Cxxx", Name: "set tick rate (hz)", Supported: true}}
+	for id, effect := range supportedEffects {
+		effects = append(effects, EffectInfo{ID: fmt.Sprintf("%02Xxx", id), Name: effect.name, Supported: true})
+	}
+	for id, name := range unsupportedEffects {
+		effects = append(effects, EffectInfo{ID: fmt.Sprintf("%02Xxx", id), Name: name})
+	}
+	slices.SortFunc(effects, func(a, b EffectInfo) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return effects
+}
+
+// Effects which have no equivalent on the SN76489, by effect ID. These are skipped with a warning
+// naming the effect, rather than causing the whole note to be dropped.
+var unsupportedEffects = map[uint64]string{
+	0xE0: "set arpeggio speed",
+	0xE3: "set vibrato direction",
+	0xE4: "set vibrato range",
+	0xE6: "quick legato",
+	0xE7: "macro release",
+	0xE8: "quick legato up",
+	0xE9: "quick legato down",
+	0xEB: "set sample bank",
+	0xED: "note delay",
+	0xEE: "send external command",
+}
+
+// An error returned when parsing an effect which is recognised, but can't be played on the SN76489.
+type unsupportedEffectError struct {
+	effect string
+	name   string
+}
+
+func (e *unsupportedEffectError) Error() string {
+	return fmt.Sprintf("effect '%s' (%s) isn't supported, skipping it", e.effect, e.name)
+}
+
 type Effect struct {
-	Type  EffectType
-	Value uint16
+	Type  EffectType `json:"type"`
+	Value uint16     `json:"value"`
+
+	Channel Channel `json:"channel"` // The channel whose effect column contains this effect.
 }
 
 /*
@@ -207,6 +333,22 @@ func parsePitchString(pitchString string) (NotePitch, error) {
 	return NotePitch(midiNote), nil
 }
 
+// String formats the pitch the way Furnace does, such as "C-4" or "F#2". Negative octaves are written
+// with "_" or "+" in place of "-" or "#", so "C_1" is C in octave -1.
+func (p NotePitch) String() string {
+	names := [12]string{"C-", "C#", "D-", "D#", "E-", "F-", "F#", "G-", "G#", "A-", "A#", "B-"}
+	octave := int(p)/12 - 1
+	if int(p) < 0 {
+		octave = (int(p)-11)/12 - 1
+	}
+	name := names[(int(p)%12+12)%12]
+	if octave < 0 {
+		name = strings.NewReplacer("-", "_", "#", "+").Replace(name)
+		octave = -octave
+	}
+	return fmt.Sprintf("%s%d", name, octave)
+}
+
 // isValidVolumeString returns true if the given volume string is of a valid format.
 // This means either .. for no change, or a hex number 00 through 0F.
 func isValidVolumeString(volumeString string) bool {
@@ -297,23 +439,15 @@ func parseEffectString(effectString string) (Effect, error) {
 			return Effect{}, fmt.Errorf("error parsing effect string: %w", err)
 		}
 	} else {
-		switch effectId {
-		case 0x0B:
-			effectType = EffectJumpToPattern
-		case 0x0D:
-			effectType = EffectJumpToNextPattern
-		case 0x09, 0x0F:
-			effectType = EffectSpeed
-		case 0x20:
-			effectType = EffectNoiseControl
-		case 0xF0:
-			effectType = EffectTickRateBpm
-		case 0xFF:
-			effectType = EffectStopSong
-		default:
+		effect, ok := supportedEffects[effectId]
+		if !ok {
+			if name, ok := unsupportedEffects[effectId]; ok {
+				return Effect{}, &unsupportedEffectError{effect: effectString, name: name}
+			}
 			// Error if we find any unrecognised effects.
 			return Effect{}, fmt.Errorf("unrecognised effect '%s'", effectString)
 		}
+		effectType = effect.effectType
 
 		if effectString[2:4] == ".." {
 			value = 0
@@ -325,7 +459,11 @@ func parseEffectString(effectString string) (Effect, error) {
 		}
 	}
 
-	return Effect{Type: effectType, Value: uint16(value)}, nil
+	effectValue, err := checked.Narrow[uint16](value)
+	if err != nil {
+		return Effect{}, fmt.Errorf("value of effect '%s' is out of range: %w", effectString, err)
+	}
+	return Effect{Type: effectType, Value: effectValue}, nil
 }
 
 var noteBase = map[byte]int{
@@ -338,26 +476,85 @@ var noteBase = map[byte]int{
 	'B': 11,
 }
 
-// parseNote accepts a note string, which is a combination of a pitch, instrument (ignored), volume,
-// and any number of effects, and returns a Note struct defining that note (or nil if there is no note),
-// a slice of effects (which may contain no effects), and an error if something went wrong.
-func parseNote(noteString string) (Note, []Effect, error) {
+// An error in part of a note string.
+type noteError struct {
+	offset int    // The byte offset of the offending part in the note string.
+	text   string // The offending part of the note string.
+	err    error
+}
+
+func (e *noteError) Error() string {
+	return fmt.Sprintf("%q: %v", e.text, e.err)
+}
+
+func (e *noteError) Unwrap() error {
+	return e.err
+}
 
-	// Remove any whitespace
-	cleanedNoteString := strings.Map(func(r rune) rune {
+// A field of a row line, and its byte offset in the line.
+type rowField struct {
+	text   string
+	offset int
+}
+
+// splitRow splits a row line into its '|' separated fields. Empty fields are kept, as they're the cells of
+// channels left blank, so every channel stays in its own column.
+func splitRow(line string) []rowField {
+	var fields []rowField
+	offset := 0
+	for _, text := range strings.Split(line, "|") {
+		fields = append(fields, rowField{text, offset})
+		offset += len(text) + 1
+	}
+	return fields
+}
+
+// parseNote accepts a note string, which is a combination of a pitch, instrument, volume,
+// and any number of effects, and returns a Note struct defining that note (or nil if there is no note),
+// a slice of effects (which may contain no effects), a slice of unsupported effects which were skipped,
+// and an error if something went wrong. Errors are *noteErrors, locating the offending part of the string.
+func parseNote(noteString string) (Note, []Effect, []error, error) {
+
+	// Remove any whitespace, remembering where each remaining byte was.
+	var cleaned strings.Builder
+	var offsets []int
+	for i, r := range noteString {
 		if unicode.IsSpace(r) {
-			return -1
+			continue
+		}
+		cleaned.WriteRune(r)
+		for range utf8.RuneLen(r) {
+			offsets = append(offsets, i)
 		}
-		return r
-	}, noteString)
+	}
+	cleanedNoteString := cleaned.String()
+	if cleanedNoteString == "" {
+		// Cells are left blank instead of filled with dots in some exports, such as of narrow pattern views.
+		return Note{}, nil, nil, nil
+	}
+
+	// wrap locates an error in the bytes from start to end of the cleaned string.
+	wrap := func(start, end int, err error) error {
+		return &noteError{
+			offset: offsets[start],
+			text:   noteString[offsets[start] : offsets[end-1]+1],
+			err:    err,
+		}
+	}
 
 	// Make sure note strings are a valid length.
 	// 3 (pitch) + 2 (instrument) + 2 (volume) + 4 for every effect (minimum 1 effect).
 	if (len(cleanedNoteString)-11)%4 != 0 {
-		return Note{}, nil, fmt.Errorf("invalid note string: %s", noteString)
+		trimmed := strings.TrimSpace(noteString)
+		return Note{}, nil, nil, &noteError{
+			offset: strings.Index(noteString, trimmed),
+			text:   trimmed,
+			err:    fmt.Errorf("invalid note string"),
+		}
 	}
 
 	pitchString := cleanedNoteString[0:3]
+	instrumentString := cleanedNoteString[3:5]
 	volumeString := cleanedNoteString[5:7]
 
 	var err error
@@ -367,6 +564,7 @@ func parseNote(noteString string) (Note, []Effect, error) {
 	hasPitch := true
 	hasVolume := true
 	off := false
+	release := false
 
 	switch pitchString {
 	case "...":
@@ -378,10 +576,14 @@ func parseNote(noteString string) (Note, []Effect, error) {
 		volume = NoteVolume(0)
 		hasVolume = false
 		off = true
+	case "===":
+		pitch = NotePitch(0)
+		hasPitch = false
+		release = true
 	default:
 		pitch, err = parsePitchString(pitchString)
 		if err != nil {
-			return Note{}, nil, err
+			return Note{}, nil, nil, wrap(0, 3, err)
 		}
 	}
 
@@ -393,12 +595,22 @@ func parseNote(noteString string) (Note, []Effect, error) {
 		default:
 			volume, err = parseVolumeString(volumeString)
 			if err != nil {
-				return Note{}, nil, err
+				return Note{}, nil, nil, wrap(5, 7, err)
 			}
 		}
 	}
 
+	instrument, hasInstrument := 0, false
+	if instrumentString != ".." {
+		n, err := strconv.ParseUint(instrumentString, 16, 8)
+		if err != nil {
+			return Note{}, nil, nil, wrap(3, 5, fmt.Errorf("invalid instrument string '%s'", instrumentString))
+		}
+		instrument, hasInstrument = int(n), true
+	}
+
 	var effects []Effect
+	var skipped []error
 
 	for i := 0; i < len(cleanedNoteString)-7; i += 4 {
 		effectString := cleanedNoteString[i+7 : i+11]
@@ -407,19 +619,27 @@ func parseNote(noteString string) (Note, []Effect, error) {
 			continue
 		}
 		effect, err := parseEffectString(effectString)
+		var unsupported *unsupportedEffectError
+		if errors.As(err, &unsupported) {
+			skipped = append(skipped, wrap(i+7, i+11, err))
+			continue
+		}
 		if err != nil {
-			return Note{}, nil, err
+			return Note{}, nil, nil, wrap(i+7, i+11, err)
 		}
 		effects = append(effects, effect)
 	}
 
 	return Note{
-		Pitch:     NotePitch(pitch),
-		HasPitch:  hasPitch,
-		Volume:    volume,
-		HasVolume: hasVolume,
-		Off:       off,
-	}, effects, nil
+		Pitch:         NotePitch(pitch),
+		HasPitch:      hasPitch,
+		Volume:        volume,
+		HasVolume:     hasVolume,
+		Instrument:    instrument,
+		HasInstrument: hasInstrument,
+		Off:           off,
+		Release:       release,
+	}, effects, skipped, nil
 }
 
 // A key and a value, used for key-value list elements.
@@ -428,70 +648,274 @@ type listElement struct {
 	value string
 }
 
-// Small struct for non-fatal warnings
-type ParseWarning struct {
-	Line    int
-	Message string
-}
-
-func (pi ParseWarning) String() string {
-	return fmt.Sprintf("line %d: %s", pi.Line, pi.Message)
-}
+// A non-fatal problem found while parsing. Warnings about the file as a whole have no line.
+type Warning = diag.Diagnostic
 
-type Parser struct {
+// parser holds the state used while parsing a single file.
+type parser struct {
 	scanner    *bufio.Scanner
-	logger     *log.Logger
 	lineNumber int
 	state      string
 	song       Song
 
 	// Collect any warnings whilst parsing.
-	warnings []ParseWarning
+	warnings []Warning
 
 	// Generic per-state context storage.
 	stateCtx map[string]any
 
-	// Whether or not the parser has already been used.
-	// Parsing can only be done once per Parser.
-	used bool
+	// Differences in the export format of the Furnace version which generated the file.
+	quirks versionQuirks
+
+	// Keys seen so far in the current group of keys (such as the song information, or a single chip's flags).
+	keys map[string]keyEntry
+
+	// Comments waiting to be attached to the next row.
+	pendingComments []string
+
+	// The number of skipped chips of other types before and after the first SN76489. Their channels have columns
+	// in the patterns too, so these pick out the SN76489's columns.
+	chipsBefore, chipsAfter int
+
+	// Called as each line is parsed, if not nil.
+	progress func(line, lines int)
+	lines    int // The number of lines in the file, or 0 if it isn't known.
+
+	// The indices of the subsongs to parse the rows of, or nil for every subsong.
+	subsongs []int
+
+	// Called with each row instead of keeping it, if not nil (see ParseOptions.Rows).
+	rows func(song *Song, subsong *Subsong, row Row) error
+	// The index of the next row of the current subsong.
+	rowIndex int
+
+	// The longest line allowed, in bytes.
+	maxLineLength int
+}
+
+// The value of a key in a group of keys, and the line it was given on.
+type keyEntry struct {
+	value string
+	line  int
 }
 
-type ParseResult struct {
-	Song     *Song
-	Warnings []ParseWarning
+// Parse reads a whole Furnace text export and returns the parsed song,
+// along with any non-fatal warnings encountered while parsing.
+func Parse(r io.Reader) (*Song, []Warning, error) {
+	return ParseWithOptions(r, ParseOptions{})
 }
 
-// NewParser creates a new parser to parse a file.
-func NewParser(r io.Reader, logger *log.Logger) *Parser {
-	if logger == nil {
-		logger = log.Default()
-	}
-	song := Song{
-		Version: 0,
-		Name:    "Unnamed",
-		Author:  "Unknown",
-		Album:   "",
-		Tuning:  440,
-	}
-	return &Parser{
-		scanner:  bufio.NewScanner(r),
-		logger:   logger,
-		state:    "signature", // Parser starts looking for the signature initially.
-		song:     song,
+// DefaultMaxLineLength is the longest line allowed in a text export if ParseOptions.MaxLineLength is 0. Rows of
+// songs with many effect columns on every channel can be far longer than bufio.Scanner's usual limit of 64KB.
+const DefaultMaxLineLength = 1 << 20
+
+// Options which change how a Furnace text export is parsed.
+// The zero value parses the whole file, like Parse.
+type ParseOptions struct {
+	// If not nil, Progress is called after each line is parsed, with the number of lines parsed so far
+	// and the number of lines in the file. If Rows is set, the file is read as it's parsed, so the number of lines
+	// isn't known and is given as 0.
+	Progress func(line, lines int)
+
+	// The indices of the subsongs to parse the rows of. If not nil, the rows of every other subsong are skipped
+	// without being kept or checked, and the subsong is marked as Skipped. Skipped subsongs keep their place in
+	// Song.Subsongs, so subsongs can still be looked up by their index.
+	Subsongs []int
+
+	// If not nil, Rows is called with each row of every subsong which isn't skipped, in order, instead of the row
+	// being kept in the subsong's Rows, so songs with any number of rows can be parsed without holding them all in
+	// memory. Each row is held back until the next one is parsed, so comments after the last row of a subsong are
+	// still attached to it. Every other part of the song and of the row's subsong is parsed before its rows, so
+	// song and subsong are complete apart from their rows. If Rows returns an error, parsing stops with it.
+	Rows func(song *Song, subsong *Subsong, row Row) error
+
+	// The longest line allowed, in bytes. Parsing stops with an error at any line which is longer.
+	// If zero, DefaultMaxLineLength is used.
+	MaxLineLength int
+}
+
+// ParseWithOptions is like Parse, but changes how the file is parsed as opts says.
+func ParseWithOptions(r io.Reader, opts ParseOptions) (*Song, []Warning, error) {
+	text, encoding, err := decodeText(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Counting the lines means holding the whole file, which is only done when the parsed rows are kept anyway.
+	lines := 0
+	if opts.Progress != nil && opts.Rows == nil {
+		data, err := io.ReadAll(text)
+		if err != nil {
+			return nil, nil, err
+		}
+		lines = bytes.Count(data, []byte("\n")) + 1
+		text = bytes.NewReader(data)
+	}
+
+	p := &parser{
+		scanner: bufio.NewScanner(text),
+		state:   "signature", // Parser starts looking for the signature initially.
+		song: Song{
+			Version: 0,
+			Name:    "Unnamed",
+			Author:  "Unknown",
+			Album:   "",
+			Tuning:  440,
+		},
 		stateCtx: make(map[string]any),
+		keys:     make(map[string]keyEntry),
+		progress: opts.Progress,
+		lines:    lines,
+		subsongs: opts.Subsongs,
+		rows:     opts.Rows,
+
+		maxLineLength: opts.MaxLineLength,
+	}
+	if p.maxLineLength == 0 {
+		p.maxLineLength = DefaultMaxLineLength
+	}
+	// The line ending has to fit in the buffer too, which is "\r\n" in exports saved on Windows.
+	p.scanner.Buffer(nil, p.maxLineLength+2)
+	if encoding != "" {
+		p.addWarning("encoding", "file is encoded as %s rather than UTF-8, and is converted to UTF-8 as it's parsed", encoding)
 	}
+	if err := p.parse(); err != nil {
+		return nil, p.warnings, err
+	}
+	return &p.song, p.warnings, nil
 }
 
-// addWarning adds to the list of warnings encountered when parsing.
-func (p *Parser) addWarning(format string, args ...any) {
-	p.warnings = append(p.warnings, ParseWarning{
-		Line:    p.lineNumber,
-		Message: fmt.Sprintf(format, args...),
-	})
+// addWarning adds to the list of warnings encountered when parsing, on the current line.
+func (p *parser) addWarning(code string, format string, args ...any) {
+	p.warn(diag.Warningf(code, format, args...))
+}
+
+// warn adds a warning to the list of warnings encountered when parsing, on the current line.
+func (p *parser) warn(w Warning) {
+	w.Line = p.lineNumber
+	p.warnings = append(p.warnings, w)
+}
+
+// flushRows passes the rows kept in the current subsong to ParseOptions.Rows and removes them from the subsong,
+// if rows are passed on as they're parsed.
+func (p *parser) flushRows() error {
+	subsongPtr := p.getCurrentSubsong()
+	if p.rows == nil || subsongPtr == nil {
+		return nil
+	}
+	for _, row := range subsongPtr.Rows {
+		if err := p.rows(&p.song, subsongPtr, row); err != nil {
+			return err
+		}
+	}
+	subsongPtr.Rows = subsongPtr.Rows[:0]
+	return nil
+}
+
+// attachTrailingComments attaches comments which weren't followed by a row to the last row of the current subsong.
+func (p *parser) attachTrailingComments() {
+	if len(p.pendingComments) == 0 {
+		return
+	}
+	subsongPtr := p.getCurrentSubsong()
+	if subsongPtr == nil || len(subsongPtr.Rows) == 0 {
+		p.addWarning("orphan-comment", "comments with no rows to attach to were ignored: %s", strings.Join(p.pendingComments, ", "))
+	} else {
+		last := &subsongPtr.Rows[len(subsongPtr.Rows)-1]
+		last.Comments = append(last.Comments, p.pendingComments...)
+	}
+	p.pendingComments = nil
+}
+
+// startKeyGroup starts a new group of keys, such as a new chip or subsong. Keys may only be given once in each group.
+func (p *parser) startKeyGroup() {
+	p.keys = make(map[string]keyEntry)
+}
+
+// recordKey records a key given on the current line, and warns if it was already given in the current group.
+// Only the last value is used, but repeated keys usually mean the export is corrupted or was edited by hand.
+func (p *parser) recordKey(section string, key string, value string) {
+	if prev, ok := p.keys[key]; ok {
+		p.addWarning("duplicate-key", "%s %q is given more than once (%q on line %d, %q on line %d), only the last value is used",
+			section, key, prev.value, prev.line, value, p.lineNumber)
+	}
+	p.keys[key] = keyEntry{value: value, line: p.lineNumber}
 }
 
-func (p *Parser) fatalf(format string, args ...any) error {
-	return fmt.Errorf("line %d: %s", p.lineNumber, fmt.Sprintf(format, args...))
+// checkChipFlagConflicts warns about chip flags in the current group which contradict each other.
+func (p *parser) checkChipFlagConflicts() {
+	clockSel, hasClockSel := p.keys["clockSel"]
+	customClock, hasCustomClock := p.keys["customClock"]
+	if hasClockSel && hasCustomClock && customClock.value != "0" && clockSel.value != "0" {
+		p.addWarning("conflicting-chip-flags", "chip flags clockSel=%s (line %d) and customClock=%s (line %d) select different clocks, only customClock is used",
+			clockSel.value, clockSel.line, customClock.value, customClock.line)
+	}
+}
+
+// The keys of the Sound Chips state which track where the parser is, rather than which fields it has seen.
+var chipParsingStates = []string{"parsingChip", "parsingFlags", "skippingChip", "skippingFlags"}
+
+// finishChip checks that every field of the chip which has just been parsed was found, and resets them for the next chip.
+func (p *parser) finishChip(st *boolMap) error {
+	if st.Ctx["parsingFlags"] {
+		p.addWarning("incomplete-chip", "didn't finish parsing chip properly in Sound Chips section. This could be because there were no flags present on a chip")
+	}
+	var missing []string
+	for key, seen := range st.Ctx {
+		if slices.Contains(chipParsingStates, key) {
+			continue // Ignore the states of the parser
+		}
+		if p.quirks.isOptionalChipField(key) {
+			st.Ctx[key] = false
+			continue
+		}
+		if !seen {
+			missing = append(missing, key)
+		}
+		st.Ctx[key] = false // Reset seen flag
+	}
+
+	if len(missing) > 0 {
+		return p.fatalf("missing fields in Sound Chips section: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// parseChipFlag parses a line of a chip flags block, in either of the layouts Furnace exports them in (key=value,
+// or "key": value as in JSON), trying the given layout first. It returns false if the line is neither.
+func parseChipFlag(line string, layout chipFlagLayout) (key string, value string, ok bool) {
+	separators := []string{"=", ":"}
+	if layout == chipFlagsJSON {
+		// JSON values may contain '=', so the separator of the layout in use goes first.
+		separators = []string{":", "="}
+	}
+	unquote := func(s string) string {
+		s = strings.TrimSpace(s)
+		if unquoted, err := strconv.Unquote(s); err == nil {
+			return unquoted
+		}
+		return s
+	}
+	for _, sep := range separators {
+		if k, v, found := strings.Cut(line, sep); found {
+			return unquote(k), unquote(strings.TrimSuffix(strings.TrimSpace(v), ",")), true
+		}
+	}
+	return "", "", false
+}
+
+// fatalf returns an error on the current line, which stops the file from being parsed.
+func (p *parser) fatalf(format string, args ...any) error {
+	d := diag.Errorf("syntax", format, args...)
+	d.Line = p.lineNumber
+	return d
+}
+
+// lineTooLong returns the error for a line longer than the limit, rather than parsing part of it.
+func (p *parser) lineTooLong() error {
+	d := diag.Errorf("line-too-long", "line is longer than the limit of %d bytes", p.maxLineLength).
+		Suggest("raise the limit with --max-line-length")
+	d.Line = p.lineNumber
+	return d
 }
 
 // Parses a line containing a list element into a ListElement struct.
@@ -514,19 +938,14 @@ func parseListElement(s string) (*listElement, error) {
 
 // parseSpeedsList parses a string containing 1..16 positive non-zero integers
 // separated by whitespace. It returns a slice of each parsed int ([]int).
-func (p *Parser) parseSpeedsList(s string) ([]uint8, error) {
+func (p *parser) parseSpeedsList(s string) ([]uint8, error) {
 	tokens := strings.Fields(s)
 	if len(tokens) == 0 {
 		return nil, fmt.Errorf("expected 1..16 numbers, got none")
 	}
 
-	// TODO: groove patterns
-	if len(tokens) > 1 {
-		return nil, fmt.Errorf("compiler doesn't currently support groove patterns")
-	}
-
 	if len(tokens) > 16 {
-		p.addWarning("speeds list contains %d numbers, only first 16 will be used", len(tokens))
+		p.addWarning("too-many-speeds", "speeds list contains %d numbers, only first 16 will be used", len(tokens))
 	}
 
 	count := min(16, len(tokens))
@@ -548,14 +967,40 @@ func (p *Parser) parseSpeedsList(s string) ([]uint8, error) {
 	return out, nil
 }
 
+// checkTickRates warns about every speed in the subsong which, combined with the tick rate and time base,
+// gives a tick rate that the NMOScillator's tempo model can't represent.
+//
+// Songs which alternate between several speeds are timed by the tick, so only the tick rate itself needs to be representable.
+func (p *parser) checkTickRates(subsong *Subsong) {
+	if len(subsong.Speeds) > 1 {
+		rate := subsong.TickRate
+		if _, _, _, _, ok := nmos.FindBestRate(rate, nmos.DefaultRateTolerance); !ok {
+			slowest, fastest := nmos.TickRateRange()
+			p.addWarning("tick-rate-out-of-range", "subsong %d: tick rate %g Hz is outside the range the NMOScillator can play (%.3f-%.3f Hz)",
+				subsong.Index, rate, slowest, fastest)
+		}
+		return
+	}
+	for _, speed := range subsong.Speeds {
+		rate := subsong.TickRate / (float64(speed) * float64(subsong.TimeBase+1))
+		if _, _, _, _, ok := nmos.FindBestRate(rate, nmos.DefaultRateTolerance); ok {
+			continue
+		}
+		slowest, fastest := nmos.TickRateRange()
+		p.addWarning("tick-rate-out-of-range", "subsong %d: speed %d with time base %d and tick rate %g Hz gives an effective tick rate of %.3f Hz, "+
+			"which is outside the range the NMOScillator can play (%.3f-%.3f Hz)",
+			subsong.Index, speed, subsong.TimeBase, subsong.TickRate, rate, slowest, fastest)
+	}
+}
+
 // setState saves an arbitrary value for a given state name.
-func (p *Parser) setState(name string, v any) {
+func (p *parser) setState(name string, v any) {
 	p.stateCtx[name] = v
 }
 
 // getState returns the stored value for name and whether it existed.
 // Usage: st, ok := getState[*SeenState](p, "song information")
-func getState[T any](p *Parser, name string) (T, bool) {
+func getState[T any](p *parser, name string) (T, bool) {
 	var zero T
 	v, ok := p.stateCtx[name]
 	if !ok {
@@ -568,14 +1013,14 @@ func getState[T any](p *Parser, name string) (T, bool) {
 	return typed, true
 }
 
-func (p *Parser) getCurrentChip() *SoundChip {
+func (p *parser) getCurrentChip() *SoundChip {
 	if len(p.song.SoundChips) == 0 {
 		return nil
 	}
 	return p.song.SoundChips[len(p.song.SoundChips)-1]
 }
 
-func (p *Parser) getCurrentSubsong() *Subsong {
+func (p *parser) getCurrentSubsong() *Subsong {
 	if len(p.song.Subsongs) == 0 {
 		return nil
 	}
@@ -586,14 +1031,17 @@ type boolMap struct {
 	Ctx map[string]bool
 }
 
-func (p *Parser) ParseInternal() (*ParseResult, error) {
-	if p.used {
-		return nil, fmt.Errorf("parser already used")
-	}
-	p.used = true
+// parse runs the parser over every line of the file.
+func (p *parser) parse() error {
 	for p.scanner.Scan() {
 		p.lineNumber++
+		if p.progress != nil {
+			p.progress(p.lineNumber, p.lines)
+		}
 		line := p.scanner.Text()
+		if len(line) > p.maxLineLength {
+			return p.lineTooLong()
+		}
 		trimmedLine := strings.TrimSpace(line)
 
 		// p.logger.Printf("Line %04d: %s", p.lineNumber, line)
@@ -610,7 +1058,7 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 				p.state = "version"
 				continue
 			}
-			p.addWarning("unexpected text found in file when looking for Furnace signature: %s", trimmedLine)
+			p.addWarning("unexpected-text", "unexpected text found in file when looking for Furnace signature: %s", trimmedLine)
 
 		// Right under the Furnace signature, the Furnace version number should be present.
 		case "version":
@@ -621,15 +1069,19 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 				version, err := strconv.Atoi(numStr)
 
 				if err != nil {
-					return nil, p.fatalf("invalid integer found in Furnace version number: %s", numStr)
+					return p.fatalf("invalid integer found in Furnace version number: %s", numStr)
 				}
 
-				if !isVersionSupported(version) {
-					p.addWarning("Furnace version number %d isn't officially supported by this program. some things might not work correctly", version)
+				quirks, ok := lookupVersionQuirks(version)
+				if !ok {
+					p.warn(diag.Warningf("unsupported-version", "Furnace version number %d isn't officially supported by this program. some things might not work correctly", version).
+						Suggest("export the song with Furnace 0.6.8.3"))
+				} else if !quirks.tested {
+					p.addWarning("untested-version", "Furnace version number %d hasn't been tested with this program, %s", version, quirks.note)
 				}
+				p.quirks = quirks
 
 				p.song.Version = version
-				p.logger.Printf("Furnace version %d detected", version)
 
 				p.setState("song information", &boolMap{
 					Ctx: map[string]bool{
@@ -642,7 +1094,7 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 				p.state = "song information"
 				continue
 			}
-			return nil, p.fatalf("unexpected text found in file when looking for Furnace version: %s", trimmedLine)
+			return p.fatalf("unexpected text found in file when looking for Furnace version: %s", trimmedLine)
 
 		case "song information":
 			if trimmedLine == "# Song Information" { // Section header.
@@ -652,7 +1104,7 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 			if trimmedLine == "# Sound Chips" { // Next section, check that we've seen everything we need to.
 				st, ok := getState[*boolMap](p, "song information")
 				if !ok {
-					return nil, p.fatalf("internal error: song info state missing")
+					return p.fatalf("internal error: song info state missing")
 				}
 				var missing []string
 				for key, seen := range st.Ctx {
@@ -662,17 +1114,19 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 				}
 
 				if len(missing) > 0 {
-					return nil, p.fatalf("missing fields in Song Information section: %s", strings.Join(missing, ", "))
+					return p.fatalf("missing fields in Song Information section: %s", strings.Join(missing, ", "))
 				}
 
 				p.setState("sound chips", &boolMap{
 					Ctx: map[string]bool{
-						"parsingChip":  false, // Should be set to true if we are in the middle of parsing a chip
-						"parsingFlags": false, // Should be set to true if we are in the middle of parsing chip flags
-						"id":           false,
-						"flags":        false,
-						"chipType":     false,
-						"customClock":  false,
+						"parsingChip":   false, // Should be set to true if we are in the middle of parsing a chip
+						"parsingFlags":  false, // Should be set to true if we are in the middle of parsing chip flags
+						"skippingChip":  false, // Should be set to true if we are in the middle of a chip of another type, which is skipped
+						"skippingFlags": false, // Should be set to true if we are in the middle of the flags of a skipped chip
+						"id":            false,
+						"flags":         false,
+						"chipType":      false,
+						"customClock":   false,
 					},
 				})
 
@@ -682,10 +1136,11 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 
 			le, err := parseListElement(trimmedLine)
 			if err != nil {
-				return nil, p.fatalf("error parsing list element when extracting song information: %s", trimmedLine)
+				return p.fatalf("error parsing list element when extracting song information: %s", trimmedLine)
 			}
 
 			st, _ := getState[*boolMap](p, "song information")
+			p.recordKey("song information field", le.key, le.value)
 			switch le.key {
 			case "name":
 				p.song.Name = le.value
@@ -698,14 +1153,28 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 			case "tuning":
 				tuning, err := strconv.ParseFloat(le.value, 64)
 				if err != nil {
-					return nil, p.fatalf("error converting song tuning in text file to a number: %s", le.value)
+					return p.fatalf("error converting song tuning in text file to a number: %s", le.value)
 				}
 				p.song.Tuning = tuning
 				st.Ctx["tuning"] = true
-			case "system", "instruments", "wavetables", "samples":
+			case "instruments", "wavetables", "samples":
+				count, err := strconv.Atoi(le.value)
+				if err != nil {
+					p.addWarning("invalid-count", "%s count in Song Information section is not a number: %s", le.key, le.value)
+					break
+				}
+				switch le.key {
+				case "instruments":
+					p.song.Ignored.Instruments = count
+				case "wavetables":
+					p.song.Ignored.Wavetables = count
+				case "samples":
+					p.song.Ignored.Samples = count
+				}
+			case "system":
 				// Ignore; not important.
 			default:
-				p.addWarning("unknown option in Song Information section: %s", le.key)
+				p.addWarning("unknown-option", "unknown option in Song Information section: %s", le.key)
 			}
 
 		case "sound chips":
@@ -715,55 +1184,60 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 
 			st, _ := getState[*boolMap](p, "sound chips")
 
-			if trimmedLine == "# Instruments" { // Next section, check that we've seen everything we need to.
-				if st.Ctx["parsingFlags"] == true {
-					p.addWarning("didn't finish parsing chip properly in Sound Chips section. This could be because there were no flags present on a chip")
-				}
+			// Chips start with their name, unindented, and their fields are indented below.
+			isChipHeader := strings.HasPrefix(line, "- ")
 
+			if trimmedLine == "# Instruments" { // Next section, check that we've seen everything we need to.
 				if st.Ctx["parsingChip"] {
-					var missing []string
-					for key, seen := range st.Ctx {
-						if key == "parsingChip" || key == "parsingFlags" {
-							continue // Ignore the parsing chip and parsing flags states
-						}
-						if !seen {
-							missing = append(missing, key)
-						}
-						st.Ctx[key] = false // Reset seen flag
-					}
-
-					if len(missing) > 0 {
-						return nil, p.fatalf("missing fields in Sound Chips section: %s", strings.Join(missing, ", "))
+					if err := p.finishChip(st); err != nil {
+						return err
 					}
 				}
 
 				if len(p.song.SoundChips) == 0 {
-					return nil, p.fatalf("no sound chips were found by the parser")
+					return p.fatalf("no sound chips were found by the parser")
+				}
+				if p.chipsBefore > 0 && p.chipsAfter > 0 {
+					// Chips of other types have different numbers of channels, so there's no telling where the SN76489's columns start.
+					d := diag.Errorf("chip-order", "the TI SN76489 is between chips of other types, so its channels can't be found in the patterns").
+						Suggest("move the TI SN76489 to the start or the end of the module's chips in Furnace")
+					d.Line = p.lineNumber
+					return d
 				}
 
+				p.setState("instruments/wavetables/samples", &instrumentsState{inInstruments: true})
 				p.state = "instruments/wavetables/samples"
 				continue
+			} else if st.Ctx["skippingChip"] && (!isChipHeader || st.Ctx["skippingFlags"]) {
+				// Only the SN76489 is played, so every line of other chips is skipped, including their flags.
+				if strings.HasPrefix(trimmedLine, "```") {
+					st.Ctx["skippingFlags"] = !st.Ctx["skippingFlags"]
+				}
+				continue
 			} else if st.Ctx["parsingFlags"] {
 				if trimmedLine == "```" {
 					st.Ctx["parsingFlags"] = false
+					p.checkChipFlagConflicts()
+					continue
+				}
+				if trimmedLine == "{" || trimmedLine == "}" { // The braces around JSON-style chip flags.
 					continue
 				}
-				kv := strings.SplitN(trimmedLine, "=", 2)
-				if len(kv) != 2 {
-					return nil, p.fatalf("invalid chip flag: %s", trimmedLine)
+				key, value, ok := parseChipFlag(trimmedLine, p.quirks.chipFlags)
+				if !ok {
+					return p.fatalf("invalid chip flag: %s", trimmedLine)
 				}
-				key := strings.TrimSpace(kv[0])
-				value := strings.TrimSpace(kv[1])
 
 				chipPtr := p.getCurrentChip()
 				if chipPtr == nil {
-					return nil, fmt.Errorf("internal error: parsingFlags true but no current chip")
+					return fmt.Errorf("internal error: parsingFlags true but no current chip")
 				}
+				p.recordKey("chip flag", key, value)
 
 				switch key {
 				case "chipType":
 					if value != "4" {
-						return nil, p.fatalf("chip type for chip number %d was expected to be TI SN76489A (chip id 4), instead found chip id %s.", len(p.song.SoundChips), value)
+						return p.fatalf("chip type for chip number %d was expected to be TI SN76489A (chip id 4), instead found chip id %s.", len(p.song.SoundChips), value)
 					}
 					st.Ctx["chipType"] = true
 				case "customClock":
@@ -773,73 +1247,77 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 					case "2000000":
 						chipPtr.ClockDiv = true
 					default:
-						p.addWarning("custom clock for chip number %d should be either 4000000 (4 MHz) or 2000000 (2 MHz) due to hardware limitations. Defaulting to 4 MHz", len(p.song.SoundChips))
+						p.warn(diag.Warningf("invalid-clock", "custom clock for chip number %d should be either 4000000 (4 MHz) or 2000000 (2 MHz) due to hardware limitations. Defaulting to 4 MHz", len(p.song.SoundChips)).
+							Suggest("set the chip's clock to 4 MHz or 2 MHz in Furnace"))
 					}
 					st.Ctx["customClock"] = true
 				case "clockSel", "noEasyNoise", "noPhaseReset":
 					// Ignore; not important.
 				default:
-					p.addWarning("unknown chip flag in Sound Chips section: %s", key)
+					p.addWarning("unknown-chip-flag", "unknown chip flag in Sound Chips section: %s", key)
 				}
 				continue
 			} else {
-				if trimmedLine == "- TI SN76489" {
+				if isChipHeader {
 					if st.Ctx["parsingChip"] == true {
-						if st.Ctx["parsingFlags"] == true {
-							p.addWarning("didn't finish parsing chip properly in Sound Chips section. This could be because there were no flags present on a chip")
-						}
-						var missing []string
-						for key, seen := range st.Ctx {
-							if key == "parsingChip" || key == "parsingFlags" {
-								continue // Ignore the parsing chip and parsing flags states
-							}
-							if !seen {
-								missing = append(missing, key)
-							}
-							st.Ctx[key] = false // Reset seen flag
-						}
-
-						if len(missing) > 0 {
-							return nil, p.fatalf("missing fields in Sound Chips section: %s", strings.Join(missing, ", "))
+						if err := p.finishChip(st); err != nil {
+							return err
 						}
 						// Fall through to start a new chip
 					}
-
-					st.Ctx["parsingChip"] = true
 					st.Ctx["parsingFlags"] = false
+					st.Ctx["skippingChip"], st.Ctx["skippingFlags"] = false, false
+
+					if trimmedLine != "- TI SN76489" {
+						// Modules may use other chips alongside the SN76489, which are left out.
+						p.addWarning("unsupported-chip", "sound chip %s isn't supported by the NMOScillator, skipping it", strings.TrimPrefix(trimmedLine, "- "))
+						st.Ctx["parsingChip"] = false
+						st.Ctx["skippingChip"] = true
+						if len(p.song.SoundChips) == 0 {
+							p.chipsBefore++
+						} else {
+							p.chipsAfter++
+						}
+						continue
+					}
+					st.Ctx["parsingChip"] = true
 					p.song.SoundChips = append(p.song.SoundChips, &SoundChip{Index: len(p.song.SoundChips)})
+					p.startKeyGroup()
 					continue
-				} else if trimmedLine == "```" {
+				} else if strings.HasPrefix(trimmedLine, "```") { // Newer versions may label the block, as in ```json.
 					st.Ctx["parsingFlags"] = true
 					continue
 				}
 				le, err := parseListElement(trimmedLine)
 				if err != nil {
-					return nil, p.fatalf("error parsing list element when extracting sound chips: %s", trimmedLine)
+					return p.fatalf("error parsing list element when extracting sound chips: %s", trimmedLine)
 				}
 
 				chipPtr := p.getCurrentChip()
 				if chipPtr == nil {
-					return nil, p.fatalf("no current chip while parsing")
+					return p.fatalf("no current chip while parsing")
 				}
+				p.recordKey("chip field", le.key, le.value)
 
 				switch le.key {
 				case "id":
 					st.Ctx["id"] = true
 					if le.value != "04" {
-						return nil, p.fatalf("expected chip id 04 at line %d in Sound Chips section, found id %s instead. Make sure you choose 'TI SN76489' as the sound chip in Furnace", p.lineNumber, le.key)
+						return p.fatalf("expected chip id 04 at line %d in Sound Chips section, found id %s instead. Make sure you choose 'TI SN76489' as the sound chip in Furnace", p.lineNumber, le.key)
 					}
 				case "flags":
 					st.Ctx["flags"] = true
 				case "volume", "panning", "front/rear":
 					// Ignore; not important.
 				default:
-					p.addWarning("unknown option in Sound Chips section at line %d: %s", p.lineNumber, le.key)
+					p.addWarning("unknown-option", "unknown option in Sound Chips section at line %d: %s", p.lineNumber, le.key)
 				}
 			}
 
 		case "instruments/wavetables/samples":
-			if trimmedLine == "# Instruments" || trimmedLine == "# Wavetables" || trimmedLine == "# Samples" { // Section headers to ignore.
+			st, _ := getState[*instrumentsState](p, "instruments/wavetables/samples")
+			if trimmedLine == "# Instruments" || trimmedLine == "# Wavetables" || trimmedLine == "# Samples" { // Section headers.
+				st.inInstruments = trimmedLine == "# Instruments"
 				continue
 			}
 			if trimmedLine == "# Subsongs" {
@@ -858,6 +1336,16 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 				p.state = "subsongs"
 				continue
 			}
+			if strings.HasPrefix(trimmedLine, "# ") {
+				p.song.Ignored.UnknownSections = append(p.song.Ignored.UnknownSections, strings.TrimPrefix(trimmedLine, "# "))
+				st.inInstruments = false
+				continue
+			}
+			if st.inInstruments {
+				if err := p.parseInstrumentLine(st, line, trimmedLine); err != nil {
+					return err
+				}
+			}
 
 		case "subsongs":
 
@@ -867,39 +1355,78 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 
 			st, _ := getState[*boolMap](p, "subsongs")
 
-			if st.Ctx["parsingRows"] {
+			// The header of the next subsong also ends the rows of the current one, so it's handled below.
+			if st.Ctx["parsingRows"] && !strings.HasPrefix(trimmedLine, "## ") {
+				if subsongPtr := p.getCurrentSubsong(); subsongPtr != nil && subsongPtr.Skipped {
+					continue
+				}
 				if strings.HasPrefix(trimmedLine, "----- ORDER") { // Order header
 					continue
 				}
-				fields := strings.FieldsFunc(trimmedLine, func(r rune) bool {
-					return r == '|'
-				})
+				if comment, ok := strings.CutPrefix(trimmedLine, "//"); ok { // Comment, attached to the next row.
+					if comment = strings.TrimSpace(comment); comment != "" {
+						p.pendingComments = append(p.pendingComments, comment)
+					}
+					continue
+				}
+				// Columns are counted from the start of the untrimmed line.
+				lineOffset := strings.Index(line, trimmedLine)
 
 				subsongPtr := p.getCurrentSubsong()
 				if subsongPtr == nil {
-					return nil, p.fatalf("no current subsong while parsing")
+					return p.fatalf("no current subsong while parsing")
 				}
 				row := Row{
-					Index: len(subsongPtr.Rows),
+					Index:    p.rowIndex,
+					Comments: p.pendingComments,
 				}
+				p.pendingComments = nil
 
+				fields := splitRow(trimmedLine)
+				// Columns of skipped chips are left out. The SN76489's channels are either the first or the last four.
+				firstColumn := 1 // The first column is the row's address.
+				if p.chipsBefore > 0 {
+					firstColumn = max(len(fields)-4, 1)
+				}
 				for i, field := range fields {
-					if i == 0 { // Ignore address values.
+					if i < firstColumn || i >= firstColumn+4 {
 						continue
 					}
+					channel := i - firstColumn
+
+					// warnAt adds a warning at the column of a note error.
+					warnAt := func(code string, err error, format string, args ...any) {
+						w := diag.Warningf(code, format, args...)
+						w.Column = lineOffset + field.offset + 1
+						var ne *noteError
+						if errors.As(err, &ne) {
+							w.Column += ne.offset
+						}
+						p.warn(w)
+					}
 
-					note, effects, err := parseNote(field)
+					note, effects, skipped, err := parseNote(field.text)
+					for _, err := range skipped {
+						warnAt("unsupported-effect", err, "row %d, channel %d: %v", row.Index, channel, err)
+					}
 					if err != nil {
-						p.addWarning("error parsing note in channel %d: %v", i-1, err)
-						row.Notes = append(row.Notes, Note{Channel: Channel(i - 1)})
+						warnAt("invalid-note", err, "error parsing note in channel %d: %v", channel, err)
+						row.Notes = append(row.Notes, Note{Channel: Channel(channel)})
 						continue
 					}
-					note.Channel = Channel(i - 1)
+					note.Channel = Channel(channel)
+					for j := range effects {
+						effects[j].Channel = note.Channel
+					}
 
 					row.Notes = append(row.Notes, note)
 					row.Effects = append(row.Effects, effects...)
 				}
 
+				p.rowIndex++
+				if err := p.flushRows(); err != nil {
+					return err
+				}
 				subsongPtr.Rows = append(subsongPtr.Rows, row)
 			}
 
@@ -940,24 +1467,24 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 						break
 					}
 					if claimedIdx != newIdx { // Make sure the subsong index is what we expect.
-						p.addWarning("expected subsong index %d, got index %d instead", newIdx, claimedIdx)
+						p.addWarning("subsong-index", "expected subsong index %d, got index %d instead", newIdx, claimedIdx)
 					}
 
 					break
 				}
 
 				if validLine == false {
-					p.addWarning("unexpected text found in file when looking for subsong start: %s", trimmedLine)
+					p.addWarning("unexpected-text", "unexpected text found in file when looking for subsong start: %s", trimmedLine)
 					continue
 				}
 
 				if st.Ctx["parsingSubsong"] == st.Ctx["parsingRows"] {
 					if st.Ctx["parsingSubsong"] == true {
 						if st.Ctx["parsingMetadata"] == true {
-							return nil, p.fatalf("didn't finish parsing subsong metadata properly in Sound Chips section")
+							return p.fatalf("didn't finish parsing subsong metadata properly in Sound Chips section")
 						}
 						if st.Ctx["parsingOrders"] == true {
-							return nil, p.fatalf("didn't finish parsing subsong orders properly in Sound Chips section")
+							return p.fatalf("didn't finish parsing subsong orders properly in Sound Chips section")
 						}
 
 						var missing []string
@@ -972,11 +1499,17 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 						}
 
 						if len(missing) > 0 {
-							return nil, p.fatalf("missing fields in Subsongs section: %s", strings.Join(missing, ", "))
+							return p.fatalf("missing fields in Subsongs section: %s", strings.Join(missing, ", "))
 						}
 						// Fall through to start a new subsong.
 					}
 
+					p.attachTrailingComments()
+					if err := p.flushRows(); err != nil {
+						return err
+					}
+					p.rowIndex = 0
+
 					st.Ctx["parsingSubsong"] = true
 					st.Ctx["parsingMetadata"] = true
 					st.Ctx["parsingOrders"] = false
@@ -987,74 +1520,92 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 						Name:     subsongName,
 						TickRate: 50,
 						Speeds:   []uint8{3},
+						Skipped:  p.subsongs != nil && !slices.Contains(p.subsongs, newIdx),
 					})
+					p.startKeyGroup()
 					continue
 				} else {
-					p.addWarning("unexpected text found in file when parsing subsong id %d: %s", newIdx-1, trimmedLine)
+					p.addWarning("unexpected-text", "unexpected text found in file when parsing subsong id %d: %s", newIdx-1, trimmedLine)
 				}
 				continue
 			}
 
+			if st.Ctx["parsingOrders"] && trimmedLine != "```" {
+				p.song.Ignored.Orders++
+				continue
+			}
+
 			if st.Ctx["parsingMetadata"] {
 				if trimmedLine == "orders:" {
 					st.Ctx["parsingMetadata"] = false
 					st.Ctx["parsingOrders"] = true
+					if subsongPtr := p.getCurrentSubsong(); subsongPtr != nil && !subsongPtr.Skipped {
+						p.checkTickRates(subsongPtr)
+					}
 					continue
 				}
 
 				le, err := parseListElement(trimmedLine)
 				if err != nil {
-					return nil, p.fatalf("error parsing list element when extracting sound chips: %s", trimmedLine)
+					return p.fatalf("error parsing list element when extracting sound chips: %s", trimmedLine)
 				}
 
 				subsongPtr := p.getCurrentSubsong()
 				if subsongPtr == nil {
-					return nil, p.fatalf("no current subsong while parsing")
+					return p.fatalf("no current subsong while parsing")
 				}
+				p.recordKey("subsong field", le.key, le.value)
 
 				switch le.key {
 				case "tick rate":
 					st.Ctx["tickRate"] = true
 					tickRate, err := strconv.ParseFloat(le.value, 64)
 					if err != nil {
-						return nil, p.fatalf("error converting song tick rate in text file to a number: %s", le.value)
+						return p.fatalf("error converting song tick rate in text file to a number: %s", le.value)
 					}
 					subsongPtr.TickRate = tickRate
 				case "speeds":
 					st.Ctx["speeds"] = true
 					speeds, err := p.parseSpeedsList(le.value)
 					if err != nil {
-						return nil, p.fatalf("error when parsing speeds: %v", err)
+						return p.fatalf("error when parsing speeds: %v", err)
 					}
 					subsongPtr.Speeds = speeds
 				case "time base":
 					timeBase, err := strconv.Atoi(le.value)
 					if err != nil {
-						return nil, p.fatalf("error converting song time base in text file to a number: %s", le.value)
+						return p.fatalf("error converting song time base in text file to a number: %s", le.value)
 					}
 					subsongPtr.TimeBase = timeBase
 				case "pattern length":
 					st.Ctx["patternLength"] = true
 					patternLength, err := strconv.ParseUint(le.value, 10, 8)
 					if err != nil {
-						return nil, p.fatalf("error convert pattern length in text file to a number: %s", le.value)
+						return p.fatalf("error convert pattern length in text file to a number: %s", le.value)
 					}
 					subsongPtr.PatternLength = uint8(patternLength)
 				case "virtual tempo":
 					// Ignore; not important.
 				default:
-					p.addWarning("unknown option in Sound Chips section: %s", le.key)
+					p.addWarning("unknown-option", "unknown option in Sound Chips section: %s", le.key)
 				}
 			}
 
 		default:
-			return nil, p.fatalf("unknown parser state: %s", p.state)
+			return p.fatalf("unknown parser state: %s", p.state)
 		}
 
 	}
 
-	if err := p.scanner.Err(); err != nil {
-		p.fatalf("error while reading file: %v", err)
+	if err := p.scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		p.lineNumber++ // The line which is too long was never scanned.
+		return p.lineTooLong()
+	} else if err != nil {
+		return p.fatalf("error while reading file: %v", err)
+	}
+	p.attachTrailingComments()
+	if err := p.flushRows(); err != nil {
+		return err
 	}
 
 	fileComplete := false
@@ -1068,357 +1619,8 @@ func (p *Parser) ParseInternal() (*ParseResult, error) {
 		}
 	}
 	if !fileComplete {
-		return nil, p.fatalf("unexpected EOF")
-	}
-
-	return &ParseResult{
-		Song:     &p.song,
-		Warnings: p.warnings,
-	}, nil
-}
-
-type noiseRateTypeEnum int
-
-const (
-	noiseRateCh3 noiseRateTypeEnum = iota
-	noiseRatePreset
-)
-
-func (p *Parser) ParseNmos(result *ParseResult, subsongIndex uint8) (*nmos.NmosSong, error) {
-	parsedSong := result.Song
-	song := nmos.NmosSong{}
-	if subsongIndex >= uint8(len(parsedSong.Subsongs)) {
-		return nil, p.fatalf("subsong %d does not exist; song only contains %d subsongs (allowed range 0..%d)",
-			subsongIndex,
-			len(parsedSong.Subsongs), len(parsedSong.Subsongs)-1,
-		)
-	}
-	subsong := parsedSong.Subsongs[subsongIndex]
-
-	if len(parsedSong.SoundChips) > 1 {
-		p.logger.Printf("Found %d sound chips, output will use the first one", len(parsedSong.SoundChips))
-	}
-
-	// Currently only one sound chip exists on the NMOScillator, so just assume the first sound chip is the one to use.
-	const soundchipIndex = 0
-
-	song.Name = ""
-	if parsedSong.Name != "" {
-		song.Name += parsedSong.Name
-		if subsong.Name != "" {
-			song.Name += " - "
-		}
-	}
-	if subsong.Name != "" {
-		song.Name += subsong.Name
-	}
-	if parsedSong.Album != "" {
-		song.Name += fmt.Sprintf(" (from %s)", parsedSong.Album)
-	}
-	song.Author = parsedSong.Author
-
-	finalTickrate := subsong.TickRate / (float64(subsong.Speeds[0]) * float64(subsong.TimeBase+1))
-
-	tempo, baseFrameDelay, _, _, ok := nmos.FindBestRate(finalTickrate)
-
-	if !ok {
-		return nil, fmt.Errorf("unable to find compatible tickrate within an acceptable tolerance")
-	}
-
-	song.InitialTempo = tempo
-	song.ClockDiv = parsedSong.SoundChips[soundchipIndex].ClockDiv
-
-	var clockRate float64
-	if song.ClockDiv {
-		clockRate = 2_000_000
-	} else {
-		clockRate = 4_000_000
-	}
-
-	if clockRate == 2_000_000 {
-		// NMOScillator doesn't currently support using the ClockDiv option.
-		return nil, fmt.Errorf("Clock rate of 2 MHz is not currently supported by the NMOScillator")
-	}
-
-	var noiseRateType noiseRateTypeEnum
-	var noiseMode nmos.NoiseMode
-	var currentSpeed uint8
-	var currentTickRate float64
-	var loopTargetIndex int
-
-	currentSpeed = subsong.Speeds[0]
-	currentTickRate = subsong.TickRate
-
-	var isHalted bool // Does the song now halt? (used for breaking out of the loop)
-	var isLooped bool // Does the song now loop back to an earlier point? (used for breaking out of the loop)
-
-	resetFrame := nmos.Frame{}
-	err := resetFrame.SetNoiseControl(nmos.WhiteNoise, nmos.Channel3Noise)
-	if err != nil {
-		return nil, fmt.Errorf("error generating reset frame: %v", err)
-	}
-
-	for c := 0; c < 4; c++ {
-		resetFrame.SetAttenuation(uint8(c), 0xf)
-	}
-
-	song.Frames = append(song.Frames, resetFrame)
-
-	channelVolumes := []uint8{0xf, 0xf, 0xf, 0xf}
-	channelOffs := []bool{true, true, true, true} // Slice of 4 bools for whether each channel is off (true) or not (false).
-
-	for rowIndex := 0; rowIndex < len(subsong.Rows); {
-		newIndex := rowIndex + 1
-		row := subsong.Rows[rowIndex]
-
-		frame := nmos.Frame{}
-
-		isBlank := true
-
-		// Effects
-		for _, effect := range row.Effects {
-			switch effect.Type {
-			case EffectJumpToPattern:
-				currentPattern := rowIndex / int(subsong.PatternLength)
-				if int(effect.Value) > currentPattern { // skip forward
-					newIndex = int(effect.Value) * int(subsong.PatternLength)
-				} else { // loop backward
-					loopTargetIndex = int(effect.Value)*int(subsong.PatternLength) + 1
-					song.LoopTarget = loopTargetIndex
-					isLooped = true
-					isBlank = false
-				}
-
-			case EffectJumpToNextPattern:
-				currentPattern := rowIndex / int(subsong.PatternLength)
-				newIndex = (currentPattern + 1) * int(subsong.PatternLength)
-
-			case EffectSpeed:
-				if len(subsong.Speeds) > 1 {
-					p.logger.Println("changing speed patterns using set groove pattern / set speed effects is not supported yet, ignoring")
-				} else {
-					finalTickrate := currentTickRate / (float64(effect.Value) * float64(subsong.TimeBase+1))
-					tempo, newBaseFrameDelay, _, _, ok := nmos.FindBestRate(finalTickrate)
-					if !ok {
-						return nil, fmt.Errorf("unable to find compatible tickrate within an acceptable tolerance")
-					}
-					baseFrameDelay = newBaseFrameDelay
-
-					err := frame.SetNewTempo(tempo)
-					if err != nil {
-						return nil, fmt.Errorf("error setting frame tempo: %v", err)
-					}
-					currentSpeed = uint8(effect.Value)
-					isBlank = false
-				}
-
-			case EffectNoiseControl:
-				rateVal := effect.Value >> 4
-				modeVal := effect.Value % 16
-
-				if rateVal == 1 {
-					noiseRateType = noiseRateCh3
-				} else {
-					noiseRateType = noiseRatePreset
-				}
-
-				if modeVal == 1 {
-					noiseMode = nmos.WhiteNoise
-				} else {
-					noiseMode = nmos.PeriodicNoise
-				}
-
-				if noiseRateType == noiseRateCh3 {
-					err := frame.SetNoiseControl(noiseMode, nmos.Channel3Noise)
-					if err != nil {
-						return nil, fmt.Errorf("error setting noise control values: %v", err)
-					}
-				}
-				// If not ch3 noise, noise uses preset frequency, and this means the noise control should be updated
-				// only when changing the preset (with a note pitch set in the noise channel).
-				isBlank = false
-
-			case EffectTickRateHz:
-				finalTickrate := float64(effect.Value) / (float64(currentSpeed) * float64(subsong.TimeBase+1))
-				tempo, newBaseFrameDelay, _, _, ok := nmos.FindBestRate(finalTickrate)
-				if !ok {
-					return nil, fmt.Errorf("unable to find compatible tickrate within an acceptable tolerance.")
-				}
-				baseFrameDelay = newBaseFrameDelay
-
-				err := frame.SetNewTempo(tempo)
-				if err != nil {
-					return nil, fmt.Errorf("error setting frame tempo: %v", err)
-				}
-				currentTickRate = float64(effect.Value)
-				isBlank = false
-
-			case EffectTickRateBpm:
-				tickRateHz := float64(effect.Value) * 24 / 60 // Furnace assumes 24 ticks per beat, I had to figure this out the hard way.
-				finalTickrate := tickRateHz / (float64(currentSpeed) * float64(subsong.TimeBase+1))
-				tempo, newBaseFrameDelay, _, _, ok := nmos.FindBestRate(finalTickrate)
-				if !ok {
-					return nil, fmt.Errorf("unable to find compatible tickrate within an acceptable tolerance")
-				}
-				baseFrameDelay = newBaseFrameDelay
-
-				err := frame.SetNewTempo(tempo)
-				if err != nil {
-					return nil, fmt.Errorf("error setting frame tempo: %v", err)
-				}
-				currentTickRate = tickRateHz
-				isBlank = false
-
-			case EffectStopSong:
-				// We can stop parsing the song after this frame.
-				// Since the NMOScillator has no way of actually halting the playback,
-				// we instead send it into an infinite loop at the end of the song.
-				isHalted = true
-				isBlank = false
-
-			default:
-				panic(fmt.Sprintf("unknown effect type %d", effect.Type))
-			}
-		}
-
-		frame.FrameDelay = baseFrameDelay
-
-		// Notes
-		for _, note := range row.Notes {
-
-			if note.Off {
-				err := frame.SetAttenuation(uint8(note.Channel), 0xf)
-				if err != nil {
-					return nil, fmt.Errorf("error setting channel off: %v", err)
-				}
-				channelOffs[note.Channel] = true
-				isBlank = false
-			}
-
-			if note.HasVolume {
-				vol := uint8(note.Volume)
-				if !channelOffs[note.Channel] {
-					err := frame.SetAttenuation(uint8(note.Channel), 0xf-vol)
-					if err != nil {
-						return nil, fmt.Errorf("error setting channel attenuation off: %v", err)
-					}
-				}
-				channelVolumes[note.Channel] = vol
-				isBlank = false
-			}
-
-			if note.HasPitch && note.Channel < 3 { // Set pitch for square channels.
-				period := nmos.CalculateSquarePeriod(pitchToFreq(note.Pitch, parsedSong.Tuning), clockRate)
-				err := frame.SetSquarePeriod(uint8(note.Channel), period)
-				if err != nil {
-					return nil, fmt.Errorf("error setting channel period: %v", err)
-				}
-				if channelOffs[note.Channel] {
-					err := frame.SetAttenuation(uint8(note.Channel), 0xf-channelVolumes[note.Channel])
-					if err != nil {
-						return nil, fmt.Errorf("error setting channel on: %v", err)
-					}
-					channelOffs[note.Channel] = false
-				}
-				isBlank = false
-			} else if note.HasPitch && note.Channel == 3 { // Set pitch for noise channel
-				if noiseRateType == noiseRateCh3 {
-					period := nmos.CalculateNoisePeriod(pitchToFreq(note.Pitch, parsedSong.Tuning), clockRate)
-					err := frame.SetSquarePeriod(2, period)
-					if err != nil {
-						return nil, fmt.Errorf("error setting noise period: %v", err)
-					}
-					if channelOffs[3] {
-						err := frame.SetAttenuation(3, 0xf-channelVolumes[3])
-						if err != nil {
-							return nil, fmt.Errorf("error setting noise attenuation: %v", err)
-						}
-						channelOffs[3] = false
-					}
-				} else {
-					// Noise mode is set to preset, so C = LOW, C# = MED, and D = HIGH.
-
-					var preset nmos.NoiseRate
-					switch note.Pitch % 12 { // Check the note pitch regardless of octave (C, C#, D, etc).
-					case 0: // C
-						preset = nmos.LowNoise
-					case 1: // C#
-						preset = nmos.MediumNoise
-					case 2: // D
-						preset = nmos.HighNoise
-					default: // any other pitch
-						return nil, fmt.Errorf("unable to convert noise pitch %d into a noise mode preset", note.Pitch)
-					}
-
-					err := frame.SetNoiseControl(noiseMode, preset)
-					if err != nil {
-						return nil, fmt.Errorf("error setting noise control values: %v", err)
-					}
-					if channelOffs[3] {
-						err := frame.SetAttenuation(3, 0xf-channelVolumes[3])
-						if err != nil {
-							return nil, fmt.Errorf("error setting noise attenuation: %v", err)
-						}
-						channelOffs[3] = false
-					}
-				}
-				isBlank = false
-			}
-		}
-
-		rowIndex = newIndex
-
-		// If this frame will be empty, increase the frame delay of the previous frame
-		// instead of making a new frame. Only make a new frame if the previous frame's delay can't get higher.
-		if isBlank {
-			prevFrame := &song.Frames[len(song.Frames)-1]
-
-			// HACK: will probably break when adding groove support.
-			if int(prevFrame.FrameDelay)+int(baseFrameDelay) <= 255 { // Frame delay can be increased.
-				prevFrame.FrameDelay += (baseFrameDelay + 1)
-				continue // Don't append this blank frame.
-			}
-		}
-
-		if isHalted { // Break out of the loop early if we encountered a halt frame.
-			song.Frames = append(song.Frames, frame)
-
-			loopTargetIndex = len(song.Frames)
-			song.LoopTarget = loopTargetIndex
-
-			song.Frames = append(song.Frames, resetFrame) // silent reset frame to target in the loop (constantly silences all channels)
-
-			haltFrame := nmos.Frame{
-				LoopToTarget: true,
-			}
-			song.Frames = append(song.Frames, haltFrame)
-			break
-		}
-
-		// TODO: groove patterns
-
-		song.Frames = append(song.Frames, frame)
-
-		if isLooped { // Finish parsing if the song will loop forever from this point.
-			song.Frames = append(song.Frames, frame)
-
-			loopFrame := nmos.Frame{
-				LoopToTarget: true,
-			}
-			song.Frames = append(song.Frames, loopFrame)
-			break
-		}
-	}
-
-	if !(isHalted || isLooped) {
-		// Song has no loop or halt effects, so default to looping back to the start (this is what furnace does).
-
-		loopFrame := nmos.Frame{
-			LoopToTarget: true,
-		}
-		song.Frames = append(song.Frames, loopFrame)
-		song.LoopTarget = 0 // This should be the default value regardless but I like being explicit.
+		return p.fatalf("unexpected EOF")
 	}
 
-	return &song, nil
+	return nil
 }
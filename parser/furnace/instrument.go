@@ -0,0 +1,185 @@
+package furnace
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// An instrument defined in the song. Only the parts of an instrument the NMOScillator can play are kept.
+type Instrument struct {
+	Index int    `json:"index"` // The number of the instrument, as given in the instrument column of a note.
+	Name  string `json:"name"`
+
+	// The volume macro, which changes the channel's volume on every tick of a note, or nil if the instrument has none.
+	Volume *Macro `json:"volume,omitempty"`
+	// The arpeggio macro, whose values are added to the note in semitones, or nil if the instrument has none.
+	Arpeggio *Macro `json:"arpeggio,omitempty"`
+	// The pitch macro, whose values bend the note in 1/128 semitones, or nil if the instrument has none.
+	Pitch *Macro `json:"pitch,omitempty"`
+}
+
+// A macro, which steps through a sequence of values on every tick after a note starts.
+type Macro struct {
+	Values  []int `json:"values"`
+	Loop    int   `json:"loop"`    // The index of the value the macro loops back to after its last value, or -1 if it doesn't loop.
+	Release int   `json:"release"` // The index of the value the macro holds at until the note is released, or -1 if it doesn't wait for a release.
+	Delay   int   `json:"delay"`   // The number of ticks before the macro starts.
+	Speed   int   `json:"speed"`   // The number of ticks each value lasts, which is at least 1.
+	Mode    int   `json:"mode"`    // How the values are used, which depends on the macro (see MacroModeRelative).
+}
+
+// The mode of pitch macros whose values are added up on every step, rather than each setting the pitch.
+const MacroModeRelative = 1
+
+// Arpeggio macro values from this one up are fixed notes, rather than offsets from the note played.
+const fixedArpeggioBit = 1 << 30
+
+// parseMacro parses the value of a macro in the Instruments section, which is a list of values with "|" before
+// the value the macro loops back to and "/" before its release point, optionally after settings in brackets
+// such as [SPEED 2] or [DELAY 4].
+func parseMacro(s string) (*Macro, error) {
+	macro := &Macro{Loop: -1, Release: -1, Speed: 1}
+
+	for s = strings.TrimSpace(s); strings.HasPrefix(s, "["); s = strings.TrimSpace(s) {
+		end := strings.Index(s, "]")
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated macro setting: %s", s)
+		}
+		setting := strings.Fields(s[1:end])
+		s = s[end+1:]
+		if len(setting) == 0 {
+			return nil, fmt.Errorf("empty macro setting")
+		}
+
+		switch setting[0] {
+		case "ADSR", "LFO":
+			return nil, fmt.Errorf("%s macros aren't supported, only sequences of values", setting[0])
+		case "MODE", "DELAY", "SPEED":
+			if len(setting) != 2 {
+				return nil, fmt.Errorf("macro setting %s needs a single value", setting[0])
+			}
+			n, err := strconv.Atoi(setting[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid macro %s %q", strings.ToLower(setting[0]), setting[1])
+			}
+			switch setting[0] {
+			case "MODE":
+				macro.Mode = n
+			case "DELAY":
+				macro.Delay = n
+			case "SPEED":
+				macro.Speed = max(n, 1)
+			}
+		default:
+			return nil, fmt.Errorf("unknown macro setting %s", setting[0])
+		}
+	}
+
+	for _, token := range strings.Fields(s) {
+		switch token {
+		case "|":
+			macro.Loop = len(macro.Values)
+		case "/":
+			macro.Release = len(macro.Values)
+		default:
+			n, err := strconv.Atoi(token)
+			if err != nil {
+				return nil, fmt.Errorf("invalid macro value %q", token)
+			}
+			macro.Values = append(macro.Values, n)
+		}
+	}
+
+	if len(macro.Values) == 0 {
+		return nil, fmt.Errorf("macro has no values")
+	}
+	// Markers after the last value have nothing to loop to or hold at.
+	if macro.Loop >= len(macro.Values) {
+		macro.Loop = -1
+	}
+	if macro.Release >= len(macro.Values) {
+		macro.Release = -1
+	}
+	return macro, nil
+}
+
+// parseInstrumentHeader parses the header which starts each instrument in the Instruments section,
+// such as "## 01: Lead", returning the instrument's index and name.
+func parseInstrumentHeader(s string) (int, string, error) {
+	header, ok := strings.CutPrefix(s, "## ")
+	if !ok {
+		return 0, "", fmt.Errorf("invalid instrument header: %s", s)
+	}
+	number, name, _ := strings.Cut(header, ":")
+	index, err := strconv.ParseUint(strings.TrimSpace(number), 16, 8)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid instrument number %q", strings.TrimSpace(number))
+	}
+	return int(index), strings.TrimSpace(name), nil
+}
+
+// The state of the parser in the Instruments, Wavetables and Samples sections.
+type instrumentsState struct {
+	inInstruments bool        // Whether the parser is in the Instruments section, rather than the Wavetables or Samples.
+	instrument    *Instrument // The instrument being parsed, or nil before the first one.
+	inMacros      bool        // Whether the parser is in the current instrument's list of macros.
+}
+
+// parseInstrumentLine parses a line of the Instruments section. Only instrument headers and volume, arpeggio and
+// pitch macros are read, and everything else about an instrument is skipped.
+func (p *parser) parseInstrumentLine(st *instrumentsState, line, trimmedLine string) error {
+	if strings.HasPrefix(trimmedLine, "## ") {
+		index, name, err := parseInstrumentHeader(trimmedLine)
+		if err != nil {
+			return p.fatalf("%v", err)
+		}
+		st.instrument = &Instrument{Index: index, Name: name}
+		st.inMacros = false
+		p.song.Instruments = append(p.song.Instruments, st.instrument)
+		return nil
+	}
+	if st.instrument == nil || !strings.HasPrefix(trimmedLine, "- ") {
+		return nil
+	}
+
+	// Macros are listed under "- macros:", indented below the instrument's other fields.
+	indented := line != strings.TrimLeft(line, " \t")
+	if trimmedLine == "- macros:" {
+		st.inMacros = true
+		return nil
+	}
+	if !st.inMacros || !indented {
+		st.inMacros = false
+		return nil
+	}
+
+	le, err := parseListElement(trimmedLine)
+	if err != nil {
+		return p.fatalf("error parsing macro of instrument %02X: %s", st.instrument.Index, trimmedLine)
+	}
+	var target **Macro
+	var name string
+	switch le.key {
+	case "vol":
+		target, name = &st.instrument.Volume, "volume"
+	case "arp":
+		target, name = &st.instrument.Arpeggio, "arpeggio"
+	case "pitch":
+		target, name = &st.instrument.Pitch, "pitch"
+	default:
+		p.addWarning("unsupported-macro", "instrument %02X (%s) has a %s macro, which isn't supported, ignoring", st.instrument.Index, st.instrument.Name, le.key)
+		return nil
+	}
+	macro, err := parseMacro(le.value)
+	if err == nil && le.key == "arp" && slices.ContainsFunc(macro.Values, func(v int) bool { return v >= fixedArpeggioBit }) {
+		err = fmt.Errorf("fixed notes aren't supported, only offsets from the note played")
+	}
+	if err != nil {
+		p.addWarning("invalid-macro", "ignoring the %s macro of instrument %02X (%s): %v", name, st.instrument.Index, st.instrument.Name, err)
+		return nil
+	}
+	*target = macro
+	return nil
+}
@@ -0,0 +1,56 @@
+package furnace
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Names of each effect type, used when printing and serialising effects.
+var effectTypeNames = map[EffectType]string{
+	EffectJumpToPattern:     "jumpToPattern",
+	EffectJumpToNextPattern: "jumpToNextPattern",
+	EffectSpeed:             "speed",
+	EffectNoiseControl:      "noiseControl",
+	EffectTickRateHz:        "tickRateHz",
+	EffectTickRateBpm:       "tickRateBpm",
+	EffectStopSong:          "stopSong",
+	EffectPanning:           "panning",
+	EffectSetPitch:          "setPitch",
+	EffectLegato:            "legato",
+	EffectNoteCut:           "noteCut",
+	EffectNoteSlideUp:       "noteSlideUp",
+	EffectNoteSlideDown:     "noteSlideDown",
+	EffectGroove:            "groove",
+	EffectPitchSlideUp:      "pitchSlideUp",
+	EffectPitchSlideDown:    "pitchSlideDown",
+	EffectVolumeSlide:       "volumeSlide",
+}
+
+func (t EffectType) String() string {
+	if name, ok := effectTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EffectType(%d)", int(t))
+}
+
+// MarshalText serialises the effect type as its name.
+func (t EffectType) MarshalText() ([]byte, error) {
+	name, ok := effectTypeNames[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown effect type %d", int(t))
+	}
+	return []byte(name), nil
+}
+
+// MarshalJSON serialises the subsong, writing the speeds as a list of numbers rather than a base64 string.
+func (s *Subsong) MarshalJSON() ([]byte, error) {
+	type subsong Subsong // Avoids recursing into this method.
+	speeds := make([]int, len(s.Speeds))
+	for i, speed := range s.Speeds {
+		speeds[i] = int(speed)
+	}
+	return json.Marshal(struct {
+		*subsong
+		Speeds []int `json:"speeds"`
+	}{(*subsong)(s), speeds})
+}
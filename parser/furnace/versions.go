@@ -0,0 +1,88 @@
+package furnace
+
+import "slices"
+
+// A struct to store a range of Furnace version numbers, used for checking version compatibility for the text exports.
+type versionRange struct {
+	min, max int
+}
+
+// Differences in the text exports generated by a range of Furnace versions.
+type versionQuirks struct {
+	versionRange
+
+	// Whether text exports from these versions have been tested with this parser.
+	tested bool
+	// Shown to the user when the versions haven't been tested, explaining how they are handled.
+	note string
+
+	// Fields in the Sound Chips section which may be missing from exports, in which case their defaults are used.
+	optionalChipFields []string
+	// The layout of the chip flags blocks in the Sound Chips section. Either layout is still read, but this one is tried first.
+	chipFlags chipFlagLayout
+}
+
+// The layouts which chip flags blocks are exported in.
+type chipFlagLayout int
+
+const (
+	chipFlagsKeyValue chipFlagLayout = iota // Lines of key=value.
+	chipFlagsJSON                           // Lines of "key": value, between braces and separated by commas.
+)
+
+// isOptionalChipField returns true if the given Sound Chips field may be missing from the export.
+func (q versionQuirks) isOptionalChipField(key string) bool {
+	return slices.Contains(q.optionalChipFields, key)
+}
+
+// The differences in text exports across every Furnace version this parser can handle.
+// Versions which aren't covered by any range are parsed the same way as the latest tested version.
+var versionTable = []versionQuirks{
+	{
+		versionRange: versionRange{232, 232},
+		tested:       true,
+	},
+	{
+		versionRange: versionRange{170, 231},
+		note:         "so any chip flags which are missing from the export are assumed to have their default values",
+		// Older versions may not list every chip flag, so fall back on Furnace's defaults (SN76489 at 4 MHz).
+		optionalChipFields: []string{"chipType", "customClock"},
+	},
+	{
+		versionRange: versionRange{233, 250},
+		note:         "so any chip flags which are missing from the export are assumed to have their default values",
+		// Newer versions may rename or drop chip flags, so fall back on Furnace's defaults (SN76489 at 4 MHz).
+		optionalChipFields: []string{"chipType", "customClock"},
+		chipFlags:          chipFlagsJSON,
+	},
+}
+
+// A range of Furnace version numbers whose text exports can be parsed.
+type VersionSupport struct {
+	Min    int  `json:"min"`
+	Max    int  `json:"max"`
+	Tested bool `json:"tested"` // Whether exports from these versions have been tested with the parser.
+}
+
+// SupportedVersions returns the ranges of Furnace version numbers whose text exports can be parsed, ordered by
+// version. Exports from other versions are parsed like the latest tested version, with a warning.
+func SupportedVersions() []VersionSupport {
+	versions := make([]VersionSupport, len(versionTable))
+	for i, q := range versionTable {
+		versions[i] = VersionSupport{Min: q.min, Max: q.max, Tested: q.tested}
+	}
+	slices.SortFunc(versions, func(a, b VersionSupport) int {
+		return a.Min - b.Min
+	})
+	return versions
+}
+
+// lookupVersionQuirks returns the quirks of the given Furnace version, and false if the version isn't supported.
+func lookupVersionQuirks(version int) (versionQuirks, bool) {
+	for _, q := range versionTable {
+		if version >= q.min && version <= q.max {
+			return q, true
+		}
+	}
+	return versionTable[0], false
+}
@@ -0,0 +1,517 @@
+// Package mml parses songs written in PSG-style Music Macro Language.
+//
+// Songs are converted into the same model used for Furnace text exports, so that they can be
+// compiled with the rest of the toolchain. See the README for the supported syntax.
+package mml
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/QEStudios/NMOScillatorCompiler/diag"
+	"github.com/QEStudios/NMOScillatorCompiler/internal/checked"
+	"github.com/QEStudios/NMOScillatorCompiler/parser/furnace"
+)
+
+// The number of ticks (and rows) in a whole note. At 24 ticks per beat, the tick rate is the
+// same as the one Furnace uses for a BPM based tempo, so tempo changes can use the same effect.
+const wholeNoteTicks = 96
+
+const (
+	defaultOctave = 4
+	defaultLength = wholeNoteTicks / 4
+	defaultVolume = 15
+	defaultTempo  = 120
+)
+
+// The channels which MML lines can be written for. A-C are the square channels and D is the noise channel.
+const channelNames = "ABCD"
+
+const noiseChannel = 3
+
+// A non-fatal problem found while parsing. Warnings about the song as a whole have no line.
+type Warning = diag.Diagnostic
+
+// A piece of a channel's MML, and the line it came from.
+type segment struct {
+	line int
+	text string
+}
+
+// A single change to a channel at a point in time.
+type event struct {
+	tick int
+	note furnace.Note
+	// Any effects which take place at the same time, such as tempo changes.
+	effects []furnace.Effect
+}
+
+// channelState holds the state of a single channel while its MML is being played.
+type channelState struct {
+	channel furnace.Channel
+
+	octave int
+	length int // Default note length in ticks.
+	volume int
+
+	tick     int  // The tick at which the next command takes effect.
+	sounding bool // Whether a note is currently playing, so rests know whether they need to stop it.
+	// The volume most recently written to the channel, or -1 if it hasn't been written yet.
+	writtenVolume int
+
+	events   []event
+	loopTick int // The tick of the loop point, or -1 if there isn't one.
+}
+
+// parser holds the state used while parsing a single file.
+type parser struct {
+	song     furnace.Song
+	warnings []Warning
+
+	channels [len(channelNames)][]segment
+}
+
+// Parse reads a whole MML file and returns it as a song with a single subsong,
+// along with any non-fatal warnings encountered while parsing.
+func Parse(r io.Reader) (*furnace.Song, []Warning, error) {
+	p := &parser{
+		song: furnace.Song{
+			Name:       "Unnamed",
+			Author:     "Unknown",
+			Tuning:     440,
+			SoundChips: []*furnace.SoundChip{{Index: 0}},
+		},
+	}
+	if err := p.readLines(r); err != nil {
+		return nil, p.warnings, err
+	}
+	subsong, err := p.buildSubsong()
+	if err != nil {
+		return nil, p.warnings, err
+	}
+	p.song.Subsongs = []*furnace.Subsong{subsong}
+	return &p.song, p.warnings, nil
+}
+
+// addWarning adds to the list of warnings encountered when parsing.
+func (p *parser) addWarning(line int, code string, format string, args ...any) {
+	w := diag.Warningf(code, format, args...)
+	w.Line = line
+	p.warnings = append(p.warnings, w)
+}
+
+// readLines reads the directives in the file, and collects the MML written for each channel.
+func (p *parser) readLines(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, _, _ := strings.Cut(scanner.Text(), ";") // Everything after a semicolon is a comment.
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if directive, ok := strings.CutPrefix(line, "#"); ok {
+			name, value, _ := strings.Cut(directive, " ")
+			value = strings.TrimSpace(value)
+			switch strings.ToUpper(name) {
+			case "TITLE":
+				p.song.Name = value
+			case "AUTHOR", "COMPOSER":
+				p.song.Author = value
+			default:
+				p.addWarning(lineNumber, "unknown-directive", "unknown directive #%s", name)
+			}
+			continue
+		}
+
+		names, mml, _ := strings.Cut(line, " ")
+		for _, name := range names {
+			channel := strings.IndexRune(channelNames, name)
+			if channel == -1 {
+				d := diag.Errorf("syntax", "expected channel names (%s) at the start of the line, found %q", channelNames, names)
+				d.Line = lineNumber
+				return d
+			}
+			p.channels[channel] = append(p.channels[channel], segment{line: lineNumber, text: mml})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error while reading file: %v", err)
+	}
+	return nil
+}
+
+// buildSubsong plays the MML of every channel, and arranges the results into rows.
+func (p *parser) buildSubsong() (*furnace.Subsong, error) {
+	subsong := &furnace.Subsong{
+		Index:         0,
+		TickRate:      tickRate(defaultTempo),
+		Speeds:        []uint8{1},
+		TimeBase:      0,
+		PatternLength: 1, // Every row is its own pattern, so loops can jump back to any row.
+	}
+
+	var states []*channelState
+	numTicks := 0
+	for i, segments := range p.channels {
+		if len(segments) == 0 {
+			continue
+		}
+		state := &channelState{
+			channel:       furnace.Channel(i),
+			octave:        defaultOctave,
+			length:        defaultLength,
+			volume:        defaultVolume,
+			writtenVolume: -1,
+			loopTick:      -1,
+		}
+		if i == noiseChannel {
+			// Noise notes use the preset rates by default, as the third square channel is usually busy.
+			state.addEffect(furnace.Effect{Type: furnace.EffectNoiseControl, Value: 0x01})
+		}
+		for _, seg := range segments {
+			if err := state.play(seg.text); err != nil {
+				d := diag.Errorf("syntax", "channel %c: %v", channelNames[i], err)
+				d.Line = seg.line
+				return nil, d
+			}
+		}
+		states = append(states, state)
+		numTicks = max(numTicks, state.tick)
+	}
+	if numTicks == 0 {
+		return nil, fmt.Errorf("song doesn't contain any notes or rests")
+	}
+
+	subsong.Rows = make([]furnace.Row, numTicks)
+	for i := range subsong.Rows {
+		subsong.Rows[i].Index = i
+	}
+
+	loopTick := -1
+	for _, state := range states {
+		for _, e := range state.events {
+			row := &subsong.Rows[e.tick]
+			for _, effect := range e.effects {
+				if effect.Type == furnace.EffectTickRateBpm && e.tick == 0 {
+					// The initial tempo is part of the subsong's metadata instead.
+					subsong.TickRate = tickRate(int(effect.Value))
+					continue
+				}
+				row.Effects = append(row.Effects, effect)
+			}
+			if e.note.HasPitch || e.note.HasVolume || e.note.Off {
+				row.Notes = append(row.Notes, e.note)
+			}
+		}
+
+		if state.loopTick == -1 {
+			continue
+		}
+		if loopTick == -1 {
+			loopTick = state.loopTick
+		} else if state.loopTick != loopTick {
+			p.addWarning(0, "loop-point-mismatch", "channel %c has its loop point at tick %d, but an earlier channel has it at tick %d; using tick %d",
+				channelNames[state.channel], state.loopTick, loopTick, loopTick)
+		}
+	}
+
+	switch {
+	case loopTick >= numTicks:
+		p.addWarning(0, "loop-at-end", "loop point is at the end of the song, looping back to the start instead")
+	case loopTick > 0:
+		// Songs without a jump loop back to the start anyway, so only loops to a later point need one.
+		value, err := checked.Narrow[uint16](loopTick)
+		if err != nil {
+			return nil, fmt.Errorf("loop point at tick %d is too far into the song: %w", loopTick, err)
+		}
+		last := &subsong.Rows[numTicks-1]
+		last.Effects = append(last.Effects, furnace.Effect{Type: furnace.EffectJumpToPattern, Value: value, Channel: 0})
+	}
+
+	return subsong, nil
+}
+
+// tickRate returns the tick rate (in Hz) for the given tempo in BPM, the same way Furnace does.
+func tickRate(bpm int) float64 {
+	return float64(bpm) * 24 / 60
+}
+
+// addEffect adds an effect to the channel at the current tick.
+func (s *channelState) addEffect(effect furnace.Effect) {
+	effect.Channel = s.channel
+	s.events = append(s.events, event{tick: s.tick, effects: []furnace.Effect{effect}})
+}
+
+// play runs the MML commands in text, advancing the channel's state.
+func (s *channelState) play(text string) error {
+	r := &reader{text: text}
+	for {
+		r.skipSpace()
+		if r.done() {
+			return nil
+		}
+		if err := s.command(r); err != nil {
+			return fmt.Errorf("column %d: %w", r.pos+1, err)
+		}
+	}
+}
+
+// command runs a single MML command.
+func (s *channelState) command(r *reader) error {
+	c := r.next()
+	switch c {
+	case 'c', 'd', 'e', 'f', 'g', 'a', 'b':
+		pitch := s.octave*12 + noteOffsets[c]
+		for r.peek() == '+' || r.peek() == '#' || r.peek() == '-' {
+			if r.next() == '-' {
+				pitch--
+			} else {
+				pitch++
+			}
+		}
+		length, err := s.readLength(r)
+		if err != nil {
+			return err
+		}
+		return s.playNote(pitch, length)
+
+	case 'r':
+		length, err := s.readLength(r)
+		if err != nil {
+			return err
+		}
+		if s.sounding {
+			s.events = append(s.events, event{tick: s.tick, note: furnace.Note{Off: true, Channel: s.channel}})
+			s.sounding = false
+		}
+		s.tick += length
+		return nil
+
+	case 'o':
+		octave, err := r.number(0, 8)
+		if err != nil {
+			return fmt.Errorf("octave: %w", err)
+		}
+		s.octave = octave
+		return nil
+
+	case '<':
+		s.octave--
+		return nil
+
+	case '>':
+		s.octave++
+		return nil
+
+	case 'l':
+		length, err := s.readLength(r)
+		if err != nil {
+			return err
+		}
+		s.length = length
+		return nil
+
+	case 'v':
+		volume, err := r.number(0, 15)
+		if err != nil {
+			return fmt.Errorf("volume: %w", err)
+		}
+		s.volume = volume
+		return nil
+
+	case 't':
+		tempo, err := r.number(1, 255)
+		if err != nil {
+			return fmt.Errorf("tempo: %w", err)
+		}
+		s.addEffect(furnace.Effect{Type: furnace.EffectTickRateBpm, Value: uint16(tempo)})
+		return nil
+
+	case 'w':
+		if s.channel != noiseChannel {
+			return fmt.Errorf("noise mode can only be set on channel %c", channelNames[noiseChannel])
+		}
+		mode, err := r.number(0, 1)
+		if err != nil {
+			return fmt.Errorf("noise mode: %w", err)
+		}
+		s.addEffect(furnace.Effect{Type: furnace.EffectNoiseControl, Value: uint16(mode)})
+		return nil
+
+	case 'L':
+		if s.loopTick != -1 {
+			return fmt.Errorf("channel already has a loop point")
+		}
+		s.loopTick = s.tick
+		return nil
+
+	case '[':
+		body, err := r.loopBody()
+		if err != nil {
+			return err
+		}
+		count := 2
+		if isDigit(r.peek()) {
+			if count, err = r.number(1, 255); err != nil {
+				return fmt.Errorf("loop count: %w", err)
+			}
+		}
+		for range count {
+			if err := s.play(body); err != nil {
+				return fmt.Errorf("in loop: %w", err)
+			}
+		}
+		return nil
+
+	case ']':
+		return fmt.Errorf("unexpected ']' without a matching '['")
+
+	default:
+		return fmt.Errorf("unknown command %q", c)
+	}
+}
+
+// Semitones above C for each note name.
+var noteOffsets = map[byte]int{
+	'c': 0,
+	'd': 2,
+	'e': 4,
+	'f': 5,
+	'g': 7,
+	'a': 9,
+	'b': 11,
+}
+
+// playNote adds a note with the given pitch (in semitones above C0) to the channel.
+func (s *channelState) playNote(pitch int, length int) error {
+	note := furnace.Note{Channel: s.channel}
+
+	if s.channel == noiseChannel {
+		// Noise notes only pick one of the preset rates, so the octave doesn't matter.
+		if pitch < 0 || pitch%12 > 2 {
+			return fmt.Errorf("noise notes must be c (low), c+ (medium) or d (high)")
+		}
+		note.Pitch = furnace.NotePitch(pitch % 12)
+	} else {
+		// Octave 4 of MML is octave 4 in scientific pitch notation, but Furnace's octaves are two octaves lower.
+		midiNote := pitch + 12
+		note.Pitch = furnace.NotePitch(midiNote - 24)
+	}
+	note.HasPitch = true
+
+	if s.volume != s.writtenVolume {
+		note.Volume = furnace.NoteVolume(s.volume)
+		note.HasVolume = true
+		s.writtenVolume = s.volume
+	}
+
+	s.events = append(s.events, event{tick: s.tick, note: note})
+	s.sounding = true
+	s.tick += length
+	return nil
+}
+
+// readLength reads an optional note length followed by any number of dots, and returns it in ticks.
+// If no length is given, the channel's default length is used.
+func (s *channelState) readLength(r *reader) (int, error) {
+	length := s.length
+	if isDigit(r.peek()) {
+		n, err := r.number(1, wholeNoteTicks)
+		if err != nil {
+			return 0, fmt.Errorf("length: %w", err)
+		}
+		if wholeNoteTicks%n != 0 {
+			return 0, fmt.Errorf("length %d can't be played, lengths must divide %d", n, wholeNoteTicks)
+		}
+		length = wholeNoteTicks / n
+	}
+
+	extra := length
+	for r.peek() == '.' {
+		r.next()
+		if extra%2 != 0 {
+			return 0, fmt.Errorf("too many dots, the note would be shorter than a 1/%d note", wholeNoteTicks)
+		}
+		extra /= 2
+		length += extra
+	}
+	return length, nil
+}
+
+// reader steps through the text of a channel's MML.
+type reader struct {
+	text string
+	pos  int
+}
+
+func (r *reader) done() bool {
+	return r.pos >= len(r.text)
+}
+
+// peek returns the next character without consuming it, or 0 at the end of the text.
+func (r *reader) peek() byte {
+	if r.done() {
+		return 0
+	}
+	return r.text[r.pos]
+}
+
+// next consumes and returns the next character, or 0 at the end of the text.
+func (r *reader) next() byte {
+	c := r.peek()
+	if !r.done() {
+		r.pos++
+	}
+	return c
+}
+
+func (r *reader) skipSpace() {
+	for r.peek() == ' ' || r.peek() == '\t' {
+		r.pos++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// number reads a decimal number, and checks that it's within the range lo..hi.
+func (r *reader) number(lo, hi int) (int, error) {
+	if !isDigit(r.peek()) {
+		return 0, fmt.Errorf("expected a number")
+	}
+	n := 0
+	for isDigit(r.peek()) {
+		n = n*10 + int(r.next()-'0')
+		if n > hi {
+			return 0, fmt.Errorf("number must be %d-%d", lo, hi)
+		}
+	}
+	if n < lo {
+		return 0, fmt.Errorf("number must be %d-%d", lo, hi)
+	}
+	return n, nil
+}
+
+// loopBody reads the text of a loop up to its matching ']', which is consumed but not returned.
+func (r *reader) loopBody() (string, error) {
+	start := r.pos
+	depth := 1
+	for !r.done() {
+		switch r.next() {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return r.text[start : r.pos-1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("loop is missing its closing ']'")
+}